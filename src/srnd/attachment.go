@@ -30,6 +30,8 @@ type NNTPAttachment interface {
   Mime() string
   // the file extension of the attachment
   Extension() string
+  // size of the attachment in bytes
+  Size() int64
   // get the sha512 hash of the attachment
   Hash() []byte
   // do we need to generate a thumbnail?
@@ -74,6 +76,10 @@ func (self nntpAttachment) Extension() string {
   return self.ext
 }
 
+func (self nntpAttachment) Size() int64 {
+  return int64(self.body.Len())
+}
+
 func (self nntpAttachment) WriteTo(wr io.Writer) (int64, error) {  
   return self.body.WriteTo(wr)
 }
@@ -0,0 +1,226 @@
+//
+// auth.go -- AUTHINFO and SASL authentication for nntp
+//
+package srnd
+
+import (
+  "bytes"
+  "crypto/subtle"
+  "encoding/base64"
+  "github.com/majestrate/configparser"
+  "log"
+  "net/textproto"
+  "strings"
+)
+
+// what an nntp user is allowed to do
+type nntpPermissions struct {
+  // TAKETHIS / CHECK / IHAVE
+  stream bool
+  // reading articles and newsgroups
+  reader bool
+  // POST
+  post bool
+}
+
+// permissions that allow everything
+func allNNTPPermissions() nntpPermissions {
+  return nntpPermissions{true, true, true}
+}
+
+// a user allowed to log into our nntp server
+type nntpCredential struct {
+  username string
+  password string
+  perms nntpPermissions
+}
+
+// username -> credential
+type nntpCredentials map[string]nntpCredential
+
+// read a credentials file
+// each section is a username with a password and the permissions it has
+//
+// [someuser]
+// password = hunter2
+// stream = 1
+// reader = 1
+// post = 0
+func readCredentials(fname string) (creds nntpCredentials, err error) {
+  var conf *configparser.Configuration
+  conf, err = configparser.Read(fname)
+  if err == nil {
+    var sections []*configparser.Section
+    sections, err = conf.Find("*")
+    if err == nil {
+      creds = make(nntpCredentials)
+      for _, sect := range sections {
+        username := strings.Trim(sect.Name(), " ")
+        password := sect.ValueOf("password")
+        if len(username) == 0 || len(password) == 0 {
+          log.Println("ignoring credential without username or password in", fname)
+          continue
+        }
+        creds[username] = nntpCredential{
+          username: username,
+          password: password,
+          perms: nntpPermissions{
+            stream: sect.ValueOf("stream") == "1",
+            reader: sect.ValueOf("reader") == "1",
+            post: sect.ValueOf("post") == "1",
+          },
+        }
+      }
+    }
+  }
+  return
+}
+
+// check a username and password
+// returns the credential and true if they are valid
+func (self nntpCredentials) Check(username, password string) (cred nntpCredential, ok bool) {
+  cred, ok = self[username]
+  if ok {
+    ok = subtle.ConstantTimeCompare([]byte(cred.password), []byte(password)) == 1
+  }
+  return
+}
+
+// authentication state of a single nntp connection
+type nntpAuthState struct {
+  // username given with AUTHINFO USER
+  username string
+  // true once we logged in
+  authenticated bool
+  // what we are allowed to do right now
+  perms nntpPermissions
+}
+
+// create the auth state for a new inbound connection
+// if we don't require auth everything is allowed
+func createNNTPAuthState(require_auth bool) nntpAuthState {
+  if require_auth {
+    return nntpAuthState{}
+  }
+  return nntpAuthState{perms: allNNTPPermissions()}
+}
+
+// the response to send when a command is not allowed
+func (self *nntpAuthState) Denied() string {
+  if self.authenticated {
+    return "502 Permission denied"
+  }
+  return "480 Authentication required"
+}
+
+// extra capabilities to advertise
+func (self *nntpAuthState) Capabilities() (caps []string) {
+  if ! self.authenticated {
+    caps = append(caps, "AUTHINFO USER SASL", "SASL PLAIN")
+  }
+  return
+}
+
+// handle an AUTHINFO command from the remote end
+// line is the entire command line
+// reads more from r if the SASL exchange needs it
+func (self *nntpAuthState) handleAuthInfo(creds nntpCredentials, line string, r *textproto.Reader, w *textproto.Writer) (err error) {
+  parts := strings.Fields(line)
+  if len(parts) < 3 {
+    return w.PrintfLine("501 Syntax error")
+  }
+  if self.authenticated {
+    return w.PrintfLine("502 Already authenticated")
+  }
+  subcmd := strings.ToUpper(parts[1])
+  if subcmd == "USER" {
+    self.username = parts[2]
+    err = w.PrintfLine("381 Password required")
+  } else if subcmd == "PASS" {
+    if self.username == "" {
+      err = w.PrintfLine("482 Authentication commands issued out of sequence")
+    } else {
+      err = self.login(creds, self.username, parts[2], w)
+    }
+  } else if subcmd == "SASL" {
+    if strings.ToUpper(parts[2]) != "PLAIN" {
+      return w.PrintfLine("503 Mechanism not recognized")
+    }
+    var response string
+    if len(parts) > 3 {
+      // initial response given
+      response = parts[3]
+    } else {
+      // ask for it
+      err = w.PrintfLine("383 =")
+      if err == nil {
+        response, err = r.ReadLine()
+      }
+      if err != nil {
+        return
+      }
+    }
+    if response == "*" {
+      return w.PrintfLine("481 Authentication cancelled")
+    }
+    username, password, ok := decodeSASLPlain(response)
+    if ok {
+      err = self.login(creds, username, password, w)
+    } else {
+      err = w.PrintfLine("504 Base64 encoding error")
+    }
+  } else {
+    err = w.PrintfLine("501 Unknown AUTHINFO variant")
+  }
+  return
+}
+
+// check credentials and respond
+func (self *nntpAuthState) login(creds nntpCredentials, username, password string, w *textproto.Writer) error {
+  cred, ok := creds.Check(username, password)
+  self.username = ""
+  if ok {
+    self.username = cred.username
+    self.authenticated = true
+    self.perms = cred.perms
+    log.Println("nntp user", username, "logged in")
+    return w.PrintfLine("281 Authentication accepted")
+  }
+  log.Println("nntp user", username, "failed to log in")
+  return w.PrintfLine("481 Authentication failed")
+}
+
+// decode a SASL PLAIN response
+// authzid NUL authcid NUL passwd, authzid is ignored
+func decodeSASLPlain(response string) (username, password string, ok bool) {
+  data, err := base64.StdEncoding.DecodeString(response)
+  if err == nil {
+    parts := bytes.Split(data, []byte{0})
+    if len(parts) == 3 {
+      username, password = string(parts[1]), string(parts[2])
+      ok = len(username) > 0
+    }
+  }
+  return
+}
+
+// log into a remote server with AUTHINFO USER/PASS
+func nntpLogin(conn *textproto.Conn, username, password string) (err error) {
+  err = conn.PrintfLine("AUTHINFO USER %s", username)
+  if err == nil {
+    var code int
+    code, _, err = conn.ReadCodeLine(-1)
+    if err == nil {
+      if code == 381 {
+        err = conn.PrintfLine("AUTHINFO PASS %s", password)
+        if err == nil {
+          _, _, err = conn.ReadCodeLine(281)
+        }
+      } else if code != 281 {
+        // 281 means no password needed
+        err = textproto.ProtocolError("AUTHINFO USER rejected")
+      }
+    }
+  }
+  return
+}
@@ -19,7 +19,17 @@ type FeedConfig struct {
   sync bool
   proxy_type string
   proxy_addr string
-  linkauth_keyfile string
+  // how we connect out to this feed
+  dialer Dialer
+  // credentials for logging into the feed
+  username string
+  password string
+  // none, starttls or implicit
+  tls_mode string
+  // don't talk to this feed without tls
+  tls_required bool
+  // pinned sha256 fingerprint of the feed's certificate
+  tls_fingerprint string
   name string
 }
 
@@ -60,11 +70,24 @@ func CheckConfig() {
 func GenFeedsConfig() error {
   conf := configparser.NewConfiguration()
   sect := conf.NewSection("feed-dummy")
+  // none, socks4a, socks5 or i2p
+  // for i2p proxy-host and proxy-port are the router's SAM bridge, usually 127.0.0.1:7656
   sect.Add("proxy-type", "socks4a")
   sect.Add("proxy-host", "127.0.0.1")
   sect.Add("proxy-port", "9050")
+  // socks5 only, tor uses a different circuit for each username
+  sect.Add("proxy-user", "")
+  sect.Add("proxy-password", "")
   sect.Add("host", "dummy")
   sect.Add("port", "119")
+  // set these to log into the feed with AUTHINFO
+  sect.Add("username", "")
+  sect.Add("password", "")
+  // set to starttls or implicit to use tls with this feed
+  sect.Add("tls", "none")
+  sect.Add("tls-required", "0")
+  // sha256 fingerprint of the feed's certificate to pin it
+  sect.Add("tls-fingerprint", "")
 
   sect = conf.NewSection("dummy")
   sect.Add("overchan.*", "1")
@@ -85,6 +108,15 @@ func GenSRNdConfig() error {
   sect.Add("sync_on_start", "1")
   sect.Add("allow_anon", "0")
   sect.Add("allow_anon_attachments", "0")
+  // set to 1 to require AUTHINFO / SASL from peers and readers
+  // users and their permissions are in the credentials file
+  sect.Add("require_auth", "0")
+  sect.Add("credentials_file", "credentials.ini")
+  // set these to enable STARTTLS
+  sect.Add("tls_cert", "")
+  sect.Add("tls_key", "")
+  // set this to also listen with implicit tls
+  sect.Add("tls_bind", "")
 
   // article store section
   sect = conf.NewSection("articles")
@@ -101,6 +133,9 @@ func GenSRNdConfig() error {
   sect = conf.NewSection("database")
 
   // change this to mysql to use with mariadb or mysql
+  // change this to sqlite to use a single database file, set host to the file's path
+  // change this to redis to use with redis, user is ignored
+  // change this to memory to keep nothing on disk, for testing
   sect.Add("type", "postgres")
   // change this to infinity to use with infinity-next
   sect.Add("schema", "srnd")
@@ -114,12 +149,16 @@ func GenSRNdConfig() error {
   sect.Add("enable", "1")
   sect.Add("allow_files", "1")
   sect.Add("regen_on_start", "0")
+  sect.Add("public_modlog", "0")
   sect.Add("regen_threads", "1")
   sect.Add("nntp", "[::]:1119")
   sect.Add("bind", "[::]:18000")
   sect.Add("name", "web.srndv2.test")
   sect.Add("webroot", "webroot")
   sect.Add("prefix", "/")
+  // absolute url the site is served at for links in rss and atom feeds
+  // if empty the prefix is used when it is absolute, otherwise there are no feeds
+  sect.Add("feed_url", "")
   sect.Add("static_files", "contrib")
   sect.Add("templates", "contrib/templates/default")
   sect.Add("domain", "localhost")
@@ -227,9 +266,30 @@ func ReadConfig() *SRNdConfig {
         proxy_port := sect.ValueOf("proxy-port")
         fconf.proxy_addr = strings.Trim(proxy_host, " ") + ":" + strings.Trim(proxy_port, " ")
       }
+      fconf.dialer, err = NewDialer(fconf.proxy_type, fconf.proxy_addr, sect.ValueOf("proxy-user"), sect.ValueOf("proxy-password"))
+      if err != nil {
+        log.Fatal("bad proxy settings in ", sect.Name(), ": ", err)
+      }
 
       host := sect.ValueOf("host")
       port := sect.ValueOf("port")
+
+      // credentials for logging in
+      fconf.username = strings.Trim(sect.ValueOf("username"), " ")
+      fconf.password = sect.ValueOf("password")
+
+      // tls settings
+      fconf.tls_mode = strings.ToLower(strings.Trim(sect.ValueOf("tls"), " "))
+      if fconf.tls_mode == "" || fconf.tls_mode == "0" {
+        fconf.tls_mode = "none"
+      } else if fconf.tls_mode == "1" {
+        fconf.tls_mode = "starttls"
+      }
+      fconf.tls_required = sect.ValueOf("tls-required") == "1"
+      if fconf.tls_required && fconf.tls_mode == "none" {
+        fconf.tls_mode = "starttls"
+      }
+      fconf.tls_fingerprint = normalizeFingerprint(sect.ValueOf("tls-fingerprint"))
       
       // check to see if we want to sync with them first
       val = sect.ValueOf("sync")
@@ -3,12 +3,11 @@
 //
 package srnd
 import (
-  "errors"
+  "crypto/tls"
   "fmt"
   "log"
   "net"
   "net/textproto"
-  "strconv"
   "strings"
   "os"
   "time"
@@ -28,6 +27,13 @@ type NNTPDaemon struct {
   // anon settings
   allow_anon bool
   allow_anon_attachments bool
+  // auth settings
+  require_auth bool
+  credentials nntpCredentials
+  // our tls config, nil if tls is disabled
+  tls_config *tls.Config
+  // implicit tls listener
+  tls_listener net.Listener
   
   running bool
   // http frontend
@@ -53,94 +59,10 @@ func (self NNTPDaemon) End() {
 }
 
 
-func (self NNTPDaemon) dialOut(proxy_type, proxy_addr, remote_addr string) (conn net.Conn, err error) {
-  
-  if proxy_type ==  "" || proxy_type == "none" {
-    // connect out without proxy 
-    log.Println("dial out to ", remote_addr)
-    conn, err = net.Dial("tcp", remote_addr)
-    if err != nil {
-      log.Println("cannot connect to outfeed", remote_addr, err)
-      return
-    }
-  } else if proxy_type == "socks4a" {
-    // connect via socks4a
-    log.Println("dial out via proxy", proxy_addr)
-    conn, err = net.Dial("tcp", proxy_addr)
-    if err != nil {
-      log.Println("cannot connect to proxy", proxy_addr)
-      return
-    }
-    // generate request
-    idx := strings.LastIndex(remote_addr, ":")
-    if idx == -1 {
-      err = errors.New("invalid address: "+remote_addr)
-      return
-    }
-    var port uint64
-    addr := remote_addr[:idx]
-    port, err = strconv.ParseUint(remote_addr[idx+1:], 10, 16)
-    if port >= 25536 {
-      err = errors.New("bad proxy port")
-      return
-    } else if err != nil {
-      return
-    }
-    var proxy_port uint16
-    proxy_port = uint16(port)
-    proxy_ident := "srndv2"
-    req_len := len(addr) + 1 + len(proxy_ident) + 1 + 8
-    
-    req := make([]byte, req_len)
-    // pack request
-    req[0] = '\x04'
-    req[1] = '\x01'
-    req[2] = byte(proxy_port & 0xff00 >> 8)
-    req[3] = byte(proxy_port & 0x00ff)
-    req[7] = '\x01'
-    idx = 8
-    
-    proxy_ident_b := []byte(proxy_ident)
-    addr_b := []byte(addr)
-    
-    var bi int
-    for bi = range proxy_ident_b {
-      req[idx] = proxy_ident_b[bi]
-      idx += 1
-    }
-    idx += 1
-    for bi = range addr_b {
-      req[idx] = addr_b[bi]
-      idx += 1
-    }
-
-    
-    log.Println("dial out via proxy", proxy_addr)
-    conn, err = net.Dial("tcp", proxy_addr)
-    // send request
-    _, err = conn.Write(req)
-    resp := make([]byte, 8)
-    
-    // receive response
-    _, err = conn.Read(resp)
-    if resp[1] == '\x5a' {
-      // success
-      log.Println("connected to", addr)
-    } else {
-      log.Println("failed to connect to", addr)
-      conn.Close()
-      conn = nil
-      err = errors.New("failed to connect via proxy")
-      return
-    }
-  }
-  return
-}
-  
 func (self NNTPDaemon) persistFeed(conf FeedConfig, mode string) {
   for {
     if self.running {
-      conn, err := self.dialOut(conf.proxy_type, conf.proxy_addr, conf.addr)
+      conn, err := self.dialFeed(conf)
       if err != nil {
         time.Sleep(time.Second * 5)
         continue
@@ -148,8 +70,8 @@ func (self NNTPDaemon) persistFeed(conf FeedConfig, mode string) {
       nntp := createNNTPConnection()
       nntp.policy = conf.policy
       nntp.name = conf.name + "-" + mode
-      c := textproto.NewConn(conn)
-      stream, reader, err := nntp.outboundHandshake(c)
+      nntp.feed = conf.name
+      c, stream, reader, err := nntp.outboundHandshake(self, conn, conf)
       if err == nil {
         if mode == "reader" && ! reader {
           log.Println(nntp.name, "we don't support reader on this feed, dropping")
@@ -161,22 +83,40 @@ func (self NNTPDaemon) persistFeed(conf FeedConfig, mode string) {
           
       } else {
         log.Println("error doing outbound hanshake", err)
+        c.Close()
       }
     }    
     time.Sleep(1 * time.Second)
   }
 }
 
+// dial out to a feed, wraps the connection in tls if it uses implicit tls
+func (self NNTPDaemon) dialFeed(conf FeedConfig) (conn net.Conn, err error) {
+  conn, err = conf.dialer.Dial(conf.addr)
+  if err == nil && conf.tls_mode == "implicit" {
+    // don't hand back a nil *tls.Conn in a non nil net.Conn
+    var tls_conn *tls.Conn
+    tls_conn, err = self.clientTLS(conn, conf)
+    if err == nil {
+      conn = tls_conn
+    } else {
+      log.Println(conf.name, "tls handshake failed", err)
+      conn = nil
+    }
+  }
+  return
+}
+
 // do a oneshot pull based sync with another server
-func (self NNTPDaemon) syncPull(proxy_type, proxy_addr, remote_addr string) {
-  c, err := self.dialOut(proxy_type, proxy_addr, remote_addr)
+func (self NNTPDaemon) syncPull(conf FeedConfig) {
+  c, err := self.dialFeed(conf)
   if err == nil {
-    conn := textproto.NewConn(c)
     // we connected
     nntp := createNNTPConnection()
-    nntp.name = remote_addr+"-sync"
+    nntp.name = conf.addr+"-sync"
+    nntp.feed = conf.name
     // do handshake
-    _, reader, err := nntp.outboundHandshake(conn)
+    conn, _, reader, err := nntp.outboundHandshake(self, c, conf)
     if reader {
       // we can do it
       err = nntp.scrapeServer(self, conn)
@@ -194,6 +134,7 @@ func (self NNTPDaemon) syncPull(proxy_type, proxy_addr, remote_addr string) {
     } else {
       // error happened
       log.Println(nntp.name, "error occurred when scraping", err)
+      conn.Close()
     }
   }
 }
@@ -210,6 +151,16 @@ func (self NNTPDaemon) Run() {
   self.listener = listener
   log.Printf("SRNd NNTPD bound at %s", listener.Addr())
 
+  // implicit tls listener
+  tls_bind := self.conf.daemon["tls_bind"]
+  if self.tls_config != nil && tls_bind != "" {
+    self.tls_listener, err = tls.Listen("tcp", tls_bind, self.tls_config)
+    if err != nil {
+      log.Fatal("failed to bind to", tls_bind, err)
+    }
+    log.Printf("SRNd NNTPD bound at %s with tls", self.tls_listener.Addr())
+  }
+
   self.register_outfeed = make(chan nntpConnection)
   self.deregister_outfeed = make(chan nntpConnection)
   self.infeed = make(chan NNTPMessage, 8)
@@ -265,12 +216,15 @@ func (self NNTPDaemon) Run() {
     if f.sync {
       // this feed wants to sync
       // fire off a 1 time sync
-      go self.syncPull(f.proxy_type, f.proxy_addr, f.addr)
+      go self.syncPull(f)
     }
   }
 
   // start accepting incoming connections
-  go self.acceptloop()
+  go self.acceptloop(self.listener)
+  if self.tls_listener != nil {
+    go self.acceptloop(self.tls_listener)
+  }
 
   go func () {
     // if we have no initial posts create one
@@ -337,33 +291,93 @@ func (self NNTPDaemon) pollinfeed() {
     log.Println("load from infeed", msgid)
     msg := self.store.ReadTempMessage(msgid)
     if msg != nil {
-      self.infeed <- msg
+      // check attachments against the board's settings now that we have them
+      settings, _ := self.database.GetBoardSettings(msg.Newsgroup())
+      reason := settings.CheckAttachments(msg.Attachments())
+      if reason == "" {
+        self.infeed <- msg
+      } else {
+        // local policy, not a ban, the temp file is already gone
+        log.Println("rejected", msgid, reason)
+      }
+    }
+  }
+}
+
+// offer a queued article to a connected feed with CHECK
+// returns false if the feed is too busy right now, it stays due and we try again later
+func (self NNTPDaemon) offerArticle(feed string, stream chan nntpStreamEvent, msgid string) bool {
+  select {
+  case stream <- nntpCHECK(msgid):
+    err := self.database.MarkArticleOffered(feed, msgid)
+    if err != nil {
+      log.Println("failed to mark", msgid, "offered to", feed, err)
+    }
+    return true
+  default:
+    return false
+  }
+}
+
+// offer everything that is due in the queue for a connected feed
+func (self NNTPDaemon) offerQueued(feed string, stream chan nntpStreamEvent) {
+  for {
+    msgids, err := self.database.GetQueuedArticlesForFeed(feed, 32)
+    if err != nil {
+      log.Println("failed to get queued articles for", feed, err)
+      return
+    }
+    for _, msgid := range msgids {
+      if ! self.offerArticle(feed, stream, msgid) {
+        return
+      }
+    }
+    if len(msgids) < 32 {
+      return
     }
   }
 }
 
 func (self NNTPDaemon) polloutfeeds() {
-  
+
+  // retry queued articles
+  ticker := time.NewTicker(time.Second * 10)
   for {
     select {
 
     case outfeed := <- self.register_outfeed:
       log.Println("outfeed", outfeed.name, "registered")
       self.feeds[outfeed.name] = outfeed
+      if strings.HasSuffix(outfeed.name, "-stream") {
+        // offer them everything they missed
+        self.offerQueued(outfeed.feed, outfeed.stream)
+      }
     case outfeed := <- self.deregister_outfeed:
       log.Println("outfeed", outfeed.name, "de-registered")
       delete(self.feeds, outfeed.name)
+    case <- ticker.C:
+      for name := range self.feeds {
+        if strings.HasSuffix(name, "-stream") {
+          self.offerQueued(self.feeds[name].feed, self.feeds[name].stream)
+        }
+      }
     case nntp := <- self.send_all_feeds:
       log.Println("federate", nntp.MessageID())
-      feeds := self.feeds
-      for _, feed := range feeds {
-        if feed.policy.AllowsNewsgroup(nntp.Newsgroup()) {
-          if strings.HasSuffix(feed.name, "-stream") {
-            log.Println("send", nntp.MessageID(), "to", feed.name)
-            feed.stream <- nntpCHECK(nntp.MessageID())
+      // queue it for every feed that wants it even if they are not connected
+      for _, conf := range self.conf.feeds {
+        if conf.policy.AllowsNewsgroup(nntp.Newsgroup()) {
+          err := self.database.QueueArticleForFeed(conf.name, nntp.MessageID())
+          if err != nil {
+            log.Println("failed to queue", nntp.MessageID(), "for", conf.name, err)
+            continue
+          }
+          name := conf.name + "-stream"
+          if _, ok := self.feeds[name]; ok {
+            log.Println("send", nntp.MessageID(), "to", name)
+            self.offerArticle(conf.name, self.feeds[name].stream, nntp.MessageID())
           }
         } else {
-          log.Println("not allowed", feed.name)
+          log.Println("not allowed", conf.name)
         }
       }
     case nntp := <- self.ask_for_article:
@@ -409,18 +423,12 @@ func (self NNTPDaemon) pollmessages() {
     }
     
     // prepare for content rollover
-    // fallback rollover
-    rollover := 100
-    
     group := nntp.Newsgroup()
-    tpp, err := self.database.GetThreadsPerPage(group)
-    ppb, err := self.database.GetPagesPerBoard(group)
-    if err == nil {
-      rollover = tpp * ppb
-    }
+    // defaults are given on error
+    settings, _ := self.database.GetBoardSettings(group)
     
     // roll over old content
-    self.expire.ExpireGroup(group, rollover)
+    self.expire.ExpireGroup(group, settings.ThreadLimit())
     // handle mod events
     if group == "ctl" {
       modchnl <- nntp
@@ -442,27 +450,45 @@ func (self NNTPDaemon) pollmessages() {
 }
 
 
-func (self NNTPDaemon) acceptloop() {	
+func (self NNTPDaemon) acceptloop(listener net.Listener) {	
   for {
     // accept
-    conn, err := self.listener.Accept()
+    conn, err := listener.Accept()
     if err != nil {
       log.Fatal(err)
     }
-    // make a new inbound nntp connection handler 
-    nntp := createNNTPConnection()
-    addr := conn.RemoteAddr()
-    nntp.name = fmt.Sprintf("%s-inbound-feed", addr.String())
-    c := textproto.NewConn(conn)
-    // send banners and shit
-    err = nntp.inboundHandshake(c)
-    if err == nil {
-      // run, we support stream and reader
-      go nntp.runConnection(self, true, true, true, "stream", c)
-    } else {
-      log.Println("failed to send banners", err)
-      c.Close()
+    go self.handleInbound(conn)
+  }
+}
+
+// handle a newly accepted inbound connection
+func (self NNTPDaemon) handleInbound(conn net.Conn) {
+  // make a new inbound nntp connection handler 
+  nntp := createNNTPConnection()
+  addr := conn.RemoteAddr()
+  nntp.name = fmt.Sprintf("%s-inbound-feed", addr.String())
+  nntp.auth = createNNTPAuthState(self.require_auth)
+  nntp.sock = conn
+  tls_conn, ok := conn.(*tls.Conn)
+  if ok {
+    // implicit tls
+    err := tls_conn.Handshake()
+    if err != nil {
+      log.Println(nntp.name, "tls handshake failed", err)
+      conn.Close()
+      return
     }
+    nntp.inboundTLS(self, tls_conn)
+  }
+  c := textproto.NewConn(conn)
+  // send banners and shit
+  err := nntp.inboundHandshake(c)
+  if err == nil {
+    // run, we support stream and reader
+    nntp.runConnection(self, true, true, true, "stream", c)
+  } else {
+    log.Println("failed to send banners", err)
+    c.Close()
   }
 }
 
@@ -481,6 +507,34 @@ func (self NNTPDaemon) Setup() NNTPDaemon {
   self.conf.Validate()
   log.Println("configs are valid")
 
+  // load nntp credentials if we require auth
+  self.require_auth = self.conf.daemon["require_auth"] == "1"
+  if self.require_auth {
+    fname := self.conf.daemon["credentials_file"]
+    if fname == "" {
+      fname = "credentials.ini"
+    }
+    log.Println("loading nntp credentials from", fname)
+    checkPerms(fname)
+    var err error
+    self.credentials, err = readCredentials(fname)
+    if err != nil {
+      log.Fatal("failed to load nntp credentials", err)
+    }
+    log.Println("loaded", len(self.credentials), "nntp credentials")
+  }
+
+  // load tls certificate if we have one
+  tls_cert := self.conf.daemon["tls_cert"]
+  tls_key := self.conf.daemon["tls_key"]
+  if tls_cert != "" && tls_key != "" {
+    var err error
+    self.tls_config, err = loadTLSConfig(tls_cert, tls_key)
+    if err != nil {
+      log.Fatal("failed to load tls certificate", err)
+    }
+    log.Println("tls enabled, our certificate fingerprint is", self.TLSFingerprint())
+  }
   
   db_host := self.conf.database["host"]
   db_port := self.conf.database["port"]
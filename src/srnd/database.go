@@ -4,10 +4,200 @@
 package srnd
 
 import (
+  "fmt"
   "log"
+  "strings"
 )
 
 
+// a token that lets someone post with the json api
+type APIToken struct {
+  // name given when it was issued, used to revoke it
+  Name string
+  // hex encoded sha256 of the token, we never store the token itself
+  Hash string
+  // wildmat of newsgroups it may post to
+  Scope string
+  // most posts allowed per hour, 0 for no limit
+  RateLimit int64
+  // when it was issued
+  Issued int64
+}
+
+// settings for a newsgroup
+type BoardSettings struct {
+  ThreadsPerPage int
+  // how many pages we keep, threads past the last page expire
+  Pages int
+  // replies after which a thread is no longer bumped, 0 for no limit
+  BumpLimit int
+  // most replies a thread can have, 0 for no limit
+  ReplyLimit int
+  // biggest attachment in bytes, 0 for no limit
+  MaxAttachmentSize int64
+  // wildmat of allowed attachment mime types
+  MimeTypes string
+  // allow posts from tor, i2p and other anonymous posters
+  AllowAnon bool
+}
+
+// settings for newsgroups that have none set
+func DefaultBoardSettings() BoardSettings {
+  return BoardSettings{
+    ThreadsPerPage: 10,
+    Pages: 10,
+    MimeTypes: "*",
+    AllowAnon: true,
+  }
+}
+
+// how many threads the newsgroup keeps before expiring them
+func (self BoardSettings) ThreadLimit() int {
+  return self.ThreadsPerPage * self.Pages
+}
+
+// does a reply bump its thread
+// replies is how many the thread has including this one
+func (self BoardSettings) ReplyBumps(replies int64) bool {
+  return self.BumpLimit == 0 || replies <= int64(self.BumpLimit)
+}
+
+// has a thread with this many replies reached the bump limit
+func (self BoardSettings) BumpLimitReached(replies int64) bool {
+  return self.BumpLimit > 0 && replies >= int64(self.BumpLimit)
+}
+
+// can a thread with this many replies take another
+func (self BoardSettings) AllowsReply(replies int64) bool {
+  return self.ReplyLimit == 0 || replies < int64(self.ReplyLimit)
+}
+
+// check attachments against these settings
+// returns empty string if they are okay otherwise the reason
+func (self BoardSettings) CheckAttachments(atts []NNTPAttachment) (reason string) {
+  for _, att := range atts {
+    // mime type without parameters
+    media_type := strings.Trim(strings.Split(att.Mime(), ";")[0], " ")
+    if self.MaxAttachmentSize > 0 && att.Size() > self.MaxAttachmentSize {
+      reason = fmt.Sprintf("attachment %s is bigger than %d bytes", att.Filename(), self.MaxAttachmentSize)
+      return
+    } else if ! wildmatMatch(self.MimeTypes, media_type) {
+      reason = fmt.Sprintf("attachments of type %s are not allowed", media_type)
+      return
+    }
+  }
+  return
+}
+
+// a ban on an address, range or encrypted address
+type IPBan struct {
+  // address, cidr range or encrypted address
+  Addr string
+  // when it was made
+  Made int64
+  // when it runs out, -1 for never
+  Expires int64
+  // why it was made, shown to the banned poster
+  Reason string
+  // regex of the newsgroups it applies to, empty for all
+  Scope string
+}
+
+// has this ban run out
+func (self IPBan) Expired() bool {
+  return self.Expires > 0 && self.Expires <= timeNow()
+}
+
+// how many seconds are left on this ban, -1 for forever
+func (self IPBan) Remaining() int64 {
+  if self.Expires <= 0 {
+    return -1
+  } else if self.Expired() {
+    return 0
+  }
+  return self.Expires - timeNow()
+}
+
+// does this ban already do everything another ban would
+// it must cover the other's address, have the same scope and last at least as long
+func (self IPBan) Covers(other IPBan) bool {
+  // bans from before scopes were kept apply everywhere
+  if (len(self.Scope) > 0 && self.Scope != other.Scope) || ! addrInRange(other.Addr, self.Addr) {
+    return false
+  }
+  return self.Expires <= 0 || (other.Expires > 0 && self.Expires >= other.Expires)
+}
+
+// does this ban apply to posts in this newsgroup
+func (self IPBan) InScope(newsgroup string) bool {
+  return len(self.Scope) == 0 || modScopeMatches(self.Scope, newsgroup)
+}
+
+// identifier a banned poster can give mods when appealing
+func (self IPBan) AppealID() string {
+  return ShorterHashMessageID(fmt.Sprintf("%s %d", self.Addr, self.Made))
+}
+
+// find a ban that stops an address from posting in a newsgroup
+func findIPBan(db Database, addr, newsgroup string) (ban IPBan, banned bool, err error) {
+  var bans []IPBan
+  bans, err = db.GetIPBansForAddr(addr)
+  for _, b := range bans {
+    if b.InScope(newsgroup) {
+      ban, banned = b, true
+      break
+    }
+  }
+  return
+}
+
+// find a ban that stops an encrypted address from posting in a newsgroup
+func findEncIPBan(db Database, encaddr, newsgroup string) (ban IPBan, banned bool, err error) {
+  var bans []IPBan
+  bans, err = db.GetEncIPBans(encaddr)
+  for _, b := range bans {
+    if b.InScope(newsgroup) {
+      ban, banned = b, true
+      break
+    }
+  }
+  return
+}
+
+// a moderation action recorded in the mod log
+type ModLogEntry struct {
+  // who did it
+  Pubkey string
+  // mod event or admin function
+  Action string
+  // message-id, newsgroup, address or pubkey it was done to
+  Target string
+  Reason string
+  // regex of newsgroups it applies to
+  Scope string
+  // when we recorded it
+  Time int64
+}
+
+// actions a mod can be allowed to do on a newsgroup
+const (
+  ModActionDelete = "delete"
+  ModActionBan = "ban"
+  ModActionSticky = "sticky"
+  ModActionNuke = "nuke"
+  // every action
+  ModActionAll = "all"
+)
+
+// is this an action we can grant to mods
+func modActionValid(action string) bool {
+  switch action {
+  case ModActionDelete, ModActionBan, ModActionSticky, ModActionNuke, ModActionAll:
+    return true
+  }
+  return false
+}
+
 // a ( MessageID , newsgroup ) tuple
 type ArticleEntry [2]string
 
@@ -19,6 +209,12 @@ func (self ArticleEntry) MessageID() string {
   return self[0]
 }
 
+// a post and its article number in its newsgroup
+type NumberedPost struct {
+  Number int64
+  PostModel
+}
+
 type Database interface {
   Close()
   CreateTables()
@@ -133,6 +329,24 @@ type Database interface {
   
   // remote a pubkey to they can't mod a newsgroup
   UnMarkModPubkeyCanModGroup(pubkey, newsgroup string) error
+
+  // check if a mod with this pubkey can do an action on the given newsgroup
+  // global mods and mods granted "all" on the newsgroup can do every action
+  CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action string) bool
+
+  // allow a pubkey to do an action on a newsgroup
+  GrantModPubkeyGroupAction(pubkey, newsgroup, action string) error
+
+  // take away a pubkey's permission to do an action on a newsgroup
+  // revoking "all" takes away every action on the newsgroup
+  RevokeModPubkeyGroupAction(pubkey, newsgroup, action string) error
+
+  // record a moderation action in the mod log
+  AddModLog(entry ModLogEntry) error
+
+  // get mod log entries newest first
+  // only entries with this pubkey or action if they are not empty
+  GetModLogs(pubkey, action string, limit, offset int) ([]ModLogEntry, error)
   
   // ban an article
   BanArticle(messageID, reason string) error
@@ -145,19 +359,33 @@ type Database interface {
   GetIPAddress(encAddr string) (string, error)
 
   // check if an ip is banned from our local
+  // bans that have run out are ignored
   CheckIPBanned(addr string) (bool, error)
 
   // check if an encrypted ip is banned from our local
   CheckEncIPBanned(encAddr string) (bool, error)
 
-  // ban an ip address from the local
-  BanAddr(addr string) error
+  // get every ban on an encrypted ip that has not run out
+  GetEncIPBans(encAddr string) ([]IPBan, error)
+
+  // ban an ip address or range from the local
+  BanAddr(ban IPBan) error
 
-  // unban an ip address from the local
+  // delete the ban on exactly this address or range
+  // bans on ranges it is in are kept
   UnbanAddr(addr string) error
   
   // ban an encrypted ip address from the remote
-  BanEncAddr(encAddr string) error
+  BanEncAddr(ban IPBan) error
+
+  // get every address and range ban that has not run out
+  GetIPBans() ([]IPBan, error)
+
+  // get every ban covering this address that has not run out
+  GetIPBansForAddr(addr string) ([]IPBan, error)
+
+  // delete every address and encrypted address ban that has run out
+  DeleteExpiredBans() error
   
   // return the encrypted version of an IPAddress
   // if it's not already there insert it into the database
@@ -168,6 +396,7 @@ type Database interface {
   GetEncKey(encAddr string) (string, error)
   
   // delete an article from the database
+  // it is taken off every feed's queue too
   DeleteArticle(msg_id string) error
   
   // detele the existance of a thread from the threads table, does NOT remove replies
@@ -178,6 +407,25 @@ type Database interface {
 
   // get pages per board for a newsgroup
   GetPagesPerBoard(group string) (int, error)
+
+  // get a newsgroup's settings
+  // returns the defaults if none were set
+  GetBoardSettings(group string) (BoardSettings, error)
+
+  // set a newsgroup's settings
+  SetBoardSettings(group string, settings BoardSettings) error
+
+  // pin or unpin a thread to the top of its board
+  SetThreadSticky(root_message_id string, sticky bool) error
+
+  // lock or unlock a thread, locked threads take no new replies
+  SetThreadLocked(root_message_id string, locked bool) error
+
+  // return true if this thread is pinned to the top of its board
+  ThreadSticky(root_message_id string) bool
+
+  // return true if this thread takes no new replies
+  ThreadLocked(root_message_id string) bool
   
   // get every newsgroup we know of
   GetAllNewsgroups() []string
@@ -187,10 +435,74 @@ type Database interface {
   GetPostsInGroup(group string) ([]PostModel, error)
   
   // get the numerical id of the last , first article for a given group
+  // nntp ids are given out in order when articles are registered and never reused
+  // last is the highest id ever given out in the group
+  // first is the lowest id we still have or last + 1 if the group is empty
   GetLastAndFirstForGroup(group string) (int64, int64, error)
 
   // get a message id give a newsgroup and the nntp id
   GetMessageIDForNNTPID(group string, id int64) (string, error)
+
+  // get the nntp id of a message given a newsgroup and its message id
+  GetNNTPIDForMessageID(group, msgid string) (int64, error)
+
+  // get all post models in a newsgroup between 2 nntp ids inclusive
+  // if last is less than 0 get every post after first
+  // ordered by nntp id
+  GetPostsInGroupRange(group string, first, last int64) ([]NumberedPost, error)
+
+  // get every article posted after a given time
+  // ordered from oldest to newest
+  GetArticlesSince(since int64) []ArticleEntry
+
+  // queue an article to be offered to a feed
+  // does nothing if it was already queued for that feed
+  QueueArticleForFeed(feed, msgid string) error
+
+  // get up to limit message ids queued for a feed that are due to be offered now
+  // ordered by when they became due
+  GetQueuedArticlesForFeed(feed string, limit int) ([]string, error)
+
+  // record that we offered a queued article to a feed
+  // it won't be due again until its backoff runs out
+  // after queueMaxAttempts offers it is taken off the queue
+  MarkArticleOffered(feed, msgid string) error
+
+  // record the response code a feed gave for a queued article
+  // 431 keeps it queued
+  // 438 and 439 are no longer offered but kept with their code until they expire
+  // anything else takes it off the queue
+  RecordArticleOutcome(feed, msgid string, code int) error
+
+  // take articles queued for longer than queueMaxAge off every feed's queue
+  DeleteExpiredQueuedArticles() error
+
+  // get the highest article number we synced from a feed for a newsgroup
+  // 0 if we never synced it
+  GetFeedHighWaterMark(feed, group string) (int64, error)
+
+  // set the highest article number we synced from a feed for a newsgroup
+  SetFeedHighWaterMark(feed, group string, mark int64) error
+
+  // forget high water marks so the next sync fetches everything again
+  // an empty feed means every feed, an empty group means every group
+  ResetFeedHighWaterMarks(feed, group string) error
+
+  // add a token for the json posting api
+  // fails if one with the same name exists
+  AddAPIToken(token APIToken) error
+
+  // get an api token given its hash
+  GetAPIToken(token_hash string) (APIToken, error)
+
+  // revoke an api token given its name
+  RevokeAPIToken(name string) error
+
+  // search posts for every word in a query by subject, name and message
+  // an empty newsgroup searches every newsgroup starting with group_prefix
+  // posts in ctl are never found
+  // ordered from newest to oldest
+  SearchPosts(prefix, newsgroup, group_prefix, query string, offset, limit int) ([]PostModel, error)
 }
 
 func NewDatabase(db_type, schema, host, port, user, password string) Database  {
@@ -198,6 +510,18 @@ func NewDatabase(db_type, schema, host, port, user, password string) Database  {
     if schema == "srnd" {
       return NewPostgresDatabase(host, port, user, password)
     }
+  } else if db_type == "sqlite" {
+    if schema == "srnd" {
+      // host is the path to the database file
+      return NewSQLiteDatabase(host)
+    }
+  } else if db_type == "redis" {
+    if schema == "srnd" {
+      return NewRedisDatabase(host, port, password)
+    }
+  } else if db_type == "memory" {
+    // nothing is saved
+    return NewMemoryDatabase()
   }
   log.Fatalf("invalid database type: %s/%s" , db_type, schema)
   return nil
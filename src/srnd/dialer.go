@@ -0,0 +1,340 @@
+//
+// dialer.go -- ways of connecting out to feeds
+//
+package srnd
+
+import (
+  "bufio"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// something that can connect out to a remote address
+type Dialer interface {
+  // connect to host:port
+  Dial(remote_addr string) (net.Conn, error)
+}
+
+// create a dialer given the proxy settings for a feed
+// proxy_type is one of none, socks4a, socks5 or i2p
+// username and password are only used by socks5
+func NewDialer(proxy_type, proxy_addr, username, password string) (Dialer, error) {
+  switch proxy_type {
+  case "", "none":
+    return directDialer{}, nil
+  case "socks4a":
+    return socks4aDialer{proxy_addr}, nil
+  case "socks5":
+    return socks5Dialer{proxy_addr, username, password}, nil
+  case "i2p", "sam":
+    return &samDialer{sam_addr: proxy_addr}, nil
+  }
+  return nil, errors.New("unknown proxy type: " + proxy_type)
+}
+
+// split host:port and parse the port
+func splitDialAddr(remote_addr string) (host string, port uint16, err error) {
+  var port_str string
+  host, port_str, err = net.SplitHostPort(remote_addr)
+  if err == nil {
+    var p uint64
+    p, err = strconv.ParseUint(port_str, 10, 16)
+    port = uint16(p)
+  }
+  return
+}
+
+// connect without a proxy
+type directDialer struct {
+}
+
+func (self directDialer) Dial(remote_addr string) (net.Conn, error) {
+  log.Println("dial out to", remote_addr)
+  return net.Dial("tcp", remote_addr)
+}
+
+// connect via a socks4a proxy
+type socks4aDialer struct {
+  proxy_addr string
+}
+
+func (self socks4aDialer) Dial(remote_addr string) (conn net.Conn, err error) {
+  var host string
+  var port uint16
+  host, port, err = splitDialAddr(remote_addr)
+  if err != nil {
+    return
+  }
+  log.Println("dial out via socks4a proxy", self.proxy_addr)
+  conn, err = net.Dial("tcp", self.proxy_addr)
+  if err != nil {
+    return
+  }
+  // version, connect, port, invalid ip 0.0.0.1, ident, hostname
+  req := []byte{4, 1, byte(port >> 8), byte(port), 0, 0, 0, 1}
+  req = append(req, []byte("srndv2")...)
+  req = append(req, 0)
+  req = append(req, []byte(host)...)
+  req = append(req, 0)
+  _, err = conn.Write(req)
+  if err == nil {
+    resp := make([]byte, 8)
+    _, err = io.ReadFull(conn, resp)
+    if err == nil && resp[1] != 0x5a {
+      err = errors.New("socks4a proxy refused connection")
+    }
+  }
+  if err != nil {
+    log.Println("failed to connect to", remote_addr, "via socks4a", err)
+    conn.Close()
+    conn = nil
+  }
+  return
+}
+
+// connect via a socks5 proxy
+// a username and password can be given to use tor stream isolation
+type socks5Dialer struct {
+  proxy_addr string
+  username string
+  password string
+}
+
+func (self socks5Dialer) Dial(remote_addr string) (conn net.Conn, err error) {
+  var host string
+  var port uint16
+  host, port, err = splitDialAddr(remote_addr)
+  if err != nil {
+    return
+  }
+  if len(host) > 255 || len(self.username) > 255 || len(self.password) > 255 {
+    err = errors.New("socks5 parameter too long")
+    return
+  }
+  log.Println("dial out via socks5 proxy", self.proxy_addr)
+  conn, err = net.Dial("tcp", self.proxy_addr)
+  if err != nil {
+    return
+  }
+  err = self.handshake(conn, host, port)
+  if err != nil {
+    log.Println("failed to connect to", remote_addr, "via socks5", err)
+    conn.Close()
+    conn = nil
+  }
+  return
+}
+
+func (self socks5Dialer) handshake(conn net.Conn, host string, port uint16) (err error) {
+  // greeting
+  method := byte(0)
+  if self.username != "" {
+    method = 2
+  }
+  _, err = conn.Write([]byte{5, 1, method})
+  if err != nil {
+    return
+  }
+  resp := make([]byte, 2)
+  _, err = io.ReadFull(conn, resp)
+  if err != nil {
+    return
+  } else if resp[0] != 5 || resp[1] != method {
+    return errors.New("socks5 proxy does not accept our auth method")
+  }
+  if method == 2 {
+    // username / password auth
+    req := []byte{1, byte(len(self.username))}
+    req = append(req, []byte(self.username)...)
+    req = append(req, byte(len(self.password)))
+    req = append(req, []byte(self.password)...)
+    _, err = conn.Write(req)
+    if err == nil {
+      _, err = io.ReadFull(conn, resp)
+    }
+    if err != nil {
+      return
+    } else if resp[1] != 0 {
+      return errors.New("socks5 proxy rejected our username and password")
+    }
+  }
+  // connect by hostname
+  req := []byte{5, 1, 0, 3, byte(len(host))}
+  req = append(req, []byte(host)...)
+  req = append(req, byte(port >> 8), byte(port))
+  _, err = conn.Write(req)
+  if err != nil {
+    return
+  }
+  resp = make([]byte, 4)
+  _, err = io.ReadFull(conn, resp)
+  if err != nil {
+    return
+  } else if resp[1] != 0 {
+    return fmt.Errorf("socks5 proxy refused connection, code %d", resp[1])
+  }
+  // discard bound address and port
+  var addr_len int
+  switch resp[3] {
+  case 1:
+    addr_len = 4
+  case 4:
+    addr_len = 16
+  case 3:
+    _, err = io.ReadFull(conn, resp[:1])
+    addr_len = int(resp[0])
+  default:
+    err = errors.New("socks5 proxy sent invalid address type")
+  }
+  if err == nil {
+    _, err = io.ReadFull(conn, make([]byte, addr_len + 2))
+  }
+  return
+}
+
+// connect via the i2p router's SAMv3 bridge
+// all connections share one transient destination that lives as long as the control socket
+type samDialer struct {
+  sam_addr string
+  access sync.Mutex
+  // control socket for our session, nil if we have none
+  control net.Conn
+  control_r *bufio.Reader
+  session_id string
+}
+
+// connect to the sam bridge and say hello
+func (self *samDialer) hello() (conn net.Conn, r *bufio.Reader, err error) {
+  conn, err = net.Dial("tcp", self.sam_addr)
+  if err == nil {
+    r = bufio.NewReader(conn)
+    _, err = samCommand(conn, r, "HELLO VERSION MIN=3.0 MAX=3.1")
+    if err != nil {
+      conn.Close()
+      conn = nil
+    }
+  }
+  return
+}
+
+// send a command to the sam bridge and read the reply
+// returns the reply's key=value pairs or an error if RESULT is not OK
+func samCommand(conn net.Conn, r *bufio.Reader, cmd string) (reply map[string]string, err error) {
+  _, err = io.WriteString(conn, cmd + "\n")
+  if err != nil {
+    return
+  }
+  var line string
+  line, err = r.ReadString('\n')
+  if err != nil {
+    return
+  }
+  reply = make(map[string]string)
+  for _, part := range strings.Fields(line) {
+    idx := strings.Index(part, "=")
+    if idx > 0 {
+      reply[part[:idx]] = strings.Trim(part[idx+1:], "\"")
+    }
+  }
+  if reply["RESULT"] != "OK" {
+    err = fmt.Errorf("sam bridge said %s %s", reply["RESULT"], reply["MESSAGE"])
+  }
+  return
+}
+
+// make sure we have a session
+// must hold lock
+func (self *samDialer) ensureSession() (err error) {
+  if self.control != nil {
+    return
+  }
+  var conn net.Conn
+  var r *bufio.Reader
+  conn, r, err = self.hello()
+  if err == nil {
+    id := fmt.Sprintf("srndv2-%s", randStr(8))
+    _, err = samCommand(conn, r, fmt.Sprintf("SESSION CREATE STYLE=STREAM ID=%s DESTINATION=TRANSIENT", id))
+    if err == nil {
+      log.Println("created i2p session", id)
+      self.control, self.control_r, self.session_id = conn, r, id
+    } else {
+      conn.Close()
+    }
+  }
+  return
+}
+
+// drop our session so the next dial makes a new one
+// must hold lock
+func (self *samDialer) resetSession() {
+  if self.control != nil {
+    self.control.Close()
+    self.control = nil
+  }
+}
+
+func (self *samDialer) Dial(remote_addr string) (conn net.Conn, err error) {
+  // i2p has no ports
+  host, _, err := splitDialAddr(remote_addr)
+  if err != nil {
+    host = remote_addr
+  }
+  self.access.Lock()
+  err = self.ensureSession()
+  var dest, id string
+  if err == nil {
+    id = self.session_id
+    var reply map[string]string
+    reply, err = samCommand(self.control, self.control_r, "NAMING LOOKUP NAME=" + host)
+    dest = reply["VALUE"]
+    if err != nil && reply == nil {
+      // control socket is dead
+      self.resetSession()
+    }
+  }
+  self.access.Unlock()
+  if err != nil {
+    log.Println("i2p lookup of", host, "failed", err)
+    return
+  }
+  var r *bufio.Reader
+  var sock net.Conn
+  sock, r, err = self.hello()
+  if err == nil {
+    log.Println("dial out to", host, "via i2p")
+    var reply map[string]string
+    reply, err = samCommand(sock, r, fmt.Sprintf("STREAM CONNECT ID=%s DESTINATION=%s SILENT=false", id, dest))
+    if err == nil {
+      // the remote end may have already sent something that we buffered
+      conn = samConn{sock, r}
+    } else {
+      log.Println("failed to connect to", host, "via i2p", err)
+      sock.Close()
+      if reply["RESULT"] == "INVALID_ID" {
+        // the router forgot our session
+        self.access.Lock()
+        if self.session_id == id {
+          self.resetSession()
+        }
+        self.access.Unlock()
+      }
+    }
+  }
+  return
+}
+
+// a stream from the sam bridge, reads go through the reader used for the handshake
+type samConn struct {
+  net.Conn
+  r *bufio.Reader
+}
+
+func (self samConn) Read(data []byte) (int, error) {
+  return self.r.Read(data)
+}
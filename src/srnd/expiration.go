@@ -8,6 +8,7 @@ import (
   "path/filepath"
   "log"
   "os"
+  "time"
 )
 
 // content expiration interface
@@ -16,6 +17,10 @@ type ExpirationCore interface {
   ExpireGroup(newsgroup string, keep int)
   // Delete a single post and all children
   DeletePost(messageID string)
+  // delete address bans that have run out
+  ExpireBans()
+  // take articles that were queued too long off feed queues
+  ExpireFeedQueues()
   // run our mainloop
   Mainloop()
 }
@@ -74,26 +79,52 @@ func (self expire) ExpireGroup(newsgroup string, keep int) {
   }
 }
 
+func (self expire) ExpireBans() {
+  err := self.database.DeleteExpiredBans()
+  if err != nil {
+    log.Println("failed to expire bans", err)
+  }
+}
+
+func (self expire) ExpireFeedQueues() {
+  err := self.database.DeleteExpiredQueuedArticles()
+  if err != nil {
+    log.Println("failed to expire feed queues", err)
+  }
+}
+
 func (self expire) Mainloop() {
+  // sweep bans and feed queues every minute
+  ticker := time.NewTicker(time.Minute)
   for {
-    ev := <- self.delChan
-    log.Println("expire")
-    atts := self.database.GetPostAttachments(ev.MessageID())
-    // remove all attachments
-    if atts != nil {
-      for _, att := range atts {
-        img := self.store.AttachmentFilepath(att)
-        os.Remove(img)
-        thm := self.store.ThumbnailFilepath(att)
-        os.Remove(thm)
-      }
+    select {
+    case <- ticker.C:
+      self.ExpireBans()
+      self.ExpireFeedQueues()
+    case ev := <- self.delChan:
+      self.handleDelete(ev)
     }
-    // remove article
-    os.Remove(ev.Path())
-    log.Println("expire")
-    err := self.database.DeleteArticle(ev.MessageID())
-    if err != nil {
-      log.Println("failed to delete article", err)
+  }
+}
+
+// delete a post's files and remove it from the database
+func (self expire) handleDelete(ev deleteEvent) {
+  log.Println("expire")
+  atts := self.database.GetPostAttachments(ev.MessageID())
+  // remove all attachments
+  if atts != nil {
+    for _, att := range atts {
+      img := self.store.AttachmentFilepath(att)
+      os.Remove(img)
+      thm := self.store.ThumbnailFilepath(att)
+      os.Remove(thm)
     }
   }
+  // remove article
+  os.Remove(ev.Path())
+  log.Println("expire")
+  err := self.database.DeleteArticle(ev.MessageID())
+  if err != nil {
+    log.Println("failed to delete article", err)
+  }
 }
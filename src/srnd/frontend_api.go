@@ -0,0 +1,613 @@
+//
+// frontend_api.go
+//
+// json api for the http frontend
+//
+package srnd
+
+import (
+  "github.com/gorilla/mux"
+  "bytes"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/hex"
+  "encoding/json"
+  "errors"
+  "fmt"
+  "html"
+  "io"
+  "log"
+  "mime"
+  "net/http"
+  "strconv"
+  "strings"
+  "sync"
+)
+
+// an attachment as json
+type apiAttachment struct {
+  Filename string `json:"filename"`
+  URL string `json:"url"`
+  Thumbnail string `json:"thumbnail"`
+}
+
+// a post as json
+type apiPost struct {
+  MessageID string `json:"message_id"`
+  Hash string `json:"hash"`
+  ShortHash string `json:"short_hash"`
+  Board string `json:"board"`
+  // message id of the thread's root post
+  Reference string `json:"reference"`
+  URL string `json:"url"`
+  OP bool `json:"op"`
+  Sage bool `json:"sage"`
+  Name string `json:"name"`
+  Subject string `json:"subject"`
+  Frontend string `json:"frontend"`
+  Posted int64 `json:"posted"`
+  Message string `json:"message"`
+  MessageHTML string `json:"message_html"`
+  Pubkey string `json:"pubkey,omitempty"`
+  Tripcode string `json:"tripcode,omitempty"`
+  Attachments []apiAttachment `json:"attachments"`
+  // short hashes of the posts that quote this one
+  Backlinks []string `json:"backlinks"`
+}
+
+// a thread as json
+type apiThread struct {
+  Board string `json:"board"`
+  OP apiPost `json:"op"`
+  Replies []apiPost `json:"replies"`
+  // total replies, can be more than len(Replies) on board pages
+  ReplyCount int64 `json:"reply_count"`
+  // replies no longer bump this thread
+  BumpLimit bool `json:"bump_limit"`
+  Sticky bool `json:"sticky"`
+  Locked bool `json:"locked"`
+}
+
+// one page of a board as json
+type apiBoardPage struct {
+  Board string `json:"board"`
+  Page int `json:"page"`
+  Pages int64 `json:"pages"`
+  Threads []apiThread `json:"threads"`
+}
+
+// a board in the board list
+type apiBoard struct {
+  Name string `json:"name"`
+  Pages int64 `json:"pages"`
+  PostsHour int64 `json:"posts_hour"`
+  PostsDay int64 `json:"posts_day"`
+  PostsTotal int64 `json:"posts_total"`
+}
+
+// the overboard as json
+type apiUkko struct {
+  Threads []apiThread `json:"threads"`
+}
+
+// the front page as json
+type apiFrontPage struct {
+  Frontend string `json:"frontend"`
+  TotalPosts int64 `json:"total_posts"`
+  Boards []apiBoard `json:"boards"`
+}
+
+// a thread in a catalog
+type apiCatalogEntry struct {
+  OP apiPost `json:"op"`
+  ReplyCount int64 `json:"reply_count"`
+}
+
+// every thread on a board as json
+type apiCatalog struct {
+  Board string `json:"board"`
+  Threads []apiCatalogEntry `json:"threads"`
+}
+
+// why a poster is banned as json
+type apiBanned struct {
+  Error string `json:"error"`
+  Reason string `json:"reason"`
+  Scope string `json:"scope"`
+  // unix time the ban runs out, -1 for never
+  Expires int64 `json:"expires"`
+  Appeal string `json:"appeal"`
+}
+
+func apiBannedFromBan(ban IPBan) apiBanned {
+  expires := ban.Expires
+  if expires <= 0 {
+    expires = -1
+  }
+  return apiBanned{
+    Error: "banned",
+    Reason: ban.Reason,
+    Scope: modScopeName(ban.Scope),
+    Expires: expires,
+    Appeal: ban.AppealID(),
+  }
+}
+
+// convert a post model to json
+func apiPostFromModel(p PostModel) (j apiPost) {
+  j = apiPost{
+    MessageID: p.MessageID(),
+    Hash: p.PostHash(),
+    ShortHash: p.ShortHash(),
+    Board: p.Board(),
+    Reference: p.Reference(),
+    URL: p.PostURL(),
+    OP: p.OP(),
+    Sage: p.Sage(),
+    Name: p.Name(),
+    Subject: p.Subject(),
+    Frontend: p.Frontend(),
+    Posted: p.Posted(),
+    Message: p.RawBody(),
+    MessageHTML: p.RenderBody(),
+    Pubkey: p.PubkeyHex(),
+    Attachments: []apiAttachment{},
+    Backlinks: []string{},
+  }
+  if len(j.Pubkey) > 0 {
+    j.Tripcode = html.UnescapeString(makeTripcode(j.Pubkey))
+  }
+  for _, att := range p.Attachments() {
+    j.Attachments = append(j.Attachments, apiAttachment{
+      Filename: att.Filename(),
+      URL: att.Source(),
+      Thumbnail: att.Thumbnail(),
+    })
+  }
+  return
+}
+
+// does this post quote the post with this hash?
+func apiPostQuotes(p apiPost, hash string) bool {
+  for _, match := range re_backlink.FindAllStringSubmatch(p.Message, -1) {
+    quoted := strings.ToLower(match[1])
+    if len(quoted) >= 10 && strings.HasPrefix(hash, quoted) {
+      return true
+    }
+  }
+  return false
+}
+
+// fill in backlinks between a list of posts
+func apiFillBacklinks(posts []*apiPost) {
+  for _, p := range posts {
+    for _, q := range posts {
+      if p != q && apiPostQuotes(*q, p.Hash) {
+        p.Backlinks = append(p.Backlinks, q.ShortHash)
+      }
+    }
+  }
+}
+
+// convert a thread model to json
+func apiThreadFromModel(th ThreadModel, db Database) (j apiThread) {
+  op := th.OP()
+  j.Board = th.Board()
+  j.OP = apiPostFromModel(op)
+  j.Replies = []apiPost{}
+  for _, p := range th.Replies() {
+    j.Replies = append(j.Replies, apiPostFromModel(p))
+  }
+  j.ReplyCount = db.CountThreadReplies(op.MessageID())
+  j.BumpLimit = th.BumpLimitReached()
+  j.Sticky = th.Sticky()
+  j.Locked = th.Locked()
+  posts := []*apiPost{&j.OP}
+  for idx := range j.Replies {
+    posts = append(posts, &j.Replies[idx])
+  }
+  apiFillBacklinks(posts)
+  return
+}
+
+// convert a board page model to json
+// threads are truncated like they are on the html page
+func apiBoardPageFromModel(board BoardModel, page int, pages int64, db Database) (j apiBoardPage) {
+  j = apiBoardPage{
+    Board: board.Name(),
+    Page: page,
+    Pages: pages,
+    Threads: []apiThread{},
+  }
+  for _, th := range board.Threads() {
+    j.Threads = append(j.Threads, apiThreadFromModel(th.Truncate(), db))
+  }
+  return
+}
+
+// load an entire thread given its root post's message id
+// returns nil if we don't have it
+func apiLoadThread(prefix, root_msgid string, db Database) ThreadModel {
+  op := db.GetPostModel(prefix, root_msgid)
+  if op == nil {
+    return nil
+  }
+  replies := db.GetThreadReplyPostModels(prefix, root_msgid, 0)
+  return thread{
+    prefix: prefix,
+    posts: append([]PostModel{op}, replies...),
+    bumplimit: threadBumpLimitReached(db, op.Board(), int64(len(replies))),
+    sticky: db.ThreadSticky(root_msgid),
+    locked: db.ThreadLocked(root_msgid),
+  }
+}
+
+// write an object as json
+func (self httpFrontend) writeJSON(wr http.ResponseWriter, code int, obj interface{}) {
+  wr.Header().Set("Content-Type", "application/json; charset=UTF-8")
+  wr.WriteHeader(code)
+  enc := json.NewEncoder(wr)
+  err := enc.Encode(obj)
+  if err != nil {
+    log.Println("failed to write json response", err)
+  }
+}
+
+// write an error as json
+func (self httpFrontend) writeJSONError(wr http.ResponseWriter, code int, msg string) {
+  self.writeJSON(wr, code, map[string]string{"error": msg})
+}
+
+// check that a board from the url exists and we serve it
+func (self httpFrontend) apiBoardValid(board string) bool {
+  return self.AllowNewsgroup(board) && board != "ctl" && self.daemon.database.HasNewsgroup(board)
+}
+
+// GET /api/boards
+func (self httpFrontend) handle_api_boards(wr http.ResponseWriter, r *http.Request) {
+  db := self.daemon.database
+  boards := []apiBoard{}
+  for _, group := range db.GetAllNewsgroups() {
+    if ! self.AllowNewsgroup(group) || group == "ctl" {
+      continue
+    }
+    boards = append(boards, apiBoard{
+      Name: group,
+      Pages: db.GetGroupPageCount(group),
+      PostsHour: db.CountPostsInGroup(group, 3600),
+      PostsDay: db.CountPostsInGroup(group, 86400),
+      PostsTotal: db.CountPostsInGroup(group, 0),
+    })
+  }
+  self.writeJSON(wr, http.StatusOK, boards)
+}
+
+// GET /api/board/{board}/{page}
+func (self httpFrontend) handle_api_board(wr http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  board := vars["board"]
+  if ! self.apiBoardValid(board) {
+    self.writeJSONError(wr, http.StatusNotFound, "no such board")
+    return
+  }
+  db := self.daemon.database
+  page, err := strconv.Atoi(vars["page"])
+  pages := db.GetGroupPageCount(board)
+  if err != nil || page < 0 || int64(page) >= pages {
+    self.writeJSONError(wr, http.StatusNotFound, "no such page")
+    return
+  }
+  perpage, _ := db.GetThreadsPerPage(board)
+  model := db.GetGroupForPage(self.prefix, self.name, board, page, perpage).Update(db)
+  self.writeJSON(wr, http.StatusOK, apiBoardPageFromModel(model, page, pages, db))
+}
+
+// GET /api/catalog/{board}
+func (self httpFrontend) handle_api_catalog(wr http.ResponseWriter, r *http.Request) {
+  board := mux.Vars(r)["board"]
+  if ! self.apiBoardValid(board) {
+    self.writeJSONError(wr, http.StatusNotFound, "no such board")
+    return
+  }
+  db := self.daemon.database
+  j := apiCatalog{
+    Board: board,
+    Threads: []apiCatalogEntry{},
+  }
+  perpage, _ := db.GetThreadsPerPage(board)
+  pages := int(db.GetGroupPageCount(board))
+  for page := 0 ; page < pages ; page ++ {
+    model := db.GetGroupForPage(self.prefix, self.name, board, page, perpage)
+    for _, th := range model.Threads() {
+      op := th.OP()
+      j.Threads = append(j.Threads, apiCatalogEntry{
+        OP: apiPostFromModel(op),
+        ReplyCount: db.CountThreadReplies(op.MessageID()),
+      })
+    }
+  }
+  self.writeJSON(wr, http.StatusOK, j)
+}
+
+// GET /api/thread/{hash}
+// hash is the post hash of the root post
+func (self httpFrontend) handle_api_thread(wr http.ResponseWriter, r *http.Request) {
+  db := self.daemon.database
+  hash := strings.ToLower(mux.Vars(r)["hash"])
+  article, err := db.GetMessageIDByHash(hash)
+  var th ThreadModel
+  if err == nil && self.apiBoardValid(article.Newsgroup()) {
+    th = apiLoadThread(self.prefix, article.MessageID(), db)
+  }
+  if th == nil || ! th.OP().OP() {
+    self.writeJSONError(wr, http.StatusNotFound, "no such thread")
+    return
+  }
+  self.writeJSON(wr, http.StatusOK, apiThreadFromModel(th, db))
+}
+
+// GET /api/post/{hash}
+func (self httpFrontend) handle_api_post(wr http.ResponseWriter, r *http.Request) {
+  db := self.daemon.database
+  hash := strings.ToLower(mux.Vars(r)["hash"])
+  article, err := db.GetMessageIDByHash(hash)
+  var p PostModel
+  if err == nil && self.apiBoardValid(article.Newsgroup()) {
+    p = db.GetPostModel(self.prefix, article.MessageID())
+  }
+  if p == nil {
+    self.writeJSONError(wr, http.StatusNotFound, "no such post")
+    return
+  }
+  j := apiPostFromModel(p)
+  // find backlinks from the rest of the thread
+  posts := []*apiPost{&j}
+  th := apiLoadThread(self.prefix, p.Reference(), db)
+  if th != nil {
+    for _, other := range append([]PostModel{th.OP()}, th.Replies()...) {
+      if other.MessageID() != p.MessageID() {
+        // we only need enough to find quotes
+        posts = append(posts, &apiPost{
+          Hash: other.PostHash(),
+          ShortHash: other.ShortHash(),
+          Message: other.RawBody(),
+        })
+      }
+    }
+  }
+  apiFillBacklinks(posts)
+  self.writeJSON(wr, http.StatusOK, j)
+}
+
+// make a new secret for an api token
+func newAPIToken() string {
+  return randStr(32)
+}
+
+// hash an api token's secret for storing in the database
+func hashAPIToken(token string) string {
+  digest := sha256.Sum256([]byte(token))
+  return hex.EncodeToString(digest[:])
+}
+
+// counts posts made with each api token in the last hour
+type apiRateLimiter struct {
+  access sync.Mutex
+  // token name -> when it posted
+  posts map[string][]int64
+}
+
+func newAPIRateLimiter() *apiRateLimiter {
+  return &apiRateLimiter{
+    posts: make(map[string][]int64),
+  }
+}
+
+// record a post by a token if it is under its limit
+// returns false if it is not allowed to post right now
+func (self *apiRateLimiter) Allow(name string, limit int64) bool {
+  if limit <= 0 {
+    return true
+  }
+  now := timeNow()
+  self.access.Lock()
+  defer self.access.Unlock()
+  var recent []int64
+  for _, posted := range self.posts[name] {
+    if now - posted < 3600 {
+      recent = append(recent, posted)
+    }
+  }
+  if int64(len(recent)) >= limit {
+    self.posts[name] = recent
+    return false
+  }
+  self.posts[name] = append(recent, now)
+  return true
+}
+
+// an attachment posted via the json api
+type apiPostAttachment struct {
+  Filename string `json:"filename"`
+  Mime string `json:"mime"`
+  // base64 encoded
+  Data string `json:"data"`
+}
+
+// largest request body /api/post reads
+// room for a 10MB message and base64 encoded attachments
+const apiMaxPostBody = 1024 * 1024 * 32
+
+// a post made via the json api
+type apiPostRequest struct {
+  Newsgroup string `json:"newsgroup"`
+  Subject string `json:"subject"`
+  Name string `json:"name"`
+  Message string `json:"message"`
+  Reference string `json:"reference"`
+  Attachments []apiPostAttachment `json:"attachments"`
+}
+
+// read a post request from a json body
+func (self httpFrontend) readJSONPostRequest(r *http.Request, nntp nntpArticle) (req apiPostRequest, article nntpArticle, err error) {
+  article = nntp
+  err = json.NewDecoder(r.Body).Decode(&req)
+  if err == nil && self.attachments {
+    for _, a := range req.Attachments {
+      var data []byte
+      data, err = base64.StdEncoding.DecodeString(a.Data)
+      if err != nil {
+        return
+      }
+      att := createAttachment(a.Mime, a.Filename, bytes.NewBuffer(data))
+      if att == nil {
+        err = errors.New("invalid attachment " + a.Filename)
+        return
+      }
+      article = article.Attach(att).(nntpArticle)
+    }
+  }
+  return
+}
+
+// read a post request from a multipart body
+// uses the same fields as the post form
+func (self httpFrontend) readMultipartPostRequest(r *http.Request, nntp nntpArticle) (req apiPostRequest, article nntpArticle, err error) {
+  article = nntp
+  mp_reader, err := r.MultipartReader()
+  if err != nil {
+    return
+  }
+  var part_buff bytes.Buffer
+  for {
+    part, err := mp_reader.NextPart()
+    if err == io.EOF {
+      return req, article, nil
+    } else if err != nil {
+      return req, article, err
+    }
+    partname := part.FormName()
+    if partname == "attachment" {
+      if self.attachments {
+        att := readAttachmentFromMimePart(part)
+        if att != nil {
+          article = article.Attach(att).(nntpArticle)
+        }
+      }
+    } else {
+      io.Copy(&part_buff, part)
+      if partname == "newsgroup" {
+        req.Newsgroup = part_buff.String()
+      } else if partname == "subject" {
+        req.Subject = part_buff.String()
+      } else if partname == "name" {
+        req.Name = part_buff.String()
+      } else if partname == "message" {
+        req.Message = part_buff.String()
+      } else if partname == "reference" {
+        req.Reference = part_buff.String()
+      }
+      part_buff.Reset()
+    }
+    part.Close()
+  }
+}
+
+// POST /api/post
+// post with an api token instead of a captcha
+// the token is given as Authorization: Bearer <token>
+// the body is either json or multipart with the same fields as the post form
+func (self httpFrontend) handle_api_post_article(wr http.ResponseWriter, r *http.Request) {
+  // check token
+  auth := r.Header.Get("Authorization")
+  if ! strings.HasPrefix(auth, "Bearer ") {
+    self.writeJSONError(wr, http.StatusUnauthorized, "no api token given")
+    return
+  }
+  db := self.daemon.database
+  token, err := db.GetAPIToken(hashAPIToken(strings.Trim(auth[7:], " ")))
+  if err != nil {
+    self.writeJSONError(wr, http.StatusUnauthorized, "invalid api token")
+    return
+  }
+  // before reading the body so a limited token can't make us read it
+  if ! self.api_limiter.Allow(token.Name, token.RateLimit) {
+    self.writeJSONError(wr, http.StatusTooManyRequests, "rate limit reached")
+    return
+  }
+
+  var nntp nntpArticle
+  nntp.headers = make(ArticleHeaders)
+  var req apiPostRequest
+  r.Body = http.MaxBytesReader(wr, r.Body, apiMaxPostBody)
+  media_type, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+  if media_type == "multipart/form-data" {
+    req, nntp, err = self.readMultipartPostRequest(r, nntp)
+  } else {
+    req, nntp, err = self.readJSONPostRequest(r, nntp)
+  }
+  if err != nil {
+    self.writeJSONError(wr, http.StatusBadRequest, fmt.Sprintf("bad request: %s", err))
+    return
+  }
+
+  // check newsgroup
+  board := strings.ToLower(req.Newsgroup)
+  if ! self.AllowNewsgroup(board) || board == "ctl" {
+    self.writeJSONError(wr, http.StatusBadRequest, "invalid newsgroup")
+    return
+  }
+  if ! wildmatMatch(token.Scope, board) {
+    self.writeJSONError(wr, http.StatusForbidden, "api token may not post to " + board)
+    return
+  }
+  nntp.headers.Set("Newsgroups", board)
+
+  // check reference
+  if len(req.Reference) > 0 {
+    if ! ValidMessageID(req.Reference) {
+      self.writeJSONError(wr, http.StatusBadRequest, "invalid reference")
+      return
+    } else if ! db.HasArticleLocal(req.Reference) {
+      self.writeJSONError(wr, http.StatusNotFound, "we don't have " + req.Reference + " locally, can't reply")
+      return
+    }
+    nntp.headers.Set("References", req.Reference)
+  }
+
+  // check message size
+  if len(nntp.attachments) == 0 && len(req.Message) == 0 {
+    self.writeJSONError(wr, http.StatusBadRequest, "no message")
+    return
+  } else if len(req.Message) > 1024 * 1024 * 10 {
+    self.writeJSONError(wr, http.StatusRequestEntityTooLarge, "message too big")
+    return
+  }
+
+  // check ban
+  ban, banned, err := self.posterHeaders(r, board, nntp.headers)
+  if banned {
+    self.writeJSON(wr, http.StatusForbidden, apiBannedFromBan(ban))
+    return
+  } else if err != nil {
+    self.writeJSONError(wr, http.StatusInternalServerError, "error checking for ban")
+    return
+  }
+
+  if reason := self.checkBoardSettings(board, nntp) ; len(reason) > 0 {
+    self.writeJSONError(wr, http.StatusForbidden, reason)
+    return
+  }
+
+  nntp, err = self.submitArticle(nntp, req.Subject, req.Name, req.Message)
+  if err != nil {
+    self.writeJSONError(wr, http.StatusInternalServerError, err.Error())
+    return
+  }
+  log.Println("api token", token.Name, "posted", nntp.MessageID())
+  root := nntp.headers.Get("References", nntp.MessageID())
+  self.writeJSON(wr, http.StatusOK, map[string]string{
+    "message_id": nntp.MessageID(),
+    "url": fmt.Sprintf("%sthread-%s.html", self.prefix, ShortHashMessageID(root)),
+  })
+}
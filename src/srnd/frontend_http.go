@@ -51,6 +51,10 @@ type httpFrontend struct {
   regen_threads int
   regen_on_start bool
   attachments bool
+  // show the mod log to everyone
+  public_modlog bool
+  // absolute base url for links in feeds, empty if we make no feeds
+  feed_url string
   
   prefix string
   regenThreadChan chan ArticleEntry
@@ -63,13 +67,21 @@ type httpFrontend struct {
   store *sessions.CookieStore
 
   upgrader websocket.Upgrader
+
+  // rate limits for posting with api tokens
+  api_limiter *apiRateLimiter
+
+  // websocket clients getting live updates
+  live *liveHub
 }
 
 // do we allow this newsgroup?
+// XXX: hardcoded nntp prefix
+// TODO: make configurable nntp prefix
+const httpNewsgroupPrefix = "overchan."
+
 func (self httpFrontend) AllowNewsgroup(group string) bool {
-  // XXX: hardcoded nntp prefix
-  // TODO: make configurable nntp prefix
-  return strings.HasPrefix(group, "overchan.") && newsgroupValidFormat(group) || group == "ctl"
+  return strings.HasPrefix(group, httpNewsgroupPrefix) && newsgroupValidFormat(group) || group == "ctl"
 }
 
 // try to delete root post's page
@@ -77,6 +89,9 @@ func (self httpFrontend) deleteThreadMarkup(root_post_id string) {
   fname :=  self.getFilenameForThread(root_post_id)
   log.Println("delete file", fname)
   os.Remove(fname)
+  os.Remove(jsonFilename(fname))
+  os.Remove(rssFilename(fname))
+  os.Remove(atomFilename(fname))
 }
 
 func (self httpFrontend) getFilenameForThread(root_post_id string) string {
@@ -90,7 +105,27 @@ func (self httpFrontend) deleteBoardMarkup(group string) {
     fname := self.getFilenameForBoardPage(group, page)
     log.Println("delete file", fname)
     os.Remove(fname)
-  }
+    os.Remove(jsonFilename(fname))
+  }
+  // board feeds
+  fname := self.getFilenameForBoardFeeds(group)
+  os.Remove(rssFilename(fname))
+  os.Remove(atomFilename(fname))
+  // catalog
+  fname = self.getFilenameForCatalog(group)
+  log.Println("delete file", fname)
+  os.Remove(fname)
+  os.Remove(jsonFilename(fname))
+}
+
+func (self httpFrontend) getFilenameForCatalog(boardname string) string {
+  fname := fmt.Sprintf("catalog-%s.html", boardname)
+  return filepath.Join(self.webroot_dir, fname)
+}
+
+// the html filename the board's rss and atom feeds are named after
+func (self httpFrontend) getFilenameForBoardFeeds(boardname string) string {
+  return filepath.Join(self.webroot_dir, boardname + ".html")
 }
 
 func (self httpFrontend) getFilenameForBoardPage(boardname string, pageno int) string {
@@ -158,13 +193,22 @@ func (self httpFrontend) pollRegen() {
       // listen for regen thread requests
     case entry := <- self.regenThreadChan:
       self.regenerateThread(entry)
+      self.regenerateThreadFeeds(entry)
       // regen ukko
     case _ = <- self.ukkoTicker.C:
       self.regenUkko()
+      self.regenUkkoFeeds()
       self.regenFrontPage()
     case _ = <- self.regenBoardTicker.C:
+      groups := make(map[string]bool)
       for _, v := range self.regenBoard {
         self.regenerateBoardPage(v.group, v.page)
+        groups[v.group] = true
+      }
+      // regen each board's catalog and feeds once
+      for group := range groups {
+        self.regenerateCatalog(group)
+        self.regenerateBoardFeeds(group)
       }
       self.regenBoard = make(map[string]groupRegenRequest)
     }
@@ -196,6 +240,10 @@ func (self httpFrontend) poll() {
         msgid = nntp.Reference()
       }
       self.regenThreadChan <- ArticleEntry{msgid, group}
+      // tell live clients about it
+      if self.AllowNewsgroup(group) && group != "ctl" {
+        self.live.Post(PostModelFromMessage(msgid, self.prefix, nntp))
+      }
       // regen the newsgroup we're in
       // TODO: regen only what we need to
       pages := self.daemon.database.GetGroupPageCount(group)
@@ -227,6 +275,13 @@ func (self httpFrontend) new_captcha_json(wr http.ResponseWriter, r *http.Reques
 // regen every page of the board
 func (self httpFrontend) regenerateBoard(group string) {
   template.genBoard(self.prefix, self.name,  group, self.webroot_dir, self.daemon.database)
+  self.regenerateCatalog(group)
+}
+
+// regen a board's catalog
+func (self httpFrontend) regenerateCatalog(group string) {
+  fname := self.getFilenameForCatalog(group)
+  template.genCatalog(self.prefix, self.name, group, fname, self.daemon.database)
 }
 
 // regenerate just a thread page
@@ -247,6 +302,30 @@ func (self httpFrontend) regenerateBoardPage(board string, page int) {
   template.genBoardPage(self.prefix, self.name, board, page, fname, self.daemon.database)
 }
 
+// regenerate a thread's rss and atom feeds
+func (self httpFrontend) regenerateThreadFeeds(root ArticleEntry) {
+  if len(self.feed_url) > 0 && self.daemon.store.HasArticle(root.MessageID()) {
+    fname := self.getFilenameForThread(root.MessageID())
+    template.genThreadFeeds(root, self.feed_url, self.name, fname, self.daemon.database)
+  }
+}
+
+// regenerate a board's rss and atom feeds
+func (self httpFrontend) regenerateBoardFeeds(board string) {
+  if len(self.feed_url) > 0 {
+    fname := self.getFilenameForBoardFeeds(board)
+    template.genBoardFeeds(self.feed_url, self.name, board, fname, self.daemon.database)
+  }
+}
+
+// regenerate the overboard's rss and atom feeds
+func (self httpFrontend) regenUkkoFeeds() {
+  if len(self.feed_url) > 0 {
+    fname := filepath.Join(self.webroot_dir, "ukko.html")
+    template.genUkkoFeeds(self.feed_url, self.name, fname, self.daemon.database)
+  }
+}
+
 // regenerate the front page
 func (self httpFrontend) regenFrontPage() {
   template.genFrontPage(10, self.name, self.webroot_dir, self.daemon.database)
@@ -260,10 +339,23 @@ func (self httpFrontend) regenUkko() {
 
 // regenerate pages after a mod event
 func (self httpFrontend) regenOnModEvent(newsgroup, msgid, root string, page int) {
+  if self.daemon.database.HasArticleLocal(msgid) {
+    // the post is still here so its thread was stuck or locked
+    // sticking moves it to the first page so regen every page up to where it was
+    self.regenThreadChan <- ArticleEntry{root, newsgroup}
+    for pg := 0 ; pg <= page ; pg ++ {
+      self.regenGroupChan <- groupRegenRequest{newsgroup, pg}
+    }
+    return
+  }
+  self.live.Delete(newsgroup, msgid, root)
   if root == msgid {
     fname := self.getFilenameForThread(root)
     log.Println("remove file", fname)
     os.Remove(fname)
+    os.Remove(jsonFilename(fname))
+    os.Remove(rssFilename(fname))
+    os.Remove(atomFilename(fname))
   } else {
     self.regenThreadChan <- ArticleEntry{root, newsgroup}
   }
@@ -294,64 +386,17 @@ func (self httpFrontend) handle_postform(wr http.ResponseWriter, r *http.Request
   nntp.headers = make(ArticleHeaders)
 
 
-  // tripcode private key
-  var tripcode_privkey []byte
 
-
-
-  // encrypt IP Addresses
-  // when a post is recv'd from a frontend, the remote address is given its own symetric key that the local srnd uses to encrypt the address with, for privacy
-  // when a mod event is fired, it includes the encrypted IP address and the symetric key that frontend used to encrypt it, thus allowing others to determine the IP address
-  // each stnf will optionally comply with the mod event, banning the address from being able to post from that frontend
-  // this will be done eventually but for now that requires too much infrastrucutre, let's go with regular IP Addresses for now.
-  
-  // get the "real" ip address from the request
-
-  address , _, err := net.SplitHostPort(r.RemoteAddr)
-  // TODO: have in config upstream proxy ip and check for that
-  if strings.HasPrefix(address, "127.") {
-    // if it's loopback check headers for reverse proxy headers
-    // TODO: make sure this isn't a tor user being sneaky
-    address = getRealIP(r.Header.Get("X-Real-IP"))
-  }
-    
-  // check for banned
-  if len(address) > 0 {
-    banned, err :=  self.daemon.database.CheckIPBanned(address)
-    if err == nil {
-      if banned {
-        wr.WriteHeader(403)
-        // TODO: ban messages
-        io.WriteString(wr,  "nigguh u banned.")
-        return
-      }
-    } else {
-      wr.WriteHeader(500)
-      io.WriteString(wr, "error checking for ban: ")
-      io.WriteString(wr, err.Error())
-      return
-    }
-  }
-  if len(address) == 0 {
-    address = "Tor"
-  }
-  if ! strings.HasPrefix(address, "127.") {
-    // set the ip address of the poster to be put into article headers
-    // if we cannot determine it, i.e. we are on Tor/i2p, this value is not set
-    if address == "Tor" {
-      nntp.headers.Set("X-Tor-Poster", "1")
-    } else {
-      address, err = self.daemon.database.GetEncAddress(address)
-      nntp.headers.Set("X-Encrypted-IP", address)
-      // TODO: add x-tor-poster header for tor exits
-    }
-  }
-  
-  // if we don't have an address for the poster try checking for i2p httpd headers
-  address = r.Header.Get("X-I2P-DestHash")
-  // TODO: make sure this isn't a Tor user being sneaky
-  if len(address) > 0 {
-    nntp.headers.Set("X-I2P-DestHash", address)
+  // check for banned and set the poster's address headers
+  ban, banned, err := self.posterHeaders(r, board, nntp.headers)
+  if banned {
+    self.writeBanned(wr, ban)
+    return
+  } else if err != nil {
+    wr.WriteHeader(500)
+    io.WriteString(wr, "error checking for ban: ")
+    io.WriteString(wr, err.Error())
+    return
   }
   
 
@@ -506,6 +551,8 @@ func (self httpFrontend) handle_postform(wr http.ResponseWriter, r *http.Request
     post_fail += "no message. "
   } else if len(msg) > 1024 * 1024 * 10 {
     post_fail += "your message is too big"
+  } else if reason := self.checkBoardSettings(board, nntp) ; len(reason) > 0 {
+    post_fail += reason + ". "
   }
   
   if captcha_retry {
@@ -549,6 +596,108 @@ func (self httpFrontend) handle_postform(wr http.ResponseWriter, r *http.Request
     return
   }
  
+  nntp, err = self.submitArticle(nntp, subject, name, msg)
+  if err != nil {
+    wr.WriteHeader(500)
+    io.WriteString(wr, err.Error())
+    return
+  }
+
+  // send success reply
+  wr.WriteHeader(200)
+  // determine the root post so we can redirect to the thread for it
+  msg_id := nntp.headers.Get("References", nntp.MessageID())
+  // render response as success
+  url = fmt.Sprintf("%sthread-%s.html", self.prefix, ShortHashMessageID(msg_id))
+  io.WriteString(wr, template.renderTemplate("post_success.mustache", map[string]string {"prefix" : self.prefix,  "message_id" : nntp.MessageID(), "redirect_url" : url}))
+}
+
+
+
+// check a post against its board's settings and its thread's state
+// must be called after posterHeaders
+// returns empty string if it's okay otherwise the reason
+func (self httpFrontend) checkBoardSettings(board string, nntp nntpArticle) (reason string) {
+  // defaults are given on error
+  settings, _ := self.daemon.database.GetBoardSettings(board)
+  reason = settings.CheckAttachments(nntp.Attachments())
+  ref := nntp.headers.Get("References", "")
+  if len(reason) == 0 && len(ref) > 0 && ! threadAllowsReply(self.daemon.database, board, ref) {
+    reason = "thread is full"
+  } else if len(reason) == 0 && len(ref) > 0 && self.daemon.database.ThreadLocked(ref) {
+    reason = "thread is locked"
+  } else if len(reason) == 0 && ! settings.AllowAnon && ( nntp.headers.Has("X-Tor-Poster") || nntp.headers.Has("X-I2P-DestHash") ) {
+    reason = "anonymous posting is not allowed on this board"
+  }
+  return
+}
+
+// tell a banned poster why they cannot post
+func (self httpFrontend) writeBanned(wr http.ResponseWriter, ban IPBan) {
+  param := make(map[string]interface{})
+  param["prefix"] = self.prefix
+  param["ban"] = newBanInfo(ban)
+  wr.WriteHeader(403)
+  io.WriteString(wr, template.renderTemplate("banned.mustache", param))
+}
+
+// check if the poster of an http request is banned from posting in a newsgroup
+// if they are not set the headers that identify them in their article
+func (self httpFrontend) posterHeaders(r *http.Request, newsgroup string, headers ArticleHeaders) (ban IPBan, banned bool, err error) {
+  // encrypt IP Addresses
+  // when a post is recv'd from a frontend, the remote address is given its own symetric key that the local srnd uses to encrypt the address with, for privacy
+  // when a mod event is fired, it includes the encrypted IP address and the symetric key that frontend used to encrypt it, thus allowing others to determine the IP address
+  // each stnf will optionally comply with the mod event, banning the address from being able to post from that frontend
+  // this will be done eventually but for now that requires too much infrastrucutre, let's go with regular IP Addresses for now.
+  
+  // get the "real" ip address from the request
+
+  address , _, _ := net.SplitHostPort(r.RemoteAddr)
+  // TODO: have in config upstream proxy ip and check for that
+  if strings.HasPrefix(address, "127.") {
+    // if it's loopback check headers for reverse proxy headers
+    // TODO: make sure this isn't a tor user being sneaky
+    address = getRealIP(r.Header.Get("X-Real-IP"))
+  }
+    
+  // check for banned
+  if len(address) > 0 {
+    ban, banned, err = findIPBan(self.daemon.database, address, newsgroup)
+    if banned || err != nil {
+      return
+    }
+  }
+  if len(address) == 0 {
+    address = "Tor"
+  }
+  if ! strings.HasPrefix(address, "127.") {
+    // set the ip address of the poster to be put into article headers
+    // if we cannot determine it, i.e. we are on Tor/i2p, this value is not set
+    if address == "Tor" {
+      headers.Set("X-Tor-Poster", "1")
+    } else {
+      address, _ = self.daemon.database.GetEncAddress(address)
+      headers.Set("X-Encrypted-IP", address)
+      // TODO: add x-tor-poster header for tor exits
+    }
+  }
+  
+  // if we don't have an address for the poster try checking for i2p httpd headers
+  address = r.Header.Get("X-I2P-DestHash")
+  // TODO: make sure this isn't a Tor user being sneaky
+  if len(address) > 0 {
+    headers.Set("X-I2P-DestHash", address)
+  }
+  return
+}
+
+// finish an article posted via http and send it to the daemon
+// sets subject, name, tripcode, message and the rest of the headers
+func (self httpFrontend) submitArticle(nntp nntpArticle, subject, name, msg string) (nntpArticle, error) {
+  var err error
+  // tripcode private key
+  var tripcode_privkey []byte
+
   // set subject
   if len(subject) == 0 {
     subject = "None"
@@ -592,9 +741,7 @@ func (self httpFrontend) handle_postform(wr http.ResponseWriter, r *http.Request
     if err != nil {
       // wtf? error!?
       log.Println("error signing", err)
-      wr.WriteHeader(500)
-      io.WriteString(wr, err.Error())
-      return 
+      return nntp, err
     }
   }
   // XXX: write it temp instead
@@ -605,18 +752,9 @@ func (self httpFrontend) handle_postform(wr http.ResponseWriter, r *http.Request
     f.Close()
   }
   self.daemon.infeed_load <- nntp.MessageID()
-
-  // send success reply
-  wr.WriteHeader(200)
-  // determine the root post so we can redirect to the thread for it
-  msg_id := nntp.headers.Get("References", nntp.MessageID())
-  // render response as success
-  url = fmt.Sprintf("%sthread-%s.html", self.prefix, ShortHashMessageID(msg_id))
-  io.WriteString(wr, template.renderTemplate("post_success.mustache", map[string]string {"prefix" : self.prefix,  "message_id" : nntp.MessageID(), "redirect_url" : url}))
+  return nntp, err
 }
 
-
-
 // handle posting / postform
 func (self httpFrontend) handle_poster(wr http.ResponseWriter, r *http.Request) {
   path := r.URL.Path
@@ -678,14 +816,26 @@ func (self httpFrontend) Mainloop() {
   self.httpmux.Path("/mod/del/{article_hash}").HandlerFunc(self.modui.HandleDeletePost).Methods("GET")
   self.httpmux.Path("/mod/ban/{address}").HandlerFunc(self.modui.HandleBanAddress).Methods("GET")
   self.httpmux.Path("/mod/unban/{address}").HandlerFunc(self.modui.HandleUnbanAddress).Methods("GET")
+  self.httpmux.Path("/mod/unban/{address}/{prefix}").HandlerFunc(self.modui.HandleUnbanAddress).Methods("GET")
+  self.httpmux.Path("/mod/bans").HandlerFunc(self.modui.HandleListBans).Methods("GET")
+  self.httpmux.Path("/mod/bans").HandlerFunc(self.modui.HandleAddBan).Methods("POST")
+  self.httpmux.Path("/mod/stick/{article_hash}").HandlerFunc(self.modui.HandleStickThread).Methods("GET")
+  self.httpmux.Path("/mod/unstick/{article_hash}").HandlerFunc(self.modui.HandleUnstickThread).Methods("GET")
+  self.httpmux.Path("/mod/lock/{article_hash}").HandlerFunc(self.modui.HandleLockThread).Methods("GET")
+  self.httpmux.Path("/mod/unlock/{article_hash}").HandlerFunc(self.modui.HandleUnlockThread).Methods("GET")
   self.httpmux.Path("/mod/addkey/{pubkey}").HandlerFunc(self.modui.HandleAddPubkey).Methods("GET")
   self.httpmux.Path("/mod/delkey/{pubkey}").HandlerFunc(self.modui.HandleDelPubkey).Methods("GET")
   self.httpmux.Path("/mod/admin/{action}").HandlerFunc(self.modui.HandleAdminCommand).Methods("GET", "POST")
+  self.httpmux.Path("/mod/log").HandlerFunc(self.modui.HandleModLog).Methods("GET")
+  self.httpmux.Path("/mod/log.json").HandlerFunc(self.modui.HandleModLogJSON).Methods("GET")
   // webroot handler
   self.httpmux.Path("/").Handler(http.FileServer(http.Dir(self.webroot_dir)))
   self.httpmux.Path("/thm/{f}").Handler(http.FileServer(http.Dir(self.webroot_dir)))
   self.httpmux.Path("/img/{f}").Handler(http.FileServer(http.Dir(self.webroot_dir)))
   self.httpmux.Path("/{f}.html").Handler(http.FileServer(http.Dir(self.webroot_dir)))
+  self.httpmux.Path("/{f}.json").Handler(http.FileServer(http.Dir(self.webroot_dir)))
+  self.httpmux.Path("/{f}.rss").Handler(http.FileServer(http.Dir(self.webroot_dir)))
+  self.httpmux.Path("/{f}.atom").Handler(http.FileServer(http.Dir(self.webroot_dir)))
   self.httpmux.Path("/static/{f}").Handler(http.FileServer(http.Dir(self.static_dir)))
   // post handler
   self.httpmux.Path("/post/{f}").HandlerFunc(self.handle_poster).Methods("POST")
@@ -693,6 +843,22 @@ func (self httpFrontend) Mainloop() {
   self.httpmux.Path("/captcha/img").HandlerFunc(self.new_captcha).Methods("GET")
   self.httpmux.Path("/captcha/{f}").Handler(captcha.Server(350, 175)).Methods("GET")
   self.httpmux.Path("/captcha/new.json").HandlerFunc(self.new_captcha_json).Methods("GET")
+  // json api handlers
+  self.httpmux.Path("/api/post").HandlerFunc(self.handle_api_post_article).Methods("POST")
+  self.httpmux.Path("/api/search").HandlerFunc(self.handle_api_search).Methods("GET")
+  self.httpmux.Path("/api/modlog").HandlerFunc(self.handle_api_modlog).Methods("GET")
+  self.httpmux.Path("/api/boards").HandlerFunc(self.handle_api_boards).Methods("GET")
+  self.httpmux.Path("/api/board/{board}/{page}").HandlerFunc(self.handle_api_board).Methods("GET")
+  self.httpmux.Path("/api/catalog/{board}").HandlerFunc(self.handle_api_catalog).Methods("GET")
+  self.httpmux.Path("/api/thread/{hash}").HandlerFunc(self.handle_api_thread).Methods("GET")
+  self.httpmux.Path("/api/post/{hash}").HandlerFunc(self.handle_api_post).Methods("GET")
+  // search page
+  self.httpmux.Path("/search").HandlerFunc(self.handle_search).Methods("GET")
+  self.httpmux.Path("/modlog").HandlerFunc(self.handle_modlog).Methods("GET")
+  // live update handlers
+  self.httpmux.Path("/live/ukko").HandlerFunc(self.handle_live).Methods("GET")
+  self.httpmux.Path("/live/board/{board}").HandlerFunc(self.handle_live).Methods("GET")
+  self.httpmux.Path("/live/thread/{hash}").HandlerFunc(self.handle_live).Methods("GET")
   // helper handlers
   self.httpmux.Path("/new/").HandlerFunc(self.handle_newboard).Methods("GET")
   
@@ -744,7 +910,15 @@ func NewHTTPFrontend(daemon *NNTPDaemon, config map[string]string, url string) F
   front.template_dir = config["templates"]
   front.prefix = config["prefix"]
   front.regen_on_start = config["regen_on_start"] == "1"
+  front.public_modlog = config["public_modlog"] == "1"
   front.regen_threads = mapGetInt(config, "regen_threads", 1)
+  var err error
+  front.feed_url, err = feedBaseURL(config["feed_url"], front.prefix)
+  if err != nil {
+    log.Fatalf("bad feed_url for frontend %s: %s", front.name, err)
+  } else if len(front.feed_url) == 0 {
+    log.Println("not making rss or atom feeds, they need absolute links, set feed_url in the frontend section")
+  }
   front.store = sessions.NewCookieStore([]byte(config["api-secret"]))
   front.store.Options = &sessions.Options{
     // TODO: detect http:// etc in prefix
@@ -755,5 +929,7 @@ func NewHTTPFrontend(daemon *NNTPDaemon, config map[string]string, url string) F
   front.recvpostchan = make(chan NNTPMessage, 16)
   front.regenThreadChan = make(chan ArticleEntry, 16)
   front.regenGroupChan = make(chan groupRegenRequest, 8)
+  front.api_limiter = newAPIRateLimiter()
+  front.live = newLiveHub()
   return front
 }
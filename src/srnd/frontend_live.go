@@ -0,0 +1,216 @@
+//
+// frontend_live.go
+//
+// live updates for the http frontend over websockets
+//
+package srnd
+
+import (
+  "github.com/gorilla/mux"
+  "github.com/gorilla/websocket"
+  "log"
+  "net/http"
+  "strings"
+  "sync"
+  "time"
+)
+
+// an event sent to live update clients
+type liveEvent struct {
+  // post or delete
+  Event string `json:"event"`
+  // the new post for post events
+  Post *apiPost `json:"post,omitempty"`
+  // the deleted post for delete events
+  MessageID string `json:"message_id,omitempty"`
+  Hash string `json:"hash,omitempty"`
+  Newsgroup string `json:"newsgroup"`
+  // message id of the thread's root post
+  Root string `json:"root"`
+}
+
+// how often we ping live update clients
+const livePingInterval = time.Second * 30
+
+// drop a live update client we haven't heard from in this long
+// a pong to each ping is enough
+const liveReadTimeout = livePingInterval * 2
+
+// largest message we read from a live update client
+const liveMaxMessage = 512
+
+// a websocket client getting live updates
+type liveClient struct {
+  conn *websocket.Conn
+  // what they subscribed to, a board, a thread's root post or the overboard
+  board string
+  thread string
+  ukko bool
+  send chan liveEvent
+}
+
+// does this client want events for this newsgroup and thread?
+func (self *liveClient) Wants(newsgroup, root string) bool {
+  if self.ukko {
+    return true
+  } else if len(self.board) > 0 {
+    return self.board == newsgroup
+  }
+  return self.thread == root
+}
+
+// send events to the websocket until we are removed
+// pings every so often so proxies don't drop us
+func (self *liveClient) writeLoop() {
+  ticker := time.NewTicker(livePingInterval)
+  defer ticker.Stop()
+  defer self.conn.Close()
+  for {
+    select {
+    case ev, ok := <- self.send:
+      if ! ok {
+        self.conn.WriteControl(websocket.CloseMessage, []byte{}, time.Now().Add(time.Second))
+        return
+      }
+      self.conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+      err := self.conn.WriteJSON(ev)
+      if err != nil {
+        return
+      }
+    case _ = <- ticker.C:
+      err := self.conn.WriteControl(websocket.PingMessage, []byte{}, time.Now().Add(time.Second * 10))
+      if err != nil {
+        return
+      }
+    }
+  }
+}
+
+// read from the websocket until it closes then remove the client
+// we don't expect anything from the client except pongs
+func (self *liveClient) readLoop(hub *liveHub) {
+  self.conn.SetReadLimit(liveMaxMessage)
+  self.conn.SetReadDeadline(time.Now().Add(liveReadTimeout))
+  self.conn.SetPongHandler(func(string) error {
+    return self.conn.SetReadDeadline(time.Now().Add(liveReadTimeout))
+  })
+  for {
+    _, _, err := self.conn.ReadMessage()
+    if err != nil {
+      break
+    }
+  }
+  hub.Remove(self)
+}
+
+// every live update client
+type liveHub struct {
+  access sync.Mutex
+  clients map[*liveClient]bool
+}
+
+func newLiveHub() *liveHub {
+  return &liveHub{
+    clients: make(map[*liveClient]bool),
+  }
+}
+
+func (self *liveHub) Add(client *liveClient) {
+  self.access.Lock()
+  self.clients[client] = true
+  self.access.Unlock()
+}
+
+// remove a client and stop its writer
+func (self *liveHub) Remove(client *liveClient) {
+  self.access.Lock()
+  self.remove(client)
+  self.access.Unlock()
+}
+
+// must hold lock
+func (self *liveHub) remove(client *liveClient) {
+  if self.clients[client] {
+    delete(self.clients, client)
+    close(client.send)
+  }
+}
+
+// send an event to every client that wants it
+// clients that can't keep up are dropped
+func (self *liveHub) Broadcast(ev liveEvent) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  for client := range self.clients {
+    if client.Wants(ev.Newsgroup, ev.Root) {
+      select {
+      case client.send <- ev:
+      default:
+        log.Println("live client too slow, dropping it")
+        self.remove(client)
+      }
+    }
+  }
+}
+
+// tell clients about a new post
+func (self *liveHub) Post(p PostModel) {
+  j := apiPostFromModel(p)
+  self.Broadcast(liveEvent{
+    Event: "post",
+    Post: &j,
+    Newsgroup: p.Board(),
+    Root: p.Reference(),
+  })
+}
+
+// tell clients a post was deleted
+func (self *liveHub) Delete(newsgroup, msgid, root string) {
+  self.Broadcast(liveEvent{
+    Event: "delete",
+    MessageID: msgid,
+    Hash: HashMessageID(msgid),
+    Newsgroup: newsgroup,
+    Root: root,
+  })
+}
+
+// GET /live/ukko, /live/board/{board} or /live/thread/{hash}
+// upgrades to a websocket that gets a json liveEvent for every new or deleted post
+func (self httpFrontend) handle_live(wr http.ResponseWriter, r *http.Request) {
+  vars := mux.Vars(r)
+  client := &liveClient{
+    send: make(chan liveEvent, 32),
+  }
+  if board, ok := vars["board"]; ok {
+    if ! self.apiBoardValid(board) {
+      self.writeJSONError(wr, http.StatusNotFound, "no such board")
+      return
+    }
+    client.board = board
+  } else if hash, ok := vars["hash"]; ok {
+    db := self.daemon.database
+    article, err := db.GetMessageIDByHash(strings.ToLower(hash))
+    var op PostModel
+    if err == nil && self.apiBoardValid(article.Newsgroup()) {
+      op = db.GetPostModel(self.prefix, article.MessageID())
+    }
+    if op == nil || ! op.OP() {
+      self.writeJSONError(wr, http.StatusNotFound, "no such thread")
+      return
+    }
+    client.thread = op.MessageID()
+  } else {
+    client.ukko = true
+  }
+  conn, err := self.upgrader.Upgrade(wr, r, nil)
+  if err != nil {
+    // upgrader already sent an error response
+    log.Println("failed to upgrade live connection", err)
+    return
+  }
+  client.conn = conn
+  self.live.Add(client)
+  go client.readLoop(self.live)
+  client.writeLoop()
+}
@@ -5,15 +5,19 @@
 package srnd
 
 import (
+  "github.com/majestrate/srndv2/src/nacl"
   "bufio"
+  "bytes"
   "fmt"
   "log"
   "io"
+  "io/ioutil"
   "os"
   "net"
   "net/textproto"
   "strconv"
   "strings"
+  "time"
 )
 
 type nntpFrontend struct {
@@ -22,6 +26,9 @@ type nntpFrontend struct {
   store ArticleStore
   db Database
   bindaddr string
+  // our name for path and message-id headers
+  name string
+  daemon *NNTPDaemon
 }
 
 func NewNNTPFrontend(d *NNTPDaemon, bindaddr string) Frontend {
@@ -31,6 +38,8 @@ func NewNNTPFrontend(d *NNTPDaemon, bindaddr string) Frontend {
     store: d.store,
     db: d.database,
     bindaddr: bindaddr,
+    name: d.instance_name,
+    daemon: d,
   }
 }
 
@@ -73,14 +82,356 @@ func (self nntpFrontend) Mainloop() {
   }
 }
 
+// find the article a reader command is about
+// arg is a message id, an article number or empty for the current article
+// returns the message id, the article number and an error response if we don't have it
+func (self nntpFrontend) findArticle(arg, newsgroup string, current int64) (msgid string, article_no int64, response string) {
+  var err error
+  if ValidMessageID(arg) {
+    msgid = arg
+    if ! self.store.HasArticle(msgid) {
+      response = "430 No article with that message-id"
+    }
+  } else if newsgroup == "" {
+    response = "412 No newsgroup selected"
+  } else if arg == "" {
+    if current < 1 {
+      response = "420 Current article number is invalid"
+    } else {
+      article_no = current
+    }
+  } else {
+    article_no, err = strconv.ParseInt(arg, 10, 64)
+    if err != nil || article_no < 1 {
+      response = "423 No article with that number"
+    }
+  }
+  if response == "" && msgid == "" {
+    msgid, err = self.db.GetMessageIDForNNTPID(newsgroup, article_no)
+    if err != nil || ! self.store.HasArticle(msgid) {
+      response = "423 No article with that number"
+    }
+  }
+  return
+}
+
+// find the next article after current in the direction of step
+// skips numbers of articles that were deleted
+// article_no is 0 if there is none
+func (self nntpFrontend) stepArticle(newsgroup string, current, step int64) (article_no int64, msgid string, err error) {
+  var last, first int64
+  last, first, err = self.db.GetLastAndFirstForGroup(newsgroup)
+  if err != nil {
+    return
+  }
+  for id := current + step ; id >= first && id <= last ; id += step {
+    msgid, err = self.db.GetMessageIDForNNTPID(newsgroup, id)
+    if err == nil {
+      article_no = id
+      return
+    }
+  }
+  err = nil
+  msgid = ""
+  return
+}
+
+// find the articles for a command that takes a range or a message id
+// arg is a message id, an article range or empty for the current article
+// article numbers are 0 when a message id is given
+func (self nntpFrontend) findArticles(arg, newsgroup string, current int64) (msgids []string, article_nos []int64, response string) {
+  if ValidMessageID(arg) || arg == "" {
+    msgid, article_no, resp := self.findArticle(arg, newsgroup, current)
+    if resp == "" {
+      msgids = append(msgids, msgid)
+      article_nos = append(article_nos, article_no)
+    }
+    response = resp
+  } else if newsgroup == "" {
+    response = "412 No newsgroup selected"
+  } else {
+    first, last, err := parseArticleRange(arg)
+    if err == nil {
+      var models []NumberedPost
+      models, err = self.db.GetPostsInGroupRange(newsgroup, first, last)
+      if err == nil {
+        for _, model := range models {
+          msgids = append(msgids, model.MessageID())
+          article_nos = append(article_nos, model.Number)
+        }
+      }
+    }
+    if err != nil {
+      response = "501 bad article range"
+    } else if len(msgids) == 0 {
+      response = "423 No articles in that range"
+    }
+  }
+  return
+}
+
+// read the headers of an article in the store
+// also get the size in bytes and the number of lines in the body
+func (self nntpFrontend) readArticleHeaders(msgid string) (hdr textproto.MIMEHeader, bytes, lines int64, err error) {
+  var f *os.File
+  f, err = os.Open(self.store.GetFilename(msgid))
+  if err == nil {
+    var st os.FileInfo
+    st, err = f.Stat()
+    if err == nil {
+      bytes = st.Size()
+      r := bufio.NewReader(f)
+      hdr, err = textproto.NewReader(r).ReadMIMEHeader()
+      if err == nil {
+        // count body lines
+        for {
+          var line string
+          line, err = r.ReadString(10)
+          if len(line) > 0 {
+            lines ++
+          }
+          if err == io.EOF {
+            err = nil
+            break
+          } else if err != nil {
+            break
+          }
+        }
+      }
+    }
+    f.Close()
+  }
+  return
+}
+
+// write out an article, just the headers or just the body
+// part is one of "article", "head" or "body"
+func (self nntpFrontend) writeArticle(w *textproto.Writer, msgid, part string) (err error) {
+  var f *os.File
+  f, err = os.Open(self.store.GetFilename(msgid))
+  if err == nil {
+    r := bufio.NewReader(f)
+    dw := w.DotWriter()
+    in_body := false
+    for {
+      var line string
+      line, err = r.ReadString(10)
+      if len(line) > 0 {
+        if ! in_body && strings.TrimRight(line, "\r\n") == "" {
+          // blank line between headers and body
+          in_body = true
+          if part == "head" {
+            break
+          } else if part == "body" {
+            continue
+          }
+        }
+        if part == "article" || (part == "head" && ! in_body) || (part == "body" && in_body) {
+          _, err = io.WriteString(dw, line)
+        }
+      }
+      if err != nil {
+        break
+      }
+    }
+    if err == io.EOF {
+      err = nil
+    }
+    dw.Close()
+    f.Close()
+  }
+  return
+}
+
+// get a header or metadata item for HDR and XHDR
+func (self nntpFrontend) getHeader(msgid, field string) (val string) {
+  hdr, bytes, lines, err := self.readArticleHeaders(msgid)
+  if err == nil {
+    field = strings.ToLower(field)
+    if field == ":bytes" {
+      val = fmt.Sprintf("%d", bytes)
+    } else if field == ":lines" {
+      val = fmt.Sprintf("%d", lines)
+    } else {
+      val = hdr.Get(field)
+    }
+  }
+  return overviewSanitize(val)
+}
+
+// make a header value safe for overview data
+func overviewSanitize(val string) string {
+  return strings.NewReplacer("\t", " ", "\r", "", "\n", "").Replace(val)
+}
+
+// write out the list of newsgroups matching a wildmat
+// if descriptions is true write out descriptions instead of active info
+func (self nntpFrontend) writeGroupList(w *textproto.Writer, wildmat string, descriptions bool) {
+  groups := self.db.GetAllNewsgroups()
+  dw := w.DotWriter()
+  for _, group := range groups {
+    if wildmat != "" && ! wildmatMatch(wildmat, group) {
+      continue
+    }
+    if descriptions {
+      io.WriteString(dw, fmt.Sprintf("%s\t%s\r\n", group, group))
+      continue
+    }
+    last, first, err := self.db.GetLastAndFirstForGroup(group)
+    if err == nil {
+      io.WriteString(dw, fmt.Sprintf("%s %d %d y\r\n", group, last, first))
+    } else {
+      log.Println("cannot get last/first ids for group", group, err)
+    }
+  }
+  dw.Close()
+}
+
+// headers posters are not allowed to set themselves
+var nntpFrontendStripHeaders = []string{"Message-Id", "Path", "Date", "X-Encrypted-Ip", "X-Tor-Poster", "X-I2p-Desthash", "X-Pubkey-Ed25519", "X-Signature-Ed25519-Sha512", "X-Tripcode", "X-Sage"}
+
+// handle an article posted by a reader
+// returns the new message id or the reason it was rejected
+func (self nntpFrontend) handlePost(r *textproto.Reader, remote net.Addr) (msgid, reason string) {
+  // read the entire article
+  body, err := ioutil.ReadAll(r.DotReader())
+  if err != nil {
+    reason = err.Error()
+    return
+  } else if len(body) > 1024 * 1024 * 10 {
+    reason = "your message is too big"
+    return
+  }
+  msg, err := read_message(bytes.NewReader(body))
+  if err != nil {
+    reason = "bad article: " + err.Error()
+    return
+  }
+  nntp, ok := msg.(nntpArticle)
+  if ! ok {
+    reason = "bad article"
+    return
+  }
+
+  // tripcode private key
+  var tripcode_privkey []byte
+  if nntp.headers.Has("X-Tripcode") {
+    tripcode_privkey = parseTripcodeSecret(nntp.headers.Get("X-Tripcode", ""))
+    if len(tripcode_privkey) != nacl.CryptoSignSeedLen() {
+      reason = "invalid tripcode secret"
+      return
+    }
+  }
+  for _, hdr := range nntpFrontendStripHeaders {
+    delete(nntp.headers, hdr)
+  }
+
+  // always lower case newsgroups
+  newsgroup := strings.ToLower(nntp.headers.Get("Newsgroups", ""))
+  nntp.headers.Set("Newsgroups", newsgroup)
+  if ! self.AllowNewsgroup(newsgroup) {
+    reason = "cannot post to " + newsgroup
+    return
+  }
+  reference := nntp.Reference()
+  if reference != "" && ! self.db.HasArticleLocal(reference) {
+    reason = "we don't have " + reference + " locally, can't reply"
+    return
+  }
+  if len(nntp.Attachments()) == 0 && len(strings.Trim(nntp.Message(), " \r\n")) == 0 {
+    reason = "no message"
+    return
+  }
+
+  // get the poster's address
+  address, _, _ := net.SplitHostPort(remote.String())
+  if strings.HasPrefix(address, "127.") || address == "::1" {
+    // local connection, probably from tor or i2p
+    nntp.headers.Set("X-Tor-Poster", "1")
+  } else {
+    var ban IPBan
+    var banned bool
+    ban, banned, err = findIPBan(self.db, address, newsgroup)
+    if err != nil {
+      reason = "error checking for ban: " + err.Error()
+      return
+    } else if banned {
+      reason = "you are banned, appeal " + ban.AppealID()
+      if len(ban.Reason) > 0 {
+        reason += ": " + ban.Reason
+      }
+      return
+    }
+    address, err = self.db.GetEncAddress(address)
+    if err != nil {
+      reason = "internal error: " + err.Error()
+      return
+    }
+    nntp.headers.Set("X-Encrypted-IP", address)
+  }
+
+  // set subject
+  subject := nntp.Subject()
+  if len(subject) == 0 {
+    subject = "None"
+  }
+  nntp.headers.Set("Subject", subject)
+  if isSage(subject) {
+    nntp.headers.Set("X-Sage", "1")
+  }
+  if ! nntp.headers.Has("From") {
+    nntp.headers.Set("From", fmt.Sprintf("Anonymous <anon@%s>", self.name))
+  }
+  nntp.headers.Set("From", nntpSanitize(nntp.headers.Get("From", "")))
+  msgid = genMessageID(self.name)
+  nntp.headers.Set("Message-ID", msgid)
+  nntp.headers.Set("Date", timeNowStr())
+  nntp.headers.Set("Path", self.name)
+  // pack it so that the article is well formed
+  nntp.Pack()
+
+  // run the same checks we do for articles from feeds
+  hdr := make(textproto.MIMEHeader)
+  for k, v := range nntp.headers {
+    hdr[textproto.CanonicalMIMEHeaderKey(k)] = v
+  }
+  if tripcode_privkey != nil {
+    hdr.Set("X-Pubkey-Ed25519", getSignPubkey(tripcode_privkey))
+  }
+  conn := nntpConnection{name: "nntp-frontend-" + remote.String()}
+  reason, err = conn.checkMIMEHeader(*self.daemon, hdr)
+  if err != nil {
+    reason = err.Error()
+  }
+  if reason != "" {
+    return
+  }
+
+  // sign if needed
+  if tripcode_privkey != nil {
+    nntp, err = signArticle(nntp, tripcode_privkey)
+    if err != nil {
+      reason = "error signing: " + err.Error()
+      return
+    }
+  }
+  // send message off to daemon
+  self.postsChan <- nntp
+  return
+}
+
 func (self nntpFrontend) handle_connection(sock net.Conn) {
   log.Println("incoming nntp frontend connection", sock.RemoteAddr())
   // wrap the socket
   r := textproto.NewReader(bufio.NewReader(sock))
   w := textproto.NewWriter(bufio.NewWriter(sock))
   var line, newsgroup string
+  // the current article number in the newsgroup
+  var current int64
+  // who we are logged in as
+  auth := createNNTPAuthState(self.daemon.require_auth)
   // write out greeting
-  err := w.PrintfLine("201 ayyy srndv2 nntp frontend here, posting disallowed")
+  err := w.PrintfLine("200 ayyy srndv2 nntp frontend here, posting allowed")
   for {
     if err != nil {
       // abort it
@@ -88,129 +439,304 @@ func (self nntpFrontend) handle_connection(sock net.Conn) {
       break
     }
     line, err = r.ReadLine()
+    if err != nil {
+      continue
+    }
     lline := strings.ToLower(line)
+    parts := strings.Fields(line)
+    if len(parts) == 0 {
+      w.PrintfLine("500 empty command")
+      continue
+    }
+    cmd := strings.ToLower(parts[0])
+    // first argument or empty
+    var arg string
+    if len(parts) > 1 {
+      arg = parts[1]
+    }
     
     // we are in reader mode
-    if lline == "quit" {
+    if cmd == "quit" {
+      w.PrintfLine("205 bai")
       break
-    } else if strings.HasPrefix(lline, "newsgroups ") {
-      // handle newsgroups command
+    } else if cmd == "authinfo" {
+      err = auth.handleAuthInfo(self.daemon.credentials, line, r, w)
+    } else if cmd == "post" && ! auth.perms.post {
+      w.PrintfLine("%s", auth.Denied())
+    } else if ! auth.perms.reader && cmd != "capabilities" && cmd != "help" && cmd != "date" && cmd != "mode" && cmd != "post" {
+      w.PrintfLine("%s", auth.Denied())
+    } else if cmd == "newsgroups" || cmd == "newgroups" {
+      // handle newgroups command
       // TODO: don't ignore dates
       w.PrintfLine("231 list of newsgroups follows")
-      groups := self.db.GetAllNewsgroups()
-      dw := w.DotWriter()
-      for _, group := range groups {
-        last, first, err := self.db.GetLastAndFirstForGroup(group)
-        if err == nil {
-          io.WriteString(dw, fmt.Sprintf("%s %d %d y\r\n", group, last, first))
-        } else {
-          log.Println("cannot get last/first ids for group", group, err)
-        }
+      self.writeGroupList(w, "", false)
+    } else if lline == "list" || lline == "list active" || strings.HasPrefix(lline, "list active ") {
+      // handle list active command
+      var wildmat string
+      if len(parts) > 2 {
+        wildmat = parts[2]
       }
-      dw.Close()
-    } else if lline == "list" {
       w.PrintfLine("215 list of newsgroups follows")
-      // handle list command
-      groups := self.db.GetAllNewsgroups()
-      dw := w.DotWriter()
-      for _, group := range groups {
-        last, first, err := self.db.GetLastAndFirstForGroup(group)
-        if err == nil {
-          io.WriteString(dw, fmt.Sprintf("%s %d %d y\r\n", group, last, first))
-        } else {
-          log.Println("cannot get last/first ids for group", group, err)
-        }
+      self.writeGroupList(w, wildmat, false)
+    } else if lline == "list newsgroups" || strings.HasPrefix(lline, "list newsgroups ") {
+      // handle list newsgroups command
+      var wildmat string
+      if len(parts) > 2 {
+        wildmat = parts[2]
       }
+      w.PrintfLine("215 information follows")
+      self.writeGroupList(w, wildmat, true)
+    } else if lline == "list overview.fmt" {
+      // handle overview listing
+      w.PrintfLine("215 Order of fields in overview database.")
+      dw := w.DotWriter()
+      io.WriteString(dw, "Subject:\r\nFrom:\r\nDate:\r\nMessage-ID:\r\nReferences:\r\n:bytes\r\n:lines\r\n")
+      dw.Close()
+    } else if strings.HasPrefix(lline, "list headers") {
+      // we can do any header
+      w.PrintfLine("215 headers supported:")
+      dw := w.DotWriter()
+      io.WriteString(dw, ":\r\n")
       dw.Close()
-    } else if strings.HasPrefix(lline, "group ") {
+    } else if cmd == "list" {
+      w.PrintfLine("501 unknown list keyword")
+    } else if cmd == "group" {
       // handle group command
-      newsgroup = lline[6:]
-      if self.db.HasNewsgroup(newsgroup) {
-        article_count := self.db.CountPostsInGroup(newsgroup, 0)
-        last, first, err := self.db.GetLastAndFirstForGroup(newsgroup)
+      if arg == "" {
+        w.PrintfLine("501 no newsgroup given")
+        continue
+      }
+      group := strings.ToLower(arg)
+      if self.db.HasNewsgroup(group) {
+        article_count := self.db.CountPostsInGroup(group, 0)
+        last, first, err := self.db.GetLastAndFirstForGroup(group)
         if err == nil {
+          newsgroup = group
+          current = 0
+          if article_count > 0 {
+            current = first
+          }
           w.PrintfLine("211 %d %d %d %s", article_count, first, last, newsgroup)
         } else {
-          w.PrintfLine("500 internal error, %s", err.Error())
+          w.PrintfLine("403 internal error, %s", err.Error())
         }
       } else {
         w.PrintfLine("411 no such news group")
-        newsgroup = ""
       }
-    } else if lline == "list overview.fmt" {
-      // handle overview listing
-      if newsgroup == "" {
-        // no newsgroup
-        w.PrintfLine("412 No newsgorup selected")
-      } else {
-        // assume we got the newsgroup set
-        dw := w.DotWriter()
-        // write out format
-        // TODO: hard coded
-        io.WriteString(dw, "215 Order of fields in overview database.\r\n")
-        io.WriteString(dw, "Subject:\r\nFrom:\r\nDate:\r\nMessage-ID:\r\nRefernces:\r\n")
-        dw.Close()
-      }
-    } else if strings.HasPrefix(lline, "xover ") {
+    } else if cmd == "listgroup" {
+      // handle listgroup command
+      group := newsgroup
+      if arg != "" {
+        group = strings.ToLower(arg)
+        if ! self.db.HasNewsgroup(group) {
+          w.PrintfLine("411 no such news group")
+          continue
+        }
+      } else if group == "" {
+        w.PrintfLine("412 No newsgroup selected")
+        continue
+      }
+      first, last := int64(1), int64(-1)
+      if len(parts) > 2 {
+        first, last, err = parseArticleRange(parts[2])
+        if err != nil {
+          err = nil
+          w.PrintfLine("501 bad article range")
+          continue
+        }
+      }
+      article_count := self.db.CountPostsInGroup(group, 0)
+      high, low, err := self.db.GetLastAndFirstForGroup(group)
+      if err != nil {
+        w.PrintfLine("403 internal error, %s", err.Error())
+        continue
+      }
+      newsgroup = group
+      current = 0
+      if article_count > 0 {
+        current = low
+      }
+      models, err := self.db.GetPostsInGroupRange(group, first, last)
+      if err != nil {
+        w.PrintfLine("403 internal error, %s", err.Error())
+        continue
+      }
+      w.PrintfLine("211 %d %d %d %s list follows", article_count, low, high, newsgroup)
+      dw := w.DotWriter()
+      for _, model := range models {
+        io.WriteString(dw, fmt.Sprintf("%d\r\n", model.Number))
+      }
+      dw.Close()
+    } else if cmd == "next" || cmd == "last" {
+      // move the current article pointer
       if newsgroup == "" {
         w.PrintfLine("412 No newsgroup selected")
+      } else if current < 1 {
+        w.PrintfLine("420 Current article number is invalid")
       } else {
-        // handle xover command
-        // every article
-        models, err := self.db.GetPostsInGroup(newsgroup)
-        if err == nil {
-          w.PrintfLine("224 Overview information follows")
-          
-          dw := w.DotWriter()
-          for idx, model := range models {
-            io.WriteString(dw, fmt.Sprintf("%.6d\t%s\t\"%s\" <%s@%s>\t%s\t%s\t%s\r\n", idx+1, model.Subject(), model.Name(), model.Name(), model.Frontend(), model.Date(), model.MessageID(), model.Reference()))
-          }
-          dw.Close()
+        step := int64(1)
+        if cmd == "last" {
+          step = -1
+        }
+        article_no, msgid, err := self.stepArticle(newsgroup, current, step)
+        if err != nil {
+          w.PrintfLine("403 internal error, %s", err.Error())
+        } else if article_no == 0 && cmd == "next" {
+          w.PrintfLine("421 No next article in this group")
+        } else if article_no == 0 {
+          w.PrintfLine("422 No previous article in this group")
         } else {
-          w.PrintfLine("500 error, %s", err.Error())
+          current = article_no
+          w.PrintfLine("223 %d %s retrieved", current, msgid)
         }
       }
-    } else if strings.HasPrefix(lline, "article ") {
-      if newsgroup == "" {
-        w.PrintfLine("412 No Newsgroup Selected")
+    } else if cmd == "article" || cmd == "head" || cmd == "body" || cmd == "stat" {
+      msgid, article_no, response := self.findArticle(arg, newsgroup, current)
+      if response != "" {
+        w.PrintfLine("%s", response)
+        continue
+      }
+      if article_no > 0 {
+        current = article_no
+      }
+      if cmd == "stat" {
+        w.PrintfLine("223 %d %s", article_no, msgid)
+      } else if cmd == "head" {
+        w.PrintfLine("221 %d %s", article_no, msgid)
+        err = self.writeArticle(w, msgid, cmd)
+      } else if cmd == "body" {
+        w.PrintfLine("222 %d %s", article_no, msgid)
+        err = self.writeArticle(w, msgid, cmd)
       } else {
-        article := line[8:]
-        var msgid string
-        var article_no int64
-        if ValidMessageID(article) {
-          article_no = 0 // eh
+        w.PrintfLine("220 %d %s", article_no, msgid)
+        err = self.writeArticle(w, msgid, cmd)
+      }
+    } else if cmd == "over" || cmd == "xover" {
+      msgids, article_nos, response := self.findArticles(arg, newsgroup, current)
+      if response != "" {
+        w.PrintfLine("%s", response)
+        continue
+      }
+      w.PrintfLine("224 Overview information follows")
+      dw := w.DotWriter()
+      for idx, msgid := range msgids {
+        hdr, bytes, lines, err := self.readArticleHeaders(msgid)
+        if err == nil {
+          io.WriteString(dw, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\t%d\t%d\r\n", article_nos[idx], overviewSanitize(hdr.Get("Subject")), overviewSanitize(hdr.Get("From")), overviewSanitize(hdr.Get("Date")), msgid, overviewSanitize(hdr.Get("References")), bytes, lines))
         } else {
-          article_no, err = strconv.ParseInt(article, 10, 32)
-          if err == nil {
-            msgid, err = self.db.GetMessageIDForNNTPID(newsgroup, article_no)
-          }
+          log.Println("cannot read overview for", msgid, err)
         }
-        if err == nil {
-          w.PrintfLine("220 %d %s", article_no, msgid)
-          fname := self.store.GetFilename(msgid)
-          f, err := os.Open(fname)
-          if err == nil {
-            dw := w.DotWriter()
-            _, err = io.Copy(dw, f)
-            dw.Close()
-            f.Close()
-          }
+      }
+      dw.Close()
+    } else if cmd == "hdr" || cmd == "xhdr" {
+      if arg == "" {
+        w.PrintfLine("501 no header field given")
+        continue
+      }
+      var which string
+      if len(parts) > 2 {
+        which = parts[2]
+      }
+      msgids, article_nos, response := self.findArticles(which, newsgroup, current)
+      if response != "" {
+        w.PrintfLine("%s", response)
+        continue
+      }
+      if cmd == "hdr" {
+        w.PrintfLine("225 Headers follow")
+      } else {
+        w.PrintfLine("221 Header follows")
+      }
+      dw := w.DotWriter()
+      for idx, msgid := range msgids {
+        if cmd == "xhdr" && article_nos[idx] == 0 {
+          // xhdr gives the message id back when asked by message id
+          io.WriteString(dw, fmt.Sprintf("%s %s\r\n", msgid, self.getHeader(msgid, arg)))
         } else {
-          w.PrintfLine("500 error, %s", err.Error())
+          io.WriteString(dw, fmt.Sprintf("%d %s\r\n", article_nos[idx], self.getHeader(msgid, arg)))
         }
       }
+      dw.Close()
+    } else if cmd == "newnews" {
+      // handle newnews command
+      if len(parts) < 4 {
+        w.PrintfLine("501 usage: NEWNEWS wildmat date time [GMT]")
+        continue
+      }
+      since, err := parseNNTPDate(parts[2], parts[3])
+      if err != nil {
+        w.PrintfLine("501 bad date")
+        continue
+      }
+      w.PrintfLine("230 list of new articles follows")
+      dw := w.DotWriter()
+      for _, article := range self.db.GetArticlesSince(since.Unix()) {
+        if wildmatMatch(arg, article.Newsgroup()) {
+          io.WriteString(dw, article.MessageID() + "\r\n")
+        }
+      }
+      dw.Close()
+    } else if cmd == "date" {
+      w.PrintfLine("111 %s", time.Now().UTC().Format("20060102150405"))
+    } else if cmd == "help" {
+      w.PrintfLine("100 help text follows")
+      dw := w.DotWriter()
+      io.WriteString(dw, "ARTICLE [message-id|number]\r\n")
+      io.WriteString(dw, "AUTHINFO USER name|PASS password|SASL PLAIN [initial-response]\r\n")
+      io.WriteString(dw, "BODY [message-id|number]\r\n")
+      io.WriteString(dw, "CAPABILITIES\r\n")
+      io.WriteString(dw, "DATE\r\n")
+      io.WriteString(dw, "GROUP newsgroup\r\n")
+      io.WriteString(dw, "HDR field [message-id|range]\r\n")
+      io.WriteString(dw, "HEAD [message-id|number]\r\n")
+      io.WriteString(dw, "HELP\r\n")
+      io.WriteString(dw, "LAST\r\n")
+      io.WriteString(dw, "LIST [ACTIVE [wildmat]|NEWSGROUPS [wildmat]|OVERVIEW.FMT|HEADERS]\r\n")
+      io.WriteString(dw, "LISTGROUP [newsgroup [range]]\r\n")
+      io.WriteString(dw, "MODE READER\r\n")
+      io.WriteString(dw, "NEWGROUPS date time [GMT]\r\n")
+      io.WriteString(dw, "NEWNEWS wildmat date time [GMT]\r\n")
+      io.WriteString(dw, "NEXT\r\n")
+      io.WriteString(dw, "OVER [message-id|range]\r\n")
+      io.WriteString(dw, "POST\r\n")
+      io.WriteString(dw, "QUIT\r\n")
+      io.WriteString(dw, "STAT [message-id|number]\r\n")
+      io.WriteString(dw, "XHDR field [message-id|range]\r\n")
+      io.WriteString(dw, "XOVER [range]\r\n")
+      dw.Close()
+    } else if cmd == "post" {
+      // handle post command
+      w.PrintfLine("340 Send article to be posted. End with <CR-LF>.<CR-LF>")
+      msgid, reason := self.handlePost(r, sock.RemoteAddr())
+      if reason == "" {
+        log.Println("nntp frontend got post", msgid)
+        w.PrintfLine("240 %s Article received OK", msgid)
+      } else {
+        log.Println("nntp frontend rejected post:", reason)
+        w.PrintfLine("441 Posting failed, %s", reason)
+      }
     } else if lline == "mode reader" {
-      w.PrintfLine("201 posting disallowed")
-    } else if strings.HasPrefix(lline, "mode ") {
+      w.PrintfLine("200 posting allowed")
+    } else if cmd == "mode" {
       // handle other mode
       w.PrintfLine("%d mode not implemented", 501)
-    } else if lline == "capabilities" {
+    } else if cmd == "capabilities" {
       // send capabilities
       dw := w.DotWriter()
       io.WriteString(dw, "101 yeh we can do stuff\r\n")
       io.WriteString(dw, "VERSION 2\r\n")
       io.WriteString(dw, "IMPLEMENTATION srndv2 nntp frontend\r\n")
       io.WriteString(dw, "READER\r\n")
+      io.WriteString(dw, "POST\r\n")
+      io.WriteString(dw, "HDR\r\n")
+      io.WriteString(dw, "OVER\r\n")
+      io.WriteString(dw, "NEWNEWS\r\n")
+      io.WriteString(dw, "LIST ACTIVE NEWSGROUPS OVERVIEW.FMT HEADERS\r\n")
+      if self.daemon.require_auth {
+        for _, cap := range auth.Capabilities() {
+          io.WriteString(dw, cap + "\r\n")
+        }
+      }
       dw.Close()
     } else {
       // idk what command this is, log it and report error
@@ -0,0 +1,141 @@
+//
+// frontend_search.go
+//
+// post search for the http frontend
+//
+package srnd
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+)
+
+// how many search results go on a page
+const searchPageSize = 20
+
+// a search from a request's query parameters
+// q is the query, board limits it to a newsgroup, page starts at 0
+type searchRequest struct {
+  query string
+  board string
+  page int
+}
+
+// a page of search results as json
+type apiSearchResult struct {
+  Query string `json:"query"`
+  Board string `json:"board,omitempty"`
+  Page int `json:"page"`
+  HasMore bool `json:"has_more"`
+  Posts []apiPost `json:"posts"`
+}
+
+func (self httpFrontend) parseSearchRequest(r *http.Request) (req searchRequest, err error) {
+  params := r.URL.Query()
+  req.query = strings.Trim(params.Get("q"), " \t")
+  req.board = strings.ToLower(params.Get("board"))
+  if len(req.query) > 256 {
+    err = errors.New("query too long")
+  } else if len(req.board) > 0 && ! self.apiBoardValid(req.board) {
+    err = errors.New("no such board")
+  } else if params.Get("page") != "" {
+    req.page, err = strconv.Atoi(params.Get("page"))
+    if err == nil && req.page < 0 {
+      err = errors.New("invalid page")
+    }
+  }
+  return
+}
+
+// run a search
+// returns a page of posts and whether there are more pages
+func (self httpFrontend) doSearch(req searchRequest) (posts []PostModel, more bool, err error) {
+  if len(req.query) == 0 {
+    return
+  }
+  // get 1 extra to see if there is another page
+  // only groups we serve, the database leaves out ctl
+  posts, err = self.daemon.database.SearchPosts(self.prefix, req.board, httpNewsgroupPrefix, req.query, req.page * searchPageSize, searchPageSize + 1)
+  if err != nil {
+    log.Println("search for", req.query, "failed", err)
+    return
+  }
+  more = len(posts) > searchPageSize
+  if more {
+    posts = posts[:searchPageSize]
+  }
+  return
+}
+
+// url for a page of search results
+func (self httpFrontend) searchURL(req searchRequest, page int) string {
+  params := url.Values{}
+  params.Set("q", req.query)
+  if len(req.board) > 0 {
+    params.Set("board", req.board)
+  }
+  params.Set("page", fmt.Sprintf("%d", page))
+  return self.prefix + "search?" + params.Encode()
+}
+
+// GET /search
+func (self httpFrontend) handle_search(wr http.ResponseWriter, r *http.Request) {
+  req, err := self.parseSearchRequest(r)
+  var posts []PostModel
+  var more bool
+  if err == nil {
+    posts, more, err = self.doSearch(req)
+  }
+  param := make(map[string]interface{})
+  param["prefix"] = self.prefix
+  param["query"] = req.query
+  param["board"] = req.board
+  param["page"] = req.page
+  param["posts"] = posts
+  param["searched"] = len(req.query) > 0
+  if err != nil {
+    wr.WriteHeader(400)
+    param["error"] = err.Error()
+  }
+  if req.page > 0 {
+    param["prev_url"] = self.searchURL(req, req.page - 1)
+  }
+  if more {
+    param["next_url"] = self.searchURL(req, req.page + 1)
+  }
+  io.WriteString(wr, template.renderTemplate("search.mustache", param))
+}
+
+// GET /api/search
+func (self httpFrontend) handle_api_search(wr http.ResponseWriter, r *http.Request) {
+  req, err := self.parseSearchRequest(r)
+  if err == nil && len(req.query) == 0 {
+    err = errors.New("no query")
+  }
+  if err != nil {
+    self.writeJSONError(wr, http.StatusBadRequest, err.Error())
+    return
+  }
+  posts, more, err := self.doSearch(req)
+  if err != nil {
+    self.writeJSONError(wr, http.StatusInternalServerError, "search failed")
+    return
+  }
+  j := apiSearchResult{
+    Query: req.query,
+    Board: req.board,
+    Page: req.page,
+    HasMore: more,
+    Posts: []apiPost{},
+  }
+  for _, p := range posts {
+    j.Posts = append(j.Posts, apiPostFromModel(p))
+  }
+  self.writeJSON(wr, http.StatusOK, j)
+}
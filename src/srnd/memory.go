@@ -0,0 +1,1424 @@
+//
+// memory.go
+// in memory database backend, for tests and ephemeral nodes
+//
+package srnd
+
+import (
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "log"
+  "os"
+  "sort"
+  "sync"
+)
+
+// article meta data
+type memoryArticle struct {
+  message_id string
+  message_id_hash string
+  newsgroup string
+  ref_id string
+  obtained int64
+}
+
+type memoryAttachment struct {
+  sha_hash string
+  filename string
+  filepath string
+}
+
+// article post content
+type memoryPost struct {
+  newsgroup string
+  message_id string
+  ref_id string
+  name string
+  subject string
+  path string
+  posted int64
+  message string
+  addr string
+  // number in its newsgroup
+  nntp_id int64
+  attachments []memoryAttachment
+}
+
+// thread state
+type memoryThread struct {
+  newsgroup string
+  root_message_id string
+  last_bump int64
+  last_post int64
+  sticky bool
+  locked bool
+}
+
+type memoryThreads []*memoryThread
+
+func (self memoryThreads) Len() int {
+  return len(self)
+}
+
+// most recently bumped first
+func (self memoryThreads) Less(i, j int) bool {
+  return self[i].last_bump > self[j].last_bump
+}
+
+func (self memoryThreads) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+type memoryPosts []*memoryPost
+
+func (self memoryPosts) Len() int {
+  return len(self)
+}
+
+// oldest first
+func (self memoryPosts) Less(i, j int) bool {
+  return self[i].posted < self[j].posted
+}
+
+func (self memoryPosts) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+type memoryPostsByNumber struct {
+  memoryPosts
+}
+
+// lowest nntp id first
+func (self memoryPostsByNumber) Less(i, j int) bool {
+  return self.memoryPosts[i].nntp_id < self.memoryPosts[j].nntp_id
+}
+
+// an article queued for a feed
+type memoryQueued struct {
+  message_id string
+  // order it was queued in
+  seq int64
+  queued int64
+  next_attempt int64
+  attempts int64
+  outcome int
+  // false once the feed told us it doesn't want it
+  pending bool
+}
+
+type memoryQueue []*memoryQueued
+
+func (self memoryQueue) Len() int {
+  return len(self)
+}
+
+// soonest due first
+func (self memoryQueue) Less(i, j int) bool {
+  if self[i].next_attempt == self[j].next_attempt {
+    return self[i].seq < self[j].seq
+  }
+  return self[i].next_attempt < self[j].next_attempt
+}
+
+func (self memoryQueue) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+// an ip and its encryption key
+type memoryEncAddr struct {
+  enckey string
+  addr string
+  encaddr string
+}
+
+type MemoryDatabase struct {
+  access sync.RWMutex
+  // newsgroup -> last post time
+  newsgroups map[string]int64
+  // newsgroup -> last nntp id given out
+  nntp_ids map[string]int64
+  // newsgroup -> time banned
+  banned_groups map[string]int64
+  // message id -> ban reason
+  banned_articles map[string]string
+  // message id -> article meta data
+  articles map[string]*memoryArticle
+  // message id hash -> message id
+  hashes map[string]string
+  // message id -> post
+  posts map[string]*memoryPost
+  // message id -> pubkey
+  keys map[string]string
+  // root message id -> thread
+  threads map[string]*memoryThread
+  // pubkey -> newsgroup -> permission
+  modprivs map[string]map[string]map[string]bool
+  // addr -> encrypted addr
+  encaddrs map[string]*memoryEncAddr
+  // encrypted addr -> addr
+  encaddrs_rev map[string]*memoryEncAddr
+  // addr or range -> ban
+  ipbans map[string]IPBan
+  // encrypted addr -> ban
+  encipbans map[string]IPBan
+  // feed -> message id -> queued article
+  feedqueue map[string]map[string]*memoryQueued
+  // how many articles we have queued ever
+  queue_seq int64
+  // feed -> newsgroup -> high water mark
+  highwater map[string]map[string]int64
+  // token hash -> api token
+  apitokens map[string]APIToken
+  // newsgroup -> settings
+  boardsettings map[string]BoardSettings
+  // mod log oldest first
+  modlogs []ModLogEntry
+}
+
+func NewMemoryDatabase() Database {
+  db := new(MemoryDatabase)
+  db.CreateTables()
+  return db
+}
+
+// nothing to close
+func (self *MemoryDatabase) Close() {
+}
+
+// (re)create all tables that don't exist
+func (self *MemoryDatabase) CreateTables() {
+  self.access.Lock()
+  defer self.access.Unlock()
+  if self.newsgroups == nil {
+    self.newsgroups = make(map[string]int64)
+    self.nntp_ids = make(map[string]int64)
+    self.banned_groups = make(map[string]int64)
+    self.banned_articles = make(map[string]string)
+    self.articles = make(map[string]*memoryArticle)
+    self.hashes = make(map[string]string)
+    self.posts = make(map[string]*memoryPost)
+    self.keys = make(map[string]string)
+    self.threads = make(map[string]*memoryThread)
+    self.modprivs = make(map[string]map[string]map[string]bool)
+    self.encaddrs = make(map[string]*memoryEncAddr)
+    self.encaddrs_rev = make(map[string]*memoryEncAddr)
+    self.ipbans = make(map[string]IPBan)
+    self.encipbans = make(map[string]IPBan)
+    self.feedqueue = make(map[string]map[string]*memoryQueued)
+    self.highwater = make(map[string]map[string]int64)
+    self.apitokens = make(map[string]APIToken)
+    self.boardsettings = make(map[string]BoardSettings)
+  }
+}
+
+func (self *MemoryDatabase) BanNewsgroup(group string) (err error) {
+  self.access.Lock()
+  self.banned_groups[group] = timeNow()
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) UnbanNewsgroup(group string) (err error) {
+  self.access.Lock()
+  delete(self.banned_groups, group)
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) NewsgroupBanned(group string) (banned bool, err error) {
+  self.access.RLock()
+  _, banned = self.banned_groups[group]
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) NukeNewsgroup(group string, store ArticleStore) {
+  // first delete all thread presences
+  self.access.Lock()
+  for root, th := range self.threads {
+    if th.newsgroup == group {
+      delete(self.threads, root)
+    }
+  }
+  self.access.Unlock()
+  // for each article delete it fully
+  for _, p := range self.postsInGroup(group) {
+    msgid := p.message_id
+    log.Println("delete", msgid)
+    // remove article from store
+    fname := store.GetFilename(msgid)
+    os.Remove(fname)
+    // get all attachments
+    for _, att := range(self.GetPostAttachments(msgid)) {
+      // remove attachment
+      log.Println("delete attachment", att)
+      os.Remove(store.ThumbnailFilepath(att))
+      os.Remove(store.AttachmentFilepath(att))
+    }
+    // delete from database
+    self.DeleteArticle(msgid)
+  }
+  log.Println("nuke of", group, "done")
+}
+
+// check if a pubkey has a permission for a newsgroup
+func (self *MemoryDatabase) hasModPriv(pubkey, newsgroup, permission string) (has bool) {
+  self.access.RLock()
+  groups, ok := self.modprivs[pubkey]
+  if ok {
+    perms, ok := groups[newsgroup]
+    if ok {
+      has = perms[permission]
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+// give a pubkey a permission for a newsgroup
+func (self *MemoryDatabase) addModPriv(pubkey, newsgroup, permission string) {
+  self.access.Lock()
+  groups, ok := self.modprivs[pubkey]
+  if ! ok {
+    groups = make(map[string]map[string]bool)
+    self.modprivs[pubkey] = groups
+  }
+  perms, ok := groups[newsgroup]
+  if ! ok {
+    perms = make(map[string]bool)
+    groups[newsgroup] = perms
+  }
+  perms[permission] = true
+  self.access.Unlock()
+}
+
+func (self *MemoryDatabase) AddModPubkey(pubkey string) error {
+  if self.CheckModPubkey(pubkey) {
+    log.Println("did not add pubkey", pubkey, "already exists")
+    return nil
+  }
+  self.addModPriv(pubkey, "ctl", "login")
+  return nil
+}
+
+func (self *MemoryDatabase) GetPageForRootMessage(root_message_id string) (group string, page int64, err error) {
+  self.access.RLock()
+  defer self.access.RUnlock()
+  th, ok := self.threads[root_message_id]
+  if ok {
+    group = th.newsgroup
+    perpage := self.boardSettings(group).ThreadsPerPage
+    page = self.countBumpedAfter(th) / int64(perpage)
+  } else {
+    err = errors.New("no such thread")
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetInfoForMessage(msgid string) (root string, newsgroup string, page int64, err error) {
+  self.access.RLock()
+  defer self.access.RUnlock()
+  p, ok := self.posts[msgid]
+  if ok {
+    newsgroup = p.newsgroup
+    root = p.ref_id
+    if root == "" {
+      root = msgid
+    }
+    perpage := self.boardSettings(newsgroup).ThreadsPerPage
+    th, ok := self.threads[root]
+    if ok {
+      page = self.countBumpedAfter(th) / int64(perpage)
+    }
+  } else {
+    err = errors.New("no such post")
+  }
+  return
+}
+
+// count how many threads in this thread's group were bumped at the same time or after it
+// must hold lock
+func (self *MemoryDatabase) countBumpedAfter(th *memoryThread) (count int64) {
+  for _, t := range self.threads {
+    if t.newsgroup == th.newsgroup && t.last_bump >= th.last_bump {
+      count ++
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) CheckModPubkeyGlobal(pubkey string) bool {
+  return self.hasModPriv(pubkey, "overchan", "all")
+}
+
+func (self *MemoryDatabase) CheckModPubkeyCanModGroup(pubkey, newsgroup string) (has bool) {
+  self.access.RLock()
+  groups, ok := self.modprivs[pubkey]
+  if ok {
+    _, has = groups[newsgroup]
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) CountPostsInGroup(newsgroup string, time_frame int64) (result int64) {
+  if time_frame > 0 {
+    time_frame = timeNow() - time_frame
+  } else if time_frame < 0 {
+    time_frame = 0
+  }
+  self.access.RLock()
+  for _, p := range self.posts {
+    if p.newsgroup == newsgroup && p.posted > time_frame {
+      result ++
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) CheckModPubkey(pubkey string) bool {
+  return self.hasModPriv(pubkey, "ctl", "login")
+}
+
+func (self *MemoryDatabase) BanArticle(messageID, reason string) error {
+  if self.ArticleBanned(messageID) {
+    log.Println(messageID, "already banned")
+    return nil
+  }
+  self.access.Lock()
+  self.banned_articles[messageID] = reason
+  self.access.Unlock()
+  return nil
+}
+
+func (self *MemoryDatabase) ArticleBanned(messageID string) (result bool) {
+  self.access.RLock()
+  _, result = self.banned_articles[messageID]
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetEncAddress(addr string) (encaddr string, err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  enc, ok := self.encaddrs[addr]
+  if ok {
+    encaddr = enc.encaddr
+  } else {
+    // needs to be inserted
+    var key string
+    key, encaddr = newAddrEnc(addr)
+    if len(encaddr) == 0 {
+      err = errors.New("failed to generate new encryption key")
+    } else {
+      enc = &memoryEncAddr{
+        enckey: key,
+        addr: addr,
+        encaddr: encaddr,
+      }
+      self.encaddrs[addr] = enc
+      self.encaddrs_rev[encaddr] = enc
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetEncKey(encAddr string) (enckey string, err error) {
+  self.access.RLock()
+  enc, ok := self.encaddrs_rev[encAddr]
+  self.access.RUnlock()
+  if ok {
+    enckey = enc.enckey
+  } else {
+    err = errors.New("no such encrypted address")
+  }
+  return
+}
+
+func (self *MemoryDatabase) CheckIPBanned(addr string) (banned bool, err error) {
+  self.access.RLock()
+  for _, ban := range self.ipbans {
+    if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+      banned = true
+      break
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetIPAddress(encaddr string) (addr string, err error) {
+  self.access.RLock()
+  enc, ok := self.encaddrs_rev[encaddr]
+  self.access.RUnlock()
+  if ok {
+    addr = enc.addr
+  }
+  return
+}
+
+func (self *MemoryDatabase) MarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    // already marked
+    log.Println("pubkey already marked as global", pubkey)
+  } else {
+    self.addModPriv(pubkey, "overchan", "all")
+  }
+  return
+}
+
+func (self *MemoryDatabase) UnMarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    self.access.Lock()
+    delete(self.modprivs[pubkey]["overchan"], "all")
+    if len(self.modprivs[pubkey]["overchan"]) == 0 {
+      delete(self.modprivs[pubkey], "overchan")
+    }
+    self.access.Unlock()
+  } else {
+    err = errors.New("public key not marked as global")
+  }
+  return
+}
+
+func (self *MemoryDatabase) CountThreadReplies(root_message_id string) (repls int64) {
+  self.access.RLock()
+  repls = self.countReplies(root_message_id)
+  self.access.RUnlock()
+  return
+}
+
+// must hold lock
+func (self *MemoryDatabase) countReplies(root_message_id string) (repls int64) {
+  for _, p := range self.posts {
+    if p.ref_id == root_message_id {
+      repls ++
+    }
+  }
+  return
+}
+
+// get all threads in a newsgroup, most recently bumped first
+// must hold lock
+func (self *MemoryDatabase) threadsInGroup(newsgroup string) (threads memoryThreads) {
+  for _, th := range self.threads {
+    if newsgroup == "" || th.newsgroup == newsgroup {
+      threads = append(threads, th)
+    }
+  }
+  sort.Sort(threads)
+  return
+}
+
+// all threads in a newsgroup with stickies first, then most recently bumped first
+// must hold lock
+func (self *MemoryDatabase) pageThreadsInGroup(newsgroup string) (threads memoryThreads) {
+  var rest memoryThreads
+  for _, th := range self.threadsInGroup(newsgroup) {
+    if th.sticky {
+      threads = append(threads, th)
+    } else {
+      rest = append(rest, th)
+    }
+  }
+  threads = append(threads, rest...)
+  return
+}
+
+func (self *MemoryDatabase) GetRootPostsForExpiration(newsgroup string, threadcount int) (roots []string) {
+  self.access.RLock()
+  threads := self.pageThreadsInGroup(newsgroup)
+  self.access.RUnlock()
+  if len(threads) > threadcount {
+    for _, th := range threads[threadcount:] {
+      // stickies never expire
+      if ! th.sticky {
+        roots = append(roots, th.root_message_id)
+      }
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetAllNewsgroups() (groups []string) {
+  self.access.RLock()
+  for group, _ := range self.newsgroups {
+    groups = append(groups, group)
+  }
+  self.access.RUnlock()
+  sort.Strings(groups)
+  return
+}
+
+func (self *MemoryDatabase) GetGroupPageCount(newsgroup string) int64 {
+  self.access.RLock()
+  count := int64(len(self.threadsInGroup(newsgroup)))
+  perpage := self.boardSettings(newsgroup).ThreadsPerPage
+  self.access.RUnlock()
+  // divide by threads per page
+  return ( count / int64(perpage) ) + 1
+}
+
+// make a post model from a post
+func (self *MemoryDatabase) postModel(prefix string, p *memoryPost) post {
+  model := post{
+    prefix: prefix,
+    board: p.newsgroup,
+    message_id: p.message_id,
+    parent: p.ref_id,
+    name: p.name,
+    subject: p.subject,
+    path: p.path,
+    posted: p.posted,
+    message: p.message,
+    addr: p.addr,
+  }
+  model.op = len(model.parent) == 0
+  if len(model.parent) == 0 {
+    model.parent = model.message_id
+  }
+  model.sage = isSage(model.subject)
+  atts := self.GetPostAttachmentModels(prefix, p.message_id)
+  if atts != nil {
+    model.attachments = append(model.attachments, atts...)
+  }
+  self.access.RLock()
+  model.pubkey = self.keys[p.message_id]
+  self.access.RUnlock()
+  return model
+}
+
+// only fetches root posts
+// does not update the thread contents
+func (self *MemoryDatabase) GetGroupForPage(prefix, frontend, newsgroup string, pageno, perpage int) BoardModel {
+  var threads []ThreadModel
+  pages := self.GetGroupPageCount(newsgroup)
+  var roots []*memoryPost
+  self.access.RLock()
+  for idx, th := range self.pageThreadsInGroup(newsgroup) {
+    if idx >= pageno * perpage && idx < (pageno + 1) * perpage {
+      p, ok := self.posts[th.root_message_id]
+      if ok {
+        roots = append(roots, p)
+      }
+    }
+  }
+  self.access.RUnlock()
+  for _, p := range roots {
+    threads = append(threads, thread{
+      prefix: prefix,
+      posts: []PostModel{self.postModel(prefix, p)},
+      links: []LinkModel{
+        linkModel{
+          text: newsgroup,
+          link: fmt.Sprintf("%s%s-0.html", prefix, newsgroup),
+        },
+      },
+    })
+  }
+  return boardModel{
+    prefix: prefix,
+    frontend: frontend,
+    board: newsgroup,
+    page: pageno,
+    pages: int(pages),
+    threads: threads,
+  }
+}
+
+// get all posts in a newsgroup, oldest first
+func (self *MemoryDatabase) postsInGroup(newsgroup string) (posts memoryPosts) {
+  self.access.RLock()
+  for _, p := range self.posts {
+    if p.newsgroup == newsgroup {
+      posts = append(posts, p)
+    }
+  }
+  self.access.RUnlock()
+  sort.Sort(posts)
+  return
+}
+
+// get all replies to a thread, oldest first
+func (self *MemoryDatabase) threadReplies(rootpost string, limit int) (posts memoryPosts) {
+  self.access.RLock()
+  for _, p := range self.posts {
+    if p.ref_id == rootpost {
+      posts = append(posts, p)
+    }
+  }
+  self.access.RUnlock()
+  sort.Sort(posts)
+  if limit > 0 && len(posts) > limit {
+    posts = posts[len(posts)-limit:]
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetPostsInGroup(newsgroup string) (models []PostModel, err error) {
+  for _, p := range self.postsInGroup(newsgroup) {
+    models = append(models, post{
+      board: p.newsgroup,
+      message_id: p.message_id,
+      parent: p.ref_id,
+      name: p.name,
+      subject: p.subject,
+      path: p.path,
+      posted: p.posted,
+      message: p.message,
+      addr: p.addr,
+    })
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetPostModel(prefix, messageID string) PostModel {
+  self.access.RLock()
+  p, ok := self.posts[messageID]
+  self.access.RUnlock()
+  if ok {
+    return self.postModel(prefix, p)
+  } else {
+    log.Println("no post model for", messageID)
+    return nil
+  }
+}
+
+func (self *MemoryDatabase) SetThreadSticky(root_message_id string, sticky bool) (err error) {
+  self.access.Lock()
+  th, ok := self.threads[root_message_id]
+  if ok {
+    th.sticky = sticky
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) SetThreadLocked(root_message_id string, locked bool) (err error) {
+  self.access.Lock()
+  th, ok := self.threads[root_message_id]
+  if ok {
+    th.locked = locked
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) ThreadSticky(root_message_id string) (sticky bool) {
+  self.access.RLock()
+  th, ok := self.threads[root_message_id]
+  sticky = ok && th.sticky
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) ThreadLocked(root_message_id string) (locked bool) {
+  self.access.RLock()
+  th, ok := self.threads[root_message_id]
+  locked = ok && th.locked
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) DeleteThread(msgid string) (err error) {
+  self.access.Lock()
+  delete(self.threads, msgid)
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) DeleteArticle(msgid string) (err error) {
+  self.access.Lock()
+  delete(self.posts, msgid)
+  delete(self.keys, msgid)
+  delete(self.threads, msgid)
+  for _, queue := range self.feedqueue {
+    delete(queue, msgid)
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetThreadReplyPostModels(prefix, rootpost string, limit int) (repls []PostModel) {
+  for _, p := range self.threadReplies(rootpost, limit) {
+    repls = append(repls, self.postModel(prefix, p))
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetThreadReplies(rootpost string, limit int) (repls []string) {
+  for _, p := range self.threadReplies(rootpost, limit) {
+    repls = append(repls, p.message_id)
+  }
+  return
+}
+
+func (self *MemoryDatabase) ThreadHasReplies(rootpost string) bool {
+  return self.CountThreadReplies(rootpost) > 0
+}
+
+func (self *MemoryDatabase) GetGroupThreads(group string, recv chan ArticleEntry) {
+  for _, p := range self.postsInGroup(group) {
+    if p.ref_id == "" {
+      recv <- ArticleEntry{p.message_id, group}
+    }
+  }
+}
+
+func (self *MemoryDatabase) GetLastBumpedThreads(newsgroup string, threads int) (roots []ArticleEntry) {
+  self.access.RLock()
+  for _, th := range self.threadsInGroup(newsgroup) {
+    if len(roots) >= threads {
+      break
+    }
+    if newsgroup == "" && th.newsgroup == "ctl" {
+      continue
+    }
+    roots = append(roots, ArticleEntry{th.root_message_id, th.newsgroup})
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GroupHasPosts(group string) (has bool) {
+  self.access.RLock()
+  for _, p := range self.posts {
+    if p.newsgroup == group {
+      has = true
+      break
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+// check if a newsgroup exists
+func (self *MemoryDatabase) HasNewsgroup(group string) (has bool) {
+  self.access.RLock()
+  _, has = self.newsgroups[group]
+  self.access.RUnlock()
+  return
+}
+
+// check if an article exists
+func (self *MemoryDatabase) HasArticle(message_id string) (has bool) {
+  self.access.RLock()
+  _, has = self.articles[message_id]
+  self.access.RUnlock()
+  return
+}
+
+// check if an article exists locally
+func (self *MemoryDatabase) HasArticleLocal(message_id string) (has bool) {
+  self.access.RLock()
+  _, has = self.posts[message_id]
+  self.access.RUnlock()
+  return
+}
+
+// count articles we have
+func (self *MemoryDatabase) ArticleCount() (count int64) {
+  self.access.RLock()
+  count = int64(len(self.posts))
+  self.access.RUnlock()
+  return
+}
+
+// register a new newsgroup
+func (self *MemoryDatabase) RegisterNewsgroup(group string) {
+  self.access.Lock()
+  self.newsgroups[group] = timeNow()
+  self.access.Unlock()
+}
+
+func (self *MemoryDatabase) GetPostAttachments(messageID string) (atts []string) {
+  self.access.RLock()
+  p, ok := self.posts[messageID]
+  if ok {
+    for _, att := range p.attachments {
+      atts = append(atts, att.filepath)
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetPostAttachmentModels(prefix, messageID string) (atts []AttachmentModel) {
+  self.access.RLock()
+  p, ok := self.posts[messageID]
+  if ok {
+    for _, att := range p.attachments {
+      atts = append(atts, attachment{
+        prefix: prefix,
+        filepath: att.filepath,
+        filename: att.filename,
+      })
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+// register a message with the database
+func (self *MemoryDatabase) RegisterArticle(message NNTPMessage) {
+
+  msgid := message.MessageID()
+  group := message.Newsgroup()
+
+  if ! self.HasNewsgroup(group) {
+    self.RegisterNewsgroup(group)
+  }
+  if self.HasArticle(msgid) {
+    return
+  }
+  now := timeNow()
+
+  self.access.Lock()
+  defer self.access.Unlock()
+  // insert article metadata
+  hash := HashMessageID(msgid)
+  self.articles[msgid] = &memoryArticle{
+    message_id: msgid,
+    message_id_hash: hash,
+    newsgroup: group,
+    ref_id: message.Reference(),
+    obtained: now,
+  }
+  self.hashes[hash] = msgid
+  // update newsgroup and take the next nntp id in it
+  self.newsgroups[group] = now
+  self.nntp_ids[group] ++
+  // insert article post
+  p := &memoryPost{
+    newsgroup: group,
+    message_id: msgid,
+    ref_id: message.Reference(),
+    name: message.Name(),
+    subject: message.Subject(),
+    path: message.Path(),
+    posted: message.Posted(),
+    message: message.Message(),
+    addr: message.Addr(),
+    nntp_id: self.nntp_ids[group],
+  }
+  // register all attachments
+  for _, att := range message.Attachments() {
+    p.attachments = append(p.attachments, memoryAttachment{
+      sha_hash: hex.EncodeToString(att.Hash()),
+      filename: att.Filename(),
+      filepath: att.Filepath(),
+    })
+  }
+  self.posts[msgid] = p
+
+  // set / update thread state
+  if message.OP() {
+    // insert new thread for op
+    self.threads[msgid] = &memoryThread{
+      newsgroup: group,
+      root_message_id: msgid,
+      last_bump: message.Posted(),
+      last_post: message.Posted(),
+    }
+  } else {
+    th, ok := self.threads[message.Reference()]
+    if ok {
+      // replies past the bump limit don't bump
+      if ! message.Sage() && self.boardSettings(group).ReplyBumps(self.countReplies(th.root_message_id)) {
+        // bump it
+        th.last_bump = message.Posted()
+      }
+      // update last posted
+      th.last_post = message.Posted()
+    }
+  }
+}
+
+func (self *MemoryDatabase) RegisterSigned(message_id , pubkey string) (err error) {
+  self.access.Lock()
+  self.keys[message_id] = pubkey
+  self.access.Unlock()
+  return
+}
+
+// get all articles in a newsgroup
+// send result down a channel
+func (self *MemoryDatabase) GetAllArticlesInGroup(group string, recv chan ArticleEntry) {
+  for _, p := range self.postsInGroup(group) {
+    recv <- ArticleEntry{p.message_id, group}
+  }
+}
+
+// get all articles
+func (self *MemoryDatabase) GetAllArticles() (articles []ArticleEntry) {
+  self.access.RLock()
+  for _, p := range self.posts {
+    articles = append(articles, ArticleEntry{p.message_id, p.newsgroup})
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetPagesPerBoard(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.Pages, err
+}
+
+func (self *MemoryDatabase) GetThreadsPerPage(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.ThreadsPerPage, err
+}
+
+// get a newsgroup's settings
+// must hold lock
+func (self *MemoryDatabase) boardSettings(group string) BoardSettings {
+  settings, ok := self.boardsettings[group]
+  if ! ok {
+    settings = DefaultBoardSettings()
+  }
+  return settings
+}
+
+func (self *MemoryDatabase) GetBoardSettings(group string) (settings BoardSettings, err error) {
+  self.access.RLock()
+  settings = self.boardSettings(group)
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) SetBoardSettings(group string, settings BoardSettings) (err error) {
+  self.access.Lock()
+  self.boardsettings[group] = settings
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetMessageIDByHash(hash string) (article ArticleEntry, err error) {
+  self.access.RLock()
+  defer self.access.RUnlock()
+  msgid, ok := self.hashes[hash]
+  if ok {
+    article[0] = msgid
+    article[1] = self.articles[msgid].newsgroup
+  } else {
+    err = errors.New("no such article")
+  }
+  return
+}
+
+func (self *MemoryDatabase) BanAddr(ban IPBan) (err error) {
+  self.access.Lock()
+  self.ipbans[ban.Addr] = ban
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetIPBans() (bans []IPBan, err error) {
+  self.access.RLock()
+  for _, ban := range self.ipbans {
+    if ! ban.Expired() {
+      bans = append(bans, ban)
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetIPBansForAddr(addr string) (bans []IPBan, err error) {
+  self.access.RLock()
+  for _, ban := range self.ipbans {
+    if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+      bans = append(bans, ban)
+    }
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) DeleteExpiredBans() (err error) {
+  self.access.Lock()
+  for addr, ban := range self.ipbans {
+    if ban.Expired() {
+      delete(self.ipbans, addr)
+    }
+  }
+  for encaddr, ban := range self.encipbans {
+    if ban.Expired() {
+      delete(self.encipbans, encaddr)
+    }
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) UnbanAddr(addr string) (err error) {
+  self.access.Lock()
+  for ban, _ := range self.ipbans {
+    if banCIDR(ban) == banCIDR(addr) {
+      delete(self.ipbans, ban)
+    }
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) CheckEncIPBanned(encaddr string) (banned bool, err error) {
+  self.access.RLock()
+  ban, ok := self.encipbans[encaddr]
+  banned = ok && ! ban.Expired()
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) GetEncIPBans(encaddr string) (bans []IPBan, err error) {
+  self.access.RLock()
+  ban, ok := self.encipbans[encaddr]
+  if ok && ! ban.Expired() {
+    bans = append(bans, ban)
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) BanEncAddr(ban IPBan) (err error) {
+  self.access.Lock()
+  self.encipbans[ban.Addr] = ban
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetLastAndFirstForGroup(group string) (last, first int64, err error) {
+  self.access.RLock()
+  last = self.nntp_ids[group]
+  self.access.RUnlock()
+  // empty group
+  first = last + 1
+  for _, p := range self.postsInGroup(group) {
+    if p.nntp_id < first {
+      first = p.nntp_id
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetMessageIDForNNTPID(group string, id int64) (msgid string, err error) {
+  for _, p := range self.postsInGroup(group) {
+    if p.nntp_id == id {
+      msgid = p.message_id
+      return
+    }
+  }
+  err = errors.New("no such article number")
+  return
+}
+
+func (self *MemoryDatabase) GetNNTPIDForMessageID(group, msgid string) (id int64, err error) {
+  for _, p := range self.postsInGroup(group) {
+    if p.message_id == msgid {
+      id = p.nntp_id
+      return
+    }
+  }
+  err = errors.New("no such article in group")
+  return
+}
+
+func (self *MemoryDatabase) GetPostsInGroupRange(group string, first, last int64) (models []NumberedPost, err error) {
+  if first < 1 {
+    first = 1
+  }
+  var posts memoryPosts
+  for _, p := range self.postsInGroup(group) {
+    if p.nntp_id >= first && (last < 0 || p.nntp_id <= last) {
+      posts = append(posts, p)
+    }
+  }
+  sort.Sort(memoryPostsByNumber{posts})
+  for _, p := range posts {
+    models = append(models, NumberedPost{
+      Number: p.nntp_id,
+      PostModel: post{
+        board: p.newsgroup,
+        message_id: p.message_id,
+        parent: p.ref_id,
+        name: p.name,
+        subject: p.subject,
+        path: p.path,
+        posted: p.posted,
+        message: p.message,
+        addr: p.addr,
+      },
+    })
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetArticlesSince(since int64) (articles []ArticleEntry) {
+  var posts memoryPosts
+  self.access.RLock()
+  for _, p := range self.posts {
+    if p.posted > since {
+      posts = append(posts, p)
+    }
+  }
+  self.access.RUnlock()
+  sort.Sort(posts)
+  for _, p := range posts {
+    articles = append(articles, ArticleEntry{p.message_id, p.newsgroup})
+  }
+  return
+}
+
+func (self *MemoryDatabase) MarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  self.addModPriv(pubkey, group, "")
+  return
+}
+
+func (self *MemoryDatabase) UnMarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  self.access.Lock()
+  groups, ok := self.modprivs[pubkey]
+  if ok {
+    delete(groups, group)
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action string) bool {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    return true
+  }
+  // empty permissions were made by MarkModPubkeyCanModGroup and allow everything
+  return self.hasModPriv(pubkey, newsgroup, "") || self.hasModPriv(pubkey, newsgroup, ModActionAll) || self.hasModPriv(pubkey, newsgroup, action)
+}
+
+func (self *MemoryDatabase) GrantModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  self.addModPriv(pubkey, newsgroup, action)
+  return
+}
+
+func (self *MemoryDatabase) RevokeModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  if action == ModActionAll {
+    return self.UnMarkModPubkeyCanModGroup(pubkey, newsgroup)
+  }
+  self.access.Lock()
+  perms, ok := self.modprivs[pubkey][newsgroup]
+  if ok {
+    delete(perms, action)
+    if len(perms) == 0 {
+      delete(self.modprivs[pubkey], newsgroup)
+    }
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) AddModLog(entry ModLogEntry) (err error) {
+  self.access.Lock()
+  self.modlogs = append(self.modlogs, entry)
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetModLogs(pubkey, action string, limit, offset int) (logs []ModLogEntry, err error) {
+  self.access.RLock()
+  for idx := len(self.modlogs) - 1; idx >= 0 && len(logs) < limit; idx -- {
+    entry := self.modlogs[idx]
+    if len(pubkey) > 0 && entry.Pubkey != pubkey {
+      continue
+    } else if len(action) > 0 && entry.Action != action {
+      continue
+    } else if offset > 0 {
+      offset --
+      continue
+    }
+    logs = append(logs, entry)
+  }
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) IsExpired(root_message_id string) bool {
+  return self.HasArticle(root_message_id) && ! self.HasArticleLocal(root_message_id)
+}
+
+func (self *MemoryDatabase) QueueArticleForFeed(feed, msgid string) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  queue, ok := self.feedqueue[feed]
+  if ! ok {
+    queue = make(map[string]*memoryQueued)
+    self.feedqueue[feed] = queue
+  }
+  if _, ok = queue[msgid]; ! ok {
+    self.queue_seq += 1
+    queue[msgid] = &memoryQueued{
+      message_id: msgid,
+      seq: self.queue_seq,
+      queued: timeNow(),
+      next_attempt: timeNow(),
+      pending: true,
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) GetQueuedArticlesForFeed(feed string, limit int) (msgids []string, err error) {
+  self.access.RLock()
+  defer self.access.RUnlock()
+  now := timeNow()
+  var due memoryQueue
+  for _, q := range self.feedqueue[feed] {
+    if q.pending && q.next_attempt <= now {
+      due = append(due, q)
+    }
+  }
+  sort.Sort(due)
+  for _, q := range due {
+    if len(msgids) >= limit {
+      break
+    }
+    msgids = append(msgids, q.message_id)
+  }
+  return
+}
+
+func (self *MemoryDatabase) MarkArticleOffered(feed, msgid string) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  q, ok := self.feedqueue[feed][msgid]
+  if ok {
+    q.attempts += 1
+    q.next_attempt = timeNow() + queueBackoff(q.attempts)
+    if q.attempts >= queueMaxAttempts {
+      // this is the last time we offer it
+      delete(self.feedqueue[feed], msgid)
+    }
+  } else {
+    err = errors.New("article not queued for feed")
+  }
+  return
+}
+
+func (self *MemoryDatabase) RecordArticleOutcome(feed, msgid string, code int) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  q, ok := self.feedqueue[feed][msgid]
+  if ok {
+    q.outcome = code
+    if queueKeepsOutcome(code) {
+      q.pending = false
+    } else if code != 431 {
+      delete(self.feedqueue[feed], msgid)
+    }
+  } else {
+    err = errors.New("article not queued for feed")
+  }
+  return
+}
+
+func (self *MemoryDatabase) DeleteExpiredQueuedArticles() (err error) {
+  self.access.Lock()
+  cutoff := timeNow() - queueMaxAge
+  for _, queue := range self.feedqueue {
+    for msgid, q := range queue {
+      if q.queued < cutoff {
+        delete(queue, msgid)
+      }
+    }
+  }
+  self.access.Unlock()
+  return
+}
+
+func (self *MemoryDatabase) GetFeedHighWaterMark(feed, group string) (mark int64, err error) {
+  self.access.RLock()
+  mark = self.highwater[feed][group]
+  self.access.RUnlock()
+  return
+}
+
+func (self *MemoryDatabase) SetFeedHighWaterMark(feed, group string, mark int64) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  marks, ok := self.highwater[feed]
+  if ! ok {
+    marks = make(map[string]int64)
+    self.highwater[feed] = marks
+  }
+  marks[group] = mark
+  return
+}
+
+func (self *MemoryDatabase) ResetFeedHighWaterMarks(feed, group string) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  for f, marks := range self.highwater {
+    if feed == "" || feed == f {
+      if group == "" {
+        delete(self.highwater, f)
+      } else {
+        delete(marks, group)
+      }
+    }
+  }
+  return
+}
+
+func (self *MemoryDatabase) AddAPIToken(token APIToken) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  for _, t := range self.apitokens {
+    if t.Name == token.Name || t.Hash == token.Hash {
+      return errors.New("api token already exists")
+    }
+  }
+  self.apitokens[token.Hash] = token
+  return
+}
+
+func (self *MemoryDatabase) GetAPIToken(token_hash string) (token APIToken, err error) {
+  self.access.RLock()
+  defer self.access.RUnlock()
+  token, ok := self.apitokens[token_hash]
+  if ! ok {
+    err = errors.New("no such api token")
+  }
+  return
+}
+
+func (self *MemoryDatabase) RevokeAPIToken(name string) (err error) {
+  self.access.Lock()
+  defer self.access.Unlock()
+  for h, t := range self.apitokens {
+    if t.Name == name {
+      delete(self.apitokens, h)
+      return
+    }
+  }
+  return errors.New("no such api token")
+}
+
+func (self *MemoryDatabase) SearchPosts(prefix, newsgroup, group_prefix, query string, offset, limit int) (models []PostModel, err error) {
+  terms := searchTerms(query)
+  var found memoryPosts
+  self.access.RLock()
+  for _, p := range self.posts {
+    if searchInGroup(p.newsgroup, newsgroup, group_prefix) && searchMatches(terms, p.subject, p.name, p.message) {
+      found = append(found, p)
+    }
+  }
+  self.access.RUnlock()
+  // newest first
+  sort.Sort(sort.Reverse(found))
+  for idx, p := range found {
+    if idx >= offset + limit {
+      break
+    } else if idx >= offset {
+      models = append(models, self.postModel(prefix, p))
+    }
+  }
+  return
+}
@@ -12,6 +12,8 @@ import (
   "log"
   "net/http"
   "os"
+  "regexp"
+  "strconv"
   "strings"
 )
 
@@ -43,6 +45,16 @@ type ModUI interface {
   HandleBanAddress(wr http.ResponseWriter, r *http.Request)
   // handle an unban address request
   HandleUnbanAddress(wr http.ResponseWriter, r *http.Request)
+  // serve the list of address bans
+  HandleListBans(wr http.ResponseWriter, r *http.Request)
+  // handle banning an address or range from a form
+  HandleAddBan(wr http.ResponseWriter, r *http.Request)
+  // handle sticking or unsticking a thread
+  HandleStickThread(wr http.ResponseWriter, r *http.Request)
+  HandleUnstickThread(wr http.ResponseWriter, r *http.Request)
+  // handle locking or unlocking a thread
+  HandleLockThread(wr http.ResponseWriter, r *http.Request)
+  HandleUnlockThread(wr http.ResponseWriter, r *http.Request)
   // handle add a pubkey
   HandleAddPubkey(wr http.ResponseWriter, r *http.Request)
   // handle removing a pubkey
@@ -51,6 +63,10 @@ type ModUI interface {
   HandleKeyGen(wr http.ResponseWriter, r *http.Request)
   // handle admin command
   HandleAdminCommand(wr http.ResponseWriter, r *http.Request)
+  // serve the mod log page
+  HandleModLog(wr http.ResponseWriter, r *http.Request)
+  // serve the mod log as json
+  HandleModLogJSON(wr http.ResponseWriter, r *http.Request)
 }
 
 type ModEvent interface {
@@ -64,46 +80,158 @@ type ModEvent interface {
   Target() string
   // scope of the event, regex of newsgroup
   Scope() string
-  // when this mod event expires, unix nano
+  // when this mod event expires, unix time, -1 for never
   Expires() int64
 }
 
-type simpleModEvent string
+// scope of mod events that don't give one
+const defaultModScope = "overchan.*"
+
+// a mod event as a ctl line:
+// action target [scope=regex] [expires=unixtime] [reason=text to the end of the line]
+// older nodes only read the action and target so plain "delete <msgid>" lines still work both ways
+type modEvent struct {
+  action string
+  target string
+  reason string
+  scope string
+  expires int64
+}
+
+func (self modEvent) String() string {
+  str := self.action + " " + self.target
+  if self.scope != defaultModScope {
+    str += " scope=" + self.scope
+  }
+  if self.expires > 0 {
+    str += fmt.Sprintf(" expires=%d", self.expires)
+  }
+  if len(self.reason) > 0 {
+    str += " reason=" + self.reason
+  }
+  return str
+}
+
+func (self modEvent) Action() string {
+  return self.action
+}
+
+func (self modEvent) Reason() string {
+  return self.reason
+}
 
-func (self simpleModEvent) String() string {
-  return string(self)
+func (self modEvent) Target() string {
+  return self.target
 }
 
-func (self simpleModEvent) Action() string {
-  return strings.Split(string(self), " ")[0]
+func (self modEvent) Scope() string {
+  return self.scope
 }
 
-func (self simpleModEvent) Reason() string {
+func (self modEvent) Expires() int64 {
+  return self.expires
+}
+
+// create a mod event
+// an empty scope means the default and the reason is kept to 1 line
+func newModEvent(action, target, reason, scope string, expires int64) ModEvent {
+  if len(scope) == 0 {
+    scope = defaultModScope
+  }
+  if expires <= 0 {
+    expires = -1
+  }
+  reason = strings.Replace(strings.Replace(reason, "\r", " ", -1), "\n", " ", -1)
+  return modEvent{action, target, strings.Trim(reason, " "), scope, expires}
+}
+
+// scope for mod events on just this newsgroup
+func newsgroupModScope(newsgroup string) string {
+  return regexp.QuoteMeta(newsgroup)
+}
+
+// get the newsgroup a scope is for if it is for just 1 newsgroup
+// returns empty string if it may cover more
+func scopeNewsgroup(scope string) string {
+  newsgroup := strings.Replace(scope, "\\.", ".", -1)
+  if len(newsgroup) > 0 && newsgroupValidFormat(newsgroup) && newsgroupModScope(newsgroup) == scope {
+    return newsgroup
+  }
   return ""
 }
 
-func (self simpleModEvent) Target() string {
-  return strings.Split(string(self), " ")[1]
+// describe a scope for people reading it
+func modScopeName(scope string) string {
+  if len(scope) == 0 || scope == defaultModScope {
+    return "all boards"
+  } else if newsgroup := scopeNewsgroup(scope) ; len(newsgroup) > 0 {
+    return newsgroup
+  }
+  return scope
+}
+
+// check if a mod event's scope covers a newsgroup
+// invalid scopes cover nothing
+func modEventInScope(ev ModEvent, newsgroup string) bool {
+  return modScopeMatches(ev.Scope(), newsgroup)
+}
+
+// does a scope regex match the whole newsgroup name
+func modScopeMatches(scope, newsgroup string) bool {
+  re, err := regexp.Compile("^(?:" + scope + ")$")
+  if err != nil {
+    log.Println("invalid mod scope", scope, err)
+    return false
+  }
+  return re.MatchString(newsgroup)
 }
 
-func (self simpleModEvent) Scope() string {
-  // TODO: hard coded
-  return "overchan.*"
+// do mod events with this action have a post as their target
+func modActionTargetsPost(action string) bool {
+  switch action {
+  case "delete", "overchan-stick", "overchan-unstick", "overchan-lock", "overchan-unlock":
+    return true
+  }
+  return false
 }
 
-func (self simpleModEvent) Expires() int64 {
-  // no expiration
-  return -1
+// has this mod event expired
+func modEventExpired(ev ModEvent) bool {
+  return ev.Expires() > 0 && ev.Expires() <= timeNow()
 }
 
 // create an overchan-delete mod event
-func overchanDelete(msgid string) ModEvent {
-  return simpleModEvent(fmt.Sprintf("delete %s", msgid))
+func overchanDelete(msgid, reason, scope string) ModEvent {
+  return newModEvent("delete", msgid, reason, scope, -1)
+}
+
+// create an overchan-stick mod event
+func overchanStick(msgid, reason, scope string) ModEvent {
+  return newModEvent("overchan-stick", msgid, reason, scope, -1)
+}
+
+// create an overchan-unstick mod event
+func overchanUnstick(msgid, reason, scope string) ModEvent {
+  return newModEvent("overchan-unstick", msgid, reason, scope, -1)
+}
+
+// create an overchan-lock mod event
+func overchanLock(msgid, reason, scope string) ModEvent {
+  return newModEvent("overchan-lock", msgid, reason, scope, -1)
+}
+
+// create an overchan-unlock mod event
+func overchanUnlock(msgid, reason, scope string) ModEvent {
+  return newModEvent("overchan-unlock", msgid, reason, scope, -1)
 }
 
 // create an overchan-inet-ban mod event
-func overchanInetBan(encAddr, key string, expire int64) ModEvent {
-  return simpleModEvent(fmt.Sprintf("overchan-inet-ban %s:%s:%d", encAddr, key, expire))
+// the expiration stays in the target for older nodes
+func overchanInetBan(encAddr, key, reason, scope string, expire int64) ModEvent {
+  if expire <= 0 {
+    expire = -1
+  }
+  return newModEvent("overchan-inet-ban", fmt.Sprintf("%s:%s:%d", encAddr, key, expire), reason, scope, expire)
 }
 
 // moderation message
@@ -123,8 +251,41 @@ func (self ModMessage) WriteTo(wr io.Writer, delim []byte) (err error) {
 
 
 
+// parse a ctl line
+// fields we don't know are skipped so newer nodes can add more
 func ParseModEvent(line string) ModEvent {
-  return simpleModEvent(line)
+  ev := modEvent{scope: defaultModScope, expires: -1}
+  parts := strings.Split(strings.Trim(line, " "), " ")
+  ev.action = parts[0]
+  if len(parts) > 1 {
+    ev.target = parts[1]
+  }
+  for idx := 2; idx < len(parts); idx ++ {
+    part := parts[idx]
+    if strings.HasPrefix(part, "reason=") {
+      // the reason is the rest of the line
+      ev.reason = strings.TrimPrefix(strings.Join(parts[idx:], " "), "reason=")
+      break
+    } else if strings.HasPrefix(part, "scope=") && len(part) > 6 {
+      ev.scope = part[6:]
+    } else if strings.HasPrefix(part, "expires=") {
+      expires, err := strconv.ParseInt(part[8:], 10, 64)
+      if err == nil && expires > 0 {
+        ev.expires = expires
+      }
+    }
+  }
+  if ev.action == "overchan-inet-ban" && ev.expires == -1 {
+    // older nodes only put it in the target
+    target := strings.Split(ev.target, ":")
+    if len(target) == 3 {
+      expires, err := strconv.ParseInt(target[2], 10, 64)
+      if err == nil && expires > 0 {
+        ev.expires = expires
+      }
+    }
+  }
+  return ev
 }
 
 // wrap mod message in an nntp message
@@ -160,12 +321,22 @@ type ModEngine interface {
 
   // delete post of a poster
   DeletePost(msgid string, regen RegenFunc) error
-  // ban a cidr
-  BanAddress(cidr string) error
-  // do we allow this public key to delete?
-  AllowDelete(pubkey string) bool
-  // do we allow this public key to ban?
-  AllowBan(pubkey string) bool
+  // ban a cidr, ban.Addr is the cidr
+  BanAddress(ban IPBan) error
+  // do we allow this public key to delete this post?
+  AllowDelete(pubkey, msgid string) bool
+  // do we allow this public key to ban in newsgroups matching this scope?
+  AllowBan(pubkey, scope string) bool
+  // pin or unpin a thread to the top of its board
+  StickThread(root_msgid string, sticky bool, regen RegenFunc) error
+  // lock or unlock a thread
+  LockThread(root_msgid string, locked bool, regen RegenFunc) error
+  // do we allow this public key to stick and lock this thread?
+  AllowSticky(pubkey, root_msgid string) bool
+  // record a mod event done by this public key in the mod log
+  LogModEvent(pubkey, target string, ev ModEvent)
+  // is the post a mod event acts on in a newsgroup the event's scope covers
+  TargetInScope(ev ModEvent) bool
 }
 
 type modEngine struct {
@@ -178,8 +349,16 @@ func (self modEngine) MessageChan() chan NNTPMessage {
   return self.chnl
 }
 
-func (self modEngine) BanAddress(cidr string) (err error) {
-  return self.database.BanAddr(cidr)
+func (self modEngine) BanAddress(ban IPBan) (err error) {
+  // the mod panel bans before it federates so we may have it already
+  // a shorter or narrower scoped ban on the address does not stop a longer or wider one
+  bans, _ := self.database.GetIPBansForAddr(ban.Addr)
+  for _, existing := range bans {
+    if existing.Covers(ban) {
+      return errors.New("already banned")
+    }
+  }
+  return self.database.BanAddr(ban)
 }
 
 func (self modEngine) DeletePost(msgid string, regen RegenFunc) (err error) {
@@ -238,15 +417,87 @@ func (self modEngine) DeletePost(msgid string, regen RegenFunc) (err error) {
   return nil
 }
 
-// TODO: permissions
-func (self modEngine) AllowBan(pubkey string) bool {
+// get a thread's newsgroup and page, errors if it's not a thread we have
+func (self modEngine) threadPage(root_msgid string) (group string, page int64, err error) {
+  group, page, err = self.database.GetPageForRootMessage(root_msgid)
+  if err != nil {
+    err = errors.New("no such thread: " + root_msgid)
+  }
+  return
+}
+
+func (self modEngine) StickThread(root_msgid string, sticky bool, regen RegenFunc) (err error) {
+  var group string
+  var page int64
+  group, page, err = self.threadPage(root_msgid)
+  if err == nil {
+    err = self.database.SetThreadSticky(root_msgid, sticky)
+  }
+  if err == nil {
+    regen(group, root_msgid, root_msgid, int(page))
+  }
+  return
+}
+
+func (self modEngine) LockThread(root_msgid string, locked bool, regen RegenFunc) (err error) {
+  var group string
+  var page int64
+  group, page, err = self.threadPage(root_msgid)
+  if err == nil {
+    err = self.database.SetThreadLocked(root_msgid, locked)
+  }
+  if err == nil {
+    regen(group, root_msgid, root_msgid, int(page))
+  }
+  return
+}
+
+// check if a public key may do an action on a post's newsgroup
+// only global mods may act on posts we don't know the newsgroup of
+func (self modEngine) allowOnPost(pubkey, msgid, action string) bool {
+  _, group, _, err := self.database.GetInfoForMessage(msgid)
+  if err == nil && len(group) > 0 {
+    return self.database.CheckModPubkeyCanModGroupAction(pubkey, group, action)
+  }
   return self.database.CheckModPubkeyGlobal(pubkey)
 }
-// TODO: permissions
-func (self modEngine) AllowDelete(pubkey string) bool {
+
+func (self modEngine) AllowSticky(pubkey, root_msgid string) bool {
+  return self.allowOnPost(pubkey, root_msgid, ModActionSticky)
+}
+
+// a scope wider than one newsgroup needs a global mod
+func (self modEngine) AllowBan(pubkey, scope string) bool {
+  newsgroup := scopeNewsgroup(scope)
+  if len(newsgroup) > 0 {
+    return self.database.CheckModPubkeyCanModGroupAction(pubkey, newsgroup, ModActionBan)
+  }
   return self.database.CheckModPubkeyGlobal(pubkey)
 }
 
+func (self modEngine) TargetInScope(ev ModEvent) bool {
+  _, group, _, err := self.database.GetInfoForMessage(ev.Target())
+  return err == nil && modEventInScope(ev, group)
+}
+
+func (self modEngine) AllowDelete(pubkey, msgid string) bool {
+  return self.allowOnPost(pubkey, msgid, ModActionDelete)
+}
+
+func (self modEngine) LogModEvent(pubkey, target string, ev ModEvent) {
+  err := self.database.AddModLog(ModLogEntry{
+    Pubkey: pubkey,
+    Action: ev.Action(),
+    Target: target,
+    Reason: ev.Reason(),
+    Scope: ev.Scope(),
+    Time: timeNow(),
+  })
+  if err != nil {
+    log.Println("failed to log mod event", ev.Action(), target, err)
+  }
+}
+
 // run a mod engine logic mainloop
 func RunModEngine(mod ModEngine, regen RegenFunc) {
   
@@ -263,17 +514,40 @@ func RunModEngine(mod ModEngine, regen RegenFunc) {
           line = strings.Trim(line, "\r\t\n")
           ev := ParseModEvent(line)
           action := ev.Action()
-          if action == "delete" {
+          if modEventExpired(ev) {
+            log.Printf("pubkey=%s will not %s %s expired", pubkey, action, ev.Target())
+          } else if modActionTargetsPost(action) && ! mod.TargetInScope(ev) {
+            log.Printf("pubkey=%s will not %s %s not in scope %s", pubkey, action, ev.Target(), ev.Scope())
+          } else if action == "delete" {
             msgid := ev.Target()
             // this is a delete action
-            if mod.AllowDelete(pubkey) {
+            if mod.AllowDelete(pubkey, msgid) {
               err := mod.DeletePost(msgid, regen)
-              if err != nil {
+              if err == nil {
+                mod.LogModEvent(pubkey, msgid, ev)
+              } else {
                 log.Println(msgid, err)
               }
             } else {
               log.Printf("pubkey=%s will not delete %s not trusted", pubkey, msgid)
             }
+          } else if action == "overchan-stick" || action == "overchan-unstick" || action == "overchan-lock" || action == "overchan-unlock" {
+            msgid := ev.Target()
+            if mod.AllowSticky(pubkey, msgid) {
+              var err error
+              if action == "overchan-stick" || action == "overchan-unstick" {
+                err = mod.StickThread(msgid, action == "overchan-stick", regen)
+              } else {
+                err = mod.LockThread(msgid, action == "overchan-lock", regen)
+              }
+              if err == nil {
+                mod.LogModEvent(pubkey, msgid, ev)
+              } else {
+                log.Println(action, msgid, err)
+              }
+            } else {
+              log.Printf("pubkey=%s will not %s %s not trusted", pubkey, action, msgid)
+            }
           } else if action == "overchan-inet-ban" {
             // ban action
             target := ev.Target()
@@ -283,11 +557,22 @@ func RunModEngine(mod ModEngine, regen RegenFunc) {
               cidr := decAddr(encaddr, key)
               if cidr == "" {
                 log.Println("failed to decrypt inet ban")
-              } else if mod.AllowBan(pubkey) {
-                err := mod.BanAddress(cidr)
-                if err != nil {
+              } else if mod.AllowBan(pubkey, ev.Scope()) {
+                err := mod.BanAddress(IPBan{
+                  Addr: cidr,
+                  Made: timeNow(),
+                  Expires: ev.Expires(),
+                  Reason: ev.Reason(),
+                  Scope: ev.Scope(),
+                })
+                if err == nil {
+                  // don't log the key, it decrypts the address
+                  mod.LogModEvent(pubkey, encaddr, ev)
+                } else {
                   log.Println(cidr, err)
                 }
+              } else {
+                log.Printf("pubkey=%s will not ban %s not trusted", pubkey, cidr)
               }
             } else {
               log.Printf("invalid overchan-inet-ban: target=%s", target)
@@ -15,8 +15,12 @@ import (
   "fmt"
   "io"
   "log"
+  "net"
   "net/http"
+  "sort"
+  "strconv"
   "strings"
+  "time"
 )
 
 type httpModUI struct {
@@ -50,6 +54,63 @@ func extractParam(param map[string]interface{}, k string) string {
   return ""
 }
 
+// update board settings from admin function parameters
+// only the parameters that are given are changed
+func updateBoardSettings(settings *BoardSettings, param map[string]interface{}) error {
+  ints := map[string]*int{
+    "threads_per_page": &settings.ThreadsPerPage,
+    "pages": &settings.Pages,
+    "bump_limit": &settings.BumpLimit,
+    "reply_limit": &settings.ReplyLimit,
+  }
+  for k, ptr := range ints {
+    v, ok := param[k]
+    if ok {
+      switch v.(type) {
+      case float64:
+        *ptr = int(v.(float64))
+      default:
+        return errors.New("invalid value for " + k)
+      }
+    }
+  }
+  v, ok := param["max_attachment_size"]
+  if ok {
+    switch v.(type) {
+    case float64:
+      settings.MaxAttachmentSize = int64(v.(float64))
+    default:
+      return errors.New("invalid value for max_attachment_size")
+    }
+  }
+  v, ok = param["mime_types"]
+  if ok {
+    switch v.(type) {
+    case string:
+      settings.MimeTypes = v.(string)
+    default:
+      return errors.New("invalid value for mime_types")
+    }
+  }
+  v, ok = param["allow_anon"]
+  if ok {
+    switch v.(type) {
+    case bool:
+      settings.AllowAnon = v.(bool)
+    default:
+      return errors.New("invalid value for allow_anon")
+    }
+  }
+  if settings.ThreadsPerPage < 1 || settings.Pages < 1 {
+    return errors.New("need at least 1 page with 1 thread")
+  } else if settings.BumpLimit < 0 || settings.ReplyLimit < 0 || settings.MaxAttachmentSize < 0 {
+    return errors.New("limits cannot be negative")
+  } else if len(settings.MimeTypes) == 0 {
+    return errors.New("no mime types given")
+  }
+  return nil
+}
+
 func (self httpModUI) getAdminFunc(funcname string) AdminFunc {
   if funcname == "template.reload" {
     return func(param map[string]interface{}) (string, error) {
@@ -164,6 +225,90 @@ func (self httpModUI) getAdminFunc(funcname string) AdminFunc {
         return "cannot nuke", errors.New("invalid parameters")
       }
     }
+  } else if funcname == "api.token.issue" {
+    return func(param map[string]interface{}) (string, error) {
+      name := extractParam(param, "name")
+      if len(name) == 0 {
+        return "cannot issue api token", errors.New("no name given")
+      }
+      scope := extractParam(param, "scope")
+      if len(scope) == 0 {
+        scope = "overchan.*"
+      }
+      var rate int64
+      r, ok := param["rate"]
+      if ok {
+        switch r.(type) {
+        case float64:
+          rate = int64(r.(float64))
+        default:
+          return "cannot issue api token", errors.New("invalid parameters")
+        }
+      }
+      token := newAPIToken()
+      err := self.database.AddAPIToken(APIToken{
+        Name: name,
+        Hash: hashAPIToken(token),
+        Scope: scope,
+        RateLimit: rate,
+        Issued: timeNow(),
+      })
+      if err == nil {
+        log.Println("issued api token", name, "for", scope)
+        return fmt.Sprintf("issued api token %s: %s", name, token), nil
+      } else {
+        return "cannot issue api token", err
+      }
+    }
+  } else if funcname == "api.token.revoke" {
+    return func(param map[string]interface{}) (string, error) {
+      name := extractParam(param, "name")
+      log.Println("api.token.revoke", name)
+      err := self.database.RevokeAPIToken(name)
+      if err == nil {
+        return "revoked api token " + name, nil
+      } else {
+        return "cannot revoke api token", err
+      }
+    }
+  } else if funcname == "board.settings" {
+    return func(param map[string]interface{}) (string, error) {
+      newsgroup := extractGroup(param)
+      if ! newsgroupValidFormat(newsgroup) {
+        return "cannot get board settings", errors.New("invalid newsgroup")
+      }
+      settings, err := self.database.GetBoardSettings(newsgroup)
+      if err == nil {
+        return fmt.Sprintf("%s: threads_per_page=%d pages=%d bump_limit=%d reply_limit=%d max_attachment_size=%d mime_types=%s allow_anon=%v",
+          newsgroup, settings.ThreadsPerPage, settings.Pages, settings.BumpLimit, settings.ReplyLimit, settings.MaxAttachmentSize, settings.MimeTypes, settings.AllowAnon), nil
+      } else {
+        return "cannot get board settings", err
+      }
+    }
+  } else if funcname == "board.settings.set" {
+    return func(param map[string]interface{}) (string, error) {
+      newsgroup := extractGroup(param)
+      if ! newsgroupValidFormat(newsgroup) {
+        return "cannot set board settings", errors.New("invalid newsgroup")
+      }
+      settings, err := self.database.GetBoardSettings(newsgroup)
+      if err == nil {
+        err = updateBoardSettings(&settings, param)
+      }
+      if err == nil {
+        err = self.database.SetBoardSettings(newsgroup, settings)
+      }
+      if err == nil {
+        log.Println("updated settings for", newsgroup)
+        // page layout may have changed
+        if self.database.HasNewsgroup(newsgroup) {
+          go self.regenGroup(newsgroup)
+        }
+        return "updated settings for " + newsgroup, nil
+      } else {
+        return "cannot set board settings", err
+      }
+    }
   } else if funcname == "pubkey.add" {
     return func(param map[string]interface{}) (string, error) {
       pubkey := extractParam(param, "pubkey")
@@ -179,6 +324,38 @@ func (self httpModUI) getAdminFunc(funcname string) AdminFunc {
         }
       }
     }
+  } else if funcname == "pubkey.grant" || funcname == "pubkey.revoke" {
+    return func(param map[string]interface{}) (string, error) {
+      pubkey := extractParam(param, "pubkey")
+      newsgroup := extractGroup(param)
+      action := extractParam(param, "action")
+      if len(action) == 0 {
+        action = ModActionAll
+      }
+      log.Println(funcname, pubkey, newsgroup, action)
+      if len(pubkey) == 0 {
+        return "cannot change permissions", errors.New("no pubkey given")
+      } else if len(newsgroup) == 0 || ! newsgroupValidFormat(newsgroup) {
+        return "cannot change permissions", errors.New("invalid newsgroup")
+      } else if ! modActionValid(action) {
+        return "cannot change permissions", errors.New("invalid action " + action)
+      }
+      var err error
+      if funcname == "pubkey.grant" {
+        // they need to be able to log in to use it
+        err = self.database.AddModPubkey(pubkey)
+        if err == nil {
+          err = self.database.GrantModPubkeyGroupAction(pubkey, newsgroup, action)
+        }
+      } else {
+        err = self.database.RevokeModPubkeyGroupAction(pubkey, newsgroup, action)
+      }
+      if err == nil {
+        return fmt.Sprintf("%s %s %s on %s", funcname, pubkey, action, newsgroup), nil
+      } else {
+        return "cannot change permissions", err
+      }
+    }
   } else if funcname == "pubkey.del" {
     return func(param map[string]interface{}) (string, error) {
       pubkey := extractParam(param, "pubkey")
@@ -214,9 +391,15 @@ func (self httpModUI) HandleAdminCommand(wr http.ResponseWriter, r *http.Request
         dec := json.NewDecoder(r.Body)
         err = dec.Decode(&req)
       }
+      if err == nil && ! self.sessionCanAdmin(r, action, req) {
+        err = errors.New("not permitted")
+      }
       if err == nil {
         msg, err = f(req)
       }
+      if err == nil && action != "board.settings" {
+        self.logAdminCommand(r, action, req)
+      }
       resp := make(map[string]interface{})
       if err == nil {
         resp["error"] = nil
@@ -231,7 +414,8 @@ func (self httpModUI) HandleAdminCommand(wr http.ResponseWriter, r *http.Request
   }, wr, r)
 }
 
-// TODO: check for different levels of permissions
+// global mods and mods of some newsgroups can log in
+// what they can do is checked for each action
 func (self httpModUI) CheckKey(privkey string) (bool, error) {
   privkey_bytes, err := hex.DecodeString(privkey)
   if err == nil {
@@ -242,6 +426,9 @@ func (self httpModUI) CheckKey(privkey string) (bool, error) {
       if self.database.CheckModPubkeyGlobal(pubkey) {
         // this user is an admin
         return true, nil
+      } else if self.database.CheckModPubkey(pubkey) {
+        // this user mods some newsgroups
+        return true, nil
       } else {
         return false, nil
       }
@@ -277,6 +464,71 @@ func (self httpModUI) getSessionPrivkeyBytes(r *http.Request) []byte {
   return nil
 }
 
+// get the session's public key as hex or empty string if we don't have it
+func (self httpModUI) getSessionPubkey(r *http.Request) (pubkey string) {
+  privkey_bytes := self.getSessionPrivkeyBytes(r)
+  if privkey_bytes != nil {
+    kp := nacl.LoadSignKey(privkey_bytes)
+    if kp != nil {
+      defer kp.Free()
+      pubkey = hex.EncodeToString(kp.Public())
+    }
+  }
+  return
+}
+
+// returns true if the session's key can do this action on a newsgroup
+func (self httpModUI) sessionCanMod(r *http.Request, newsgroup, action string) bool {
+  pubkey := self.getSessionPubkey(r)
+  return len(pubkey) > 0 && self.database.CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action)
+}
+
+// returns true if the session's key is a global mod
+func (self httpModUI) sessionIsGlobal(r *http.Request) bool {
+  pubkey := self.getSessionPubkey(r)
+  return len(pubkey) > 0 && self.database.CheckModPubkeyGlobal(pubkey)
+}
+
+// returns true if the session can call this admin function
+// mods can only nuke newsgroups they have permission to, everything else is for global mods
+func (self httpModUI) sessionCanAdmin(r *http.Request, funcname string, param map[string]interface{}) bool {
+  if self.sessionIsGlobal(r) {
+    return true
+  } else if funcname == "frontend.nuke" {
+    return self.sessionCanMod(r, extractGroup(param), ModActionNuke)
+  }
+  return false
+}
+
+// record something done from the mod panel in the mod log
+func (self httpModUI) logModAction(r *http.Request, action, target, reason, scope string) {
+  err := self.database.AddModLog(ModLogEntry{
+    Pubkey: self.getSessionPubkey(r),
+    Action: action,
+    Target: target,
+    Reason: reason,
+    Scope: scope,
+    Time: timeNow(),
+  })
+  if err != nil {
+    log.Println("failed to log mod action", action, target, err)
+  }
+}
+
+// record an admin command in the mod log
+// the target is the pubkey, newsgroup or name it was given
+func (self httpModUI) logAdminCommand(r *http.Request, funcname string, param map[string]interface{}) {
+  newsgroup := extractGroup(param)
+  target := extractParam(param, "pubkey")
+  if len(target) == 0 {
+    target = newsgroup
+  }
+  if len(target) == 0 {
+    target = extractParam(param, "name")
+  }
+  self.logModAction(r, funcname, target, "", newsgroup)
+}
+
 // returns true if the session is okay
 // otherwise redirect to login page
 func (self httpModUI) checkSession(r *http.Request) bool {
@@ -346,22 +598,45 @@ func (self httpModUI) HandleDelPubkey(wr http.ResponseWriter, r *http.Request) {
 
 func (self httpModUI) HandleUnbanAddress(wr http.ResponseWriter, r *http.Request) {
   self.asAuthed(func(path string) {
-    // extract the ip address
-    // TODO: ip ranges and prefix detection
+    // extract the ip address or range
     if strings.Count(path, "/") > 2 {
-      addr := strings.Split(path, "/")[3]
+      // TODO: prefix detection
+      addr := strings.Join(strings.Split(path, "/")[3:], "/")
       resp := make(map[string]interface{})
-      banned, err := self.database.CheckIPBanned(addr)
-      if err != nil {
+      bans, err := self.database.GetIPBansForAddr(addr)
+      // the ban on exactly this address or range and the ranges it is in
+      banned := false
+      var ranges []string
+      for _, ban := range bans {
+        if banCIDR(ban.Addr) == banCIDR(addr) {
+          banned = true
+        } else {
+          ranges = append(ranges, ban.Addr)
+        }
+      }
+      if len(ranges) > 0 {
+        resp["ranges"] = ranges
+      }
+      if ! self.sessionIsGlobal(r) {
+        // address bans are not per newsgroup
+        resp["error"] = "only global mods can unban addresses"
+      } else if err != nil {
         resp["error"] = fmt.Sprintf("cannot tell if %s is banned: %s", addr, err.Error())
       } else if banned {
-        // TODO: rangebans
+        // only this ban goes, not the ranges it is in
         err = self.database.UnbanAddr(addr)
         if err == nil {
-          resp["result"] = fmt.Sprintf("%s was unbanned", addr)
+          self.logModAction(r, "overchan-inet-unban", addr, "", defaultModScope)
+          if len(ranges) > 0 {
+            resp["result"] = fmt.Sprintf("%s was unbanned but is still in banned ranges %s", addr, strings.Join(ranges, ", "))
+          } else {
+            resp["result"] = fmt.Sprintf("%s was unbanned", addr)
+          }
         } else {
           resp["error"] = err.Error()
         }
+      } else if len(ranges) > 0 {
+        resp["error"] = fmt.Sprintf("%s is not banned itself, it is in banned ranges %s", addr, strings.Join(ranges, ", "))
       } else {
         resp["error"] = fmt.Sprintf("%s was not banned", addr)
       }
@@ -373,11 +648,71 @@ func (self httpModUI) HandleUnbanAddress(wr http.ResponseWriter, r *http.Request
   }, wr, r)
 }
 
+// get the reason, scope and expiration for a ban from the mod panel
+// scope is "global" or "board", global mods ban everywhere by default
+// expires is how many seconds the ban lasts, 0 or none for forever
+// returns when the ban runs out as unix time or -1 for never
+func (self httpModUI) banParams(r *http.Request, newsgroup string) (reason, scope string, expires int64, err error) {
+  expires = -1
+  reason = r.FormValue("reason")
+  scope = r.FormValue("scope")
+  if len(scope) == 0 {
+    if self.sessionIsGlobal(r) {
+      scope = "global"
+    } else {
+      scope = "board"
+    }
+  }
+  if scope == "global" {
+    scope = defaultModScope
+  } else if scope == "board" {
+    scope = newsgroupModScope(newsgroup)
+  } else {
+    err = errors.New("invalid scope " + scope)
+    return
+  }
+  if len(r.FormValue("expires")) > 0 {
+    var duration int64
+    duration, err = strconv.ParseInt(r.FormValue("expires"), 10, 64)
+    if err != nil || duration < 0 {
+      err = errors.New("invalid ban duration")
+    } else if duration > 0 {
+      expires = timeNow() + duration
+    }
+  }
+  return
+}
+
+// get the range of a given prefix length an address is in
+// returns the address if no prefix length is given
+func banRange(addr, prefix string) (string, error) {
+  if len(prefix) == 0 {
+    return addr, nil
+  }
+  _, network, err := net.ParseCIDR(addr + "/" + prefix)
+  if err != nil {
+    return "", errors.New("invalid range /" + prefix)
+  }
+  return network.String(), nil
+}
+
 // handle ban logic
 func (self httpModUI) handleBanAddress(msg ArticleEntry, r *http.Request) map[string]interface{} {
   // get the article headers
   resp := make(map[string]interface{})
   msgid := msg.MessageID()
+  reason, scope, expires, err := self.banParams(r, msg.Newsgroup())
+  if err != nil {
+    resp["error"] = err.Error()
+    return resp
+  }
+  if scope == defaultModScope && ! self.sessionIsGlobal(r) {
+    resp["error"] = "only global mods can ban everywhere"
+    return resp
+  } else if ! self.sessionCanMod(r, msg.Newsgroup(), ModActionBan) {
+    resp["error"] = fmt.Sprintf("not permitted to ban on %s", msg.Newsgroup())
+    return resp
+  }
   hdr := self.articles.GetHeaders(msgid)
   if hdr == nil {
     // we don't got it?!
@@ -395,15 +730,24 @@ func (self httpModUI) handleBanAddress(msg ArticleEntry, r *http.Request) map[st
       ip, err := self.database.GetIPAddress(encip)
       if len(ip) > 0 {
         // we have it
-        // ban the address
-        err = self.database.BanAddr(ip)
+        // ban the address or the range it is in
+        var addr string
+        addr, err = banRange(ip, r.FormValue("range"))
+        if err == nil {
+          err = self.database.BanAddr(IPBan{Addr: addr, Made: timeNow(), Expires: expires, Reason: reason, Scope: scope})
+        }
+        if err != nil {
+          resp["error"] = err.Error()
+          return resp
+        }
+        ip = addr
         // then we tell everyone about it
+        // other nodes only get the address, not the range
         var key string
         // TODO: we SHOULD have the key, but what if we do not? 
         key, err = self.database.GetEncKey(encip)
         // create mod message
-        // TODO: hardcoded ban period
-        mm := ModMessage{overchanInetBan(encip, key, -1),}
+        mm := ModMessage{overchanInetBan(encip, key, reason, scope, expires),}
         privkey_bytes := self.getSessionPrivkeyBytes(r)
         if privkey_bytes == nil {
           // this should not happen
@@ -421,9 +765,11 @@ func (self httpModUI) handleBanAddress(msg ArticleEntry, r *http.Request) map[st
       } else {
         // we don't have it
         // ban the encrypted version
-        err = self.database.BanEncAddr(encip)
+        err = self.database.BanEncAddr(IPBan{Addr: encip, Made: timeNow(), Expires: expires, Reason: reason, Scope: scope})
       }
       if err == nil {
+        // the mod engine won't log it again when the federated ban comes back
+        self.logModAction(r, "overchan-inet-ban", encip, reason, scope)
         result_msg :=  fmt.Sprintf("We banned %s", encip)
         if len(ip) > 0 {
           result_msg += fmt.Sprintf(" (%s)", ip)
@@ -442,6 +788,12 @@ func (self httpModUI) handleDeletePost(msg ArticleEntry, r *http.Request) map[st
   var mm ModMessage
   resp := make(map[string]interface{})
   msgid := msg.MessageID()
+  if ! self.sessionCanMod(r, msg.Newsgroup(), ModActionDelete) {
+    resp["error"] = fmt.Sprintf("not permitted to delete on %s", msg.Newsgroup())
+    return resp
+  }
+  reason := r.FormValue("reason")
+  scope := newsgroupModScope(msg.Newsgroup())
   delmsgs := []string{}
   // get headers
   hdr := self.articles.GetHeaders(msgid)
@@ -457,7 +809,7 @@ func (self httpModUI) handleDeletePost(msg ArticleEntry, r *http.Request) map[st
       if replies != nil {
         for _, repl := range(replies) {
           // append mod line to mod message for reply
-          mm = append(mm, overchanDelete(repl))
+          mm = append(mm, overchanDelete(repl, reason, scope))
           // add to delete queue
           delmsgs = append(delmsgs, repl)
         }
@@ -465,7 +817,7 @@ func (self httpModUI) handleDeletePost(msg ArticleEntry, r *http.Request) map[st
     }
     delmsgs = append(delmsgs, msgid)
     // append mod line to mod message
-    mm = append(mm, overchanDelete(msgid))
+    mm = append(mm, overchanDelete(msgid, reason, scope))
     
     resp["deleted"] = delmsgs
     // only regen threads when we delete a non root port
@@ -493,6 +845,60 @@ func (self httpModUI) handleDeletePost(msg ArticleEntry, r *http.Request) map[st
   return resp
 }
 
+// make a handler that sends a signed mod event for a thread
+// the page is regenerated once the mod engine handles the event
+func (self httpModUI) handleThreadEvent(action string, event func(string, string, string) ModEvent) func(ArticleEntry, *http.Request) map[string]interface{} {
+  return func(msg ArticleEntry, r *http.Request) map[string]interface{} {
+    resp := make(map[string]interface{})
+    msgid := msg.MessageID()
+    group, _, err := self.database.GetPageForRootMessage(msgid)
+    if err != nil {
+      resp["error"] = fmt.Sprintf("%s is not a thread we have", msgid)
+      return resp
+    } else if ! self.sessionCanMod(r, group, ModActionSticky) {
+      resp["error"] = fmt.Sprintf("not permitted to stick or lock threads on %s", group)
+      return resp
+    }
+    privkey_bytes := self.getSessionPrivkeyBytes(r)
+    if privkey_bytes == nil {
+      // this should not happen
+      log.Println("failed to get private keys from session, not federating")
+      resp["error"] = "failed to get private key from session. wtf?"
+      return resp
+    }
+    // wrap and sign mod message
+    nntp, err := signArticle(wrapModMessage(ModMessage{event(msgid, r.FormValue("reason"), newsgroupModScope(group))}), privkey_bytes)
+    if err == nil {
+      // send it off to federate, we apply it when it comes back in ctl
+      self.modMessageChan <- nntp
+      resp[action] = msgid
+    } else {
+      resp["error"] = fmt.Sprintf("signing error: %s", err.Error())
+    }
+    return resp
+  }
+}
+
+// pin a thread to the top of its board
+func (self httpModUI) HandleStickThread(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthedWithMessage(self.handleThreadEvent("stuck", overchanStick), wr, r)
+}
+
+// unpin a thread
+func (self httpModUI) HandleUnstickThread(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthedWithMessage(self.handleThreadEvent("unstuck", overchanUnstick), wr, r)
+}
+
+// stop a thread from taking new replies
+func (self httpModUI) HandleLockThread(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthedWithMessage(self.handleThreadEvent("locked", overchanLock), wr, r)
+}
+
+// let a locked thread take new replies again
+func (self httpModUI) HandleUnlockThread(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthedWithMessage(self.handleThreadEvent("unlocked", overchanUnlock), wr, r)
+}
+
 // ban the address of a poster
 func (self httpModUI) HandleBanAddress(wr http.ResponseWriter, r *http.Request) {
   self.asAuthedWithMessage(self.handleBanAddress, wr, r)
@@ -502,6 +908,159 @@ func (self httpModUI) HandleBanAddress(wr http.ResponseWriter, r *http.Request)
 func (self httpModUI) HandleDeletePost(wr http.ResponseWriter, r *http.Request) {
   self.asAuthedWithMessage(self.handleDeletePost, wr, r)
 }
+
+// a ban as shown on the bans page and to banned posters
+type banInfo struct {
+  Addr string
+  Made string
+  Expires string
+  Remaining string
+  Reason string
+  Scope string
+  Appeal string
+}
+
+func newBanInfo(ban IPBan) (info banInfo) {
+  info = banInfo{
+    Addr: ban.Addr,
+    Made: time.Unix(ban.Made, 0).UTC().Format(time.RFC1123Z),
+    Expires: "never",
+    Remaining: "forever",
+    Reason: ban.Reason,
+    Scope: modScopeName(ban.Scope),
+    Appeal: ban.AppealID(),
+  }
+  if ban.Expires > 0 {
+    info.Expires = time.Unix(ban.Expires, 0).UTC().Format(time.RFC1123Z)
+    info.Remaining = (time.Duration(ban.Remaining()) * time.Second).String()
+  }
+  return
+}
+
+// bans sorted newest first
+type bansNewestFirst []IPBan
+
+func (self bansNewestFirst) Len() int {
+  return len(self)
+}
+
+func (self bansNewestFirst) Less(i, j int) bool {
+  return self[i].Made > self[j].Made
+}
+
+func (self bansNewestFirst) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+// serve the list of address bans with how long they have left
+// single addresses and ranges are listed apart
+// if addr is given the bans covering it are listed too
+func (self httpModUI) HandleListBans(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthed(func(path string) {
+    param := make(map[string]interface{})
+    param["prefix"] = self.prefix
+    param["mod_prefix"] = self.mod_prefix
+    addr := strings.Trim(r.URL.Query().Get("addr"), " \t")
+    bans, err := self.database.GetIPBans()
+    if ! self.sessionIsGlobal(r) {
+      err = errors.New("only global mods can see address bans")
+    }
+    var covering []IPBan
+    if err == nil && len(addr) > 0 {
+      covering, err = self.database.GetIPBansForAddr(addr)
+    }
+    if err == nil {
+      sort.Sort(bansNewestFirst(bans))
+      var addrs, ranges []banInfo
+      for _, ban := range bans {
+        if banIsRange(ban.Addr) {
+          ranges = append(ranges, newBanInfo(ban))
+        } else {
+          addrs = append(addrs, newBanInfo(ban))
+        }
+      }
+      param["bans"] = addrs
+      param["ranges"] = ranges
+      if len(addr) > 0 {
+        var infos []banInfo
+        for _, ban := range covering {
+          infos = append(infos, newBanInfo(ban))
+        }
+        param["addr"] = addr
+        param["covering"] = infos
+      }
+    } else {
+      wr.WriteHeader(403)
+      param["error"] = err.Error()
+    }
+    io.WriteString(wr, template.renderTemplate("bans.mustache", param))
+  }, wr, r)
+}
+
+// ban an address or range given in a form
+// addr is the address or cidr range, expires is how many seconds it lasts
+func (self httpModUI) HandleAddBan(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthed(func(path string) {
+    addr := strings.Trim(r.FormValue("addr"), " \t")
+    reason, scope, expires, err := self.banParams(r, "")
+    if err == nil && ! self.sessionIsGlobal(r) {
+      err = errors.New("only global mods can ban addresses")
+    } else if err == nil && scope != defaultModScope {
+      err = errors.New("address bans from this page are global")
+    }
+    if err == nil && net.ParseIP(addr) == nil {
+      var network *net.IPNet
+      _, network, err = net.ParseCIDR(addr)
+      if err == nil {
+        addr = network.String()
+      } else {
+        err = errors.New("invalid address or range " + addr)
+      }
+    }
+    if err == nil {
+      err = self.database.BanAddr(IPBan{Addr: addr, Made: timeNow(), Expires: expires, Reason: reason, Scope: scope})
+    }
+    if err == nil {
+      self.logModAction(r, "overchan-inet-ban", addr, reason, scope)
+      http.Redirect(wr, r, self.mod_prefix + "bans", 303)
+    } else {
+      wr.WriteHeader(400)
+      io.WriteString(wr, err.Error())
+    }
+  }, wr, r)
+}
+
+// serve a page of the mod log, addresses are decrypted for global mods
+func (self httpModUI) HandleModLog(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthed(func(path string) {
+    req, err := parseModLogRequest(r)
+    var j apiModLog
+    if err == nil {
+      j, err = getModLog(self.database, req, self.sessionIsGlobal(r))
+    }
+    writeModLog(wr, self.prefix, self.mod_prefix + "log", req, j, err)
+  }, wr, r)
+}
+
+// serve a page of the mod log as json, addresses are decrypted for global mods
+func (self httpModUI) HandleModLogJSON(wr http.ResponseWriter, r *http.Request) {
+  self.asAuthed(func(path string) {
+    resp := make(map[string]interface{})
+    req, err := parseModLogRequest(r)
+    var j apiModLog
+    if err == nil {
+      j, err = getModLog(self.database, req, self.sessionIsGlobal(r))
+    }
+    if err == nil {
+      resp["error"] = nil
+      resp["result"] = j
+    } else {
+      resp["error"] = err.Error()
+    }
+    enc := json.NewEncoder(wr)
+    enc.Encode(resp)
+  }, wr, r)
+}
  
 
 func (self httpModUI) HandleLogin(wr http.ResponseWriter, r *http.Request) {
@@ -57,7 +57,13 @@ type PostModel interface {
   Sage() bool
   Pubkey() string
   Reference() string
+  // unix timestamp of when it was posted
+  Posted() int64
+  // hex encoded pubkey of the tripcode, empty if none
+  PubkeyHex() string
   
+  // unrendered message body
+  RawBody() string
   RenderBody() string
   RenderPost() string
 
@@ -94,6 +100,12 @@ type ThreadModel interface {
   // update the thread's replies
   // return the updated model
   Update(db Database) ThreadModel
+  // true if replies no longer bump this thread
+  BumpLimitReached() bool
+  // true if this thread is pinned to the top of its board
+  Sticky() bool
+  // true if this thread takes no new replies
+  Locked() bool
 }
 
 // board interface
@@ -123,6 +135,31 @@ type BoardModel interface {
   Update(db Database) BoardModel
 }
 
+// a thread in a catalog
+type CatalogItemModel interface {
+
+  OP() PostModel
+  // url of the thread's page
+  ThreadURL() string
+  // thumbnail of the root post's first attachment, empty if none
+  Thumbnail() string
+  // start of the root post's message
+  Snippet() string
+  ReplyCount() int
+  ImageCount() int
+}
+
+// every live thread on a board
+type CatalogModel interface {
+
+  BaseModel
+  NavbarModel
+
+  Frontend() string
+  Name() string
+  Threads() []CatalogItemModel
+}
+
 type LinkModel interface {
 
   Text() string
@@ -174,6 +211,10 @@ func (self boardModel) Navbar() string {
       text: fmt.Sprintf("[ %d ]", i),
     })
   }
+  links = append(links, linkModel{
+    link: fmt.Sprintf("%scatalog-%s.html", self.prefix, self.board),
+    text: "[ catalog ]",
+  })
   param["prefix"] = self.prefix
   param["links"] = links
   return template.renderTemplate("navbar.mustache", param)
@@ -331,6 +372,14 @@ func (self post) Pubkey() string {
 }
 
 
+func (self post) PubkeyHex() string {
+  return self.pubkey
+}
+
+func (self post) Posted() int64 {
+  return self.posted
+}
+
 func (self post) Sage() bool {
   return self.sage
 }
@@ -440,6 +489,10 @@ func (self post) Truncate() PostModel {
   return self
 }
 
+func (self post) RawBody() string {
+  return self.message
+}
+
 func (self post) RenderShortBody() string {
   // TODO: hardcoded limit
   return memeposting(self.message)
@@ -457,6 +510,9 @@ type thread struct {
   prefix string
   links []LinkModel
   posts []PostModel
+  bumplimit bool
+  sticky bool
+  locked bool
 }
 
 func (self thread) Prefix() string {
@@ -510,15 +566,34 @@ func (self thread) Truncate() ThreadModel {
       links: self.links,
       posts: append([]PostModel{self.posts[0]}, self.posts[len(self.posts)-trunc:]...),
       prefix: self.prefix,
+      bumplimit: self.bumplimit,
+      sticky: self.sticky,
+      locked: self.locked,
     }
   }
   return self
 }
 
+func (self thread) BumpLimitReached() bool {
+  return self.bumplimit
+}
+
+func (self thread) Sticky() bool {
+  return self.sticky
+}
+
+func (self thread) Locked() bool {
+  return self.locked
+}
+
 // refetch all replies if anything differs
 func (self thread) Update(db Database) ThreadModel {
   root := self.posts[0].MessageID()
   reply_count := db.CountThreadReplies(root)
+  // the board's settings and the thread's state may have changed so always check these
+  self.bumplimit = threadBumpLimitReached(db, self.Board(), reply_count)
+  self.sticky = db.ThreadSticky(root)
+  self.locked = db.ThreadLocked(root)
 
   if int(reply_count) + 1 != len(self.posts) {
 
@@ -526,11 +601,28 @@ func (self thread) Update(db Database) ThreadModel {
       posts: append([]PostModel{self.posts[0]}, db.GetThreadReplyPostModels(self.prefix, root, 0)...),
       links: self.links,
       prefix: self.prefix,
+      bumplimit: self.bumplimit,
+      sticky: self.sticky,
+      locked: self.locked,
     }
   }
   return self
 }
 
+// check if a thread can take another reply under its board's reply limit
+func threadAllowsReply(db Database, newsgroup, root_message_id string) bool {
+  // defaults are given on error
+  settings, _ := db.GetBoardSettings(newsgroup)
+  return settings.ReplyLimit == 0 || settings.AllowsReply(db.CountThreadReplies(root_message_id))
+}
+
+// check if a thread with this many replies has reached its board's bump limit
+func threadBumpLimitReached(db Database, newsgroup string, replies int64) bool {
+  // defaults are given on error
+  settings, _ := db.GetBoardSettings(newsgroup)
+  return settings.BumpLimitReached(replies)
+}
+
 
 type linkModel struct {
   text string
@@ -544,3 +636,98 @@ func (self linkModel) LinkURL() string {
 func (self linkModel) Text() string {
   return self.text
 }
+
+// how long a snippet in the catalog is
+const catalogSnippetLen = 120
+
+type catalogItem struct {
+  thread ThreadModel
+}
+
+// make a catalog entry from a thread with all its replies loaded
+func catalogItemFromThread(th ThreadModel) CatalogItemModel {
+  return catalogItem{th}
+}
+
+func (self catalogItem) OP() PostModel {
+  return self.thread.OP()
+}
+
+func (self catalogItem) ThreadURL() string {
+  return fmt.Sprintf("%sthread-%s.html", self.thread.Prefix(), self.thread.OP().ShortHash())
+}
+
+func (self catalogItem) Thumbnail() string {
+  atts := self.thread.OP().Attachments()
+  if len(atts) > 0 {
+    return atts[0].Thumbnail()
+  }
+  return ""
+}
+
+func (self catalogItem) Snippet() string {
+  msg := []rune(strings.Trim(self.thread.OP().RawBody(), "\n\t "))
+  if len(msg) > catalogSnippetLen {
+    return string(msg[:catalogSnippetLen]) + "..."
+  }
+  return string(msg)
+}
+
+func (self catalogItem) ReplyCount() int {
+  return len(self.thread.Replies())
+}
+
+func (self catalogItem) ImageCount() int {
+  count := len(self.thread.OP().Attachments())
+  for _, p := range self.thread.Replies() {
+    count += len(p.Attachments())
+  }
+  return count
+}
+
+type catalogModel struct {
+  frontend string
+  prefix string
+  board string
+  threads []CatalogItemModel
+}
+
+func (self catalogModel) Prefix() string {
+  return self.prefix
+}
+
+func (self catalogModel) Frontend() string {
+  return self.frontend
+}
+
+func (self catalogModel) Name() string {
+  return self.board
+}
+
+func (self catalogModel) Threads() []CatalogItemModel {
+  return self.threads
+}
+
+func (self catalogModel) Navbar() string {
+  param := make(map[string]interface{})
+  param["name"] = fmt.Sprintf("catalog for %s", self.board)
+  param["frontend"] = self.frontend
+  param["prefix"] = self.prefix
+  param["links"] = []LinkModel{
+    linkModel{
+      link: fmt.Sprintf("%s%s-0.html", self.prefix, self.board),
+      text: self.board,
+    },
+  }
+  return template.renderTemplate("navbar.mustache", param)
+}
+
+func (self catalogModel) RenderTo(wr io.Writer) error {
+  param := make(map[string]interface{})
+  param["prefix"] = self.prefix
+  param["board"] = self.board
+  param["navbar"] = self.Navbar()
+  param["threads"] = self.threads
+  _, err := io.WriteString(wr, template.renderTemplate("catalog.mustache", param))
+  return err
+}
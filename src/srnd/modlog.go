@@ -0,0 +1,182 @@
+//
+// modlog.go
+//
+// browsing the moderation log
+//
+package srnd
+
+import (
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "net/http"
+  "net/url"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// how many mod log entries go on a page
+const modLogPageSize = 50
+
+// a mod log query from a request's query parameters
+// pubkey and action filter the log, page starts at 0
+type modLogRequest struct {
+  pubkey string
+  action string
+  page int
+}
+
+// a mod log entry as json
+type apiModLogEntry struct {
+  Pubkey string `json:"pubkey"`
+  Action string `json:"action"`
+  Target string `json:"target,omitempty"`
+  // decrypted address of a ban, only shown to mods
+  Addr string `json:"addr,omitempty"`
+  Reason string `json:"reason,omitempty"`
+  Scope string `json:"scope,omitempty"`
+  Time int64 `json:"time"`
+  Date string `json:"date"`
+}
+
+// a page of the mod log as json
+type apiModLog struct {
+  Pubkey string `json:"pubkey,omitempty"`
+  Action string `json:"action,omitempty"`
+  Page int `json:"page"`
+  HasMore bool `json:"has_more"`
+  Entries []apiModLogEntry `json:"entries"`
+}
+
+func parseModLogRequest(r *http.Request) (req modLogRequest, err error) {
+  params := r.URL.Query()
+  req.pubkey = strings.Trim(params.Get("pubkey"), " \t")
+  req.action = strings.Trim(params.Get("action"), " \t")
+  if len(req.pubkey) > 255 || len(req.action) > 255 {
+    err = errors.New("filter too long")
+  } else if params.Get("page") != "" {
+    req.page, err = strconv.Atoi(params.Get("page"))
+    if err == nil && req.page < 0 {
+      err = errors.New("invalid page")
+    }
+  }
+  return
+}
+
+// is the target of this action an address
+func modLogTargetIsAddr(action string) bool {
+  return strings.HasPrefix(action, "overchan-inet-")
+}
+
+// get a page of the mod log
+// addresses are decrypted if show_addrs is true and left out otherwise
+func getModLog(db Database, req modLogRequest, show_addrs bool) (j apiModLog, err error) {
+  j = apiModLog{
+    Pubkey: req.pubkey,
+    Action: req.action,
+    Page: req.page,
+    Entries: []apiModLogEntry{},
+  }
+  var logs []ModLogEntry
+  // get 1 extra to see if there is another page
+  logs, err = db.GetModLogs(req.pubkey, req.action, modLogPageSize + 1, req.page * modLogPageSize)
+  if err != nil {
+    log.Println("failed to get mod log", err)
+    return
+  }
+  j.HasMore = len(logs) > modLogPageSize
+  if j.HasMore {
+    logs = logs[:modLogPageSize]
+  }
+  for _, entry := range logs {
+    e := apiModLogEntry{
+      Pubkey: entry.Pubkey,
+      Action: entry.Action,
+      Target: entry.Target,
+      Reason: entry.Reason,
+      Scope: entry.Scope,
+      Time: entry.Time,
+      Date: time.Unix(entry.Time, 0).UTC().Format(time.RFC1123Z),
+    }
+    if modLogTargetIsAddr(entry.Action) {
+      if show_addrs {
+        e.Addr, _ = db.GetIPAddress(entry.Target)
+      } else {
+        e.Target = ""
+      }
+    }
+    j.Entries = append(j.Entries, e)
+  }
+  return
+}
+
+// url for a page of the mod log
+func modLogURL(base string, req modLogRequest, page int) string {
+  params := url.Values{}
+  if len(req.pubkey) > 0 {
+    params.Set("pubkey", req.pubkey)
+  }
+  if len(req.action) > 0 {
+    params.Set("action", req.action)
+  }
+  params.Set("page", fmt.Sprintf("%d", page))
+  return base + "?" + params.Encode()
+}
+
+// write a page of the mod log as html
+// base is the url of the log page
+func writeModLog(wr http.ResponseWriter, prefix, base string, req modLogRequest, j apiModLog, err error) {
+  param := make(map[string]interface{})
+  param["prefix"] = prefix
+  param["log_url"] = base
+  param["pubkey"] = req.pubkey
+  param["action"] = req.action
+  param["page"] = req.page
+  param["entries"] = j.Entries
+  if err != nil {
+    wr.WriteHeader(400)
+    param["error"] = err.Error()
+  }
+  if req.page > 0 {
+    param["prev_url"] = modLogURL(base, req, req.page - 1)
+  }
+  if j.HasMore {
+    param["next_url"] = modLogURL(base, req, req.page + 1)
+  }
+  io.WriteString(wr, template.renderTemplate("modlog.mustache", param))
+}
+
+// GET /modlog
+func (self httpFrontend) handle_modlog(wr http.ResponseWriter, r *http.Request) {
+  if ! self.public_modlog {
+    wr.WriteHeader(404)
+    return
+  }
+  req, err := parseModLogRequest(r)
+  var j apiModLog
+  if err == nil {
+    j, err = getModLog(self.daemon.database, req, false)
+  }
+  writeModLog(wr, self.prefix, self.prefix + "modlog", req, j, err)
+}
+
+// GET /api/modlog
+func (self httpFrontend) handle_api_modlog(wr http.ResponseWriter, r *http.Request) {
+  if ! self.public_modlog {
+    self.writeJSONError(wr, http.StatusNotFound, "mod log is not public")
+    return
+  }
+  req, err := parseModLogRequest(r)
+  if err != nil {
+    self.writeJSONError(wr, http.StatusBadRequest, err.Error())
+    return
+  }
+  j, err := getModLog(self.daemon.database, req, false)
+  if err != nil {
+    self.writeJSONError(wr, http.StatusInternalServerError, "cannot get mod log")
+    return
+  }
+  self.writeJSON(wr, http.StatusOK, j)
+}
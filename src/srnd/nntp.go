@@ -8,13 +8,15 @@ import (
   "fmt"
   "io"
   "io/ioutil"
+  "crypto/tls"
+  "errors"
   "log"
+  "net"
   "net/textproto"
   "os"
   "strconv"
   "strings"
   "sync"
-  "time"
 )
 
 
@@ -40,6 +42,8 @@ func nntpCHECK(msgid string) nntpStreamEvent {
 type nntpConnection struct {
   // the name of this feed
   name string
+  // the name of the feed in feeds.ini for outbound connections
+  feed string
   // the mode we are in now
   mode string
   // what newsgroup is currently selected or empty string if none is selected
@@ -48,6 +52,12 @@ type nntpConnection struct {
   policy FeedPolicy
   // lock help when expecting non pipelined activity
   access sync.Mutex
+  // authentication state for inbound connections
+  auth nntpAuthState
+  // the underlying socket for inbound connections, used for STARTTLS
+  sock net.Conn
+  // true if we are using tls
+  tls bool
   
   // ARTICLE <message-id>
   article chan string
@@ -70,6 +80,7 @@ func writeMIMEHeader(wr io.Writer, hdr textproto.MIMEHeader) (err error) {
 
 func createNNTPConnection() nntpConnection {
   return nntpConnection{
+    auth: createNNTPAuthState(false),
     article: make(chan string, 32),
     stream: make(chan nntpStreamEvent, 64),
   }
@@ -109,16 +120,34 @@ func (self *nntpConnection) inboundHandshake(conn *textproto.Conn) (err error) {
   return err
 }
 
-// outbound setup, check capabilities and set mode
-// returns (supports stream, supports reader) + error
-func (self *nntpConnection) outboundHandshake(conn *textproto.Conn) (stream, reader bool, err error) {
+// outbound setup, do STARTTLS and log in if the feed wants it, check capabilities and set mode
+// returns the connection to use from now on, (supports stream, supports reader) + error
+func (self *nntpConnection) outboundHandshake(daemon NNTPDaemon, sock net.Conn, conf FeedConfig) (conn *textproto.Conn, stream, reader bool, err error) {
   log.Println(self.name, "outbound handshake")
+  conn = textproto.NewConn(sock)
   var code int
   var line string
   for err == nil {
     code, line, err = conn.ReadCodeLine(-1)
     log.Println(self.name, line)
     if err == nil {
+      if (code == 200 || code == 201) && conf.tls_mode == "starttls" {
+        conn, err = self.startTLS(daemon, conn, sock, conf)
+        if err != nil {
+          log.Println(self.name, "STARTTLS failed", err)
+          return
+        }
+      }
+      if (code == 200 || code == 201) && conf.username != "" {
+        // log in before asking for capabilities, they can change after auth
+        log.Println(self.name, "logging in as", conf.username)
+        err = nntpLogin(conn, conf.username, conf.password)
+        if err != nil {
+          log.Println(self.name, "failed to log in", err)
+          return
+        }
+        code = 200
+      }
       if code == 200 {
         // send capabilities
         log.Println(self.name, "ask for capabilities")
@@ -157,8 +186,7 @@ func (self *nntpConnection) outboundHandshake(conn *textproto.Conn) (stream, rea
           return
         }
       } else if code == 201 {
-        log.Println("feed", self.name,"does not allow posting")
-        // we don't do auth yet
+        log.Println("feed", self.name,"does not allow posting, set username and password for it in feeds.ini")
         break
       } else {
         continue
@@ -168,6 +196,33 @@ func (self *nntpConnection) outboundHandshake(conn *textproto.Conn) (stream, rea
   return
 }
 
+// upgrade an outbound connection with STARTTLS
+// if they don't support it we go on in plaintext unless the feed requires tls
+func (self *nntpConnection) startTLS(daemon NNTPDaemon, conn *textproto.Conn, sock net.Conn, conf FeedConfig) (c *textproto.Conn, err error) {
+  c = conn
+  err = conn.PrintfLine("STARTTLS")
+  if err == nil {
+    var code int
+    var line string
+    code, line, err = conn.ReadCodeLine(-1)
+    if code == 382 {
+      var tls_conn *tls.Conn
+      tls_conn, err = daemon.clientTLS(sock, conf)
+      if err == nil {
+        log.Println(self.name, "tls enabled")
+        self.tls = true
+        c = textproto.NewConn(tls_conn)
+      }
+    } else if err == nil {
+      log.Println(self.name, "does not do STARTTLS:", code, line)
+      if conf.tls_required {
+        err = errors.New("feed requires tls but STARTTLS was refused")
+      }
+    }
+  }
+  return
+}
+
 // handle streaming event
 // this function should send only
 func (self *nntpConnection) handleStreaming(daemon NNTPDaemon, reader bool, conn *textproto.Conn) (err error) {
@@ -190,6 +245,7 @@ func (self *nntpConnection) handleStreaming(daemon NNTPDaemon, reader bool, conn
           }
         } else {
           log.Println(self.name, "didn't send", msgid, "we don't have it locally")
+          self.recordOutcome(daemon, msgid, 430)
         }
       } else if cmd == "CHECK" {
         conn.PrintfLine("%s", ev)
@@ -242,12 +298,22 @@ func (self *nntpConnection) checkMIMEHeader(daemon NNTPDaemon, hdr textproto.MIM
     // we have already seen this article
     reason = "already seen"
     return
+  } else if reference != "" && ! threadAllowsReply(daemon.database, newsgroup, reference) {
+    // the thread hit its board's reply limit
+    reason = "thread is full"
+    return
+  } else if reference != "" && daemon.database.ThreadLocked(reference) {
+    // a moderator locked the thread
+    reason = "thread locked"
+    return
   } else if is_ctl {
     // we always allow control messages
     return 
   } else if anon_poster {
     // this was posted anonymously
-    if daemon.allow_anon {
+    // both we and the board must allow it
+    settings, _ := daemon.database.GetBoardSettings(newsgroup)
+    if daemon.allow_anon && settings.AllowAnon {
       if has_attachment || is_signed {
         // this is a signed message or has attachment
         if daemon.allow_anon_attachments {
@@ -271,7 +337,8 @@ func (self *nntpConnection) checkMIMEHeader(daemon NNTPDaemon, hdr textproto.MIM
     // check for banned address
     var banned bool
     if encaddr != "" {
-      banned, err = daemon.database.CheckEncIPBanned(encaddr)
+      // bans only apply to the newsgroups in their scope
+      _, banned, err = findEncIPBan(daemon.database, encaddr, newsgroup)
       if err == nil {
         if banned {
           // this address is banned
@@ -306,25 +373,40 @@ func (self *nntpConnection) handleLine(daemon NNTPDaemon, code int, line string,
   } else if code == 239 {
     // successful TAKETHIS
     log.Println(msgid, "sent via", self.name)
+    self.recordOutcome(daemon, msgid, code)
     return
-    // TODO: remember success 
   } else if code == 431 {
     // CHECK said we would like this article later
+    // it stays queued and is offered again after backing off
     log.Println("defer sending", msgid, "to", self.name)
-    go self.articleDefer(msgid)
+    self.recordOutcome(daemon, msgid, code)
   } else if code == 439 {
     // TAKETHIS failed
     log.Println(msgid, "was not sent to", self.name, "denied:", line)
-    // TODO: remember denial
+    self.recordOutcome(daemon, msgid, code)
   } else if code == 438 {
     // they don't want the article
-    // TODO: remeber rejection
+    self.recordOutcome(daemon, msgid, code)
   } else {
     // handle command
     parts := strings.Split(line, " ")
     if len(parts) > 1 {
       cmd := parts[0]
-      if cmd == "MODE" {
+      if cmd == "AUTHINFO" {
+        err = self.auth.handleAuthInfo(daemon.credentials, line, &conn.Reader, &conn.Writer)
+      } else if self.needsAuth(cmd, parts[1]) {
+        log.Println(self.name, "denied", cmd, "for user", self.auth.username)
+        if cmd == "TAKETHIS" {
+          // they send the article anyways, discard it
+          _, err = conn.ReadMIMEHeader()
+          if err == nil {
+            _, err = io.Copy(ioutil.Discard, conn.DotReader())
+          }
+          conn.PrintfLine("%s %s", self.auth.Denied(), msgid)
+        } else {
+          conn.PrintfLine("%s", self.auth.Denied())
+        }
+      } else if cmd == "MODE" {
         if parts[1] == "READER" {
           // reader mode
           self.mode = "READER"
@@ -561,13 +643,21 @@ func (self *nntpConnection) handleLine(daemon NNTPDaemon, code int, line string,
           conn.PrintfLine("412 No newsgroup selected")
         } else {
           // handle xover command
-          // right now it's every article in group
-          models, err := daemon.database.GetPostsInGroup(self.group)
+          // every article in the group in the given range
+          first, last, err := parseArticleRange(parts[1])
+          if first == 0 && last == 0 {
+            // old peers send XOVER 0 for everything
+            last = -1
+          }
+          var models []NumberedPost
+          if err == nil {
+            models, err = daemon.database.GetPostsInGroupRange(self.group, first, last)
+          }
           if err == nil {
             conn.PrintfLine("224 Overview information follows")
             dw := conn.DotWriter()
-            for idx, model := range models {
-              io.WriteString(dw, fmt.Sprintf("%.6d\t%s\t\"%s\" <%s@%s>\t%s\t%s\t%s\r\n", idx+1, model.Subject(), model.Name(), model.Name(), model.Frontend(), model.Date(), model.MessageID(), model.Reference()))
+            for _, model := range models {
+              io.WriteString(dw, fmt.Sprintf("%.6d\t%s\t\"%s\" <%s@%s>\t%s\t%s\t%s\r\n", model.Number, model.Subject(), model.Name(), model.Name(), model.Frontend(), model.Date(), model.MessageID(), model.Reference()))
             }
             dw.Close()
           } else {
@@ -585,7 +675,7 @@ func (self *nntpConnection) handleLine(daemon NNTPDaemon, code int, line string,
           // count posts
           number := daemon.database.CountPostsInGroup(group, 0)
           // get hi/low water marks
-          low, hi, err := daemon.database.GetLastAndFirstForGroup(group)
+          hi, low, err := daemon.database.GetLastAndFirstForGroup(group)
           if err == nil {
             // we gud
             conn.PrintfLine("211 %d %d %d %s", number, low, hi, group)
@@ -608,6 +698,34 @@ func (self *nntpConnection) handleLine(daemon NNTPDaemon, code int, line string,
   return
 }
 
+// set up state after an inbound connection did its tls handshake
+// a peer that presents a client certificate pinned by one of our feeds is trusted as that feed
+func (self *nntpConnection) inboundTLS(daemon NNTPDaemon, tls_conn *tls.Conn) {
+  self.tls = true
+  self.auth = createNNTPAuthState(daemon.require_auth)
+  feed := daemon.feedForCert(tls_conn.ConnectionState())
+  if feed != "" {
+    log.Println(self.name, "presented the pinned certificate for feed", feed)
+    self.name = feed + "-inbound-feed"
+    self.auth.username = feed
+    self.auth.authenticated = true
+    self.auth.perms = nntpPermissions{stream: true, reader: true}
+  }
+}
+
+// return true if the remote end is not allowed to run this command
+func (self *nntpConnection) needsAuth(cmd, arg string) bool {
+  perms := self.auth.perms
+  if cmd == "CHECK" || cmd == "TAKETHIS" || cmd == "IHAVE" || (cmd == "MODE" && arg == "STREAM") {
+    return ! perms.stream
+  } else if cmd == "ARTICLE" || cmd == "NEWSGROUPS" || cmd == "XOVER" || cmd == "GROUP" || (cmd == "MODE" && arg == "READER") {
+    return ! perms.reader
+  } else if cmd == "POST" {
+    return ! perms.post
+  }
+  return false
+}
+
 func (self *nntpConnection) startStreaming(daemon NNTPDaemon, reader bool, conn *textproto.Conn) {
   var err error
   for err == nil {
@@ -616,7 +734,7 @@ func (self *nntpConnection) startStreaming(daemon NNTPDaemon, reader bool, conn
   log.Println(self.name, "error while streaming:", err)
 }
 
-// scrape all posts in a newsgroup
+// scrape posts in a newsgroup newer than what we got last sync
 // download ones we do not have
 func (self *nntpConnection) scrapeGroup(daemon NNTPDaemon, conn *textproto.Conn, group string) (err error) {
   log.Println(self.name, "scrape newsgroup", group)
@@ -625,12 +743,32 @@ func (self *nntpConnection) scrapeGroup(daemon NNTPDaemon, conn *textproto.Conn,
   if err == nil {
     // read reply to GROUP command
     code := 0
-    code, _, err = conn.ReadCodeLine(211)
+    var line string
+    code, line, err = conn.ReadCodeLine(211)
     // check code
     if code == 211 {
       // success
-      // send XOVER command, dummy parameter for now
-      err = conn.PrintfLine("XOVER 0")
+      // where did we stop last time?
+      var mark int64
+      mark, err = daemon.database.GetFeedHighWaterMark(self.feed, group)
+      if err != nil {
+        log.Println(self.name, "failed to get high water mark for", group, err)
+        return
+      }
+      count, low, high := parseGroupReply(line)
+      if high < mark {
+        // their numbers went backwards, the ones we have are meaningless now
+        log.Println(self.name, "renumbered", group, "rescanning from", low)
+        mark = 0
+      }
+      if count == 0 || high == mark {
+        log.Println(self.name, "nothing new in", group)
+        return
+      }
+      // the highest article number we saw
+      newmark := mark
+      // send XOVER command for everything after our mark
+      err = conn.PrintfLine("XOVER %d-", mark + 1)
       if err == nil {
         // no error sending command, read first line
         code, _, err = conn.ReadCodeLine(224)
@@ -648,6 +786,10 @@ func (self *nntpConnection) scrapeGroup(daemon NNTPDaemon, conn *textproto.Conn,
               msgid := parts[4]
               // msgid -> reference
               articles[msgid] = parts[5]
+              num, e := strconv.ParseInt(parts[0], 10, 64)
+              if e == nil && num > newmark {
+                newmark = num
+              }
             } else {
               // probably not valid line
               // ignore
@@ -693,6 +835,17 @@ func (self *nntpConnection) scrapeGroup(daemon NNTPDaemon, conn *textproto.Conn,
                 }
               }
             }
+            // we got everything, remember where we stopped
+            // skip past the end even if the last few were deleted
+            if high > newmark {
+              newmark = high
+            }
+            if newmark > mark {
+              err = daemon.database.SetFeedHighWaterMark(self.feed, group, newmark)
+              if err != nil {
+                log.Println(self.name, "failed to set high water mark for", group, err)
+              }
+            }
           } else {
             // something bad went down when reading multiline
             log.Println(self.name, "failed to read multiline for", group, "XOVER command")
@@ -884,12 +1037,40 @@ func (self *nntpConnection) runConnection(daemon NNTPDaemon, inbound, stream, re
           conn.PrintfLine("101 i support to the following:")
           dw := conn.DotWriter()
           caps := []string{"VERSION 2", "READER", "STREAMING", "IMPLEMENTATION srndv2"}
+          if daemon.tls_config != nil && ! self.tls && ! self.auth.authenticated {
+            caps = append(caps, "STARTTLS")
+          }
+          if daemon.require_auth {
+            caps = append(caps, self.auth.Capabilities()...)
+          }
           for _, cap := range caps {
             io.WriteString(dw, cap)
             io.WriteString(dw, "\n")
           }
           dw.Close()
           log.Println(self.name, "sent Capabilities")
+        } else if cmd == "STARTTLS" {
+          if daemon.tls_config == nil || self.sock == nil {
+            conn.PrintfLine("580 Can not initiate TLS negotiation")
+          } else if self.tls || self.auth.authenticated {
+            conn.PrintfLine("502 Command unavailable")
+          } else {
+            conn.PrintfLine("382 Continue with TLS negotiation")
+            tls_conn := tls.Server(self.sock, daemon.tls_config)
+            err = tls_conn.Handshake()
+            if err != nil {
+              log.Println(self.name, "tls handshake failed", err)
+              conn.Close()
+              return
+            }
+            // all state from before tls is discarded
+            conn = textproto.NewConn(tls_conn)
+            self.sock = tls_conn
+            self.inboundTLS(daemon, tls_conn)
+          }
+        } else if cmd == "MODE" && len(parts) == 2 && self.needsAuth(cmd, parts[1]) {
+          log.Println(self.name, "denied MODE", parts[1], "for user", self.auth.username)
+          conn.PrintfLine("%s", self.auth.Denied())
         } else if cmd == "MODE" {
           if len(parts) == 2 {
             if parts[1] == "READER" {
@@ -969,7 +1150,12 @@ func (self *nntpConnection) runConnection(daemon NNTPDaemon, inbound, stream, re
   conn.Close()
 }
 
-func (self *nntpConnection) articleDefer(msgid string) {
-  time.Sleep(time.Second * 90)
-  self.stream <- nntpCHECK(msgid)
+// record what happened to an article queued for our feed
+func (self *nntpConnection) recordOutcome(daemon NNTPDaemon, msgid string, code int) {
+  if self.feed != "" && ValidMessageID(msgid) {
+    err := daemon.database.RecordArticleOutcome(self.feed, msgid, code)
+    if err != nil {
+      log.Println(self.name, "failed to record outcome for", msgid, err)
+    }
+  }
 }
@@ -19,9 +19,14 @@ import (
   "log"
   "os"
   "strconv"
+  "strings"
   _ "github.com/lib/pq"
 )
 
+// text search vector for a post, SearchPosts must use the same expression so it uses the index
+// words are runs of letters and numbers like searchWords
+const postgresSearchVector = "to_tsvector('simple', regexp_replace(COALESCE(subject, '') || ' ' || COALESCE(name, '') || ' ' || COALESCE(message, ''), '[^[:alnum:]]+', ' ', 'g'))"
+
 type PostgresDatabase struct {
   conn *sql.DB
   db_str string
@@ -71,7 +76,62 @@ func (self PostgresDatabase) CreateTables() {
   } else if version == 0 {
     // upgrade to version 1
     self.upgrade0to1()
-  } else if version == 1 {
+  }
+  version = self.getDBVersion()
+  if version == 1 {
+    // upgrade to version 2
+    self.upgrade1to2()
+  }
+  version = self.getDBVersion()
+  if version == 2 {
+    // upgrade to version 3
+    self.upgrade2to3()
+  }
+  version = self.getDBVersion()
+  if version == 3 {
+    // upgrade to version 4
+    self.upgrade3to4()
+  }
+  version = self.getDBVersion()
+  if version == 4 {
+    // upgrade to version 5
+    self.upgrade4to5()
+  }
+  version = self.getDBVersion()
+  if version == 5 {
+    // upgrade to version 6
+    self.upgrade5to6()
+  }
+  version = self.getDBVersion()
+  if version == 6 {
+    // upgrade to version 7
+    self.upgrade6to7()
+  }
+  version = self.getDBVersion()
+  if version == 7 {
+    // upgrade to version 8
+    self.upgrade7to8()
+  }
+  version = self.getDBVersion()
+  if version == 8 {
+    // upgrade to version 9
+    self.upgrade8to9()
+  }
+  version = self.getDBVersion()
+  if version == 9 {
+    // upgrade to version 10
+    self.upgrade9to10()
+  }
+  version = self.getDBVersion()
+  if version == 10 {
+    // upgrade to version 11
+    self.upgrade10to11()
+  }
+  version = self.getDBVersion()
+  if version == 11 {
+    // upgrade to version 12
+    self.upgrade11to12()
+  } else if version == 12 {
     // we are up to date
     log.Println("we are up to date at version", version)
   }
@@ -120,6 +180,244 @@ func (self PostgresDatabase) upgrade0to1() {
 }
 
 
+// version 2 adds the outbound feed queue
+func (self PostgresDatabase) upgrade1to2() {
+
+  log.Println("migrating... 1 -> 2")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS ArticleFeedQueue(
+       feed VARCHAR(255) NOT NULL,
+       message_id VARCHAR(255) NOT NULL,
+       queued INTEGER NOT NULL,
+       next_attempt INTEGER NOT NULL,
+       attempts INTEGER NOT NULL DEFAULT 0,
+       outcome INTEGER NOT NULL DEFAULT 0,
+       pending BOOLEAN NOT NULL DEFAULT TRUE,
+       PRIMARY KEY(feed, message_id)
+     )`,
+    "CREATE INDEX ON ArticleFeedQueue(feed, pending, next_attempt)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(2)
+}
+
+// version 3 adds high water marks for syncing from feeds
+func (self PostgresDatabase) upgrade2to3() {
+
+  log.Println("migrating... 2 -> 3")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS FeedHighWaterMarks(
+       feed VARCHAR(255) NOT NULL,
+       newsgroup VARCHAR(255) NOT NULL,
+       mark INTEGER NOT NULL,
+       updated INTEGER NOT NULL,
+       PRIMARY KEY(feed, newsgroup)
+     )`,
+    "CREATE INDEX ON FeedHighWaterMarks(feed)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(3)
+}
+
+func (self PostgresDatabase) upgrade3to4() {
+
+  log.Println("migrating... 3 -> 4")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS APITokens(
+       name VARCHAR(255) PRIMARY KEY,
+       token_hash VARCHAR(64) NOT NULL UNIQUE,
+       scope TEXT NOT NULL,
+       rate_limit INTEGER NOT NULL,
+       issued INTEGER NOT NULL
+     )`,
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(4)
+}
+
+func (self PostgresDatabase) upgrade4to5() {
+
+  log.Println("migrating... 4 -> 5")
+
+  var err error
+
+  cmds := []string{
+    "CREATE INDEX IF NOT EXISTS articleposts_search ON ArticlePosts USING GIN(" + postgresSearchVector + ")",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(5)
+}
+
+func (self PostgresDatabase) upgrade5to6() {
+
+  log.Println("migrating... 5 -> 6")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS BoardSettings(
+       newsgroup VARCHAR(255) PRIMARY KEY,
+       threads_per_page INTEGER NOT NULL,
+       pages INTEGER NOT NULL,
+       bump_limit INTEGER NOT NULL,
+       reply_limit INTEGER NOT NULL,
+       max_attachment_size BIGINT NOT NULL,
+       mime_types TEXT NOT NULL,
+       allow_anon BOOLEAN NOT NULL
+     )`,
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(6)
+}
+
+func (self PostgresDatabase) upgrade6to7() {
+
+  log.Println("migrating... 6 -> 7")
+
+  var err error
+
+  cmds := []string{
+    "ALTER TABLE ArticleThreads ADD COLUMN IF NOT EXISTS sticky BOOLEAN NOT NULL DEFAULT FALSE",
+    "ALTER TABLE ArticleThreads ADD COLUMN IF NOT EXISTS locked BOOLEAN NOT NULL DEFAULT FALSE",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(7)
+}
+
+func (self PostgresDatabase) upgrade7to8() {
+
+  log.Println("migrating... 7 -> 8")
+
+  var err error
+
+  cmds := []string{
+    "ALTER TABLE ModLogs ADD COLUMN IF NOT EXISTS reason TEXT",
+    "ALTER TABLE ModLogs ADD COLUMN IF NOT EXISTS scope VARCHAR(255)",
+    "CREATE INDEX IF NOT EXISTS modlogs_time ON ModLogs(time)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(8)
+}
+
+func (self PostgresDatabase) upgrade8to9() {
+
+  log.Println("migrating... 8 -> 9")
+
+  var err error
+
+  cmds := []string{
+    "ALTER TABLE IPBans ADD COLUMN IF NOT EXISTS reason TEXT",
+    "ALTER TABLE IPBans ADD COLUMN IF NOT EXISTS scope VARCHAR(255)",
+    "ALTER TABLE EncIPBans ADD COLUMN IF NOT EXISTS reason TEXT",
+    "ALTER TABLE EncIPBans ADD COLUMN IF NOT EXISTS scope VARCHAR(255)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(9)
+}
+
+// finished articles are deleted from the feed queue instead of kept
+func (self PostgresDatabase) upgrade9to10() {
+
+  log.Println("migrating... 9 -> 10")
+
+  var err error
+
+  cmds := []string{
+    "DELETE FROM ArticleFeedQueue WHERE NOT pending",
+    "CREATE INDEX IF NOT EXISTS articlefeedqueue_message_id ON ArticleFeedQueue(message_id)",
+    "CREATE INDEX IF NOT EXISTS articlefeedqueue_queued ON ArticleFeedQueue(queued)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(10)
+}
+
+// articles get a stable number in their newsgroup when registered
+// number what we have oldest first
+func (self PostgresDatabase) upgrade10to11() {
+
+  log.Println("migrating... 10 -> 11")
+
+  var err error
+
+  cmds := []string{
+    "ALTER TABLE Newsgroups ADD COLUMN IF NOT EXISTS last_nntp_id INTEGER NOT NULL DEFAULT 0",
+    "ALTER TABLE ArticlePosts ADD COLUMN IF NOT EXISTS nntp_id INTEGER NOT NULL DEFAULT 0",
+    "UPDATE ArticlePosts p SET nntp_id = n.nntp_id FROM ( SELECT message_id, ROW_NUMBER() OVER ( PARTITION BY newsgroup ORDER BY time_posted, message_id ) AS nntp_id FROM ArticlePosts ) n WHERE p.message_id = n.message_id",
+    "UPDATE Newsgroups SET last_nntp_id = ( SELECT COALESCE(MAX(nntp_id), 0) FROM ArticlePosts WHERE newsgroup = Newsgroups.name )",
+    "CREATE INDEX IF NOT EXISTS articleposts_nntp_id ON ArticlePosts(newsgroup, nntp_id)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(11)
+}
+
+// search matches whole words the same way as the other backends
+func (self PostgresDatabase) upgrade11to12() {
+
+  log.Println("migrating... 11 -> 12")
+
+  var err error
+
+  cmds := []string{
+    "DROP INDEX IF EXISTS articleposts_search",
+    "CREATE INDEX articleposts_search ON ArticlePosts USING GIN(" + postgresSearchVector + ")",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(12)
+}
+
 // create all tables for database version 0
 func (self PostgresDatabase) createTablesV0() {
   tables := make(map[string]string)
@@ -345,7 +643,7 @@ func (self PostgresDatabase) GetGroupForMessage(message_id string) (group string
 func(self PostgresDatabase) GetPageForRootMessage(root_message_id string) (group string, page int64, err error) {
   err = self.conn.QueryRow("SELECT newsgroup FROM ArticleThreads WHERE root_message_id = $1", root_message_id).Scan(&group)
   if err == nil {
-    perpage, _ := self.GetPagesPerBoard(group)
+    perpage, _ := self.GetThreadsPerPage(group)
     err = self.conn.QueryRow("WITH thread(bump) AS (SELECT last_bump FROM ArticleThreads WHERE root_message_id = $1 ) SELECT COUNT(*) FROM ( SELECT last_bump FROM ArticleThreads INNER JOIN thread ON (thread.bump <= ArticleThreads.last_bump AND newsgroup = $2 ) ) AS amount", root_message_id, group).Scan(&page)
     return group, page / int64(perpage), err
   }
@@ -358,7 +656,7 @@ func (self PostgresDatabase) GetInfoForMessage(msgid string) (root string, newsg
     if root == "" {
       root = msgid
     }
-    perpage, _ := self.GetPagesPerBoard(newsgroup)
+    perpage, _ := self.GetThreadsPerPage(newsgroup)
     err = self.conn.QueryRow("WITH thread(bump) AS (SELECT last_bump FROM ArticleThreads WHERE root_message_id = $1 ) SELECT COUNT(*) FROM ( SELECT last_bump FROM ArticleThreads INNER JOIN thread ON (thread.bump <= ArticleThreads.last_bump AND newsgroup = $2 ) ) AS amount", root, newsgroup).Scan(&page)
     page = page / int64(perpage)
   }
@@ -441,7 +739,7 @@ func (self PostgresDatabase) GetEncKey(encAddr string) (enckey string, err error
 
 func (self PostgresDatabase) CheckIPBanned(addr string) (banned bool, err error) {
   var amount int64
-  err = self.conn.QueryRow("SELECT COUNT(*) FROM IPBans WHERE addr >>= $1 ", addr).Scan(&amount)
+  err = self.conn.QueryRow("SELECT COUNT(*) FROM IPBans WHERE addr >>= $1 AND ( expires < 0 OR expires > $2 )", addr, timeNow()).Scan(&amount)
   banned = amount > 0
   return 
 }
@@ -482,7 +780,7 @@ func (self PostgresDatabase) CountThreadReplies(root_message_id string) (repls i
 
 func (self PostgresDatabase) GetRootPostsForExpiration(newsgroup string, threadcount int) (roots []string) {
   
-  rows, err := self.conn.Query("SELECT root_message_id FROM ArticleThreads WHERE newsgroup = $1 AND root_message_id NOT IN ( SELECT root_message_id FROM ArticleThreads WHERE newsgroup = $1 ORDER BY last_bump DESC LIMIT $2)", newsgroup, threadcount)
+  rows, err := self.conn.Query("SELECT root_message_id FROM ArticleThreads WHERE newsgroup = $1 AND NOT sticky AND root_message_id NOT IN ( SELECT root_message_id FROM ArticleThreads WHERE newsgroup = $1 ORDER BY sticky DESC, last_bump DESC LIMIT $2)", newsgroup, threadcount)
   if err == nil {
     // get results
     for rows.Next() {
@@ -520,7 +818,8 @@ func (self PostgresDatabase) GetGroupPageCount(newsgroup string) int64 {
     log.Println("failed to count pages in group", newsgroup, err)
   }
   // divide by threads per page
-  return ( count / 10 ) + 1
+  perpage, _ := self.GetThreadsPerPage(newsgroup)
+  return ( count / int64(perpage) ) + 1
 }
 
 // only fetches root posts
@@ -528,7 +827,7 @@ func (self PostgresDatabase) GetGroupPageCount(newsgroup string) int64 {
 func (self PostgresDatabase) GetGroupForPage(prefix, frontend, newsgroup string, pageno, perpage int) BoardModel {
   var threads []ThreadModel
   pages := self.GetGroupPageCount(newsgroup)
-  rows, err := self.conn.Query("WITH roots(root_message_id, last_bump) AS ( SELECT root_message_id, last_bump FROM ArticleThreads WHERE newsgroup = $1 ORDER BY last_bump DESC OFFSET $2 LIMIT $3 ) SELECT p.newsgroup, p.message_id, p.name, p.subject, p.path, p.time_posted, p.message FROM ArticlePosts p INNER JOIN roots ON ( roots.root_message_id = p.message_id ) ORDER BY roots.last_bump DESC", newsgroup, pageno * perpage, perpage)
+  rows, err := self.conn.Query("WITH roots(root_message_id, last_bump, sticky) AS ( SELECT root_message_id, last_bump, sticky FROM ArticleThreads WHERE newsgroup = $1 ORDER BY sticky DESC, last_bump DESC OFFSET $2 LIMIT $3 ) SELECT p.newsgroup, p.message_id, p.name, p.subject, p.path, p.time_posted, p.message FROM ArticlePosts p INNER JOIN roots ON ( roots.root_message_id = p.message_id ) ORDER BY roots.sticky DESC, roots.last_bump DESC", newsgroup, pageno * perpage, perpage)
   if err == nil {
     for rows.Next() {
 
@@ -606,6 +905,26 @@ func (self PostgresDatabase) GetPostModel(prefix, messageID string) PostModel {
   }
 }
 
+func (self PostgresDatabase) SetThreadSticky(root_message_id string, sticky bool) (err error) {
+  _, err = self.conn.Exec("UPDATE ArticleThreads SET sticky = $2 WHERE root_message_id = $1", root_message_id, sticky)
+  return
+}
+
+func (self PostgresDatabase) SetThreadLocked(root_message_id string, locked bool) (err error) {
+  _, err = self.conn.Exec("UPDATE ArticleThreads SET locked = $2 WHERE root_message_id = $1", root_message_id, locked)
+  return
+}
+
+func (self PostgresDatabase) ThreadSticky(root_message_id string) (sticky bool) {
+  _ = self.conn.QueryRow("SELECT sticky FROM ArticleThreads WHERE root_message_id = $1", root_message_id).Scan(&sticky)
+  return
+}
+
+func (self PostgresDatabase) ThreadLocked(root_message_id string) (locked bool) {
+  _ = self.conn.QueryRow("SELECT locked FROM ArticleThreads WHERE root_message_id = $1", root_message_id).Scan(&locked)
+  return
+}
+
 func (self PostgresDatabase) DeleteThread(msgid string) (err error) {
   _, err = self.conn.Exec("DELETE FROM ArticleThreads WHERE root_message_id = $1", msgid)
   return
@@ -615,6 +934,7 @@ func (self PostgresDatabase) DeleteArticle(msgid string) (err error) {
   _, err = self.conn.Exec("DELETE FROM ArticlePosts WHERE message_id = $1", msgid)
   _, err = self.conn.Exec("DELETE FROM ArticleKeys WHERE message_id = $1", msgid)
   _, err = self.conn.Exec("DELETE FROM ArticleAttachments WHERE message_id = $1", msgid)  
+  _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE message_id = $1", msgid)
   return
 }
 
@@ -834,14 +1154,15 @@ func (self PostgresDatabase) RegisterArticle(message NNTPMessage) {
     log.Println("failed to insert article metadata", err)
     return
   }
-  // update newsgroup
-  _, err = self.conn.Exec("UPDATE Newsgroups SET last_post = $1 WHERE name = $2", now, group)
+  // update newsgroup and take the next nntp id in it
+  var nntp_id int64
+  err = self.conn.QueryRow("UPDATE Newsgroups SET last_post = $1, last_nntp_id = last_nntp_id + 1 WHERE name = $2 RETURNING last_nntp_id", now, group).Scan(&nntp_id)
   if err != nil {
     log.Println("failed to update newsgroup last post", err)
     return
   }
   // insert article post
-  _, err = self.conn.Exec("INSERT INTO ArticlePosts(newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)", group, msgid, message.Reference(), message.Name(), message.Subject(), message.Path(), message.Posted(), message.Message(), message.Addr())
+  _, err = self.conn.Exec("INSERT INTO ArticlePosts(newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)", group, msgid, message.Reference(), message.Name(), message.Subject(), message.Path(), message.Posted(), message.Message(), message.Addr(), nntp_id)
   if err != nil {
     log.Println("cannot insert article post", err)
     return
@@ -859,7 +1180,9 @@ func (self PostgresDatabase) RegisterArticle(message NNTPMessage) {
     }
   } else {
     ref := message.Reference()
-    if ! message.Sage() {
+    // replies past the bump limit don't bump
+    settings, _ := self.GetBoardSettings(group)
+    if ! message.Sage() && settings.ReplyBumps(self.CountThreadReplies(ref)) {
       // bump it nigguh
       _, err = self.conn.Exec("UPDATE ArticleThreads SET last_bump = $2 WHERE root_message_id = $1", ref, message.Posted())
       if err != nil {
@@ -930,13 +1253,33 @@ func (self PostgresDatabase) GetAllArticles() (articles []ArticleEntry) {
 
 
 func (self PostgresDatabase) GetPagesPerBoard(group string) (int, error) {
-  //XXX: hardcoded
-  return 10, nil
+  settings, err := self.GetBoardSettings(group)
+  return settings.Pages, err
 }
 
 func (self PostgresDatabase) GetThreadsPerPage(group string) (int, error) {
-  //XXX: hardcoded
-  return 10, nil
+  settings, err := self.GetBoardSettings(group)
+  return settings.ThreadsPerPage, err
+}
+
+func (self PostgresDatabase) GetBoardSettings(group string) (settings BoardSettings, err error) {
+  err = self.conn.QueryRow("SELECT threads_per_page, pages, bump_limit, reply_limit, max_attachment_size, mime_types, allow_anon FROM BoardSettings WHERE newsgroup = $1", group).Scan(&settings.ThreadsPerPage, &settings.Pages, &settings.BumpLimit, &settings.ReplyLimit, &settings.MaxAttachmentSize, &settings.MimeTypes, &settings.AllowAnon)
+  if err != nil {
+    if err != sql.ErrNoRows {
+      log.Println("failed to get settings for", group, err)
+    }
+    // fall back to defaults so callers can ignore the error
+    settings = DefaultBoardSettings()
+    if err == sql.ErrNoRows {
+      err = nil
+    }
+  }
+  return
+}
+
+func (self PostgresDatabase) SetBoardSettings(group string, settings BoardSettings) (err error) {
+  _, err = self.conn.Exec("INSERT INTO BoardSettings(newsgroup, threads_per_page, pages, bump_limit, reply_limit, max_attachment_size, mime_types, allow_anon) VALUES($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT(newsgroup) DO UPDATE SET threads_per_page = $2, pages = $3, bump_limit = $4, reply_limit = $5, max_attachment_size = $6, mime_types = $7, allow_anon = $8", group, settings.ThreadsPerPage, settings.Pages, settings.BumpLimit, settings.ReplyLimit, settings.MaxAttachmentSize, settings.MimeTypes, settings.AllowAnon)
+  return
 }
 
 
@@ -945,47 +1288,138 @@ func (self PostgresDatabase) GetMessageIDByHash(hash string) (article ArticleEnt
   return
 }
 
-func (self PostgresDatabase) BanAddr(addr string) (err error) {
-  _, err = self.conn.Exec("INSERT INTO IPBans(addr, made, expires) VALUES($1, $2, $3)", addr, timeNow(), -1)
+func (self PostgresDatabase) BanAddr(ban IPBan) (err error) {
+  _, err = self.conn.Exec("INSERT INTO IPBans(addr, made, expires, reason, scope) VALUES($1, $2, $3, $4, $5)", ban.Addr, ban.Made, ban.Expires, ban.Reason, ban.Scope)
+  return
+}
+
+// get address bans from a query that selects every column of IPBans
+func (self PostgresDatabase) getIPBans(query string, args ...interface{}) (bans []IPBan, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query(query, args...)
+  if err == nil {
+    for rows.Next() {
+      var ban IPBan
+      rows.Scan(&ban.Addr, &ban.Made, &ban.Expires, &ban.Reason, &ban.Scope)
+      bans = append(bans, ban)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self PostgresDatabase) GetIPBans() (bans []IPBan, err error) {
+  return self.getIPBans("SELECT addr, made, expires, COALESCE(reason, ''), COALESCE(scope, '') FROM IPBans WHERE expires < 0 OR expires > $1 ORDER BY made DESC", timeNow())
+}
+
+func (self PostgresDatabase) GetIPBansForAddr(addr string) (bans []IPBan, err error) {
+  return self.getIPBans("SELECT addr, made, expires, COALESCE(reason, ''), COALESCE(scope, '') FROM IPBans WHERE addr >>= $1 AND ( expires < 0 OR expires > $2 ) ORDER BY made DESC", addr, timeNow())
+}
+
+func (self PostgresDatabase) DeleteExpiredBans() (err error) {
+  now := timeNow()
+  _, err = self.conn.Exec("DELETE FROM IPBans WHERE expires > 0 AND expires <= $1", now)
+  if err == nil {
+    _, err = self.conn.Exec("DELETE FROM EncIPBans WHERE expires > 0 AND expires <= $1", now)
+  }
   return
 }
 
 
 // assumes it is there
 func (self PostgresDatabase) UnbanAddr(addr string) (err error) {
-  _, err = self.conn.Exec("DELETE FROM IPBans WHERE addr >>= $1", addr)
+  _, err = self.conn.Exec("DELETE FROM IPBans WHERE addr = $1", addr)
   return
 }
 
 func (self PostgresDatabase) CheckEncIPBanned(encaddr string) (banned bool, err error) {
   var result int64
-  err = self.conn.QueryRow("SELECT COUNT(*) FROM EncIPBans WHERE encaddr = $1", encaddr).Scan(&result)
+  err = self.conn.QueryRow("SELECT COUNT(*) FROM EncIPBans WHERE encaddr = $1 AND ( expires < 0 OR expires > $2 )", encaddr, timeNow()).Scan(&result)
   banned = result > 0
   return 
 }
 
-func (self PostgresDatabase) BanEncAddr(encaddr string) (err error) {
-  _, err = self.conn.Exec("INSERT INTO EncIPBans(encaddr, made, expires) VALUES($1, $2, $3)", encaddr, timeNow(), -1)
+func (self PostgresDatabase) GetEncIPBans(encaddr string) (bans []IPBan, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query("SELECT encaddr, made, expires, COALESCE(reason, ''), COALESCE(scope, '') FROM EncIPBans WHERE encaddr = $1 AND ( expires < 0 OR expires > $2 ) ORDER BY made DESC", encaddr, timeNow())
+  if err == nil {
+    for rows.Next() {
+      var ban IPBan
+      rows.Scan(&ban.Addr, &ban.Made, &ban.Expires, &ban.Reason, &ban.Scope)
+      bans = append(bans, ban)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self PostgresDatabase) BanEncAddr(ban IPBan) (err error) {
+  _, err = self.conn.Exec("INSERT INTO EncIPBans(encaddr, made, expires, reason, scope) VALUES($1, $2, $3, $4, $5)", ban.Addr, ban.Made, ban.Expires, ban.Reason, ban.Scope)
   return
 }
 
 func (self PostgresDatabase) GetLastAndFirstForGroup(group string) (last, first int64, err error) {
-  err = self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts WHERE newsgroup = $1", group).Scan(&last)
-  if last == 0 {
-    last = 0
+  err = self.conn.QueryRow("SELECT COALESCE(MAX(last_nntp_id), 0) FROM Newsgroups WHERE name = $1", group).Scan(&last)
+  if err == nil {
+    var lowest sql.NullInt64
+    err = self.conn.QueryRow("SELECT MIN(nntp_id) FROM ArticlePosts WHERE newsgroup = $1", group).Scan(&lowest)
+    if lowest.Valid {
+      first = lowest.Int64
+    } else {
+      // empty group
+      first = last + 1
+    }
+  }
+  return
+}
+
+func (self PostgresDatabase) GetMessageIDForNNTPID(group string, id int64) (msgid string, err error) {
+  err = self.conn.QueryRow("SELECT message_id FROM ArticlePosts WHERE newsgroup = $1 AND nntp_id = $2", group, id).Scan(&msgid)
+  return
+}
+
+func (self PostgresDatabase) GetNNTPIDForMessageID(group, msgid string) (id int64, err error) {
+  err = self.conn.QueryRow("SELECT nntp_id FROM ArticlePosts WHERE newsgroup = $1 AND message_id = $2", group, msgid).Scan(&id)
+  return
+}
+
+func (self PostgresDatabase) GetPostsInGroupRange(group string, first, last int64) (models []NumberedPost, err error) {
+  if first < 1 {
     first = 1
+  }
+  var rows *sql.Rows
+  if last < 0 {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id FROM ArticlePosts WHERE newsgroup = $1 AND nntp_id >= $2 ORDER BY nntp_id", group, first)
+  } else if last >= first {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id FROM ArticlePosts WHERE newsgroup = $1 AND nntp_id >= $2 AND nntp_id <= $3 ORDER BY nntp_id", group, first, last)
   } else {
-    last += 1
-    first = 1
+    // empty range
+    return
+  }
+  if err == nil {
+    for rows.Next() {
+      model := post{}
+      var nntp_id int64
+      rows.Scan(&model.board, &model.message_id, &model.parent, &model.name, &model.subject, &model.path, &model.posted, &model.message, &model.addr, &nntp_id)
+      models = append(models, NumberedPost{Number: nntp_id, PostModel: model})
+    }
+    rows.Close()
   }
   return
 }
 
-func (self PostgresDatabase) GetMessageIDForNNTPID(group string, id int64) (msgid string, err error) {
-  if id == 0 {
-    id = 1
+func (self PostgresDatabase) GetArticlesSince(since int64) (articles []ArticleEntry) {
+  rows, err := self.conn.Query("SELECT message_id, newsgroup FROM ArticlePosts WHERE time_posted > $1 ORDER BY time_posted", since)
+  if err == nil {
+    for rows.Next() {
+      var entry ArticleEntry
+      rows.Scan(&entry[0], &entry[1])
+      articles = append(articles, entry)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get articles since", since, err)
   }
-  err = self.conn.QueryRow("SELECT message_id FROM ArticlePosts WHERE newsgroup = $1 ORDER BY time_posted LIMIT 1 OFFSET $2", group, id - 1).Scan(&msgid)
   return
 }
 
@@ -999,6 +1433,207 @@ func (self PostgresDatabase) UnMarkModPubkeyCanModGroup(pubkey, group string) (e
   return
 }
 
+func (self PostgresDatabase) CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action string) bool {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    return true
+  }
+  var result int64
+  // rows without a permission were made by MarkModPubkeyCanModGroup and allow everything
+  _ = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = $1 AND newsgroup = $2 AND ( permission IS NULL OR permission = $3 OR permission = $4 )", pubkey, newsgroup, ModActionAll, action).Scan(&result)
+  return result > 0
+}
+
+func (self PostgresDatabase) GrantModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  var result int64
+  err = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = $1 AND newsgroup = $2 AND permission = $3", pubkey, newsgroup, action).Scan(&result)
+  if err == nil && result == 0 {
+    _, err = self.conn.Exec("INSERT INTO ModPrivs(pubkey, newsgroup, permission) VALUES($1, $2, $3)", pubkey, newsgroup, action)
+  }
+  return
+}
+
+func (self PostgresDatabase) RevokeModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  if action == ModActionAll {
+    err = self.UnMarkModPubkeyCanModGroup(pubkey, newsgroup)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM ModPrivs WHERE pubkey = $1 AND newsgroup = $2 AND permission = $3", pubkey, newsgroup, action)
+  }
+  return
+}
+
+func (self PostgresDatabase) AddModLog(entry ModLogEntry) (err error) {
+  _, err = self.conn.Exec("INSERT INTO ModLogs(pubkey, action, target, reason, scope, time) VALUES($1, $2, $3, $4, $5, $6)", entry.Pubkey, entry.Action, entry.Target, entry.Reason, entry.Scope, entry.Time)
+  return
+}
+
+func (self PostgresDatabase) GetModLogs(pubkey, action string, limit, offset int) (logs []ModLogEntry, err error) {
+  var where []string
+  var args []interface{}
+  if len(pubkey) > 0 {
+    args = append(args, pubkey)
+    where = append(where, fmt.Sprintf("pubkey = $%d", len(args)))
+  }
+  if len(action) > 0 {
+    args = append(args, action)
+    where = append(where, fmt.Sprintf("action = $%d", len(args)))
+  }
+  q := "SELECT pubkey, action, COALESCE(target, ''), COALESCE(reason, ''), COALESCE(scope, ''), time FROM ModLogs"
+  if len(where) > 0 {
+    q += " WHERE " + strings.Join(where, " AND ")
+  }
+  args = append(args, limit, offset)
+  q += fmt.Sprintf(" ORDER BY time DESC LIMIT $%d OFFSET $%d", len(args) - 1, len(args))
+  var rows *sql.Rows
+  rows, err = self.conn.Query(q, args...)
+  if err == nil {
+    for rows.Next() {
+      var entry ModLogEntry
+      rows.Scan(&entry.Pubkey, &entry.Action, &entry.Target, &entry.Reason, &entry.Scope, &entry.Time)
+      logs = append(logs, entry)
+    }
+    rows.Close()
+  }
+  return
+}
+
 func (self PostgresDatabase) IsExpired(root_message_id string) bool {
   return self.HasArticle(root_message_id) && ! self.HasArticleLocal(root_message_id)
 }
+
+func (self PostgresDatabase) QueueArticleForFeed(feed, msgid string) (err error) {
+  now := timeNow()
+  _, err = self.conn.Exec("INSERT INTO ArticleFeedQueue(feed, message_id, queued, next_attempt) VALUES($1, $2, $3, $3) ON CONFLICT DO NOTHING", feed, msgid, now)
+  return
+}
+
+func (self PostgresDatabase) GetQueuedArticlesForFeed(feed string, limit int) (msgids []string, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query("SELECT message_id FROM ArticleFeedQueue WHERE feed = $1 AND pending AND next_attempt <= $2 ORDER BY next_attempt ASC LIMIT $3", feed, timeNow(), limit)
+  if err == nil {
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      msgids = append(msgids, msgid)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self PostgresDatabase) MarkArticleOffered(feed, msgid string) (err error) {
+  var attempts int64
+  err = self.conn.QueryRow("SELECT attempts FROM ArticleFeedQueue WHERE feed = $1 AND message_id = $2", feed, msgid).Scan(&attempts)
+  if err == nil {
+    attempts += 1
+    if attempts >= queueMaxAttempts {
+      // this is the last time we offer it
+      _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE feed = $1 AND message_id = $2", feed, msgid)
+    } else {
+      _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET attempts = $1, next_attempt = $2 WHERE feed = $3 AND message_id = $4", attempts, timeNow() + queueBackoff(attempts), feed, msgid)
+    }
+  }
+  return
+}
+
+func (self PostgresDatabase) RecordArticleOutcome(feed, msgid string, code int) (err error) {
+  if code == 431 {
+    _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET outcome = $1 WHERE feed = $2 AND message_id = $3", code, feed, msgid)
+  } else if queueKeepsOutcome(code) {
+    _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET outcome = $1, pending = FALSE WHERE feed = $2 AND message_id = $3", code, feed, msgid)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE feed = $1 AND message_id = $2", feed, msgid)
+  }
+  return
+}
+
+func (self PostgresDatabase) DeleteExpiredQueuedArticles() (err error) {
+  _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE queued < $1", timeNow() - queueMaxAge)
+  return
+}
+
+func (self PostgresDatabase) GetFeedHighWaterMark(feed, group string) (mark int64, err error) {
+  err = self.conn.QueryRow("SELECT mark FROM FeedHighWaterMarks WHERE feed = $1 AND newsgroup = $2", feed, group).Scan(&mark)
+  if err == sql.ErrNoRows {
+    // never synced
+    err = nil
+  }
+  return
+}
+
+func (self PostgresDatabase) SetFeedHighWaterMark(feed, group string, mark int64) (err error) {
+  _, err = self.conn.Exec("INSERT INTO FeedHighWaterMarks(feed, newsgroup, mark, updated) VALUES($1, $2, $3, $4) ON CONFLICT(feed, newsgroup) DO UPDATE SET mark = $3, updated = $4", feed, group, mark, timeNow())
+  return
+}
+
+func (self PostgresDatabase) ResetFeedHighWaterMarks(feed, group string) (err error) {
+  if feed == "" && group == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks")
+  } else if feed == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE newsgroup = $1", group)
+  } else if group == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE feed = $1", feed)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE feed = $1 AND newsgroup = $2", feed, group)
+  }
+  return
+}
+
+func (self PostgresDatabase) AddAPIToken(token APIToken) (err error) {
+  _, err = self.conn.Exec("INSERT INTO APITokens(name, token_hash, scope, rate_limit, issued) VALUES($1, $2, $3, $4, $5)", token.Name, token.Hash, token.Scope, token.RateLimit, token.Issued)
+  return
+}
+
+func (self PostgresDatabase) GetAPIToken(token_hash string) (token APIToken, err error) {
+  token.Hash = token_hash
+  err = self.conn.QueryRow("SELECT name, scope, rate_limit, issued FROM APITokens WHERE token_hash = $1", token_hash).Scan(&token.Name, &token.Scope, &token.RateLimit, &token.Issued)
+  return
+}
+
+func (self PostgresDatabase) RevokeAPIToken(name string) (err error) {
+  var res sql.Result
+  res, err = self.conn.Exec("DELETE FROM APITokens WHERE name = $1", name)
+  if err == nil {
+    var count int64
+    count, err = res.RowsAffected()
+    if err == nil && count == 0 {
+      err = errors.New("no such api token")
+    }
+  }
+  return
+}
+
+func (self PostgresDatabase) SearchPosts(prefix, newsgroup, group_prefix, query string, offset, limit int) (models []PostModel, err error) {
+  terms := searchTerms(query)
+  if len(terms) == 0 {
+    return
+  }
+  q := "SELECT message_id FROM ArticlePosts WHERE " + postgresSearchVector + " @@ plainto_tsquery('simple', $1) AND newsgroup != 'ctl'"
+  args := []interface{}{strings.Join(terms, " ")}
+  if newsgroup != "" {
+    args = append(args, newsgroup)
+    q += fmt.Sprintf(" AND newsgroup = $%d", len(args))
+  } else if group_prefix != "" {
+    args = append(args, group_prefix)
+    q += fmt.Sprintf(" AND substr(newsgroup, 1, length($%d)) = $%d", len(args), len(args))
+  }
+  args = append(args, limit, offset)
+  q += fmt.Sprintf(" ORDER BY time_posted DESC LIMIT $%d OFFSET $%d", len(args) - 1, len(args))
+  var rows *sql.Rows
+  rows, err = self.conn.Query(q, args...)
+  if err == nil {
+    var msgids []string
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      msgids = append(msgids, msgid)
+    }
+    rows.Close()
+    for _, msgid := range msgids {
+      model := self.GetPostModel(prefix, msgid)
+      if model != nil {
+        models = append(models, model)
+      }
+    }
+  }
+  return
+}
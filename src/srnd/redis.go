@@ -0,0 +1,1629 @@
+//
+// redis.go
+// redis db backend
+//
+package srnd
+
+import (
+  "errors"
+  "fmt"
+  "github.com/go-redis/redis"
+  "log"
+  "os"
+  "strconv"
+  "strings"
+  "time"
+)
+
+// all keys used by the redis backend
+const redis_prefix = "srnd::"
+// hash of setting name -> value
+const redis_settings = redis_prefix + "settings"
+// hash of newsgroup -> last post time
+const redis_newsgroups = redis_prefix + "newsgroups"
+// hash of newsgroup -> last nntp id given out
+const redis_nntp_ids = redis_prefix + "nntp_ids"
+// hash of newsgroup -> time banned
+const redis_banned_groups = redis_prefix + "banned_groups"
+// hash of message id -> ban reason
+const redis_banned_articles = redis_prefix + "banned_articles"
+// hash of message id hash -> message id
+const redis_hashes = redis_prefix + "hashes"
+// hash of addr or range -> time banned
+const redis_ipbans = redis_prefix + "ipbans"
+// hash of encrypted addr -> time banned
+const redis_encipbans = redis_prefix + "encipbans"
+// sorted set of every local post by time posted
+const redis_posts = redis_prefix + "posts"
+// sorted set of every root post not in ctl by last bump
+const redis_threads = redis_prefix + "threads"
+
+// hash of article meta data
+func redisArticleKey(msgid string) string {
+  return redis_prefix + "article::" + msgid
+}
+
+// hash of post content
+func redisPostKey(msgid string) string {
+  return redis_prefix + "post::" + msgid
+}
+
+// hash of attachment filepath -> filename
+func redisAttachmentsKey(msgid string) string {
+  return redis_prefix + "attachments::" + msgid
+}
+
+// hash of thread state
+func redisThreadKey(root_message_id string) string {
+  return redis_prefix + "thread::" + root_message_id
+}
+
+// sorted set of replies in a thread by time posted
+func redisThreadPostsKey(root_message_id string) string {
+  return redis_prefix + "thread_posts::" + root_message_id
+}
+
+// sorted set of posts in a group by time posted
+func redisGroupPostsKey(group string) string {
+  return redis_prefix + "group_posts::" + group
+}
+
+// sorted set of posts in a group by nntp id
+func redisGroupNumbersKey(group string) string {
+  return redis_prefix + "group_nntp_ids::" + group
+}
+
+// sorted set of posts with a search word in them by time posted
+func redisSearchWordKey(word string) string {
+  return redis_prefix + "search::" + word
+}
+
+// sorted set of root posts in a group by last bump
+func redisGroupThreadsKey(group string) string {
+  return redis_prefix + "group_threads::" + group
+}
+
+// set of sticky root posts in a group
+func redisGroupStickiesKey(group string) string {
+  return redis_prefix + "group_stickies::" + group
+}
+
+// set of permissions a pubkey has for a newsgroup
+func redisModPrivKey(pubkey, group string) string {
+  return redis_prefix + "modpriv::" + pubkey + "::" + group
+}
+
+// hash of the details of a ban on an addr or range
+func redisIPBanKey(addr string) string {
+  return redis_prefix + "ipban::" + addr
+}
+
+// hash of the details of a ban on an encrypted addr
+func redisEncIPBanKey(encaddr string) string {
+  return redis_prefix + "encipban::" + encaddr
+}
+
+// hash of ip -> encrypted addr and key
+func redisEncAddrKey(addr string) string {
+  return redis_prefix + "encaddr::" + addr
+}
+
+// hash of encrypted addr -> ip and key
+func redisEncAddrRevKey(encaddr string) string {
+  return redis_prefix + "encaddr_rev::" + encaddr
+}
+
+// sorted set of message ids queued for a feed by when they are due
+func redisFeedQueueKey(feed string) string {
+  return redis_prefix + "feedqueue::" + feed
+}
+
+// sorted set of message ids queued for a feed by when they were queued
+func redisFeedQueueAgeKey(feed string) string {
+  return redis_prefix + "feedqueue_age::" + feed
+}
+
+// set of feeds that have had articles queued
+const redis_feedqueues = redis_prefix + "feedqueues"
+
+// hash of the state of an article queued for a feed
+func redisFeedQueueArticleKey(feed, msgid string) string {
+  return redis_prefix + "feedqueue_article::" + feed + "::" + msgid
+}
+
+// hash of newsgroup -> high water mark for syncing from a feed
+func redisHighWaterKey(feed string) string {
+  return redis_prefix + "highwater::" + feed
+}
+
+// hash of api token name -> token hash
+const redisAPITokenNamesKey = redis_prefix + "apitoken_names"
+
+// hash of a newsgroup's settings
+func redisBoardSettingsKey(group string) string {
+  return redis_prefix + "boardsettings::" + group
+}
+
+// hash of an api token's settings
+func redisAPITokenKey(token_hash string) string {
+  return redis_prefix + "apitoken::" + token_hash
+}
+
+// list of mod log entry ids newest first
+const redis_modlogs = redis_prefix + "modlogs"
+// last mod log entry id
+const redis_modlog_seq = redis_prefix + "modlog_seq"
+
+// hash of a mod log entry
+func redisModLogKey(id string) string {
+  return redis_prefix + "modlog::" + id
+}
+
+type RedisDatabase struct {
+  client *redis.Client
+}
+
+func NewRedisDatabase(host, port, password string) Database {
+  var db RedisDatabase
+  opts := &redis.Options{
+    Password: password,
+  }
+  if strings.HasPrefix(host, "/") {
+    // unix socket
+    opts.Network = "unix"
+    opts.Addr = host
+  } else {
+    opts.Addr = fmt.Sprintf("%s:%s", host, port)
+  }
+  log.Println("connecting to redis at", opts.Addr)
+  db.client = redis.NewClient(opts)
+  _, err := db.client.Ping().Result()
+  if err != nil {
+    log.Fatalf("cannot connect to redis: %s", err)
+  }
+  return db
+}
+
+// close database connections
+func (self RedisDatabase) Close() {
+  if self.client != nil {
+    self.client.Close()
+  }
+}
+
+// redis has no tables, just keep track of the version
+func (self RedisDatabase) CreateTables() {
+  version := self.getDBVersion()
+  if version == -1 {
+    self.setDBVersion(3)
+    return
+  } else if version == 1 {
+    // upgrade to version 2
+    self.upgrade1to2()
+  }
+  version = self.getDBVersion()
+  if version == 2 {
+    // upgrade to version 3
+    self.upgrade2to3()
+  } else if version == 3 {
+    log.Println("we are up to date at version", version)
+  }
+}
+
+// articles get a stable number in their newsgroup when registered
+// number what we have oldest first
+func (self RedisDatabase) upgrade1to2() {
+
+  log.Println("migrating... 1 -> 2")
+
+  groups, err := self.client.HKeys(redis_newsgroups).Result()
+  checkError(err)
+  for _, group := range groups {
+    var msgids []string
+    msgids, err = self.client.ZRange(redisGroupPostsKey(group), 0, -1).Result()
+    checkError(err)
+    pipe := self.client.TxPipeline()
+    pipe.Del(redisGroupNumbersKey(group))
+    for idx, msgid := range msgids {
+      pipe.ZAdd(redisGroupNumbersKey(group), redis.Z{Score: float64(idx + 1), Member: msgid})
+    }
+    pipe.HSet(redis_nntp_ids, group, len(msgids))
+    _, err = pipe.Exec()
+    checkError(err)
+  }
+  self.setDBVersion(2)
+}
+
+// index the words in every post for search
+func (self RedisDatabase) upgrade2to3() {
+
+  log.Println("migrating... 2 -> 3")
+
+  msgids, err := self.client.ZRange(redis_posts, 0, -1).Result()
+  checkError(err)
+  for _, msgid := range msgids {
+    var vals []interface{}
+    vals, err = self.client.HMGet(redisPostKey(msgid), "subject", "name", "message", "posted").Result()
+    checkError(err)
+    subject, _ := vals[0].(string)
+    name, _ := vals[1].(string)
+    message, _ := vals[2].(string)
+    posted, _ := vals[3].(string)
+    score, _ := strconv.ParseFloat(posted, 64)
+    pipe := self.client.TxPipeline()
+    for _, word := range searchWords(subject + " " + name + " " + message) {
+      pipe.ZAdd(redisSearchWordKey(word), redis.Z{Score: score, Member: msgid})
+    }
+    _, err = pipe.Exec()
+    checkError(err)
+  }
+  self.setDBVersion(3)
+}
+
+// set what the current database version is
+func (self RedisDatabase) setDBVersion(version int) (err error) {
+  log.Println("set db version to", version)
+  err = self.client.HSet(redis_settings, "version", version).Err()
+  return
+}
+
+// get the current database version
+func (self RedisDatabase) getDBVersion() (version int) {
+  val, err := self.client.HGet(redis_settings, "version").Int64()
+  if err == nil {
+    version = int(val)
+  } else {
+    version = -1
+  }
+  return
+}
+
+func (self RedisDatabase) BanNewsgroup(group string) (err error) {
+  err = self.client.HSet(redis_banned_groups, group, timeNow()).Err()
+  return
+}
+
+func (self RedisDatabase) UnbanNewsgroup(group string) (err error) {
+  err = self.client.HDel(redis_banned_groups, group).Err()
+  return
+}
+
+func (self RedisDatabase) NewsgroupBanned(group string) (banned bool, err error) {
+  banned, err = self.client.HExists(redis_banned_groups, group).Result()
+  return
+}
+
+func (self RedisDatabase) NukeNewsgroup(group string, store ArticleStore) {
+  // first delete all thread presences
+  roots, _ := self.client.ZRange(redisGroupThreadsKey(group), 0, -1).Result()
+  for _, root := range roots {
+    self.DeleteThread(root)
+  }
+  // get all articles in that newsgroup
+  msgids, err := self.client.ZRange(redisGroupPostsKey(group), 0, -1).Result()
+  if err != nil {
+    log.Println("failed to get articles in", group, err)
+    return
+  }
+  // for each article delete it fully
+  for _, msgid := range msgids {
+    log.Println("delete", msgid)
+    // remove article from store
+    fname := store.GetFilename(msgid)
+    os.Remove(fname)
+    // get all attachments
+    for _, att := range(self.GetPostAttachments(msgid)) {
+      // remove attachment
+      log.Println("delete attachment", att)
+      os.Remove(store.ThumbnailFilepath(att))
+      os.Remove(store.AttachmentFilepath(att))
+    }
+    // delete from database
+    self.DeleteArticle(msgid)
+  }
+  log.Println("nuke of", group, "done")
+}
+
+func (self RedisDatabase) AddModPubkey(pubkey string) error {
+  if self.CheckModPubkey(pubkey) {
+    log.Println("did not add pubkey", pubkey, "already exists")
+    return nil
+  }
+  return self.client.SAdd(redisModPrivKey(pubkey, "ctl"), "login").Err()
+}
+
+// get which page a thread is on
+func (self RedisDatabase) getThreadPage(group, root_message_id string) (page int64, err error) {
+  var rank int64
+  perpage, _ := self.GetThreadsPerPage(group)
+  rank, err = self.client.ZRevRank(redisGroupThreadsKey(group), root_message_id).Result()
+  if err == nil {
+    page = (rank + 1) / int64(perpage)
+  }
+  return
+}
+
+func (self RedisDatabase) GetPageForRootMessage(root_message_id string) (group string, page int64, err error) {
+  group, err = self.client.HGet(redisThreadKey(root_message_id), "newsgroup").Result()
+  if err == nil {
+    page, err = self.getThreadPage(group, root_message_id)
+  }
+  return
+}
+
+func (self RedisDatabase) GetInfoForMessage(msgid string) (root string, newsgroup string, page int64, err error) {
+  var vals []interface{}
+  vals, err = self.client.HMGet(redisPostKey(msgid), "newsgroup", "ref_id").Result()
+  if err == nil {
+    if vals[0] == nil {
+      err = errors.New("no such post")
+      return
+    }
+    newsgroup, _ = vals[0].(string)
+    root, _ = vals[1].(string)
+    if root == "" {
+      root = msgid
+    }
+    page, err = self.getThreadPage(newsgroup, root)
+  }
+  return
+}
+
+func (self RedisDatabase) CheckModPubkeyGlobal(pubkey string) bool {
+  result, _ := self.client.SIsMember(redisModPrivKey(pubkey, "overchan"), "all").Result()
+  return result
+}
+
+func (self RedisDatabase) CheckModPubkeyCanModGroup(pubkey, newsgroup string) bool {
+  result, _ := self.client.Exists(redisModPrivKey(pubkey, newsgroup)).Result()
+  return result > 0
+}
+
+func (self RedisDatabase) CountPostsInGroup(newsgroup string, time_frame int64) (result int64) {
+  if time_frame > 0 {
+    time_frame = timeNow() - time_frame
+  } else if time_frame < 0 {
+    time_frame = 0
+  }
+  result, _ = self.client.ZCount(redisGroupPostsKey(newsgroup), fmt.Sprintf("(%d", time_frame), "+inf").Result()
+  return
+}
+
+func (self RedisDatabase) CheckModPubkey(pubkey string) bool {
+  result, _ := self.client.SIsMember(redisModPrivKey(pubkey, "ctl"), "login").Result()
+  return result
+}
+
+func (self RedisDatabase) BanArticle(messageID, reason string) error {
+  if self.ArticleBanned(messageID) {
+    log.Println(messageID, "already banned")
+    return nil
+  }
+  return self.client.HSet(redis_banned_articles, messageID, reason).Err()
+}
+
+func (self RedisDatabase) ArticleBanned(messageID string) (result bool) {
+  result, err := self.client.HExists(redis_banned_articles, messageID).Result()
+  if err != nil {
+    log.Println("error checking if article is banned", err)
+  }
+  return
+}
+
+func (self RedisDatabase) GetEncAddress(addr string) (encaddr string, err error) {
+  encaddr, err = self.client.HGet(redisEncAddrKey(addr), "encaddr").Result()
+  if err == redis.Nil {
+    // needs to be inserted
+    var key string
+    key, encaddr = newAddrEnc(addr)
+    if len(encaddr) == 0 {
+      err = errors.New("failed to generate new encryption key")
+    } else {
+      pipe := self.client.TxPipeline()
+      pipe.HMSet(redisEncAddrKey(addr), map[string]interface{}{
+        "enckey": key,
+        "encaddr": encaddr,
+      })
+      pipe.HMSet(redisEncAddrRevKey(encaddr), map[string]interface{}{
+        "enckey": key,
+        "addr": addr,
+      })
+      _, err = pipe.Exec()
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetEncKey(encAddr string) (enckey string, err error) {
+  enckey, err = self.client.HGet(redisEncAddrRevKey(encAddr), "enckey").Result()
+  return
+}
+
+// get a ban from a hash of addr -> time banned and its details
+// bans from before they could expire never do
+func (self RedisDatabase) getBan(addr, made, key string) (ban IPBan) {
+  ban.Addr = addr
+  ban.Made, _ = strconv.ParseInt(made, 10, 64)
+  ban.Expires = -1
+  details, err := self.client.HGetAll(key).Result()
+  if err == nil {
+    if expires, ok := details["expires"]; ok {
+      ban.Expires, _ = strconv.ParseInt(expires, 10, 64)
+    }
+    ban.Reason = details["reason"]
+    ban.Scope = details["scope"]
+  }
+  return
+}
+
+// get every banned address or range even if it ran out
+func (self RedisDatabase) getIPBans() (bans []IPBan, err error) {
+  var all map[string]string
+  all, err = self.client.HGetAll(redis_ipbans).Result()
+  if err == nil {
+    for addr, made := range all {
+      bans = append(bans, self.getBan(addr, made, redisIPBanKey(addr)))
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) CheckIPBanned(addr string) (banned bool, err error) {
+  var bans []IPBan
+  bans, err = self.getIPBans()
+  if err == nil {
+    for _, ban := range bans {
+      if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+        banned = true
+        break
+      }
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetIPAddress(encaddr string) (addr string, err error) {
+  addr, err = self.client.HGet(redisEncAddrRevKey(encaddr), "addr").Result()
+  if err == redis.Nil {
+    err = nil
+  }
+  return
+}
+
+func (self RedisDatabase) MarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    // already marked
+    log.Println("pubkey already marked as global", pubkey)
+  } else {
+    err = self.client.SAdd(redisModPrivKey(pubkey, "overchan"), "all").Err()
+  }
+  return
+}
+
+func (self RedisDatabase) UnMarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    err = self.client.SRem(redisModPrivKey(pubkey, "overchan"), "all").Err()
+  } else {
+    err = errors.New("public key not marked as global")
+  }
+  return
+}
+
+func (self RedisDatabase) CountThreadReplies(root_message_id string) (repls int64) {
+  repls, _ = self.client.ZCard(redisThreadPostsKey(root_message_id)).Result()
+  return
+}
+
+// every root post in a group with stickies first, then most recently bumped first
+func (self RedisDatabase) pageThreadsInGroup(newsgroup string) (roots []string, stickies map[string]bool, err error) {
+  var all, sticky []string
+  all, err = self.client.ZRevRange(redisGroupThreadsKey(newsgroup), 0, -1).Result()
+  if err == nil {
+    sticky, err = self.client.SMembers(redisGroupStickiesKey(newsgroup)).Result()
+  }
+  if err != nil {
+    return
+  }
+  stickies = make(map[string]bool)
+  for _, root := range sticky {
+    stickies[root] = true
+  }
+  var rest []string
+  for _, root := range all {
+    if stickies[root] {
+      roots = append(roots, root)
+    } else {
+      rest = append(rest, root)
+    }
+  }
+  roots = append(roots, rest...)
+  return
+}
+
+func (self RedisDatabase) GetRootPostsForExpiration(newsgroup string, threadcount int) (roots []string) {
+  threads, stickies, err := self.pageThreadsInGroup(newsgroup)
+  if err != nil {
+    log.Println("failed to get root posts for expiration", err)
+  } else if len(threads) > threadcount {
+    for _, root := range threads[threadcount:] {
+      // stickies never expire
+      if ! stickies[root] {
+        roots = append(roots, root)
+      }
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetAllNewsgroups() (groups []string) {
+  groups, _ = self.client.HKeys(redis_newsgroups).Result()
+  return
+}
+
+func (self RedisDatabase) GetGroupPageCount(newsgroup string) int64 {
+  count, err := self.client.ZCard(redisGroupThreadsKey(newsgroup)).Result()
+  if err != nil {
+    log.Println("failed to count pages in group", newsgroup, err)
+  }
+  // divide by threads per page
+  perpage, _ := self.GetThreadsPerPage(newsgroup)
+  return ( count / int64(perpage) ) + 1
+}
+
+// get a post model, nil if it's not there
+func (self RedisDatabase) getPost(prefix, msgid string) (model post, ok bool) {
+  vals, err := self.client.HGetAll(redisPostKey(msgid)).Result()
+  if err == nil && len(vals) > 0 {
+    posted, _ := strconv.ParseInt(vals["posted"], 10, 64)
+    model = post{
+      prefix: prefix,
+      board: vals["newsgroup"],
+      message_id: vals["message_id"],
+      parent: vals["ref_id"],
+      name: vals["name"],
+      subject: vals["subject"],
+      path: vals["path"],
+      posted: posted,
+      message: vals["message"],
+      addr: vals["addr"],
+      pubkey: vals["pubkey"],
+    }
+    ok = true
+  } else if err != nil {
+    log.Println("failed to get post", msgid, err)
+  }
+  return
+}
+
+// get a post model with attachments
+func (self RedisDatabase) getPostModel(prefix, msgid string) (model post, ok bool) {
+  model, ok = self.getPost(prefix, msgid)
+  if ok {
+    model.op = len(model.parent) == 0
+    if len(model.parent) == 0 {
+      model.parent = model.message_id
+    }
+    model.sage = isSage(model.subject)
+    atts := self.GetPostAttachmentModels(prefix, msgid)
+    if atts != nil {
+      model.attachments = append(model.attachments, atts...)
+    }
+  }
+  return
+}
+
+// only fetches root posts
+// does not update the thread contents
+func (self RedisDatabase) GetGroupForPage(prefix, frontend, newsgroup string, pageno, perpage int) BoardModel {
+  var threads []ThreadModel
+  pages := self.GetGroupPageCount(newsgroup)
+  roots, _, err := self.pageThreadsInGroup(newsgroup)
+  if err == nil {
+    start := pageno * perpage
+    if start > len(roots) {
+      start = len(roots)
+    }
+    roots = roots[start:]
+    if len(roots) > perpage {
+      roots = roots[:perpage]
+    }
+    for _, root := range roots {
+      p, ok := self.getPostModel(prefix, root)
+      if ! ok {
+        continue
+      }
+      threads = append(threads, thread{
+        prefix: prefix,
+        posts: []PostModel{p},
+        links: []LinkModel{
+          linkModel{
+            text: newsgroup,
+            link: fmt.Sprintf("%s%s-0.html", prefix, newsgroup),
+          },
+        },
+      })
+    }
+  } else {
+    log.Println("failed to fetch board model for", newsgroup, "page", pageno, err)
+  }
+  return boardModel{
+    prefix: prefix,
+    frontend: frontend,
+    board: newsgroup,
+    page: pageno,
+    pages: int(pages),
+    threads: threads,
+  }
+}
+
+func (self RedisDatabase) GetPostsInGroup(newsgroup string) (models []PostModel, err error) {
+  var msgids []string
+  msgids, err = self.client.ZRange(redisGroupPostsKey(newsgroup), 0, -1).Result()
+  if err == nil {
+    for _, msgid := range msgids {
+      model, ok := self.getPost("", msgid)
+      if ok {
+        model.pubkey = ""
+        models = append(models, model)
+      }
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetPostModel(prefix, messageID string) PostModel {
+  model, ok := self.getPostModel(prefix, messageID)
+  if ok {
+    return model
+  } else {
+    log.Println("no post model for", messageID)
+    return nil
+  }
+}
+
+func (self RedisDatabase) SetThreadSticky(root_message_id string, sticky bool) (err error) {
+  var group string
+  group, err = self.client.HGet(redisThreadKey(root_message_id), "newsgroup").Result()
+  if err == redis.Nil {
+    // no thread
+    err = nil
+    return
+  } else if err != nil {
+    return
+  }
+  if sticky {
+    err = self.client.SAdd(redisGroupStickiesKey(group), root_message_id).Err()
+  } else {
+    err = self.client.SRem(redisGroupStickiesKey(group), root_message_id).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) SetThreadLocked(root_message_id string, locked bool) (err error) {
+  has, _ := self.client.Exists(redisThreadKey(root_message_id)).Result()
+  if has == 0 {
+    // no thread
+    return
+  }
+  if locked {
+    err = self.client.HSet(redisThreadKey(root_message_id), "locked", "1").Err()
+  } else {
+    err = self.client.HDel(redisThreadKey(root_message_id), "locked").Err()
+  }
+  return
+}
+
+func (self RedisDatabase) ThreadSticky(root_message_id string) bool {
+  group, err := self.client.HGet(redisThreadKey(root_message_id), "newsgroup").Result()
+  if err == nil {
+    sticky, _ := self.client.SIsMember(redisGroupStickiesKey(group), root_message_id).Result()
+    return sticky
+  }
+  return false
+}
+
+func (self RedisDatabase) ThreadLocked(root_message_id string) bool {
+  locked, _ := self.client.HGet(redisThreadKey(root_message_id), "locked").Result()
+  return locked == "1"
+}
+
+func (self RedisDatabase) DeleteThread(msgid string) (err error) {
+  var group string
+  group, err = self.client.HGet(redisThreadKey(msgid), "newsgroup").Result()
+  if err == redis.Nil {
+    // no thread
+    err = nil
+    return
+  } else if err != nil {
+    return
+  }
+  pipe := self.client.TxPipeline()
+  pipe.Del(redisThreadKey(msgid))
+  pipe.ZRem(redisGroupThreadsKey(group), msgid)
+  pipe.SRem(redisGroupStickiesKey(group), msgid)
+  pipe.ZRem(redis_threads, msgid)
+  _, err = pipe.Exec()
+  return
+}
+
+func (self RedisDatabase) DeleteArticle(msgid string) (err error) {
+  var vals []interface{}
+  vals, err = self.client.HMGet(redisPostKey(msgid), "newsgroup", "ref_id", "subject", "name", "message").Result()
+  if err != nil {
+    return
+  }
+  group, _ := vals[0].(string)
+  ref, _ := vals[1].(string)
+  subject, _ := vals[2].(string)
+  name, _ := vals[3].(string)
+  message, _ := vals[4].(string)
+  err = self.DeleteThread(msgid)
+  if err != nil {
+    return
+  }
+  pipe := self.client.TxPipeline()
+  pipe.Del(redisPostKey(msgid), redisAttachmentsKey(msgid))
+  pipe.ZRem(redis_posts, msgid)
+  if group != "" {
+    pipe.ZRem(redisGroupPostsKey(group), msgid)
+    pipe.ZRem(redisGroupNumbersKey(group), msgid)
+  }
+  if ref != "" {
+    pipe.ZRem(redisThreadPostsKey(ref), msgid)
+  }
+  for _, word := range searchWords(subject + " " + name + " " + message) {
+    pipe.ZRem(redisSearchWordKey(word), msgid)
+  }
+  _, err = pipe.Exec()
+  if err == nil {
+    err = self.dequeueArticleFromFeeds(msgid)
+  }
+  return
+}
+
+// get replies to a thread oldest first, limit to the last few if limit > 0
+func (self RedisDatabase) getThreadReplies(rootpost string, limit int) (repls []string, err error) {
+  start := int64(0)
+  if limit > 0 {
+    start = int64(-limit)
+  }
+  repls, err = self.client.ZRange(redisThreadPostsKey(rootpost), start, -1).Result()
+  return
+}
+
+func (self RedisDatabase) GetThreadReplyPostModels(prefix, rootpost string, limit int) (repls []PostModel) {
+  msgids, err := self.getThreadReplies(rootpost, limit)
+  if err == nil {
+    for _, msgid := range msgids {
+      model, ok := self.getPostModel(prefix, msgid)
+      if ok {
+        repls = append(repls, model)
+      }
+    }
+  } else {
+    log.Println("failed to get thread replies", rootpost, err)
+  }
+  return
+}
+
+func (self RedisDatabase) GetThreadReplies(rootpost string, limit int) (repls []string) {
+  repls, err := self.getThreadReplies(rootpost, limit)
+  if err != nil {
+    log.Println("failed to get thread replies", rootpost, err)
+  }
+  return
+}
+
+func (self RedisDatabase) ThreadHasReplies(rootpost string) bool {
+  return self.CountThreadReplies(rootpost) > 0
+}
+
+func (self RedisDatabase) GetGroupThreads(group string, recv chan ArticleEntry) {
+  roots, err := self.client.ZRange(redisGroupThreadsKey(group), 0, -1).Result()
+  if err == nil {
+    for _, root := range roots {
+      recv <- ArticleEntry{root, group}
+    }
+  } else {
+    log.Println("failed to get group threads", err)
+  }
+}
+
+func (self RedisDatabase) GetLastBumpedThreads(newsgroup string, threads int) (roots []ArticleEntry) {
+  var msgids []string
+  var err error
+  if len(newsgroup) > 0 {
+    msgids, err = self.client.ZRevRange(redisGroupThreadsKey(newsgroup), 0, int64(threads - 1)).Result()
+  } else {
+    msgids, err = self.client.ZRevRange(redis_threads, 0, int64(threads - 1)).Result()
+  }
+  if err == nil {
+    for _, msgid := range msgids {
+      group := newsgroup
+      if len(group) == 0 {
+        group, _ = self.client.HGet(redisThreadKey(msgid), "newsgroup").Result()
+      }
+      roots = append(roots, ArticleEntry{msgid, group})
+    }
+  } else {
+    log.Println("failed to get last bumped", err)
+  }
+  return
+}
+
+func (self RedisDatabase) GroupHasPosts(group string) bool {
+  count, err := self.client.ZCard(redisGroupPostsKey(group)).Result()
+  if err != nil {
+    log.Println("error counting posts in group", group, err)
+  }
+  return count > 0
+}
+
+// check if a newsgroup exists
+func (self RedisDatabase) HasNewsgroup(group string) bool {
+  has, err := self.client.HExists(redis_newsgroups, group).Result()
+  if err != nil {
+    log.Println("failed to check for newsgroup", group, err)
+  }
+  return has
+}
+
+// check if an article exists
+func (self RedisDatabase) HasArticle(message_id string) bool {
+  count, err := self.client.Exists(redisArticleKey(message_id)).Result()
+  if err != nil {
+    log.Println("failed to check for article", message_id, err)
+  }
+  return count > 0
+}
+
+// check if an article exists locally
+func (self RedisDatabase) HasArticleLocal(message_id string) bool {
+  count, err := self.client.Exists(redisPostKey(message_id)).Result()
+  if err != nil {
+    log.Println("failed to check for local article", message_id, err)
+  }
+  return count > 0
+}
+
+// count articles we have
+func (self RedisDatabase) ArticleCount() (count int64) {
+  count, err := self.client.ZCard(redis_posts).Result()
+  if err != nil {
+    log.Println("failed to count articles", err)
+  }
+  return
+}
+
+// register a new newsgroup
+func (self RedisDatabase) RegisterNewsgroup(group string) {
+  err := self.client.HSet(redis_newsgroups, group, timeNow()).Err()
+  if err != nil {
+    log.Println("failed to register newsgroup", group, err)
+  }
+}
+
+func (self RedisDatabase) GetPostAttachments(messageID string) (atts []string) {
+  atts, err := self.client.HKeys(redisAttachmentsKey(messageID)).Result()
+  if err != nil {
+    log.Println("cannot find attachments for", messageID, err)
+  }
+  return
+}
+
+func (self RedisDatabase) GetPostAttachmentModels(prefix, messageID string) (atts []AttachmentModel) {
+  vals, err := self.client.HGetAll(redisAttachmentsKey(messageID)).Result()
+  if err == nil {
+    for fpath, fname := range vals {
+      atts = append(atts, attachment{
+        prefix: prefix,
+        filepath: fpath,
+        filename: fname,
+      })
+    }
+  } else {
+    log.Println("failed to get attachment models for", messageID, err)
+  }
+  return
+}
+
+// register a message with the database
+func (self RedisDatabase) RegisterArticle(message NNTPMessage) {
+
+  msgid := message.MessageID()
+  group := message.Newsgroup()
+
+  if ! self.HasNewsgroup(group) {
+    self.RegisterNewsgroup(group)
+  }
+  if self.HasArticle(msgid) {
+    return
+  }
+  now := timeNow()
+  posted := float64(message.Posted())
+  ref := message.Reference()
+
+  // take the next nntp id in the newsgroup
+  nntp_id, err := self.client.HIncrBy(redis_nntp_ids, group, 1).Result()
+  if err != nil {
+    log.Println("failed to get nntp id for", msgid, err)
+    return
+  }
+
+  pipe := self.client.TxPipeline()
+  // insert article metadata
+  hash := HashMessageID(msgid)
+  pipe.HMSet(redisArticleKey(msgid), map[string]interface{}{
+    "message_id_hash": hash,
+    "newsgroup": group,
+    "ref_id": ref,
+    "time_obtained": now,
+  })
+  pipe.HSet(redis_hashes, hash, msgid)
+  // update newsgroup
+  pipe.HSet(redis_newsgroups, group, now)
+  // insert article post
+  pipe.HMSet(redisPostKey(msgid), map[string]interface{}{
+    "newsgroup": group,
+    "message_id": msgid,
+    "ref_id": ref,
+    "name": message.Name(),
+    "subject": message.Subject(),
+    "path": message.Path(),
+    "posted": message.Posted(),
+    "message": message.Message(),
+    "addr": message.Addr(),
+  })
+  pipe.ZAdd(redis_posts, redis.Z{Score: posted, Member: msgid})
+  pipe.ZAdd(redisGroupPostsKey(group), redis.Z{Score: posted, Member: msgid})
+  pipe.ZAdd(redisGroupNumbersKey(group), redis.Z{Score: float64(nntp_id), Member: msgid})
+  // index words for search
+  for _, word := range searchWords(message.Subject() + " " + message.Name() + " " + message.Message()) {
+    pipe.ZAdd(redisSearchWordKey(word), redis.Z{Score: posted, Member: msgid})
+  }
+
+  // set / update thread state
+  if message.OP() {
+    // insert new thread for op
+    pipe.HMSet(redisThreadKey(msgid), map[string]interface{}{
+      "newsgroup": group,
+      "last_bump": message.Posted(),
+      "last_post": message.Posted(),
+    })
+    pipe.ZAdd(redisGroupThreadsKey(group), redis.Z{Score: posted, Member: msgid})
+    if group != "ctl" {
+      pipe.ZAdd(redis_threads, redis.Z{Score: posted, Member: msgid})
+    }
+  } else {
+    pipe.ZAdd(redisThreadPostsKey(ref), redis.Z{Score: posted, Member: msgid})
+    // only touch threads we have
+    has, _ := self.client.Exists(redisThreadKey(ref)).Result()
+    if has > 0 {
+      // replies past the bump limit don't bump
+      settings, _ := self.GetBoardSettings(group)
+      replies, _ := self.client.ZCard(redisThreadPostsKey(ref)).Result()
+      // count this one too
+      if ! message.Sage() && settings.ReplyBumps(replies + 1) {
+        // bump it
+        pipe.HSet(redisThreadKey(ref), "last_bump", message.Posted())
+        pipe.ZAdd(redisGroupThreadsKey(group), redis.Z{Score: posted, Member: ref})
+        if group != "ctl" {
+          pipe.ZAdd(redis_threads, redis.Z{Score: posted, Member: ref})
+        }
+      }
+      // update last posted
+      pipe.HSet(redisThreadKey(ref), "last_post", message.Posted())
+    }
+  }
+
+  // register all attachments
+  for _, att := range message.Attachments() {
+    pipe.HSet(redisAttachmentsKey(msgid), att.Filepath(), att.Filename())
+  }
+  _, err = pipe.Exec()
+  if err != nil {
+    log.Println("failed to register article", msgid, err)
+  }
+}
+
+func (self RedisDatabase) RegisterSigned(message_id , pubkey string) (err error) {
+  err = self.client.HSet(redisPostKey(message_id), "pubkey", pubkey).Err()
+  return
+}
+
+// get all articles in a newsgroup
+// send result down a channel
+func (self RedisDatabase) GetAllArticlesInGroup(group string, recv chan ArticleEntry) {
+  msgids, err := self.client.ZRange(redisGroupPostsKey(group), 0, -1).Result()
+  if err != nil {
+    log.Printf("failed to get all articles in %s: %s", group, err)
+    return
+  }
+  for _, msgid := range msgids {
+    recv <- ArticleEntry{msgid, group}
+  }
+}
+
+// get all articles
+func (self RedisDatabase) GetAllArticles() (articles []ArticleEntry) {
+  msgids, err := self.client.ZRange(redis_posts, 0, -1).Result()
+  if err == nil {
+    for _, msgid := range msgids {
+      group, _ := self.client.HGet(redisPostKey(msgid), "newsgroup").Result()
+      articles = append(articles, ArticleEntry{msgid, group})
+    }
+  } else {
+    log.Println("failed to get all articles", err)
+  }
+  return articles
+}
+
+func (self RedisDatabase) GetPagesPerBoard(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.Pages, err
+}
+
+func (self RedisDatabase) GetThreadsPerPage(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.ThreadsPerPage, err
+}
+
+func (self RedisDatabase) GetBoardSettings(group string) (settings BoardSettings, err error) {
+  settings = DefaultBoardSettings()
+  var vals map[string]string
+  vals, err = self.client.HGetAll(redisBoardSettingsKey(group)).Result()
+  if err == nil && len(vals) > 0 {
+    settings.ThreadsPerPage, _ = strconv.Atoi(vals["threads_per_page"])
+    settings.Pages, _ = strconv.Atoi(vals["pages"])
+    settings.BumpLimit, _ = strconv.Atoi(vals["bump_limit"])
+    settings.ReplyLimit, _ = strconv.Atoi(vals["reply_limit"])
+    settings.MaxAttachmentSize, _ = strconv.ParseInt(vals["max_attachment_size"], 10, 64)
+    settings.MimeTypes = vals["mime_types"]
+    settings.AllowAnon = vals["allow_anon"] == "1"
+  } else if err != nil {
+    log.Println("failed to get settings for", group, err)
+  }
+  return
+}
+
+func (self RedisDatabase) SetBoardSettings(group string, settings BoardSettings) (err error) {
+  allow_anon := "0"
+  if settings.AllowAnon {
+    allow_anon = "1"
+  }
+  err = self.client.HMSet(redisBoardSettingsKey(group), map[string]interface{}{
+    "threads_per_page": settings.ThreadsPerPage,
+    "pages": settings.Pages,
+    "bump_limit": settings.BumpLimit,
+    "reply_limit": settings.ReplyLimit,
+    "max_attachment_size": settings.MaxAttachmentSize,
+    "mime_types": settings.MimeTypes,
+    "allow_anon": allow_anon,
+  }).Err()
+  return
+}
+
+func (self RedisDatabase) GetMessageIDByHash(hash string) (article ArticleEntry, err error) {
+  article[0], err = self.client.HGet(redis_hashes, hash).Result()
+  if err == nil {
+    article[1], err = self.client.HGet(redisArticleKey(article[0]), "newsgroup").Result()
+  }
+  return
+}
+
+func (self RedisDatabase) BanAddr(ban IPBan) (err error) {
+  err = self.client.HMSet(redisIPBanKey(ban.Addr), map[string]interface{}{
+    "expires": ban.Expires,
+    "reason": ban.Reason,
+    "scope": ban.Scope,
+  }).Err()
+  if err == nil {
+    err = self.client.HSet(redis_ipbans, ban.Addr, ban.Made).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) GetIPBans() (bans []IPBan, err error) {
+  var all []IPBan
+  all, err = self.getIPBans()
+  for _, ban := range all {
+    if ! ban.Expired() {
+      bans = append(bans, ban)
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetIPBansForAddr(addr string) (bans []IPBan, err error) {
+  var all []IPBan
+  all, err = self.getIPBans()
+  for _, ban := range all {
+    if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+      bans = append(bans, ban)
+    }
+  }
+  return
+}
+
+// delete a ban from a hash of addr -> time banned and its details
+func (self RedisDatabase) deleteBan(hash, addr, key string) (err error) {
+  err = self.client.HDel(hash, addr).Err()
+  if err == nil {
+    err = self.client.Del(key).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) DeleteExpiredBans() (err error) {
+  var bans []IPBan
+  bans, err = self.getIPBans()
+  for _, ban := range bans {
+    if err == nil && ban.Expired() {
+      err = self.deleteBan(redis_ipbans, ban.Addr, redisIPBanKey(ban.Addr))
+    }
+  }
+  var encbans map[string]string
+  if err == nil {
+    encbans, err = self.client.HGetAll(redis_encipbans).Result()
+  }
+  for encaddr, made := range encbans {
+    if err == nil && self.getBan(encaddr, made, redisEncIPBanKey(encaddr)).Expired() {
+      err = self.deleteBan(redis_encipbans, encaddr, redisEncIPBanKey(encaddr))
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) UnbanAddr(addr string) (err error) {
+  var bans []string
+  bans, err = self.client.HKeys(redis_ipbans).Result()
+  if err == nil {
+    for _, ban := range bans {
+      if banCIDR(ban) == banCIDR(addr) {
+        err = self.deleteBan(redis_ipbans, ban, redisIPBanKey(ban))
+      }
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) CheckEncIPBanned(encaddr string) (banned bool, err error) {
+  var made string
+  made, err = self.client.HGet(redis_encipbans, encaddr).Result()
+  if err == redis.Nil {
+    err = nil
+  } else if err == nil {
+    banned = ! self.getBan(encaddr, made, redisEncIPBanKey(encaddr)).Expired()
+  }
+  return
+}
+
+func (self RedisDatabase) GetEncIPBans(encaddr string) (bans []IPBan, err error) {
+  var made string
+  made, err = self.client.HGet(redis_encipbans, encaddr).Result()
+  if err == redis.Nil {
+    err = nil
+  } else if err == nil {
+    ban := self.getBan(encaddr, made, redisEncIPBanKey(encaddr))
+    if ! ban.Expired() {
+      bans = append(bans, ban)
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) BanEncAddr(ban IPBan) (err error) {
+  err = self.client.HMSet(redisEncIPBanKey(ban.Addr), map[string]interface{}{
+    "expires": ban.Expires,
+    "reason": ban.Reason,
+    "scope": ban.Scope,
+  }).Err()
+  if err == nil {
+    err = self.client.HSet(redis_encipbans, ban.Addr, ban.Made).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) GetLastAndFirstForGroup(group string) (last, first int64, err error) {
+  last, err = self.client.HGet(redis_nntp_ids, group).Int64()
+  if err == redis.Nil {
+    // no articles yet
+    last, err = 0, nil
+  }
+  if err == nil {
+    var lowest []redis.Z
+    lowest, err = self.client.ZRangeWithScores(redisGroupNumbersKey(group), 0, 0).Result()
+    if len(lowest) > 0 {
+      first = int64(lowest[0].Score)
+    } else {
+      // empty group
+      first = last + 1
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetMessageIDForNNTPID(group string, id int64) (msgid string, err error) {
+  var msgids []string
+  n := strconv.FormatInt(id, 10)
+  msgids, err = self.client.ZRangeByScore(redisGroupNumbersKey(group), redis.ZRangeBy{Min: n, Max: n}).Result()
+  if err == nil {
+    if len(msgids) == 0 {
+      err = errors.New("no such article number")
+    } else {
+      msgid = msgids[0]
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetNNTPIDForMessageID(group, msgid string) (id int64, err error) {
+  var score float64
+  score, err = self.client.ZScore(redisGroupNumbersKey(group), msgid).Result()
+  if err == nil {
+    id = int64(score)
+  } else if err == redis.Nil {
+    err = errors.New("no such article in group")
+  }
+  return
+}
+
+func (self RedisDatabase) GetPostsInGroupRange(group string, first, last int64) (models []NumberedPost, err error) {
+  if first < 1 {
+    first = 1
+  }
+  if last >= 0 && last < first {
+    // empty range
+    return
+  }
+  max := "+inf"
+  if last >= 0 {
+    max = strconv.FormatInt(last, 10)
+  }
+  var msgids []redis.Z
+  msgids, err = self.client.ZRangeByScoreWithScores(redisGroupNumbersKey(group), redis.ZRangeBy{Min: strconv.FormatInt(first, 10), Max: max}).Result()
+  if err == nil {
+    for _, z := range msgids {
+      msgid, _ := z.Member.(string)
+      model, ok := self.getPost("", msgid)
+      if ok {
+        model.pubkey = ""
+        models = append(models, NumberedPost{Number: int64(z.Score), PostModel: model})
+      }
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetArticlesSince(since int64) (articles []ArticleEntry) {
+  msgids, err := self.client.ZRangeByScore(redis_posts, redis.ZRangeBy{
+    Min: fmt.Sprintf("(%d", since),
+    Max: "+inf",
+  }).Result()
+  if err == nil {
+    for _, msgid := range msgids {
+      group, _ := self.client.HGet(redisPostKey(msgid), "newsgroup").Result()
+      articles = append(articles, ArticleEntry{msgid, group})
+    }
+  } else {
+    log.Println("failed to get articles since", since, err)
+  }
+  return
+}
+
+func (self RedisDatabase) MarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  err = self.client.SAdd(redisModPrivKey(pubkey, group), "").Err()
+  return
+}
+
+func (self RedisDatabase) UnMarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  err = self.client.Del(redisModPrivKey(pubkey, group)).Err()
+  return
+}
+
+func (self RedisDatabase) CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action string) bool {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    return true
+  }
+  // empty permissions were made by MarkModPubkeyCanModGroup and allow everything
+  for _, perm := range []string{"", ModActionAll, action} {
+    result, _ := self.client.SIsMember(redisModPrivKey(pubkey, newsgroup), perm).Result()
+    if result {
+      return true
+    }
+  }
+  return false
+}
+
+func (self RedisDatabase) GrantModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  err = self.client.SAdd(redisModPrivKey(pubkey, newsgroup), action).Err()
+  return
+}
+
+func (self RedisDatabase) RevokeModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  if action == ModActionAll {
+    err = self.UnMarkModPubkeyCanModGroup(pubkey, newsgroup)
+  } else {
+    err = self.client.SRem(redisModPrivKey(pubkey, newsgroup), action).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) AddModLog(entry ModLogEntry) (err error) {
+  var id int64
+  id, err = self.client.Incr(redis_modlog_seq).Result()
+  if err == nil {
+    err = self.client.HMSet(redisModLogKey(strconv.FormatInt(id, 10)), map[string]interface{}{
+      "pubkey": entry.Pubkey,
+      "action": entry.Action,
+      "target": entry.Target,
+      "reason": entry.Reason,
+      "scope": entry.Scope,
+      "time": entry.Time,
+    }).Err()
+  }
+  if err == nil {
+    err = self.client.LPush(redis_modlogs, id).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) GetModLogs(pubkey, action string, limit, offset int) (logs []ModLogEntry, err error) {
+  var ids []string
+  ids, err = self.client.LRange(redis_modlogs, 0, -1).Result()
+  if err != nil {
+    return
+  }
+  for _, id := range ids {
+    if len(logs) >= limit {
+      break
+    }
+    var vals map[string]string
+    vals, err = self.client.HGetAll(redisModLogKey(id)).Result()
+    if err != nil {
+      return
+    }
+    if len(pubkey) > 0 && vals["pubkey"] != pubkey {
+      continue
+    } else if len(action) > 0 && vals["action"] != action {
+      continue
+    } else if offset > 0 {
+      offset --
+      continue
+    }
+    t, _ := strconv.ParseInt(vals["time"], 10, 64)
+    logs = append(logs, ModLogEntry{
+      Pubkey: vals["pubkey"],
+      Action: vals["action"],
+      Target: vals["target"],
+      Reason: vals["reason"],
+      Scope: vals["scope"],
+      Time: t,
+    })
+  }
+  return
+}
+
+func (self RedisDatabase) IsExpired(root_message_id string) bool {
+  return self.HasArticle(root_message_id) && ! self.HasArticleLocal(root_message_id)
+}
+
+func (self RedisDatabase) QueueArticleForFeed(feed, msgid string) (err error) {
+  now := timeNow()
+  var added bool
+  added, err = self.client.HSetNX(redisFeedQueueArticleKey(feed, msgid), "queued", now).Result()
+  if err == nil && added {
+    pipe := self.client.TxPipeline()
+    pipe.ZAdd(redisFeedQueueKey(feed), redis.Z{Score: float64(now), Member: msgid})
+    pipe.ZAdd(redisFeedQueueAgeKey(feed), redis.Z{Score: float64(now), Member: msgid})
+    pipe.SAdd(redis_feedqueues, feed)
+    _, err = pipe.Exec()
+  }
+  return
+}
+
+// take an article off a feed's queue
+func (self RedisDatabase) dequeueArticle(feed, msgid string) (err error) {
+  pipe := self.client.TxPipeline()
+  pipe.Del(redisFeedQueueArticleKey(feed, msgid))
+  pipe.ZRem(redisFeedQueueKey(feed), msgid)
+  pipe.ZRem(redisFeedQueueAgeKey(feed), msgid)
+  _, err = pipe.Exec()
+  return
+}
+
+// take an article off every feed's queue
+func (self RedisDatabase) dequeueArticleFromFeeds(msgid string) (err error) {
+  var feeds []string
+  feeds, err = self.client.SMembers(redis_feedqueues).Result()
+  for _, feed := range feeds {
+    err = self.dequeueArticle(feed, msgid)
+  }
+  return
+}
+
+func (self RedisDatabase) GetQueuedArticlesForFeed(feed string, limit int) (msgids []string, err error) {
+  msgids, err = self.client.ZRangeByScore(redisFeedQueueKey(feed), redis.ZRangeBy{
+    Min: "-inf",
+    Max: strconv.FormatInt(timeNow(), 10),
+    Count: int64(limit),
+  }).Result()
+  return
+}
+
+func (self RedisDatabase) MarkArticleOffered(feed, msgid string) (err error) {
+  var attempts int64
+  attempts, err = self.client.HIncrBy(redisFeedQueueArticleKey(feed, msgid), "attempts", 1).Result()
+  if err == nil && attempts >= queueMaxAttempts {
+    // this is the last time we offer it
+    err = self.dequeueArticle(feed, msgid)
+  } else if err == nil {
+    next := timeNow() + queueBackoff(attempts)
+    err = self.client.ZAddXX(redisFeedQueueKey(feed), redis.Z{Score: float64(next), Member: msgid}).Err()
+  }
+  return
+}
+
+func (self RedisDatabase) RecordArticleOutcome(feed, msgid string, code int) (err error) {
+  if code == 431 {
+    err = self.client.HSet(redisFeedQueueArticleKey(feed, msgid), "outcome", code).Err()
+  } else if queueKeepsOutcome(code) {
+    // off the due set, still in the age set so it expires
+    pipe := self.client.TxPipeline()
+    pipe.HSet(redisFeedQueueArticleKey(feed, msgid), "outcome", code)
+    pipe.ZRem(redisFeedQueueKey(feed), msgid)
+    _, err = pipe.Exec()
+  } else {
+    err = self.dequeueArticle(feed, msgid)
+  }
+  return
+}
+
+func (self RedisDatabase) DeleteExpiredQueuedArticles() (err error) {
+  var feeds []string
+  feeds, err = self.client.SMembers(redis_feedqueues).Result()
+  for _, feed := range feeds {
+    var msgids []string
+    msgids, err = self.client.ZRangeByScore(redisFeedQueueAgeKey(feed), redis.ZRangeBy{
+      Min: "-inf",
+      Max: strconv.FormatInt(timeNow() - queueMaxAge, 10),
+    }).Result()
+    for _, msgid := range msgids {
+      err = self.dequeueArticle(feed, msgid)
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetFeedHighWaterMark(feed, group string) (mark int64, err error) {
+  mark, err = self.client.HGet(redisHighWaterKey(feed), group).Int64()
+  if err == redis.Nil {
+    // never synced
+    err = nil
+  }
+  return
+}
+
+func (self RedisDatabase) SetFeedHighWaterMark(feed, group string, mark int64) (err error) {
+  err = self.client.HSet(redisHighWaterKey(feed), group, mark).Err()
+  return
+}
+
+func (self RedisDatabase) ResetFeedHighWaterMarks(feed, group string) (err error) {
+  var keys []string
+  if feed == "" {
+    keys, err = self.client.Keys(redisHighWaterKey("*")).Result()
+  } else {
+    keys = []string{redisHighWaterKey(feed)}
+  }
+  for _, key := range keys {
+    if err != nil {
+      break
+    }
+    if group == "" {
+      err = self.client.Del(key).Err()
+    } else {
+      err = self.client.HDel(key, group).Err()
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) AddAPIToken(token APIToken) (err error) {
+  var added bool
+  added, err = self.client.HSetNX(redisAPITokenNamesKey, token.Name, token.Hash).Result()
+  if err == nil {
+    if added {
+      err = self.client.HMSet(redisAPITokenKey(token.Hash), map[string]interface{}{
+        "name": token.Name,
+        "scope": token.Scope,
+        "rate_limit": token.RateLimit,
+        "issued": token.Issued,
+      }).Err()
+    } else {
+      err = errors.New("api token already exists")
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) GetAPIToken(token_hash string) (token APIToken, err error) {
+  var vals map[string]string
+  vals, err = self.client.HGetAll(redisAPITokenKey(token_hash)).Result()
+  if err == nil {
+    if len(vals) == 0 {
+      err = errors.New("no such api token")
+    } else {
+      token.Hash = token_hash
+      token.Name = vals["name"]
+      token.Scope = vals["scope"]
+      token.RateLimit, _ = strconv.ParseInt(vals["rate_limit"], 10, 64)
+      token.Issued, _ = strconv.ParseInt(vals["issued"], 10, 64)
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) RevokeAPIToken(name string) (err error) {
+  var token_hash string
+  token_hash, err = self.client.HGet(redisAPITokenNamesKey, name).Result()
+  if err == redis.Nil {
+    err = errors.New("no such api token")
+  } else if err == nil {
+    err = self.client.Del(redisAPITokenKey(token_hash)).Err()
+    if err == nil {
+      err = self.client.HDel(redisAPITokenNamesKey, name).Err()
+    }
+  }
+  return
+}
+
+func (self RedisDatabase) SearchPosts(prefix, newsgroup, group_prefix, query string, offset, limit int) (models []PostModel, err error) {
+  terms := searchTerms(query)
+  if len(terms) == 0 {
+    return
+  }
+  // posts with every word, in the group if one is given
+  var keys []string
+  for _, term := range terms {
+    keys = append(keys, redisSearchWordKey(term))
+  }
+  if newsgroup != "" {
+    keys = append(keys, redisGroupPostsKey(newsgroup))
+  }
+  // every score is the time posted
+  tmp := redis_prefix + "search_results::" + randStr(16)
+  pipe := self.client.TxPipeline()
+  pipe.ZInterStore(tmp, redis.ZStore{Aggregate: "MAX"}, keys...)
+  // in case we never get to delete it
+  pipe.Expire(tmp, time.Minute)
+  _, err = pipe.Exec()
+  if err != nil {
+    return
+  }
+  defer self.client.Del(tmp)
+  // look at the results newest first in chunks, skipping other newsgroups
+  var start int64
+  var chunk int64 = 256
+  skipped := 0
+  for len(models) < limit {
+    var msgids []string
+    msgids, err = self.client.ZRevRange(tmp, start, start + chunk - 1).Result()
+    if err != nil || len(msgids) == 0 {
+      break
+    }
+    for _, msgid := range msgids {
+      p, ok := self.getPost(prefix, msgid)
+      if ! ok || ! searchInGroup(p.board, newsgroup, group_prefix) {
+        continue
+      } else if skipped < offset {
+        skipped ++
+      } else if len(models) < limit {
+        model, _ := self.getPostModel(prefix, msgid)
+        models = append(models, model)
+      }
+    }
+    start += chunk
+  }
+  return
+}
@@ -0,0 +1,1853 @@
+//
+// sqlite db backend
+//
+package srnd
+
+import (
+  "database/sql"
+  "encoding/hex"
+  "errors"
+  "fmt"
+  "log"
+  "net"
+  "os"
+  "strconv"
+  "strings"
+  _ "github.com/mattn/go-sqlite3"
+)
+
+type SQLiteDatabase struct {
+  conn *sql.DB
+  db_str string
+}
+
+func NewSQLiteDatabase(fname string) Database {
+  var db SQLiteDatabase
+  var err error
+  // wait on locks instead of failing right away
+  db.db_str = fmt.Sprintf("file:%s?cache=shared&_busy_timeout=5000", fname)
+  log.Println("opening sqlite database", fname)
+  db.conn, err = sql.Open("sqlite3", db.db_str)
+  if err != nil {
+    log.Fatalf("cannot open sqlite database: %s", err)
+  }
+  // sqlite only allows 1 writer at a time
+  db.conn.SetMaxOpenConns(1)
+  return db
+}
+
+// finalize all transactions
+// close database connections
+func (self SQLiteDatabase) Close() {
+  if self.conn != nil {
+    self.conn.Close()
+    self.conn = nil
+  }
+}
+
+func (self SQLiteDatabase) CreateTables() {
+  version := self.getDBVersion()
+  if version == -1 {
+    // no tables
+    self.createTablesV0()
+    self.upgrade0to1()
+  } else if version == 0 {
+    // upgrade to version 1
+    self.upgrade0to1()
+  }
+  version = self.getDBVersion()
+  if version == 1 {
+    // upgrade to version 2
+    self.upgrade1to2()
+  }
+  version = self.getDBVersion()
+  if version == 2 {
+    // upgrade to version 3
+    self.upgrade2to3()
+  }
+  version = self.getDBVersion()
+  if version == 3 {
+    // upgrade to version 4
+    self.upgrade3to4()
+  }
+  version = self.getDBVersion()
+  if version == 4 {
+    // upgrade to version 5
+    self.upgrade4to5()
+  }
+  version = self.getDBVersion()
+  if version == 5 {
+    // upgrade to version 6
+    self.upgrade5to6()
+  }
+  version = self.getDBVersion()
+  if version == 6 {
+    // upgrade to version 7
+    self.upgrade6to7()
+  }
+  version = self.getDBVersion()
+  if version == 7 {
+    // upgrade to version 8
+    self.upgrade7to8()
+  }
+  version = self.getDBVersion()
+  if version == 8 {
+    // upgrade to version 9
+    self.upgrade8to9()
+  }
+  version = self.getDBVersion()
+  if version == 9 {
+    // upgrade to version 10
+    self.upgrade9to10()
+  }
+  version = self.getDBVersion()
+  if version == 10 {
+    // upgrade to version 11
+    self.upgrade10to11()
+  } else if version == 11 {
+    // we are up to date
+    log.Println("we are up to date at version", version)
+  }
+  // fts5 is optional so the search index is set up outside of the versions
+  self.createSearchIndex()
+}
+
+// check if sqlite was built with fts5, build with -tags sqlite_fts5
+func (self SQLiteDatabase) hasFTS5() (has bool) {
+  self.conn.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&has)
+  return
+}
+
+// check if a table, index or trigger exists
+func (self SQLiteDatabase) hasSchema(kind, name string) bool {
+  var count int64
+  self.conn.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = ? AND name = ?", kind, name).Scan(&count)
+  return count > 0
+}
+
+// full text search index of posts, kept in sync with ArticlePosts by triggers
+// words are runs of letters and numbers like searchWords
+func (self SQLiteDatabase) createSearchIndex() {
+  var err error
+  if ! self.hasFTS5() {
+    log.Println("sqlite was built without fts5, search falls back to scanning posts, build with -tags sqlite_fts5 for an index")
+    // inserts would fail if the triggers are left around
+    for _, trigger := range []string{"articleposts_search_insert", "articleposts_search_delete"} {
+      _, err = self.conn.Exec("DROP TRIGGER IF EXISTS " + trigger)
+      checkError(err)
+    }
+    return
+  }
+  if self.hasSchema("trigger", "articleposts_search_insert") {
+    // up to date
+    return
+  }
+  log.Println("building sqlite search index...")
+  cmds := []string{
+    // an older index may point at the implicit rowid
+    "DROP TABLE IF EXISTS ArticlePostsSearch",
+    "CREATE VIRTUAL TABLE ArticlePostsSearch USING fts5(subject, name, message, content = 'ArticlePosts', content_rowid = 'post_id', tokenize = 'unicode61 remove_diacritics 0')",
+    "CREATE TRIGGER IF NOT EXISTS articleposts_search_insert AFTER INSERT ON ArticlePosts BEGIN INSERT INTO ArticlePostsSearch(rowid, subject, name, message) VALUES(new.post_id, new.subject, new.name, new.message); END",
+    "CREATE TRIGGER IF NOT EXISTS articleposts_search_delete AFTER DELETE ON ArticlePosts BEGIN INSERT INTO ArticlePostsSearch(ArticlePostsSearch, rowid, subject, name, message) VALUES('delete', old.post_id, old.subject, old.name, old.message); END",
+    // index everything posted while the triggers were not there
+    "INSERT INTO ArticlePostsSearch(ArticlePostsSearch) VALUES('rebuild')",
+  }
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+}
+
+// sqlite cannot add constraints to existing tables
+// cascading deletes are done by hand in DeleteArticle
+func (self SQLiteDatabase) upgrade0to1() {
+
+  log.Println("migrating... 0 -> 1")
+
+  var err error
+
+  // sqlite has no DROP COLUMN, only add it if we don't have it
+  if ! self.hasColumn("ArticlePosts", "addr") {
+    _, err = self.conn.Exec("ALTER TABLE ArticlePosts ADD COLUMN addr VARCHAR(255)")
+    checkError(err)
+  }
+
+  cmds := []string{
+    // newsgroups table
+    "CREATE INDEX IF NOT EXISTS newsgroups_name ON Newsgroups(name)",
+    // article posts table
+    "CREATE UNIQUE INDEX IF NOT EXISTS articleposts_msgid ON ArticlePosts(message_id)",
+    "CREATE INDEX IF NOT EXISTS articleposts_ref ON ArticlePosts(ref_id)",
+    "CREATE INDEX IF NOT EXISTS articleposts_group ON ArticlePosts(newsgroup)",
+    // article keys table
+    "DELETE FROM ArticleKeys WHERE message_id NOT IN ( SELECT message_id FROM ArticlePosts )",
+    "CREATE INDEX IF NOT EXISTS articlekeys_msgid ON ArticleKeys(message_id)",
+    // article threads table
+    "DELETE FROM ArticleThreads WHERE root_message_id NOT IN ( SELECT message_id FROM ArticlePosts )",
+    "CREATE INDEX IF NOT EXISTS articlethreads_root ON ArticleThreads(root_message_id)",
+    "CREATE INDEX IF NOT EXISTS articlethreads_group ON ArticleThreads(newsgroup)",
+    // article attachments table
+    "DELETE FROM ArticleAttachments WHERE message_id NOT IN ( SELECT message_id FROM ArticlePosts )",
+    "CREATE INDEX IF NOT EXISTS articleattachments_msgid ON ArticleAttachments(message_id)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(1)
+}
+
+// version 2 adds the outbound feed queue
+func (self SQLiteDatabase) upgrade1to2() {
+
+  log.Println("migrating... 1 -> 2")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS ArticleFeedQueue(
+       feed VARCHAR(255) NOT NULL,
+       message_id VARCHAR(255) NOT NULL,
+       queued INTEGER NOT NULL,
+       next_attempt INTEGER NOT NULL,
+       attempts INTEGER NOT NULL DEFAULT 0,
+       outcome INTEGER NOT NULL DEFAULT 0,
+       pending INTEGER NOT NULL DEFAULT 1,
+       PRIMARY KEY(feed, message_id)
+     )`,
+    "CREATE INDEX IF NOT EXISTS articlefeedqueue_due ON ArticleFeedQueue(feed, pending, next_attempt)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(2)
+}
+
+// version 3 adds high water marks for syncing from feeds
+func (self SQLiteDatabase) upgrade2to3() {
+
+  log.Println("migrating... 2 -> 3")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS FeedHighWaterMarks(
+       feed VARCHAR(255) NOT NULL,
+       newsgroup VARCHAR(255) NOT NULL,
+       mark INTEGER NOT NULL,
+       updated INTEGER NOT NULL,
+       PRIMARY KEY(feed, newsgroup)
+     )`,
+    "CREATE INDEX IF NOT EXISTS feedhighwatermarks_feed ON FeedHighWaterMarks(feed)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(3)
+}
+
+func (self SQLiteDatabase) upgrade3to4() {
+
+  log.Println("migrating... 3 -> 4")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS APITokens(
+       name VARCHAR(255) PRIMARY KEY,
+       token_hash VARCHAR(64) NOT NULL UNIQUE,
+       scope TEXT NOT NULL,
+       rate_limit INTEGER NOT NULL,
+       issued INTEGER NOT NULL
+     )`,
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(4)
+}
+
+func (self SQLiteDatabase) upgrade4to5() {
+
+  log.Println("migrating... 4 -> 5")
+
+  var err error
+
+  cmds := []string{
+    `CREATE TABLE IF NOT EXISTS BoardSettings(
+       newsgroup VARCHAR(255) PRIMARY KEY,
+       threads_per_page INTEGER NOT NULL,
+       pages INTEGER NOT NULL,
+       bump_limit INTEGER NOT NULL,
+       reply_limit INTEGER NOT NULL,
+       max_attachment_size INTEGER NOT NULL,
+       mime_types TEXT NOT NULL,
+       allow_anon BOOLEAN NOT NULL
+     )`,
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(5)
+}
+
+func (self SQLiteDatabase) upgrade5to6() {
+
+  log.Println("migrating... 5 -> 6")
+
+  var err error
+
+  // sqlite has no ADD COLUMN IF NOT EXISTS
+  if ! self.hasColumn("ArticleThreads", "sticky") {
+    _, err = self.conn.Exec("ALTER TABLE ArticleThreads ADD COLUMN sticky BOOLEAN NOT NULL DEFAULT 0")
+    checkError(err)
+  }
+  if ! self.hasColumn("ArticleThreads", "locked") {
+    _, err = self.conn.Exec("ALTER TABLE ArticleThreads ADD COLUMN locked BOOLEAN NOT NULL DEFAULT 0")
+    checkError(err)
+  }
+  self.setDBVersion(6)
+}
+
+func (self SQLiteDatabase) upgrade6to7() {
+
+  log.Println("migrating... 6 -> 7")
+
+  var err error
+
+  if ! self.hasColumn("ModLogs", "reason") {
+    _, err = self.conn.Exec("ALTER TABLE ModLogs ADD COLUMN reason TEXT")
+    checkError(err)
+  }
+  if ! self.hasColumn("ModLogs", "scope") {
+    _, err = self.conn.Exec("ALTER TABLE ModLogs ADD COLUMN scope VARCHAR(255)")
+    checkError(err)
+  }
+  _, err = self.conn.Exec("CREATE INDEX IF NOT EXISTS modlogs_time ON ModLogs(time)")
+  checkError(err)
+  self.setDBVersion(7)
+}
+
+func (self SQLiteDatabase) upgrade7to8() {
+
+  log.Println("migrating... 7 -> 8")
+
+  var err error
+
+  for _, table := range []string{"IPBans", "EncIPBans"} {
+    if ! self.hasColumn(table, "reason") {
+      _, err = self.conn.Exec("ALTER TABLE " + table + " ADD COLUMN reason TEXT")
+      checkError(err)
+    }
+    if ! self.hasColumn(table, "scope") {
+      _, err = self.conn.Exec("ALTER TABLE " + table + " ADD COLUMN scope VARCHAR(255)")
+      checkError(err)
+    }
+  }
+  self.setDBVersion(8)
+}
+
+// finished articles are deleted from the feed queue instead of kept
+func (self SQLiteDatabase) upgrade8to9() {
+
+  log.Println("migrating... 8 -> 9")
+
+  var err error
+
+  cmds := []string{
+    "DELETE FROM ArticleFeedQueue WHERE pending = 0",
+    "CREATE INDEX IF NOT EXISTS articlefeedqueue_message_id ON ArticleFeedQueue(message_id)",
+    "CREATE INDEX IF NOT EXISTS articlefeedqueue_queued ON ArticleFeedQueue(queued)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(9)
+}
+
+// articles get a stable number in their newsgroup when registered
+// number what we have oldest first
+func (self SQLiteDatabase) upgrade9to10() {
+
+  log.Println("migrating... 9 -> 10")
+
+  var err error
+
+  if ! self.hasColumn("Newsgroups", "last_nntp_id") {
+    _, err = self.conn.Exec("ALTER TABLE Newsgroups ADD COLUMN last_nntp_id INTEGER NOT NULL DEFAULT 0")
+    checkError(err)
+  }
+  if ! self.hasColumn("ArticlePosts", "nntp_id") {
+    _, err = self.conn.Exec("ALTER TABLE ArticlePosts ADD COLUMN nntp_id INTEGER NOT NULL DEFAULT 0")
+    checkError(err)
+  }
+
+  cmds := []string{
+    "UPDATE ArticlePosts SET nntp_id = ( SELECT COUNT(*) FROM ArticlePosts p WHERE p.newsgroup = ArticlePosts.newsgroup AND ( p.time_posted < ArticlePosts.time_posted OR ( p.time_posted = ArticlePosts.time_posted AND p.message_id <= ArticlePosts.message_id ) ) )",
+    "UPDATE Newsgroups SET last_nntp_id = ( SELECT COALESCE(MAX(nntp_id), 0) FROM ArticlePosts WHERE newsgroup = Newsgroups.name )",
+    "CREATE INDEX IF NOT EXISTS articleposts_nntp_id ON ArticlePosts(newsgroup, nntp_id)",
+  }
+
+  for _, cmd := range cmds {
+    _, err = self.conn.Exec(cmd)
+    checkError(err)
+  }
+  self.setDBVersion(10)
+}
+
+// give posts an integer primary key for the search index to use
+// the implicit rowid can change on VACUUM
+// sqlite cannot add a primary key to a table so copy it to a new one
+func (self SQLiteDatabase) upgrade10to11() {
+
+  log.Println("migrating... 10 -> 11")
+
+  cmds := []string{
+    `CREATE TABLE ArticlePostsNew (
+       post_id INTEGER PRIMARY KEY,
+       newsgroup VARCHAR(255),
+       message_id VARCHAR(255),
+       ref_id VARCHAR(255),
+       name TEXT NOT NULL,
+       subject TEXT NOT NULL,
+       path TEXT NOT NULL,
+       time_posted INTEGER NOT NULL,
+       message TEXT NOT NULL,
+       addr VARCHAR(255),
+       nntp_id INTEGER NOT NULL DEFAULT 0
+     )`,
+    "INSERT INTO ArticlePostsNew(newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id) SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id FROM ArticlePosts ORDER BY rowid",
+    // takes the search triggers with it, createSearchIndex makes new ones
+    "DROP TABLE ArticlePosts",
+    "ALTER TABLE ArticlePostsNew RENAME TO ArticlePosts",
+    "CREATE UNIQUE INDEX IF NOT EXISTS articleposts_msgid ON ArticlePosts(message_id)",
+    "CREATE INDEX IF NOT EXISTS articleposts_ref ON ArticlePosts(ref_id)",
+    "CREATE INDEX IF NOT EXISTS articleposts_group ON ArticlePosts(newsgroup)",
+    "CREATE INDEX IF NOT EXISTS articleposts_nntp_id ON ArticlePosts(newsgroup, nntp_id)",
+  }
+
+  tx, err := self.conn.Begin()
+  checkError(err)
+  for _, cmd := range cmds {
+    _, err = tx.Exec(cmd)
+    if err != nil {
+      tx.Rollback()
+      checkError(err)
+    }
+  }
+  checkError(tx.Commit())
+  self.setDBVersion(11)
+}
+
+// check if a table has a column
+func (self SQLiteDatabase) hasColumn(table, column string) (has bool) {
+  rows, err := self.conn.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+  if err == nil {
+    for rows.Next() {
+      var cid, notnull, pk int
+      var name, coltype string
+      var dflt sql.NullString
+      rows.Scan(&cid, &name, &coltype, &notnull, &dflt, &pk)
+      if name == column {
+        has = true
+      }
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get table info for", table, err)
+  }
+  return
+}
+
+// create all tables for database version 0
+func (self SQLiteDatabase) createTablesV0() {
+  tables := make(map[string]string)
+
+  // table of active newsgroups
+  tables["Newsgroups"] = `(
+                            name VARCHAR(255) PRIMARY KEY,
+                            last_post INTEGER NOT NULL,
+                            restricted BOOLEAN
+                          )`
+
+  // table for ip and their encryption key
+  tables["EncryptedAddrs"] = `(
+                                enckey VARCHAR(255) NOT NULL,
+                                addr VARCHAR(255) NOT NULL,
+                                encaddr VARCHAR(255) NOT NULL
+                              )`
+
+  // table for articles that have been banned
+  tables["BannedArticles"] = `(
+                                message_id VARCHAR(255) PRIMARY KEY,
+                                time_banned INTEGER NOT NULL,
+                                ban_reason TEXT NOT NULL
+                              )`
+
+  // table for banned newsgroups
+  tables["BannedGroups"] = `(
+                             newsgroup VARCHAR(255) PRIMARY KEY,
+                             time_banned INTEGER NOT NULL
+                           )`
+
+  // table for storing nntp article meta data
+  tables["Articles"] = `(
+                          message_id VARCHAR(255) PRIMARY KEY,
+                          message_id_hash VARCHAR(40) UNIQUE NOT NULL,
+                          message_newsgroup VARCHAR(255),
+                          message_ref_id VARCHAR(255),
+                          time_obtained INTEGER NOT NULL,
+                          FOREIGN KEY(message_newsgroup) REFERENCES Newsgroups(name)
+                        )`
+
+  // table for storing nntp article post content
+  tables["ArticlePosts"] = `(
+                              newsgroup VARCHAR(255),
+                              message_id VARCHAR(255),
+                              ref_id VARCHAR(255),
+                              name TEXT NOT NULL,
+                              subject TEXT NOT NULL,
+                              path TEXT NOT NULL,
+                              time_posted INTEGER NOT NULL,
+                              message TEXT NOT NULL
+                            )`
+
+  // table for storing nntp article posts to pubkey mapping
+  tables["ArticleKeys"] = `(
+                             message_id VARCHAR(255) NOT NULL,
+                             pubkey VARCHAR(255) NOT NULL
+                           )`
+
+  // table for thread state
+  tables["ArticleThreads"] = `(
+                                newsgroup VARCHAR(255) NOT NULL,
+                                root_message_id VARCHAR(255) NOT NULL,
+                                last_bump INTEGER NOT NULL,
+                                last_post INTEGER NOT NULL
+                              )`
+
+  // table for storing nntp article attachment info
+  tables["ArticleAttachments"] = `(
+                                    message_id VARCHAR(255),
+                                    sha_hash VARCHAR(128) NOT NULL,
+                                    filename TEXT NOT NULL,
+                                    filepath TEXT NOT NULL
+                                  )`
+
+  // table for storing current permissions of mod pubkeys
+  tables["ModPrivs"] = `(
+                          pubkey VARCHAR(255),
+                          newsgroup VARCHAR(255),
+                          permission VARCHAR(255)
+                        )`
+
+  // table for storing moderation events
+  tables["ModLogs"] = `(
+                         pubkey VARCHAR(255),
+                         action VARCHAR(255),
+                         target VARCHAR(255),
+                         time INTEGER
+                       )`
+
+  // ip range bans
+  // sqlite has no cidr type, ranges are matched in CheckIPBanned
+  tables["IPBans"] = `(
+                        addr VARCHAR(255) NOT NULL,
+                        made INTEGER NOT NULL,
+                        expires INTEGER NOT NULL
+                      )`
+  // bans for encrypted addresses that we don't have the ip for
+  tables["EncIPBans"] = `(
+                           encaddr VARCHAR(255) NOT NULL,
+                           made INTEGER NOT NULL,
+                           expires INTEGER NOT NULL
+                         )`
+
+  tables["Settings"] = `(
+                           name VARCHAR(255) NOT NULL,
+                           value VARCHAR(255) NOT NULL
+                        )`
+  var err error
+
+  table_order := []string{"Newsgroups", "BannedGroups", "BannedArticles", "IPBans", "EncIPBans", "Settings", "Articles", "ArticlePosts", "ArticleKeys", "ArticleThreads", "ArticleAttachments", "ModPrivs", "ModLogs", "EncryptedAddrs" }
+  for _, table := range table_order {
+    q := tables[table]
+    // create table
+    _, err = self.conn.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s%s", table, q))
+    if err != nil {
+      log.Fatalf("cannot create table %s, %s, database was '%s'", table, err, self.db_str)
+    }
+  }
+  self.setDBVersion(0)
+}
+
+// set what the current database version is
+func (self SQLiteDatabase) setDBVersion(version int) (err error) {
+  log.Println("set db version to", version)
+  _, err = self.conn.Exec("DELETE FROM Settings WHERE name = ?", "version")
+  _, err = self.conn.Exec("INSERT INTO Settings(name, value) VALUES(?, ?)", "version", fmt.Sprintf("%d", version))
+  return
+}
+
+// get the current database version
+func (self SQLiteDatabase) getDBVersion() (version int) {
+  var val string
+  var vers int64
+  err := self.conn.QueryRow("SELECT value FROM Settings WHERE name = ?", "version").Scan(&val)
+  if err == nil {
+    vers, err = strconv.ParseInt(val, 10, 32)
+    if err == nil {
+      version = int(vers)
+    } else {
+      log.Fatal("cannot figure out db version", err)
+    }
+  } else {
+    version = -1
+  }
+  return
+}
+
+func (self SQLiteDatabase) BanNewsgroup(group string) (err error) {
+  _, err = self.conn.Exec("INSERT INTO BannedGroups(newsgroup, time_banned) VALUES(?, ?)", group, timeNow())
+  return
+}
+
+func (self SQLiteDatabase) UnbanNewsgroup(group string) (err error) {
+  _, err = self.conn.Exec("DELETE FROM BannedGroups WHERE newsgroup = ?", group)
+  return
+}
+
+func (self SQLiteDatabase) NewsgroupBanned(group string) (banned bool, err error) {
+  var count int64
+  err = self.conn.QueryRow("SELECT COUNT(newsgroup) FROM BannedGroups WHERE newsgroup = ?", group).Scan(&count)
+  banned = count > 0
+  return
+}
+
+func (self SQLiteDatabase) NukeNewsgroup(group string, store ArticleStore) {
+  // first delete all thread presences
+  _, _ = self.conn.Exec("DELETE FROM ArticleThreads WHERE newsgroup = ?", group)
+  // get all articles in that newsgroup
+  // read them all first, we only have 1 connection
+  var articles []ArticleEntry
+  chnl := make(chan ArticleEntry, 24)
+  go func () {
+    self.GetAllArticlesInGroup(group, chnl)
+    close(chnl)
+  }()
+  for article := range chnl {
+    articles = append(articles, article)
+  }
+  // for each article delete it fully
+  for _, article := range articles {
+    msgid := article.MessageID()
+    log.Println("delete", msgid)
+    // remove article from store
+    fname := store.GetFilename(msgid)
+    os.Remove(fname)
+    // get all attachments
+    for _, att := range(self.GetPostAttachments(msgid)) {
+      // remove attachment
+      log.Println("delete attachment", att)
+      os.Remove(store.ThumbnailFilepath(att))
+      os.Remove(store.AttachmentFilepath(att))
+    }
+    // delete from database
+    self.DeleteArticle(msgid)
+  }
+  log.Println("nuke of", group, "done")
+}
+
+func (self SQLiteDatabase) AddModPubkey(pubkey string) error {
+  if self.CheckModPubkey(pubkey) {
+    log.Println("did not add pubkey", pubkey, "already exists")
+    return nil
+  }
+  _, err := self.conn.Exec("INSERT INTO ModPrivs(pubkey, newsgroup, permission) VALUES ( ?, ?, ? )", pubkey, "ctl", "login")
+  return err
+}
+
+func (self SQLiteDatabase) GetGroupForMessage(message_id string) (group string, err error) {
+  err = self.conn.QueryRow("SELECT newsgroup FROM ArticlePosts WHERE message_id = ?", message_id).Scan(&group)
+  return
+}
+
+func (self SQLiteDatabase) GetPageForRootMessage(root_message_id string) (group string, page int64, err error) {
+  err = self.conn.QueryRow("SELECT newsgroup FROM ArticleThreads WHERE root_message_id = ?", root_message_id).Scan(&group)
+  if err == nil {
+    perpage, _ := self.GetThreadsPerPage(group)
+    err = self.conn.QueryRow("SELECT COUNT(*) FROM ArticleThreads WHERE newsgroup = ? AND last_bump >= ( SELECT last_bump FROM ArticleThreads WHERE root_message_id = ? )", group, root_message_id).Scan(&page)
+    return group, page / int64(perpage), err
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetInfoForMessage(msgid string) (root string, newsgroup string, page int64, err error) {
+  err = self.conn.QueryRow("SELECT newsgroup, ref_id FROM ArticlePosts WHERE message_id = ?", msgid).Scan(&newsgroup, &root)
+  if err == nil {
+    if root == "" {
+      root = msgid
+    }
+    perpage, _ := self.GetThreadsPerPage(newsgroup)
+    err = self.conn.QueryRow("SELECT COUNT(*) FROM ArticleThreads WHERE newsgroup = ? AND last_bump >= ( SELECT last_bump FROM ArticleThreads WHERE root_message_id = ? )", newsgroup, root).Scan(&page)
+    page = page / int64(perpage)
+  }
+  return
+}
+
+func (self SQLiteDatabase) CheckModPubkeyGlobal(pubkey string) bool {
+  var result int64
+  _ = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND permission = ?", pubkey, "overchan", "all").Scan(&result)
+  return result > 0
+}
+
+func (self SQLiteDatabase) CheckModPubkeyCanModGroup(pubkey, newsgroup string) bool {
+  var result int64
+  _ = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = ? AND newsgroup = ?", pubkey, newsgroup).Scan(&result)
+  return result > 0
+}
+
+func (self SQLiteDatabase) CountPostsInGroup(newsgroup string, time_frame int64) (result int64) {
+  if time_frame > 0 {
+    time_frame = timeNow() - time_frame
+  } else if time_frame < 0 {
+    time_frame = 0
+  }
+  self.conn.QueryRow("SELECT COUNT(*) FROM ArticlePosts WHERE time_posted > ? AND newsgroup = ?", time_frame, newsgroup).Scan(&result)
+  return
+}
+
+func (self SQLiteDatabase) CheckModPubkey(pubkey string) bool {
+  var result int64
+  self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND permission = ?", pubkey, "ctl", "login").Scan(&result)
+  return result > 0
+}
+
+func (self SQLiteDatabase) BanArticle(messageID, reason string) error {
+  if self.ArticleBanned(messageID) {
+    log.Println(messageID, "already banned")
+    return nil
+  }
+  _, err := self.conn.Exec("INSERT INTO BannedArticles(message_id, time_banned, ban_reason) VALUES(?, ?, ?)", messageID, timeNow(), reason)
+  return err
+}
+
+func (self SQLiteDatabase) ArticleBanned(messageID string) (result bool) {
+
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM BannedArticles WHERE message_id = ?", messageID).Scan(&count)
+  if err == nil {
+    result = count > 0
+  } else {
+    log.Println("error checking if article is banned", err)
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetEncAddress(addr string) (encaddr string, err error) {
+  var count int64
+  err = self.conn.QueryRow("SELECT COUNT(addr) FROM EncryptedAddrs WHERE addr = ?", addr).Scan(&count)
+  if err == nil {
+    if count == 0 {
+      // needs to be inserted
+      var key string
+      key, encaddr = newAddrEnc(addr)
+      if len(encaddr) == 0 {
+        err = errors.New("failed to generate new encryption key")
+      } else {
+        _, err = self.conn.Exec("INSERT INTO EncryptedAddrs(enckey, encaddr, addr) VALUES(?, ?, ?)", key, encaddr, addr)
+      }
+    } else {
+      err = self.conn.QueryRow("SELECT encAddr FROM EncryptedAddrs WHERE addr = ? LIMIT 1", addr).Scan(&encaddr)
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetEncKey(encAddr string) (enckey string, err error) {
+  err = self.conn.QueryRow("SELECT enckey FROM EncryptedAddrs WHERE encaddr = ? LIMIT 1", encAddr).Scan(&enckey)
+  return
+}
+
+// get every banned address or range even if it ran out
+func (self SQLiteDatabase) getIPBans() (bans []IPBan, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query("SELECT addr, made, expires, COALESCE(reason, ''), COALESCE(scope, '') FROM IPBans ORDER BY made DESC")
+  if err == nil {
+    for rows.Next() {
+      var ban IPBan
+      rows.Scan(&ban.Addr, &ban.Made, &ban.Expires, &ban.Reason, &ban.Scope)
+      bans = append(bans, ban)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) CheckIPBanned(addr string) (banned bool, err error) {
+  var bans []IPBan
+  bans, err = self.getIPBans()
+  if err == nil {
+    for _, ban := range bans {
+      if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+        banned = true
+        break
+      }
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetIPAddress(encaddr string) (addr string, err error) {
+  var count int64
+  err = self.conn.QueryRow("SELECT COUNT(encAddr) FROM EncryptedAddrs WHERE encAddr = ?", encaddr).Scan(&count)
+  if err == nil && count > 0 {
+    err = self.conn.QueryRow("SELECT addr FROM EncryptedAddrs WHERE encAddr = ? LIMIT 1", encaddr).Scan(&addr)
+  }
+  return
+}
+
+func (self SQLiteDatabase) MarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    // already marked
+    log.Println("pubkey already marked as global", pubkey)
+  } else {
+    _, err = self.conn.Exec("INSERT INTO ModPrivs(pubkey, newsgroup, permission) VALUES ( ?, ?, ? )", pubkey, "overchan", "all")
+  }
+  return
+}
+
+func (self SQLiteDatabase) UnMarkModPubkeyGlobal(pubkey string) (err error) {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    // already marked
+    _ , err = self.conn.Exec("DELETE FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND permission = ?", pubkey, "overchan", "all")
+  } else {
+    err = errors.New("public key not marked as global")
+  }
+  return
+}
+
+func (self SQLiteDatabase) CountThreadReplies(root_message_id string) (repls int64) {
+  _ = self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts WHERE ref_id = ?", root_message_id).Scan(&repls)
+  return
+}
+
+func (self SQLiteDatabase) GetRootPostsForExpiration(newsgroup string, threadcount int) (roots []string) {
+
+  rows, err := self.conn.Query("SELECT root_message_id FROM ArticleThreads WHERE newsgroup = ? AND NOT sticky AND root_message_id NOT IN ( SELECT root_message_id FROM ArticleThreads WHERE newsgroup = ? ORDER BY sticky DESC, last_bump DESC LIMIT ?)", newsgroup, newsgroup, threadcount)
+  if err == nil {
+    // get results
+    for rows.Next() {
+      var root string
+      rows.Scan(&root)
+      roots = append(roots, root)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get root posts for expiration", err)
+  }
+  // return the list of expired roots
+  return
+}
+
+func (self SQLiteDatabase) GetAllNewsgroups() (groups []string) {
+
+  rows, err := self.conn.Query("SELECT name FROM Newsgroups")
+  if err == nil {
+    for rows.Next() {
+      var group string
+      rows.Scan(&group)
+      groups = append(groups, group)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetGroupPageCount(newsgroup string) int64 {
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(*) FROM ArticleThreads WHERE newsgroup = ?", newsgroup).Scan(&count)
+  if err != nil {
+    log.Println("failed to count pages in group", newsgroup, err)
+  }
+  // divide by threads per page
+  perpage, _ := self.GetThreadsPerPage(newsgroup)
+  return ( count / int64(perpage) ) + 1
+}
+
+// only fetches root posts
+// does not update the thread contents
+func (self SQLiteDatabase) GetGroupForPage(prefix, frontend, newsgroup string, pageno, perpage int) BoardModel {
+  var threads []ThreadModel
+  pages := self.GetGroupPageCount(newsgroup)
+  var posts []post
+  rows, err := self.conn.Query("SELECT p.newsgroup, p.message_id, p.name, p.subject, p.path, p.time_posted, p.message FROM ArticlePosts p INNER JOIN ( SELECT root_message_id, last_bump, sticky FROM ArticleThreads WHERE newsgroup = ? ORDER BY sticky DESC, last_bump DESC LIMIT ? OFFSET ? ) AS roots ON ( roots.root_message_id = p.message_id ) ORDER BY roots.sticky DESC, roots.last_bump DESC", newsgroup, perpage, pageno * perpage)
+  if err == nil {
+    // read all rows before doing more queries, we only have 1 connection
+    for rows.Next() {
+      p := post{
+        prefix: prefix,
+      }
+      rows.Scan(&p.board, &p.message_id, &p.name, &p.subject, &p.path, &p.posted, &p.message)
+      posts = append(posts, p)
+    }
+    rows.Close()
+    for _, p := range posts {
+      p.parent = p.message_id
+      p.op = true
+      _ = self.conn.QueryRow("SELECT pubkey FROM ArticleKeys WHERE message_id = ?", p.message_id).Scan(&p.pubkey)
+      p.sage = isSage(p.subject)
+      atts := self.GetPostAttachmentModels(prefix, p.message_id)
+      if atts != nil {
+        p.attachments = append(p.attachments, atts...)
+      }
+      threads = append(threads, thread{
+        prefix: prefix,
+        posts: []PostModel{p},
+        links: []LinkModel{
+          linkModel{
+            text: newsgroup,
+            link: fmt.Sprintf("%s%s-0.html", prefix, newsgroup),
+          },
+        },
+      })
+    }
+  } else {
+    log.Println("failed to fetch board model for", newsgroup, "page", pageno, err)
+  }
+  return boardModel{
+    prefix: prefix,
+    frontend: frontend,
+    board: newsgroup,
+    page: pageno,
+    pages: int(pages),
+    threads: threads,
+  }
+}
+
+func (self SQLiteDatabase) GetPostsInGroup(newsgroup string) (models []PostModel, err error) {
+
+  rows, err := self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr FROM ArticlePosts WHERE newsgroup = ? ORDER BY time_posted", newsgroup)
+  if err == nil {
+    for rows.Next() {
+      model := post{}
+      var addr sql.NullString
+      rows.Scan(&model.board, &model.message_id, &model.parent, &model.name, &model.subject, &model.path, &model.posted, &model.message, &addr)
+      model.addr = addr.String
+      models = append(models, model)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetPostModel(prefix, messageID string) PostModel {
+  model := post{}
+  var addr sql.NullString
+  err := self.conn.QueryRow("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr FROM ArticlePosts WHERE message_id = ? LIMIT 1", messageID).Scan(&model.board, &model.message_id, &model.parent, &model.name, &model.subject, &model.path, &model.posted, &model.message, &addr)
+  if err == nil {
+    model.addr = addr.String
+    model.op = len(model.parent) == 0
+    if len(model.parent) == 0 {
+      model.parent = model.message_id
+    }
+    model.sage = isSage(model.subject)
+    atts := self.GetPostAttachmentModels(prefix, messageID)
+    if atts != nil {
+      model.attachments = append(model.attachments, atts...)
+    }
+    // quiet fail
+    self.conn.QueryRow("SELECT pubkey FROM ArticleKeys WHERE message_id = ?", messageID).Scan(&model.pubkey)
+    return model
+  } else {
+    log.Println("failed to prepare query for geting post model for", messageID, err)
+    return nil
+  }
+}
+
+func (self SQLiteDatabase) SetThreadSticky(root_message_id string, sticky bool) (err error) {
+  _, err = self.conn.Exec("UPDATE ArticleThreads SET sticky = ? WHERE root_message_id = ?", sticky, root_message_id)
+  return
+}
+
+func (self SQLiteDatabase) SetThreadLocked(root_message_id string, locked bool) (err error) {
+  _, err = self.conn.Exec("UPDATE ArticleThreads SET locked = ? WHERE root_message_id = ?", locked, root_message_id)
+  return
+}
+
+func (self SQLiteDatabase) ThreadSticky(root_message_id string) (sticky bool) {
+  _ = self.conn.QueryRow("SELECT sticky FROM ArticleThreads WHERE root_message_id = ?", root_message_id).Scan(&sticky)
+  return
+}
+
+func (self SQLiteDatabase) ThreadLocked(root_message_id string) (locked bool) {
+  _ = self.conn.QueryRow("SELECT locked FROM ArticleThreads WHERE root_message_id = ?", root_message_id).Scan(&locked)
+  return
+}
+
+func (self SQLiteDatabase) DeleteThread(msgid string) (err error) {
+  _, err = self.conn.Exec("DELETE FROM ArticleThreads WHERE root_message_id = ?", msgid)
+  return
+}
+
+// no foreign key cascades in sqlite, delete everything by hand
+func (self SQLiteDatabase) DeleteArticle(msgid string) (err error) {
+  _, err = self.conn.Exec("DELETE FROM ArticlePosts WHERE message_id = ?", msgid)
+  _, err = self.conn.Exec("DELETE FROM ArticleKeys WHERE message_id = ?", msgid)
+  _, err = self.conn.Exec("DELETE FROM ArticleAttachments WHERE message_id = ?", msgid)
+  _, err = self.conn.Exec("DELETE FROM ArticleThreads WHERE root_message_id = ?", msgid)
+  _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE message_id = ?", msgid)
+  return
+}
+
+func (self SQLiteDatabase) GetThreadReplyPostModels(prefix, rootpost string, limit int) (repls []PostModel) {
+  var rows *sql.Rows
+  var err error
+  if limit > 0 {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr FROM ArticlePosts WHERE message_id IN ( SELECT message_id FROM ArticlePosts WHERE ref_id = ? ORDER BY time_posted DESC LIMIT ? ) ORDER BY time_posted ASC", rootpost, limit)
+  } else {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr FROM ArticlePosts WHERE ref_id = ? ORDER BY time_posted ASC", rootpost)
+  }
+
+  if err == nil {
+    var models []post
+    for rows.Next() {
+      model := post{}
+      model.prefix = prefix
+      var addr sql.NullString
+      rows.Scan(&model.board, &model.message_id, &model.parent, &model.name, &model.subject, &model.path, &model.posted, &model.message, &addr)
+      model.addr = addr.String
+      models = append(models, model)
+    }
+    rows.Close()
+    for _, model := range models {
+      model.op = len(model.parent) == 0
+      if len(model.parent) == 0 {
+        model.parent = model.message_id
+      }
+      model.sage = isSage(model.subject)
+      atts := self.GetPostAttachmentModels(prefix, model.message_id)
+      if atts != nil {
+        model.attachments = append(model.attachments, atts...)
+      }
+      // get pubkey if it exists
+      // quiet fail
+      _ = self.conn.QueryRow("SELECT pubkey FROM ArticleKeys WHERE message_id = ?", model.message_id).Scan(&model.pubkey)
+      repls = append(repls, model)
+    }
+  } else {
+    log.Println("failed to get thread replies", rootpost, err)
+  }
+
+  return
+}
+
+func (self SQLiteDatabase) GetThreadReplies(rootpost string, limit int) (repls []string) {
+  var rows *sql.Rows
+  var err error
+  if limit > 0 {
+    rows, err = self.conn.Query("SELECT message_id FROM ArticlePosts WHERE message_id IN ( SELECT message_id FROM ArticlePosts WHERE ref_id = ? ORDER BY time_posted DESC LIMIT ? ) ORDER BY time_posted ASC", rootpost, limit)
+  } else {
+    rows, err = self.conn.Query("SELECT message_id FROM ArticlePosts WHERE ref_id = ? ORDER BY time_posted ASC", rootpost)
+  }
+  if err == nil {
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      repls = append(repls, msgid)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get thread replies", rootpost, err)
+  }
+  return
+}
+
+func (self SQLiteDatabase) ThreadHasReplies(rootpost string) bool {
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts WHERE ref_id = ?", rootpost).Scan(&count)
+  if err != nil {
+    log.Println("failed to count thread replies", err)
+  }
+  return count > 0
+}
+
+func (self SQLiteDatabase) GetGroupThreads(group string, recv chan ArticleEntry) {
+  var roots []string
+  rows, err := self.conn.Query("SELECT message_id FROM ArticlePosts WHERE newsgroup = ? AND ref_id = '' ", group)
+  if err == nil {
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      roots = append(roots, msgid)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get group threads", err)
+  }
+  // send after the rows are closed so we don't hold our only connection
+  for _, msgid := range roots {
+    recv <- ArticleEntry{msgid, group}
+  }
+}
+
+func (self SQLiteDatabase) GetLastBumpedThreads(newsgroup string, threads int) (roots []ArticleEntry) {
+  var err error
+  var rows *sql.Rows
+  if len(newsgroup) > 0 {
+    rows, err = self.conn.Query("SELECT root_message_id, newsgroup FROM ArticleThreads WHERE newsgroup = ? ORDER BY last_bump DESC LIMIT ?", newsgroup, threads)
+  } else {
+    rows, err = self.conn.Query("SELECT root_message_id, newsgroup FROM ArticleThreads WHERE newsgroup != 'ctl' ORDER BY last_bump DESC LIMIT ?", threads)
+  }
+
+  if err == nil {
+    for rows.Next() {
+      var ent ArticleEntry
+      rows.Scan(&ent[0], &ent[1])
+      roots = append(roots, ent)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get last bumped", err)
+  }
+  return
+}
+
+func (self SQLiteDatabase) GroupHasPosts(group string) bool {
+
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts WHERE newsgroup = ?", group).Scan(&count)
+  if err != nil {
+    log.Println("error counting posts in group", group, err)
+  }
+  return count > 0
+}
+
+// check if a newsgroup exists
+func (self SQLiteDatabase) HasNewsgroup(group string) bool {
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(name) FROM Newsgroups WHERE name = ?", group).Scan(&count)
+  if err != nil {
+    log.Println("failed to check for newsgroup", group, err)
+  }
+  return count > 0
+}
+
+// check if an article exists
+func (self SQLiteDatabase) HasArticle(message_id string) bool {
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM Articles WHERE message_id = ?", message_id).Scan(&count)
+  if err != nil {
+    log.Println("failed to check for article", message_id, err)
+  }
+  return count > 0
+}
+
+// check if an article exists locally
+func (self SQLiteDatabase) HasArticleLocal(message_id string) bool {
+  var count int64
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts WHERE message_id = ?", message_id).Scan(&count)
+  if err != nil {
+    log.Println("failed to check for local article", message_id, err)
+  }
+  return count > 0
+}
+
+// count articles we have
+func (self SQLiteDatabase) ArticleCount() (count int64) {
+
+  err := self.conn.QueryRow("SELECT COUNT(message_id) FROM ArticlePosts").Scan(&count)
+  if err != nil {
+    log.Println("failed to count articles", err)
+  }
+  return
+}
+
+// register a new newsgroup
+func (self SQLiteDatabase) RegisterNewsgroup(group string) {
+  _, err := self.conn.Exec("INSERT INTO Newsgroups (name, last_post) VALUES(?, ?)", group, timeNow())
+  if err != nil {
+    log.Println("failed to register newsgroup", group, err)
+  }
+}
+
+func (self SQLiteDatabase) GetPostAttachments(messageID string) (atts []string) {
+  rows, err := self.conn.Query("SELECT filepath FROM ArticleAttachments WHERE message_id = ?", messageID)
+  if err == nil {
+    for rows.Next() {
+      var val string
+      rows.Scan(&val)
+      atts = append(atts, val)
+    }
+    rows.Close()
+  } else {
+    log.Println("cannot find attachments for", messageID, err)
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetPostAttachmentModels(prefix, messageID string) (atts []AttachmentModel) {
+  rows, err := self.conn.Query("SELECT filepath, filename FROM ArticleAttachments WHERE message_id = ?", messageID)
+  if err == nil {
+    for rows.Next() {
+      var fpath, fname string
+      rows.Scan(&fpath, &fname)
+      atts = append(atts, attachment{
+        prefix: prefix,
+        filepath: fpath,
+        filename: fname,
+      })
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get attachment models for", messageID, err)
+  }
+  return
+}
+
+// register a message with the database
+// bump a newsgroup's last post time and give out the next nntp id in it
+// done in a transaction so no 2 articles get the same id
+func (self SQLiteDatabase) nextNNTPID(group string, now int64) (nntp_id int64, err error) {
+  var tx *sql.Tx
+  tx, err = self.conn.Begin()
+  if err == nil {
+    _, err = tx.Exec("UPDATE Newsgroups SET last_post = ?, last_nntp_id = last_nntp_id + 1 WHERE name = ?", now, group)
+    if err == nil {
+      err = tx.QueryRow("SELECT last_nntp_id FROM Newsgroups WHERE name = ?", group).Scan(&nntp_id)
+    }
+    if err == nil {
+      err = tx.Commit()
+    } else {
+      tx.Rollback()
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) RegisterArticle(message NNTPMessage) {
+
+  msgid := message.MessageID()
+  group := message.Newsgroup()
+
+  if ! self.HasNewsgroup(group) {
+    self.RegisterNewsgroup(group)
+  }
+  if self.HasArticle(msgid) {
+    return
+  }
+  now := timeNow()
+  // insert article metadata
+  _, err := self.conn.Exec("INSERT INTO Articles (message_id, message_id_hash, message_newsgroup, time_obtained, message_ref_id) VALUES(?, ?, ?, ?, ?)", msgid, HashMessageID(msgid), group, now, message.Reference())
+  if err != nil {
+    log.Println("failed to insert article metadata", err)
+    return
+  }
+  // update newsgroup and take the next nntp id in it
+  nntp_id, err := self.nextNNTPID(group, now)
+  if err != nil {
+    log.Println("failed to update newsgroup last post", err)
+    return
+  }
+  // insert article post
+  _, err = self.conn.Exec("INSERT INTO ArticlePosts(newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?)", group, msgid, message.Reference(), message.Name(), message.Subject(), message.Path(), message.Posted(), message.Message(), message.Addr(), nntp_id)
+  if err != nil {
+    log.Println("cannot insert article post", err)
+    return
+  }
+
+  // set / update thread state
+  if message.OP() {
+    // insert new thread for op
+    _, err = self.conn.Exec("INSERT INTO ArticleThreads(root_message_id, last_bump, last_post, newsgroup) VALUES(?, ?, ?, ?)", message.MessageID(), message.Posted(), message.Posted(), group)
+
+    if err != nil {
+      log.Println("cannot register thread", msgid, err)
+      return
+    }
+  } else {
+    ref := message.Reference()
+    // replies past the bump limit don't bump
+    settings, _ := self.GetBoardSettings(group)
+    if ! message.Sage() && settings.ReplyBumps(self.CountThreadReplies(ref)) {
+      // bump it
+      _, err = self.conn.Exec("UPDATE ArticleThreads SET last_bump = ? WHERE root_message_id = ?", message.Posted(), ref)
+      if err != nil {
+        log.Println("failed to bump thread", ref, err)
+        return
+      }
+    }
+    // update last posted
+    _, err = self.conn.Exec("UPDATE ArticleThreads SET last_post = ? WHERE root_message_id = ?", message.Posted(), ref)
+    if err != nil {
+      log.Println("failed to update post time for", ref, err)
+      return
+    }
+  }
+
+  // register all attachments
+  atts := message.Attachments()
+  if atts == nil {
+    // no attachments
+    return
+  }
+  for _, att := range atts {
+    _, err = self.conn.Exec("INSERT INTO ArticleAttachments(message_id, sha_hash, filename, filepath) VALUES(?, ?, ?, ?)", msgid, hex.EncodeToString(att.Hash()), att.Filename(), att.Filepath())
+    if err != nil {
+      log.Println("failed to register attachment", err)
+      continue
+    }
+  }
+}
+
+func (self SQLiteDatabase) RegisterSigned(message_id , pubkey string) (err error) {
+  _, err = self.conn.Exec("INSERT INTO ArticleKeys(message_id, pubkey) VALUES (?, ?)", message_id, pubkey)
+  return
+}
+
+// get all articles in a newsgroup
+// send result down a channel
+func (self SQLiteDatabase) GetAllArticlesInGroup(group string, recv chan ArticleEntry) {
+  var articles []ArticleEntry
+  rows, err := self.conn.Query("SELECT message_id FROM ArticlePosts WHERE newsgroup = ?", group)
+  if err != nil {
+    log.Printf("failed to get all articles in %s: %s", group, err)
+    return
+  }
+  for rows.Next() {
+    var msgid string
+    rows.Scan(&msgid)
+    articles = append(articles, ArticleEntry{msgid, group})
+  }
+  rows.Close()
+  // send after the rows are closed so we don't hold our only connection
+  for _, article := range articles {
+    recv <- article
+  }
+}
+
+// get all articles
+func (self SQLiteDatabase) GetAllArticles() (articles []ArticleEntry) {
+  rows, err := self.conn.Query("SELECT message_id, newsgroup FROM ArticlePosts")
+  if err == nil {
+    for rows.Next() {
+      var entry ArticleEntry
+      rows.Scan(&entry[0], &entry[1])
+      articles = append(articles, entry)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get all articles", err)
+  }
+  return articles
+}
+
+func (self SQLiteDatabase) GetPagesPerBoard(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.Pages, err
+}
+
+func (self SQLiteDatabase) GetThreadsPerPage(group string) (int, error) {
+  settings, err := self.GetBoardSettings(group)
+  return settings.ThreadsPerPage, err
+}
+
+func (self SQLiteDatabase) GetBoardSettings(group string) (settings BoardSettings, err error) {
+  err = self.conn.QueryRow("SELECT threads_per_page, pages, bump_limit, reply_limit, max_attachment_size, mime_types, allow_anon FROM BoardSettings WHERE newsgroup = ?", group).Scan(&settings.ThreadsPerPage, &settings.Pages, &settings.BumpLimit, &settings.ReplyLimit, &settings.MaxAttachmentSize, &settings.MimeTypes, &settings.AllowAnon)
+  if err != nil {
+    if err != sql.ErrNoRows {
+      log.Println("failed to get settings for", group, err)
+    }
+    // fall back to defaults so callers can ignore the error
+    settings = DefaultBoardSettings()
+    if err == sql.ErrNoRows {
+      err = nil
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) SetBoardSettings(group string, settings BoardSettings) (err error) {
+  _, err = self.conn.Exec("INSERT OR REPLACE INTO BoardSettings(newsgroup, threads_per_page, pages, bump_limit, reply_limit, max_attachment_size, mime_types, allow_anon) VALUES(?, ?, ?, ?, ?, ?, ?, ?)", group, settings.ThreadsPerPage, settings.Pages, settings.BumpLimit, settings.ReplyLimit, settings.MaxAttachmentSize, settings.MimeTypes, settings.AllowAnon)
+  return
+}
+
+func (self SQLiteDatabase) GetMessageIDByHash(hash string) (article ArticleEntry, err error) {
+  err = self.conn.QueryRow("SELECT message_id, message_newsgroup FROM Articles WHERE message_id_hash = ? LIMIT 1", hash).Scan(&article[0], &article[1])
+  return
+}
+
+func (self SQLiteDatabase) BanAddr(ban IPBan) (err error) {
+  _, err = self.conn.Exec("INSERT INTO IPBans(addr, made, expires, reason, scope) VALUES(?, ?, ?, ?, ?)", ban.Addr, ban.Made, ban.Expires, ban.Reason, ban.Scope)
+  return
+}
+
+func (self SQLiteDatabase) GetIPBansForAddr(addr string) (bans []IPBan, err error) {
+  var all []IPBan
+  all, err = self.getIPBans()
+  for _, ban := range all {
+    if ! ban.Expired() && addrInRange(addr, ban.Addr) {
+      bans = append(bans, ban)
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetIPBans() (bans []IPBan, err error) {
+  var all []IPBan
+  all, err = self.getIPBans()
+  for _, ban := range all {
+    if ! ban.Expired() {
+      bans = append(bans, ban)
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) DeleteExpiredBans() (err error) {
+  now := timeNow()
+  _, err = self.conn.Exec("DELETE FROM IPBans WHERE expires > 0 AND expires <= ?", now)
+  if err == nil {
+    _, err = self.conn.Exec("DELETE FROM EncIPBans WHERE expires > 0 AND expires <= ?", now)
+  }
+  return
+}
+
+func (self SQLiteDatabase) UnbanAddr(addr string) (err error) {
+  var bans []IPBan
+  bans, err = self.getIPBans()
+  if err == nil {
+    for _, ban := range bans {
+      if banCIDR(ban.Addr) == banCIDR(addr) {
+        _, err = self.conn.Exec("DELETE FROM IPBans WHERE addr = ?", ban.Addr)
+      }
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) CheckEncIPBanned(encaddr string) (banned bool, err error) {
+  var result int64
+  err = self.conn.QueryRow("SELECT COUNT(*) FROM EncIPBans WHERE encaddr = ? AND ( expires < 0 OR expires > ? )", encaddr, timeNow()).Scan(&result)
+  banned = result > 0
+  return
+}
+
+func (self SQLiteDatabase) GetEncIPBans(encaddr string) (bans []IPBan, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query("SELECT encaddr, made, expires, COALESCE(reason, ''), COALESCE(scope, '') FROM EncIPBans WHERE encaddr = ? AND ( expires < 0 OR expires > ? ) ORDER BY made DESC", encaddr, timeNow())
+  if err == nil {
+    for rows.Next() {
+      var ban IPBan
+      rows.Scan(&ban.Addr, &ban.Made, &ban.Expires, &ban.Reason, &ban.Scope)
+      bans = append(bans, ban)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) BanEncAddr(ban IPBan) (err error) {
+  _, err = self.conn.Exec("INSERT INTO EncIPBans(encaddr, made, expires, reason, scope) VALUES(?, ?, ?, ?, ?)", ban.Addr, ban.Made, ban.Expires, ban.Reason, ban.Scope)
+  return
+}
+
+func (self SQLiteDatabase) GetLastAndFirstForGroup(group string) (last, first int64, err error) {
+  err = self.conn.QueryRow("SELECT COALESCE(MAX(last_nntp_id), 0) FROM Newsgroups WHERE name = ?", group).Scan(&last)
+  if err == nil {
+    var lowest sql.NullInt64
+    err = self.conn.QueryRow("SELECT MIN(nntp_id) FROM ArticlePosts WHERE newsgroup = ?", group).Scan(&lowest)
+    if lowest.Valid {
+      first = lowest.Int64
+    } else {
+      // empty group
+      first = last + 1
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetMessageIDForNNTPID(group string, id int64) (msgid string, err error) {
+  err = self.conn.QueryRow("SELECT message_id FROM ArticlePosts WHERE newsgroup = ? AND nntp_id = ?", group, id).Scan(&msgid)
+  return
+}
+
+func (self SQLiteDatabase) GetNNTPIDForMessageID(group, msgid string) (id int64, err error) {
+  err = self.conn.QueryRow("SELECT nntp_id FROM ArticlePosts WHERE newsgroup = ? AND message_id = ?", group, msgid).Scan(&id)
+  return
+}
+
+func (self SQLiteDatabase) GetPostsInGroupRange(group string, first, last int64) (models []NumberedPost, err error) {
+  if first < 1 {
+    first = 1
+  }
+  var rows *sql.Rows
+  if last < 0 {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id FROM ArticlePosts WHERE newsgroup = ? AND nntp_id >= ? ORDER BY nntp_id", group, first)
+  } else if last >= first {
+    rows, err = self.conn.Query("SELECT newsgroup, message_id, ref_id, name, subject, path, time_posted, message, addr, nntp_id FROM ArticlePosts WHERE newsgroup = ? AND nntp_id >= ? AND nntp_id <= ? ORDER BY nntp_id", group, first, last)
+  } else {
+    // empty range
+    return
+  }
+  if err == nil {
+    for rows.Next() {
+      model := post{}
+      var addr sql.NullString
+      var nntp_id int64
+      rows.Scan(&model.board, &model.message_id, &model.parent, &model.name, &model.subject, &model.path, &model.posted, &model.message, &addr, &nntp_id)
+      model.addr = addr.String
+      models = append(models, NumberedPost{Number: nntp_id, PostModel: model})
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) GetArticlesSince(since int64) (articles []ArticleEntry) {
+  rows, err := self.conn.Query("SELECT message_id, newsgroup FROM ArticlePosts WHERE time_posted > ? ORDER BY time_posted", since)
+  if err == nil {
+    for rows.Next() {
+      var entry ArticleEntry
+      rows.Scan(&entry[0], &entry[1])
+      articles = append(articles, entry)
+    }
+    rows.Close()
+  } else {
+    log.Println("failed to get articles since", since, err)
+  }
+  return
+}
+
+func (self SQLiteDatabase) MarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  _, err = self.conn.Exec("INSERT INTO ModPrivs(pubkey, newsgroup) VALUES(?, ?)", pubkey, group)
+  return
+}
+
+func (self SQLiteDatabase) UnMarkModPubkeyCanModGroup(pubkey, group string) (err error) {
+  _, err = self.conn.Exec("DELETE FROM ModPrivs WHERE pubkey = ? AND newsgroup = ?", pubkey, group)
+  return
+}
+
+func (self SQLiteDatabase) CheckModPubkeyCanModGroupAction(pubkey, newsgroup, action string) bool {
+  if self.CheckModPubkeyGlobal(pubkey) {
+    return true
+  }
+  var result int64
+  // rows without a permission were made by MarkModPubkeyCanModGroup and allow everything
+  _ = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND ( permission IS NULL OR permission = ? OR permission = ? )", pubkey, newsgroup, ModActionAll, action).Scan(&result)
+  return result > 0
+}
+
+func (self SQLiteDatabase) GrantModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  var result int64
+  err = self.conn.QueryRow("SELECT COUNT(*) FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND permission = ?", pubkey, newsgroup, action).Scan(&result)
+  if err == nil && result == 0 {
+    _, err = self.conn.Exec("INSERT INTO ModPrivs(pubkey, newsgroup, permission) VALUES(?, ?, ?)", pubkey, newsgroup, action)
+  }
+  return
+}
+
+func (self SQLiteDatabase) RevokeModPubkeyGroupAction(pubkey, newsgroup, action string) (err error) {
+  if action == ModActionAll {
+    err = self.UnMarkModPubkeyCanModGroup(pubkey, newsgroup)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM ModPrivs WHERE pubkey = ? AND newsgroup = ? AND permission = ?", pubkey, newsgroup, action)
+  }
+  return
+}
+
+func (self SQLiteDatabase) AddModLog(entry ModLogEntry) (err error) {
+  _, err = self.conn.Exec("INSERT INTO ModLogs(pubkey, action, target, reason, scope, time) VALUES(?, ?, ?, ?, ?, ?)", entry.Pubkey, entry.Action, entry.Target, entry.Reason, entry.Scope, entry.Time)
+  return
+}
+
+func (self SQLiteDatabase) GetModLogs(pubkey, action string, limit, offset int) (logs []ModLogEntry, err error) {
+  var where []string
+  var args []interface{}
+  if len(pubkey) > 0 {
+    where = append(where, "pubkey = ?")
+    args = append(args, pubkey)
+  }
+  if len(action) > 0 {
+    where = append(where, "action = ?")
+    args = append(args, action)
+  }
+  q := "SELECT pubkey, action, COALESCE(target, ''), COALESCE(reason, ''), COALESCE(scope, ''), time FROM ModLogs"
+  if len(where) > 0 {
+    q += " WHERE " + strings.Join(where, " AND ")
+  }
+  // rowid keeps entries from the same second in order
+  q += " ORDER BY time DESC, rowid DESC LIMIT ? OFFSET ?"
+  args = append(args, limit, offset)
+  var rows *sql.Rows
+  rows, err = self.conn.Query(q, args...)
+  if err == nil {
+    for rows.Next() {
+      var entry ModLogEntry
+      rows.Scan(&entry.Pubkey, &entry.Action, &entry.Target, &entry.Reason, &entry.Scope, &entry.Time)
+      logs = append(logs, entry)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) IsExpired(root_message_id string) bool {
+  return self.HasArticle(root_message_id) && ! self.HasArticleLocal(root_message_id)
+}
+
+// check if an address or range is inside an address or cidr range
+// mirrors postgres' cidr >>= inet operator
+func addrInRange(addr, cidr string) bool {
+  // prefix length of addr if it is a range
+  bits := -1
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    _, addr_network, err := net.ParseCIDR(addr)
+    if err != nil {
+      return false
+    }
+    ip = addr_network.IP
+    bits, _ = addr_network.Mask.Size()
+  }
+  _, network, err := net.ParseCIDR(cidr)
+  if err == nil {
+    ones, _ := network.Mask.Size()
+    // a range is only inside if it is not bigger
+    return network.Contains(ip) && (bits < 0 || ones <= bits)
+  }
+  // not a range, single address
+  banned := net.ParseIP(cidr)
+  return bits < 0 && banned != nil && banned.Equal(ip)
+}
+
+// an address or range as a cidr so the same ban is always written the same way
+// returns the input if it is neither
+func banCIDR(addr string) string {
+  ip := net.ParseIP(addr)
+  if ip == nil {
+    _, network, err := net.ParseCIDR(addr)
+    if err == nil {
+      return network.String()
+    }
+    return addr
+  } else if ip.To4() != nil {
+    return ip.String() + "/32"
+  }
+  return ip.String() + "/128"
+}
+
+// is this ban on a range and not a single address
+func banIsRange(addr string) bool {
+  _, network, err := net.ParseCIDR(banCIDR(addr))
+  if err != nil {
+    return false
+  }
+  ones, bits := network.Mask.Size()
+  return ones < bits
+}
+
+func (self SQLiteDatabase) QueueArticleForFeed(feed, msgid string) (err error) {
+  now := timeNow()
+  _, err = self.conn.Exec("INSERT OR IGNORE INTO ArticleFeedQueue(feed, message_id, queued, next_attempt) VALUES(?, ?, ?, ?)", feed, msgid, now, now)
+  return
+}
+
+func (self SQLiteDatabase) GetQueuedArticlesForFeed(feed string, limit int) (msgids []string, err error) {
+  var rows *sql.Rows
+  rows, err = self.conn.Query("SELECT message_id FROM ArticleFeedQueue WHERE feed = ? AND pending = 1 AND next_attempt <= ? ORDER BY next_attempt ASC LIMIT ?", feed, timeNow(), limit)
+  if err == nil {
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      msgids = append(msgids, msgid)
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) MarkArticleOffered(feed, msgid string) (err error) {
+  var attempts int64
+  err = self.conn.QueryRow("SELECT attempts FROM ArticleFeedQueue WHERE feed = ? AND message_id = ?", feed, msgid).Scan(&attempts)
+  if err == nil {
+    attempts += 1
+    if attempts >= queueMaxAttempts {
+      // this is the last time we offer it
+      _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE feed = ? AND message_id = ?", feed, msgid)
+    } else {
+      _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET attempts = ?, next_attempt = ? WHERE feed = ? AND message_id = ?", attempts, timeNow() + queueBackoff(attempts), feed, msgid)
+    }
+  }
+  return
+}
+
+func (self SQLiteDatabase) RecordArticleOutcome(feed, msgid string, code int) (err error) {
+  if code == 431 {
+    _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET outcome = ? WHERE feed = ? AND message_id = ?", code, feed, msgid)
+  } else if queueKeepsOutcome(code) {
+    _, err = self.conn.Exec("UPDATE ArticleFeedQueue SET outcome = ?, pending = 0 WHERE feed = ? AND message_id = ?", code, feed, msgid)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE feed = ? AND message_id = ?", feed, msgid)
+  }
+  return
+}
+
+func (self SQLiteDatabase) DeleteExpiredQueuedArticles() (err error) {
+  _, err = self.conn.Exec("DELETE FROM ArticleFeedQueue WHERE queued < ?", timeNow() - queueMaxAge)
+  return
+}
+
+func (self SQLiteDatabase) GetFeedHighWaterMark(feed, group string) (mark int64, err error) {
+  err = self.conn.QueryRow("SELECT mark FROM FeedHighWaterMarks WHERE feed = ? AND newsgroup = ?", feed, group).Scan(&mark)
+  if err == sql.ErrNoRows {
+    // never synced
+    err = nil
+  }
+  return
+}
+
+func (self SQLiteDatabase) SetFeedHighWaterMark(feed, group string, mark int64) (err error) {
+  _, err = self.conn.Exec("INSERT OR REPLACE INTO FeedHighWaterMarks(feed, newsgroup, mark, updated) VALUES(?, ?, ?, ?)", feed, group, mark, timeNow())
+  return
+}
+
+func (self SQLiteDatabase) ResetFeedHighWaterMarks(feed, group string) (err error) {
+  if feed == "" && group == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks")
+  } else if feed == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE newsgroup = ?", group)
+  } else if group == "" {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE feed = ?", feed)
+  } else {
+    _, err = self.conn.Exec("DELETE FROM FeedHighWaterMarks WHERE feed = ? AND newsgroup = ?", feed, group)
+  }
+  return
+}
+
+func (self SQLiteDatabase) AddAPIToken(token APIToken) (err error) {
+  _, err = self.conn.Exec("INSERT INTO APITokens(name, token_hash, scope, rate_limit, issued) VALUES(?, ?, ?, ?, ?)", token.Name, token.Hash, token.Scope, token.RateLimit, token.Issued)
+  return
+}
+
+func (self SQLiteDatabase) GetAPIToken(token_hash string) (token APIToken, err error) {
+  token.Hash = token_hash
+  err = self.conn.QueryRow("SELECT name, scope, rate_limit, issued FROM APITokens WHERE token_hash = ?", token_hash).Scan(&token.Name, &token.Scope, &token.RateLimit, &token.Issued)
+  return
+}
+
+func (self SQLiteDatabase) RevokeAPIToken(name string) (err error) {
+  var res sql.Result
+  res, err = self.conn.Exec("DELETE FROM APITokens WHERE name = ?", name)
+  if err == nil {
+    var count int64
+    count, err = res.RowsAffected()
+    if err == nil && count == 0 {
+      err = errors.New("no such api token")
+    }
+  }
+  return
+}
+
+// sql to limit a search to a newsgroup or newsgroups starting with group_prefix
+func sqliteSearchGroups(newsgroup, group_prefix string) (q string, args []interface{}) {
+  q = " AND p.newsgroup != 'ctl'"
+  if newsgroup != "" {
+    q += " AND p.newsgroup = ?"
+    args = append(args, newsgroup)
+  } else if group_prefix != "" {
+    q += " AND substr(p.newsgroup, 1, ?) = ?"
+    args = append(args, len(group_prefix), group_prefix)
+  }
+  return
+}
+
+// search the fts5 index, every term as a quoted word
+func (self SQLiteDatabase) searchIndex(newsgroup, group_prefix string, terms []string, offset, limit int) (msgids []string, err error) {
+  var match []string
+  for _, term := range terms {
+    match = append(match, "\"" + term + "\"")
+  }
+  q := "SELECT p.message_id FROM ArticlePostsSearch INNER JOIN ArticlePosts p ON ( p.post_id = ArticlePostsSearch.rowid ) WHERE ArticlePostsSearch MATCH ?"
+  args := []interface{}{strings.Join(match, " ")}
+  groups, group_args := sqliteSearchGroups(newsgroup, group_prefix)
+  q += groups + " ORDER BY p.time_posted DESC LIMIT ? OFFSET ?"
+  args = append(append(args, group_args...), limit, offset)
+  var rows *sql.Rows
+  rows, err = self.conn.Query(q, args...)
+  if err == nil {
+    for rows.Next() {
+      var msgid string
+      rows.Scan(&msgid)
+      msgids = append(msgids, msgid)
+    }
+    rows.Close()
+  }
+  return
+}
+
+// search without fts5
+// LIKE finds posts with every term in them, newest first
+// searchMatches keeps the ones that have them as whole words
+func (self SQLiteDatabase) searchScan(newsgroup, group_prefix string, terms []string, offset, limit int) (msgids []string, err error) {
+  q := "SELECT p.message_id, p.subject, p.name, p.message FROM ArticlePosts p WHERE 1 = 1"
+  groups, args := sqliteSearchGroups(newsgroup, group_prefix)
+  q += groups
+  for _, term := range terms {
+    // terms are only letters and numbers so there is nothing to escape
+    // LIKE is case insensitive for ascii
+    q += " AND ( COALESCE(p.subject, '') || ' ' || COALESCE(p.name, '') || ' ' || COALESCE(p.message, '') ) LIKE ?"
+    args = append(args, "%" + term + "%")
+  }
+  q += " ORDER BY p.time_posted DESC"
+  var rows *sql.Rows
+  rows, err = self.conn.Query(q, args...)
+  if err == nil {
+    skipped := 0
+    for len(msgids) < limit && rows.Next() {
+      var msgid, subject, name, message string
+      rows.Scan(&msgid, &subject, &name, &message)
+      if ! searchMatches(terms, subject, name, message) {
+        continue
+      } else if skipped < offset {
+        skipped ++
+      } else {
+        msgids = append(msgids, msgid)
+      }
+    }
+    rows.Close()
+  }
+  return
+}
+
+func (self SQLiteDatabase) SearchPosts(prefix, newsgroup, group_prefix, query string, offset, limit int) (models []PostModel, err error) {
+  terms := searchTerms(query)
+  if len(terms) == 0 {
+    return
+  }
+  var msgids []string
+  if self.hasFTS5() {
+    msgids, err = self.searchIndex(newsgroup, group_prefix, terms, offset, limit)
+  } else {
+    msgids, err = self.searchScan(newsgroup, group_prefix, terms, offset, limit)
+  }
+  for _, msgid := range msgids {
+    model := self.GetPostModel(prefix, msgid)
+    if model != nil {
+      models = append(models, model)
+    }
+  }
+  return
+}
@@ -6,7 +6,18 @@ package srnd
 
 
 import (
+  "bufio"
+  "fmt"
+  "github.com/go-redis/redis"
+  "io"
+  "io/ioutil"
+  "net"
+  "net/textproto"
+  "os"
+  "path/filepath"
+  "strings"
   "testing"
+  "time"
 )
 
 
@@ -23,3 +34,782 @@ func TestSignVerify(t *testing.T) {
   t.Logf("create message")
   
 }
+
+// make a test post posted at a given time
+func testPost(msgid, ref, subject string, posted int64) NNTPMessage {
+  nntp := newPlaintextArticle("test", "", subject, "anon", "test", msgid, "overchan.test")
+  if ref != "" {
+    nntp.Headers().Set("References", ref)
+  }
+  nntp.Headers().Set("Date", time.Unix(posted, 0).UTC().Format(time.RFC1123Z))
+  return nntp
+}
+
+func TestMemoryDatabaseBumpOrder(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  // bump a
+  db.RegisterArticle(testPost("<c@test>", "<a@test>", "c", 300))
+  // sage does not bump b
+  db.RegisterArticle(testPost("<d@test>", "<b@test>", "sage", 400))
+
+  roots := db.GetLastBumpedThreads("overchan.test", 10)
+  if len(roots) != 2 || roots[0].MessageID() != "<a@test>" || roots[1].MessageID() != "<b@test>" {
+    t.Fatalf("bad bump order: %v", roots)
+  }
+  if db.GetGroupPageCount("overchan.test") != 1 {
+    t.Fatal("bad page count")
+  }
+  expired := db.GetRootPostsForExpiration("overchan.test", 1)
+  if len(expired) != 1 || expired[0] != "<b@test>" {
+    t.Fatalf("bad expiration: %v", expired)
+  }
+  if db.CountThreadReplies("<a@test>") != 1 {
+    t.Fatal("bad reply count")
+  }
+}
+
+func TestMemoryDatabaseModPubkey(t *testing.T) {
+  db := NewMemoryDatabase()
+  pk := "testpubkey"
+  db.AddModPubkey(pk)
+  if ! db.CheckModPubkey(pk) || db.CheckModPubkeyGlobal(pk) {
+    t.Fatal("pubkey should only be able to log in")
+  }
+  db.MarkModPubkeyGlobal(pk)
+  if ! db.CheckModPubkeyGlobal(pk) {
+    t.Fatal("pubkey should be global")
+  }
+  db.UnMarkModPubkeyGlobal(pk)
+  if db.CheckModPubkeyGlobal(pk) || ! db.CheckModPubkey(pk) {
+    t.Fatal("pubkey should no longer be global")
+  }
+  db.MarkModPubkeyCanModGroup(pk, "overchan.test")
+  if ! db.CheckModPubkeyCanModGroup(pk, "overchan.test") {
+    t.Fatal("pubkey should be able to mod group")
+  }
+}
+
+// needs a local redis-server, uses db 15 and wipes it
+// needs SRND_TEST_REDIS set to the address of a redis-server
+// database 15 on it is flushed
+func TestRedisDatabase(t *testing.T) {
+  addr := os.Getenv("SRND_TEST_REDIS")
+  if addr == "" {
+    t.Skip("SRND_TEST_REDIS not set")
+  }
+  db := RedisDatabase{
+    client: redis.NewClient(&redis.Options{
+      Addr: addr,
+      DB: 15,
+    }),
+  }
+  defer db.Close()
+  err := db.client.FlushDB().Err()
+  if err != nil {
+    t.Fatal(err)
+  }
+  db.CreateTables()
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  db.RegisterArticle(testPost("<c@test>", "<a@test>", "c", 300))
+
+  if ! db.HasArticle("<c@test>") || db.ArticleCount() != 3 {
+    t.Fatal("articles not registered")
+  }
+  roots := db.GetLastBumpedThreads("", 10)
+  if len(roots) != 2 || roots[0].MessageID() != "<a@test>" || roots[0].Newsgroup() != "overchan.test" {
+    t.Fatalf("bad bump order: %v", roots)
+  }
+  repls := db.GetThreadReplyPostModels("/", "<a@test>", 5)
+  if len(repls) != 1 || repls[0].MessageID() != "<c@test>" {
+    t.Fatal("bad replies")
+  }
+  db.BanArticle("<d@test>", "test")
+  if ! db.ArticleBanned("<d@test>") {
+    t.Fatal("article not banned")
+  }
+  db.DeleteArticle("<a@test>")
+  if db.HasArticleLocal("<a@test>") || len(db.GetLastBumpedThreads("", 10)) != 1 {
+    t.Fatal("article not deleted")
+  }
+  db.QueueArticleForFeed("peer", "<b@test>")
+  db.RecordArticleOutcome("peer", "<b@test>", 438)
+  outcome, _ := db.client.HGet(redisFeedQueueArticleKey("peer", "<b@test>"), "outcome").Int()
+  if msgids, _ := db.GetQueuedArticlesForFeed("peer", 10); len(msgids) != 0 || outcome != 438 {
+    t.Fatalf("438 not recorded or still due: %v %d", msgids, outcome)
+  }
+}
+
+// runs every migration on a new database file
+func TestSQLiteDatabase(t *testing.T) {
+  dir, err := ioutil.TempDir("", "srnd")
+  if err != nil {
+    t.Fatal(err)
+  }
+  defer os.RemoveAll(dir)
+  db := NewSQLiteDatabase(filepath.Join(dir, "srnd.db"))
+  defer db.Close()
+  db.CreateTables()
+  sqlite := db.(SQLiteDatabase)
+  if sqlite.getDBVersion() != 11 || ! sqlite.hasColumn("ArticlePosts", "post_id") || ! sqlite.hasColumn("IPBans", "scope") {
+    t.Fatalf("not migrated to the latest version, at %d", sqlite.getDBVersion())
+  }
+  // again on an up to date database
+  db.CreateTables()
+
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  db.RegisterArticle(testPost("<c@test>", "<a@test>", "c", 300))
+  db.RegisterArticle(testPost("<d@test>", "<b@test>", "sage", 400))
+  roots := db.GetLastBumpedThreads("overchan.test", 10)
+  if len(roots) != 2 || roots[0].MessageID() != "<a@test>" || roots[1].MessageID() != "<b@test>" {
+    t.Fatalf("bad bump order: %v", roots)
+  }
+  if last, first, _ := db.GetLastAndFirstForGroup("overchan.test"); last != 4 || first != 1 {
+    t.Fatalf("bad high/low water marks %d %d", last, first)
+  }
+  // with the fts5 index or without it, and after VACUUM
+  sqlite.conn.Exec("VACUUM")
+  found, err := db.SearchPosts("/", "", "overchan.", "SAGE", 0, 10)
+  if err != nil || len(found) != 1 || found[0].MessageID() != "<d@test>" {
+    t.Fatalf("bad search results: %v %v", found, err)
+  }
+  if found, _ = db.SearchPosts("/", "", "overchan.", "sag", 0, 10); len(found) != 0 {
+    t.Fatal("search matched part of a word")
+  }
+
+  db.BanAddr(IPBan{Addr: "10.0.0.0/8", Made: timeNow(), Expires: -1, Scope: "overchan.test"})
+  db.BanAddr(IPBan{Addr: "10.1.2.3", Made: timeNow(), Expires: -1})
+  if ban, banned, _ := findIPBan(db, "10.4.5.6", "overchan.test"); ! banned || ban.Addr != "10.0.0.0/8" {
+    t.Fatal("address in banned range not banned")
+  }
+  if _, banned, _ := findIPBan(db, "10.4.5.6", "overchan.other"); banned {
+    t.Fatal("range ban applied outside its scope")
+  }
+  db.UnbanAddr("10.1.2.3")
+  if bans, _ := db.GetIPBansForAddr("10.1.2.3"); len(bans) != 1 || bans[0].Addr != "10.0.0.0/8" {
+    t.Fatalf("unbanning an address touched the range it is in: %v", bans)
+  }
+
+  db.QueueArticleForFeed("peer", "<a@test>")
+  db.QueueArticleForFeed("peer", "<b@test>")
+  db.MarkArticleOffered("peer", "<a@test>")
+  db.RecordArticleOutcome("peer", "<a@test>", 239)
+  db.DeleteArticle("<b@test>")
+  var queued int64
+  sqlite.conn.QueryRow("SELECT COUNT(*) FROM ArticleFeedQueue").Scan(&queued)
+  if queued != 0 {
+    t.Fatalf("%d finished or deleted articles still queued", queued)
+  }
+  db.QueueArticleForFeed("peer", "<c@test>")
+  db.RecordArticleOutcome("peer", "<c@test>", 439)
+  var outcome int
+  sqlite.conn.QueryRow("SELECT outcome FROM ArticleFeedQueue WHERE feed = ? AND message_id = ?", "peer", "<c@test>").Scan(&outcome)
+  if msgids, _ := db.GetQueuedArticlesForFeed("peer", 10); len(msgids) != 0 || outcome != 439 {
+    t.Fatalf("439 not recorded or still due: %v %d", msgids, outcome)
+  }
+
+  settings := DefaultBoardSettings()
+  settings.BumpLimit = 10
+  settings.MimeTypes = "image/*"
+  db.SetBoardSettings("overchan.test", settings)
+  if saved, _ := db.GetBoardSettings("overchan.test"); saved != settings {
+    t.Fatalf("board settings not saved: %v", saved)
+  }
+}
+
+func TestWildmatMatch(t *testing.T) {
+  if ! wildmatMatch("overchan.*", "overchan.test") {
+    t.Fatal("overchan.* should match overchan.test")
+  }
+  if wildmatMatch("overchan.*,!overchan.test", "overchan.test") {
+    t.Fatal("negated pattern should not match")
+  }
+  if ! wildmatMatch("*,!ctl", "overchan.test") || wildmatMatch("*,!ctl", "ctl") {
+    t.Fatal("*,!ctl should match everything but ctl")
+  }
+}
+
+func TestSASLPlain(t *testing.T) {
+  creds := nntpCredentials{"user": nntpCredential{username: "user", password: "pass"}}
+  username, password, ok := decodeSASLPlain("AHVzZXIAcGFzcw==")
+  if ! ok || username != "user" || password != "pass" {
+    t.Fatalf("bad SASL PLAIN decode: %s %s", username, password)
+  }
+  if _, ok = creds.Check(username, password); ! ok {
+    t.Fatal("valid credentials rejected")
+  }
+  if _, ok = creds.Check(username, "wrong"); ok {
+    t.Fatal("invalid credentials accepted")
+  }
+}
+
+// run a stand-in server that handles one connection
+func testServer(t *testing.T, handle func(net.Conn)) string {
+  l, err := net.Listen("tcp", "127.0.0.1:0")
+  if err != nil {
+    t.Fatal(err)
+  }
+  go func() {
+    for {
+      conn, err := l.Accept()
+      if err != nil {
+        return
+      }
+      go handle(conn)
+    }
+  }()
+  return l.Addr().String()
+}
+
+// check that a dialer's connection reaches the stand-in
+func testDialerGreeting(t *testing.T, d Dialer, addr string) {
+  conn, err := d.Dial(addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  line, err := bufio.NewReader(conn).ReadString('\n')
+  conn.Close()
+  if line != "200 hi\n" {
+    t.Fatalf("bad greeting: %q %v", line, err)
+  }
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+  proxy := testServer(t, func(conn net.Conn) {
+    defer conn.Close()
+    buf := make([]byte, 512)
+    // greeting, expect username auth
+    io.ReadFull(conn, buf[:3])
+    conn.Write([]byte{5, 2})
+    io.ReadFull(conn, buf[:2])
+    user := make([]byte, buf[1])
+    io.ReadFull(conn, user)
+    io.ReadFull(conn, buf[:1])
+    password := make([]byte, buf[0])
+    io.ReadFull(conn, password)
+    if string(user) != "feed" || string(password) != "secret" {
+      conn.Write([]byte{1, 1})
+      return
+    }
+    conn.Write([]byte{1, 0})
+    // connect request by hostname
+    io.ReadFull(conn, buf[:5])
+    io.ReadFull(conn, buf[:buf[4] + 2])
+    conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 119})
+    io.WriteString(conn, "200 hi\n")
+  })
+  d, _ := NewDialer("socks5", proxy, "feed", "secret")
+  testDialerGreeting(t, d, "example.onion:119")
+  d, _ = NewDialer("socks5", proxy, "feed", "wrong")
+  if _, err := d.Dial("example.onion:119"); err == nil {
+    t.Fatal("bad password accepted")
+  }
+}
+
+func TestSAMDialer(t *testing.T) {
+  sam := testServer(t, func(conn net.Conn) {
+    defer conn.Close()
+    r := bufio.NewReader(conn)
+    for {
+      line, err := r.ReadString('\n')
+      if err != nil {
+        return
+      }
+      if strings.HasPrefix(line, "HELLO") {
+        io.WriteString(conn, "HELLO REPLY RESULT=OK VERSION=3.1\n")
+      } else if strings.HasPrefix(line, "SESSION CREATE") {
+        io.WriteString(conn, "SESSION STATUS RESULT=OK DESTINATION=privkey\n")
+      } else if strings.HasPrefix(line, "NAMING LOOKUP NAME=example.i2p") {
+        io.WriteString(conn, "NAMING REPLY RESULT=OK NAME=example.i2p VALUE=dest\n")
+      } else if strings.HasPrefix(line, "STREAM CONNECT") && strings.Contains(line, "DESTINATION=dest ") {
+        // greeting comes along with the status
+        io.WriteString(conn, "STREAM STATUS RESULT=OK\n200 hi\n")
+        return
+      } else {
+        io.WriteString(conn, "STREAM STATUS RESULT=CANT_REACH_PEER\n")
+      }
+    }
+  })
+  d, _ := NewDialer("i2p", sam, "", "")
+  testDialerGreeting(t, d, "example.i2p:119")
+  testDialerGreeting(t, d, "example.i2p:119")
+}
+
+func TestFeedQueue(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.QueueArticleForFeed("peer", "<a@test>")
+  db.QueueArticleForFeed("peer", "<b@test>")
+  db.QueueArticleForFeed("peer", "<a@test>")
+  msgids, _ := db.GetQueuedArticlesForFeed("peer", 10)
+  if len(msgids) != 2 || msgids[0] != "<a@test>" {
+    t.Fatalf("bad queue: %v", msgids)
+  }
+  // offered articles back off, 431 keeps them queued
+  db.MarkArticleOffered("peer", "<a@test>")
+  db.RecordArticleOutcome("peer", "<a@test>", 431)
+  // anything else takes them off the queue
+  db.MarkArticleOffered("peer", "<b@test>")
+  db.RecordArticleOutcome("peer", "<b@test>", 239)
+  // 438 and 439 are kept until they expire but never offered again
+  db.QueueArticleForFeed("peer", "<e@test>")
+  db.RecordArticleOutcome("peer", "<e@test>", 438)
+  db.QueueArticleForFeed("peer", "<e@test>")
+  msgids, _ = db.GetQueuedArticlesForFeed("peer", 10)
+  if len(msgids) != 0 {
+    t.Fatalf("offered articles still due: %v", msgids)
+  }
+  if queueBackoff(1) != 30 || queueBackoff(3) != 120 || queueBackoff(100) != 3600 {
+    t.Fatal("bad backoff")
+  }
+  mem := db.(*MemoryDatabase)
+  if len(mem.feedqueue["peer"]) != 2 || mem.feedqueue["peer"]["<e@test>"].outcome != 438 {
+    t.Fatal("finished article kept in the queue or 438 not recorded")
+  }
+  // deleted articles and old articles come off the queue
+  db.QueueArticleForFeed("peer", "<c@test>")
+  db.DeleteArticle("<a@test>")
+  mem.feedqueue["peer"]["<c@test>"].queued -= queueMaxAge + 1
+  mem.feedqueue["peer"]["<e@test>"].queued -= queueMaxAge + 1
+  db.DeleteExpiredQueuedArticles()
+  if len(mem.feedqueue["peer"]) != 0 {
+    t.Fatalf("queue not emptied: %v", mem.feedqueue["peer"])
+  }
+  // and so do articles offered too many times
+  db.QueueArticleForFeed("peer", "<d@test>")
+  for i := 0 ; i < queueMaxAttempts ; i ++ {
+    db.MarkArticleOffered("peer", "<d@test>")
+  }
+  if len(mem.feedqueue["peer"]) != 0 {
+    t.Fatal("article offered too many times still queued")
+  }
+}
+
+func TestAPIBacklinks(t *testing.T) {
+  op := post{message_id: "<op@test>", message: "hello"}
+  reply := post{message_id: "<reply@test>", parent: "<op@test>", message: ">>" + ShorterHashMessageID("<op@test>") + " hi"}
+  th := thread{posts: []PostModel{op, reply}}
+  j := apiThreadFromModel(th, NewMemoryDatabase())
+  if len(j.OP.Backlinks) != 1 || j.OP.Backlinks[0] != reply.ShortHash() {
+    t.Fatalf("bad backlinks: %v", j.OP.Backlinks)
+  }
+  if len(j.Replies[0].Backlinks) != 0 {
+    t.Fatalf("reply should have no backlinks: %v", j.Replies[0].Backlinks)
+  }
+}
+
+func TestAPIRateLimit(t *testing.T) {
+  limiter := newAPIRateLimiter()
+  if ! limiter.Allow("bot", 2) || ! limiter.Allow("bot", 2) {
+    t.Fatal("posts under the limit were not allowed")
+  }
+  if limiter.Allow("bot", 2) {
+    t.Fatal("post over the limit was allowed")
+  }
+  if ! limiter.Allow("other", 2) || ! limiter.Allow("bot", 0) {
+    t.Fatal("limit applied to the wrong token")
+  }
+}
+
+func TestLiveHub(t *testing.T) {
+  hub := newLiveHub()
+  board := &liveClient{board: "overchan.test", send: make(chan liveEvent, 1)}
+  thread := &liveClient{thread: "<op@test>", send: make(chan liveEvent, 1)}
+  hub.Add(board)
+  hub.Add(thread)
+  hub.Delete("overchan.test", "<reply@test>", "<other@test>")
+  if len(board.send) != 1 || len(thread.send) != 0 {
+    t.Fatal("delete went to the wrong clients")
+  }
+  // board client is full and gets dropped
+  hub.Delete("overchan.test", "<reply@test>", "<op@test>")
+  if len(thread.send) != 1 || len(hub.clients) != 1 {
+    t.Fatal("slow client was not dropped")
+  }
+}
+
+func TestSearchMatches(t *testing.T) {
+  terms := searchTerms("Hello  WORLD")
+  if len(terms) != 2 {
+    t.Fatal("bad search terms", terms)
+  }
+  if ! searchMatches(terms, "hello", "Anonymous", "the world is big") {
+    t.Fatal("post with every term did not match")
+  }
+  if searchMatches(terms, "hello", "Anonymous", "nothing here") {
+    t.Fatal("post missing a term matched")
+  }
+  // whole words only, punctuation splits words
+  if searchMatches(terms, "hello", "Anonymous", "worldwide") {
+    t.Fatal("part of a word matched")
+  }
+  if ! searchMatches(terms, "Re: hello,", "Anonymous", "(world)") {
+    t.Fatal("words next to punctuation did not match")
+  }
+  if ! searchInGroup("overchan.test", "", "overchan.") || searchInGroup("ctl", "", "") || searchInGroup("overchan.test", "overchan.other", "") {
+    t.Fatal("bad search newsgroup check")
+  }
+  if searchMatches(searchTerms(""), "", "", "") {
+    t.Fatal("empty query matched")
+  }
+}
+
+func TestBoardSettings(t *testing.T) {
+  db := NewMemoryDatabase()
+  settings, _ := db.GetBoardSettings("overchan.test")
+  if settings != DefaultBoardSettings() {
+    t.Fatal("no default settings")
+  }
+  settings.ThreadsPerPage = 5
+  settings.MaxAttachmentSize = 4
+  settings.MimeTypes = "image/png,image/jpeg"
+  db.SetBoardSettings("overchan.test", settings)
+  if tpp, _ := db.GetThreadsPerPage("overchan.test"); tpp != 5 {
+    t.Fatal("settings not saved")
+  }
+  if settings.ThreadLimit() != 50 {
+    t.Fatal("bad thread limit")
+  }
+  small := createAttachment("image/png", "a.png", strings.NewReader("abc"))
+  big := createAttachment("image/png", "b.png", strings.NewReader("abcdef"))
+  text := createAttachment("text/plain", "c.txt", strings.NewReader("abc"))
+  if settings.CheckAttachments([]NNTPAttachment{small}) != "" {
+    t.Fatal("allowed attachment rejected")
+  }
+  if settings.CheckAttachments([]NNTPAttachment{big}) == "" || settings.CheckAttachments([]NNTPAttachment{text}) == "" {
+    t.Fatal("disallowed attachment accepted")
+  }
+  if reason := DefaultBoardSettings().CheckAttachments([]NNTPAttachment{small}); reason != "" {
+    t.Fatal("default settings rejected attachment:", reason)
+  }
+  if ! wildmatMatch("image/*,!image/gif", "image/png") || wildmatMatch("image/*,!image/gif", "image/gif") {
+    t.Fatal("bad mime type wildmat")
+  }
+}
+
+func TestBumpLimit(t *testing.T) {
+  db := NewMemoryDatabase()
+  settings := DefaultBoardSettings()
+  settings.BumpLimit = 1
+  settings.ReplyLimit = 2
+  db.SetBoardSettings("overchan.test", settings)
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  // first reply bumps a
+  db.RegisterArticle(testPost("<c@test>", "<a@test>", "c", 300))
+  // reply to b bumps it, the second reply to a does not bump a
+  db.RegisterArticle(testPost("<d@test>", "<b@test>", "d", 400))
+  db.RegisterArticle(testPost("<e@test>", "<a@test>", "e", 500))
+  roots := db.GetLastBumpedThreads("overchan.test", 10)
+  if len(roots) != 2 || roots[0].MessageID() != "<b@test>" {
+    t.Fatalf("bump limit ignored: %v", roots)
+  }
+  if threadAllowsReply(db, "overchan.test", "<a@test>") || ! threadAllowsReply(db, "overchan.test", "<b@test>") {
+    t.Fatal("reply limit ignored")
+  }
+  th := apiLoadThread("/", "<a@test>", db)
+  if ! th.BumpLimitReached() {
+    t.Fatal("bump limit not reached")
+  }
+}
+
+func TestStickyThreads(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  db.RegisterArticle(testPost("<c@test>", "", "c", 300))
+  db.SetThreadSticky("<a@test>", true)
+  db.SetThreadLocked("<b@test>", true)
+  threads := db.GetGroupForPage("/", "test", "overchan.test", 0, 10).Threads()
+  if len(threads) != 3 || threads[0].OP().MessageID() != "<a@test>" {
+    t.Fatal("sticky thread not first")
+  }
+  // a is the oldest but never expires
+  expired := db.GetRootPostsForExpiration("overchan.test", 1)
+  if len(expired) != 2 || expired[0] == "<a@test>" || expired[1] == "<a@test>" {
+    t.Fatalf("bad expiration: %v", expired)
+  }
+  if ! db.ThreadLocked("<b@test>") || db.ThreadLocked("<c@test>") {
+    t.Fatal("bad lock state")
+  }
+  if th := threads[0].Update(db); ! th.Sticky() || th.Locked() {
+    t.Fatal("thread model has wrong state")
+  }
+}
+
+func TestModPermissions(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.RegisterArticle(testPost("<a@test>", "", "a", 100))
+  mod := modEngine{database: db}
+  pk := "testpubkey"
+  db.GrantModPubkeyGroupAction(pk, "overchan.test", ModActionDelete)
+  if ! mod.AllowDelete(pk, "<a@test>") || mod.AllowSticky(pk, "<a@test>") {
+    t.Fatal("pubkey should only be able to delete")
+  }
+  if mod.AllowBan(pk, "overchan.*") || mod.AllowDelete(pk, "<unknown@test>") {
+    t.Fatal("pubkey should not act outside its newsgroup")
+  }
+  db.GrantModPubkeyGroupAction(pk, "overchan.test", ModActionAll)
+  if ! mod.AllowSticky(pk, "<a@test>") || ! mod.AllowBan(pk, newsgroupModScope("overchan.test")) {
+    t.Fatal("pubkey should be able to do everything on its newsgroup")
+  }
+  db.RevokeModPubkeyGroupAction(pk, "overchan.test", ModActionAll)
+  if db.CheckModPubkeyCanModGroupAction(pk, "overchan.test", ModActionDelete) {
+    t.Fatal("pubkey should have no permissions left")
+  }
+  db.MarkModPubkeyGlobal(pk)
+  if ! mod.AllowBan(pk, "overchan.*") || ! mod.AllowDelete(pk, "<unknown@test>") {
+    t.Fatal("global pubkey should be able to do everything")
+  }
+}
+
+func TestModLog(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.AddModLog(ModLogEntry{Pubkey: "a", Action: "delete", Target: "<a@test>", Scope: "overchan.*", Time: 100})
+  db.AddModLog(ModLogEntry{Pubkey: "b", Action: "overchan-inet-ban", Target: "encaddr", Scope: "overchan.*", Time: 200})
+  db.AddModLog(ModLogEntry{Pubkey: "a", Action: "delete", Target: "<b@test>", Scope: "overchan.*", Time: 300})
+  logs, _ := db.GetModLogs("a", "", 10, 0)
+  if len(logs) != 2 || logs[0].Target != "<b@test>" {
+    t.Fatalf("bad pubkey filter: %v", logs)
+  }
+  logs, _ = db.GetModLogs("", "delete", 1, 1)
+  if len(logs) != 1 || logs[0].Target != "<a@test>" {
+    t.Fatalf("bad paging: %v", logs)
+  }
+  j, _ := getModLog(db, modLogRequest{action: "overchan-inet-ban"}, false)
+  if len(j.Entries) != 1 || j.Entries[0].Target != "" || j.HasMore {
+    t.Fatalf("public mod log should hide addresses: %v", j)
+  }
+}
+
+func TestParseModEvent(t *testing.T) {
+  ev := ParseModEvent("delete <a@test>")
+  if ev.Action() != "delete" || ev.Target() != "<a@test>" || ev.Scope() != defaultModScope || ev.Expires() != -1 {
+    t.Fatalf("bad plain mod event: %v", ev)
+  }
+  line := overchanDelete("<a@test>", "spam and\nmore spam", newsgroupModScope("overchan.test")).String()
+  ev = ParseModEvent(line)
+  if ev.Reason() != "spam and more spam" || ev.Scope() != "overchan\\.test" || ev.String() != line {
+    t.Fatalf("bad mod event: %s", line)
+  }
+  if ! modEventInScope(ev, "overchan.test") || modEventInScope(ev, "overchan.testing") || modEventInScope(ev, "overchanxtest") {
+    t.Fatal("bad mod event scope")
+  }
+  ev = ParseModEvent("overchan-inet-ban encaddr:key:100")
+  if ev.Expires() != 100 || ! modEventExpired(ev) {
+    t.Fatal("inet ban expiration not read from target")
+  }
+  if scopeNewsgroup(ev.Scope()) != "" || scopeNewsgroup("overchan\\.test") != "overchan.test" {
+    t.Fatal("bad scope newsgroup")
+  }
+}
+
+func TestIPBans(t *testing.T) {
+  db := NewMemoryDatabase()
+  db.BanAddr(IPBan{Addr: "10.0.0.0/8", Made: timeNow(), Expires: -1})
+  db.BanAddr(IPBan{Addr: "192.168.1.1/32", Made: timeNow() - 100, Expires: timeNow() - 10})
+  banned, _ := db.CheckIPBanned("10.1.2.3")
+  if ! banned {
+    t.Fatal("address in banned range not banned")
+  }
+  banned, _ = db.CheckIPBanned("192.168.1.1")
+  if banned {
+    t.Fatal("expired ban still applies")
+  }
+  if ! addrInRange("10.1.0.0/16", "10.0.0.0/8") || addrInRange("10.0.0.0/8", "10.1.0.0/16") {
+    t.Fatal("bad range in range check")
+  }
+  db.DeleteExpiredBans()
+  db.BanAddr(IPBan{Addr: "192.168.1.2/32", Made: timeNow(), Expires: timeNow() + 100})
+  bans, _ := db.GetIPBans()
+  if len(bans) != 2 {
+    t.Fatalf("bad ban list: %v", bans)
+  }
+  db.BanAddr(IPBan{Addr: "10.1.2.3", Made: timeNow(), Expires: -1})
+  db.UnbanAddr("10.1.2.3/32")
+  banned, _ = db.CheckIPBanned("10.1.2.3")
+  if ! banned {
+    t.Fatal("unbanning an address lifted the range it is in")
+  }
+  if len(db.(*MemoryDatabase).ipbans) != 2 || ! banIsRange("10.0.0.0/8") || banIsRange("10.1.2.3") {
+    t.Fatal("address ban not deleted on its own")
+  }
+}
+
+func TestBannedPoster(t *testing.T) {
+  db := NewMemoryDatabase()
+  ban := IPBan{Addr: "10.0.0.0/8", Made: timeNow(), Expires: -1, Reason: "spam", Scope: newsgroupModScope("overchan.test")}
+  db.BanAddr(ban)
+  found, banned, _ := findIPBan(db, "10.1.2.3", "overchan.test")
+  if ! banned || found.Reason != "spam" || found.AppealID() != ban.AppealID() {
+    t.Fatalf("ban not found: %v", found)
+  }
+  _, banned, _ = findIPBan(db, "10.1.2.3", "overchan.other")
+  if banned {
+    t.Fatal("ban applied outside its scope")
+  }
+  db.BanEncAddr(IPBan{Addr: "encaddr", Made: timeNow(), Expires: -1, Scope: newsgroupModScope("overchan.test")})
+  _, banned, _ = findEncIPBan(db, "encaddr", "overchan.other")
+  if banned {
+    t.Fatal("encrypted address ban applied outside its scope")
+  }
+  j := apiBannedFromBan(found)
+  if j.Scope != "overchan.test" || j.Expires != -1 || len(j.Appeal) == 0 {
+    t.Fatalf("bad banned json: %v", j)
+  }
+}
+
+func TestBanAddressDedupe(t *testing.T) {
+  db := NewMemoryDatabase()
+  mod := modEngine{database: db}
+  if mod.BanAddress(IPBan{Addr: "10.0.0.0/8", Made: timeNow(), Expires: timeNow() + 3600}) != nil {
+    t.Fatal("first ban failed")
+  }
+  if mod.BanAddress(IPBan{Addr: "10.1.2.3", Made: timeNow(), Expires: timeNow() + 60}) == nil {
+    t.Fatal("shorter ban inside a range was not deduped")
+  }
+  if mod.BanAddress(IPBan{Addr: "10.1.2.3", Made: timeNow(), Expires: -1}) != nil {
+    t.Fatal("permanent ban dropped because of a shorter one")
+  }
+  if mod.BanAddress(IPBan{Addr: "11.0.0.0/8", Made: timeNow(), Expires: -1, Scope: newsgroupModScope("overchan.test")}) != nil {
+    t.Fatal("board ban failed")
+  }
+  if mod.BanAddress(IPBan{Addr: "11.0.0.0/8", Made: timeNow(), Expires: -1, Scope: defaultModScope}) != nil {
+    t.Fatal("global ban dropped because of a board ban")
+  }
+}
+
+func TestFeedBaseURL(t *testing.T) {
+  if base, err := feedBaseURL("", "/"); base != "" || err != nil {
+    t.Fatal("relative prefix used for feeds")
+  }
+  if base, _ := feedBaseURL("", "https://example.com/chan"); base != "https://example.com/chan/" {
+    t.Fatal("absolute prefix not used for feeds:", base)
+  }
+  if base, _ := feedBaseURL("http://example.onion/", "/"); base != "http://example.onion/" {
+    t.Fatal("feed_url not used:", base)
+  }
+  if _, err := feedBaseURL("/feeds/", "/"); err == nil {
+    t.Fatal("relative feed_url accepted")
+  }
+}
+
+func TestArticleNumbers(t *testing.T) {
+  db := NewMemoryDatabase()
+  // same time posted and an older post arriving late keep their numbers
+  db.RegisterArticle(testPost("<a@test>", "", "a", 200))
+  db.RegisterArticle(testPost("<b@test>", "", "b", 200))
+  db.RegisterArticle(testPost("<c@test>", "", "c", 100))
+  if id, _ := db.GetNNTPIDForMessageID("overchan.test", "<c@test>"); id != 3 {
+    t.Fatalf("late post got number %d", id)
+  }
+  // expire the first one
+  db.DeleteArticle("<a@test>")
+  db.RegisterArticle(testPost("<d@test>", "", "d", 300))
+  last, first, _ := db.GetLastAndFirstForGroup("overchan.test")
+  if last != 4 || first != 2 {
+    t.Fatalf("bad high/low water marks %d %d", last, first)
+  }
+  if msgid, _ := db.GetMessageIDForNNTPID("overchan.test", 2); msgid != "<b@test>" {
+    t.Fatalf("number 2 is now %s", msgid)
+  }
+  models, _ := db.GetPostsInGroupRange("overchan.test", 3, -1)
+  if len(models) != 2 || models[0].Number != 3 || models[1].MessageID() != "<d@test>" {
+    t.Fatalf("bad range %v", models)
+  }
+  // numbers are not reused once the group is empty
+  for _, msgid := range []string{"<b@test>", "<c@test>", "<d@test>"} {
+    db.DeleteArticle(msgid)
+  }
+  last, first, _ = db.GetLastAndFirstForGroup("overchan.test")
+  if last != 4 || first != 5 {
+    t.Fatalf("bad high/low water marks for empty group %d %d", last, first)
+  }
+}
+
+// run a stand-in reader peer serving a database
+// sends the message ids it was asked for on articles and knows none of them
+func testReaderPeer(t *testing.T, remote Database, articles chan string) *textproto.Conn {
+  addr := testServer(t, func(sock net.Conn) {
+    conn := textproto.NewConn(sock)
+    defer conn.Close()
+    for {
+      line, err := conn.ReadLine()
+      if err != nil {
+        return
+      }
+      parts := strings.Split(line, " ")
+      if parts[0] == "GROUP" {
+        last, first, _ := remote.GetLastAndFirstForGroup(parts[1])
+        conn.PrintfLine("211 %d %d %d %s", remote.CountPostsInGroup(parts[1], 0), first, last, parts[1])
+      } else if parts[0] == "XOVER" {
+        first, last, _ := parseArticleRange(parts[1])
+        models, _ := remote.GetPostsInGroupRange("overchan.test", first, last)
+        conn.PrintfLine("224 Overview information follows")
+        dw := conn.DotWriter()
+        for _, model := range models {
+          io.WriteString(dw, fmt.Sprintf("%d\t%s\t%s\t%s\t%s\t%s\r\n", model.Number, model.Subject(), model.Name(), model.Date(), model.MessageID(), model.Reference()))
+        }
+        dw.Close()
+      } else if parts[0] == "ARTICLE" {
+        articles <- parts[1]
+        conn.PrintfLine("430 no such article")
+      }
+    }
+  })
+  sock, err := net.Dial("tcp", addr)
+  if err != nil {
+    t.Fatal(err)
+  }
+  return textproto.NewConn(sock)
+}
+
+// message ids sent on articles so far
+func testDrain(articles chan string) (msgids []string) {
+  for {
+    select {
+    case msgid := <- articles:
+      msgids = append(msgids, msgid)
+    default:
+      return
+    }
+  }
+}
+
+func TestScrapeGroupAcrossExpiry(t *testing.T) {
+  remote := NewMemoryDatabase()
+  daemon := NNTPDaemon{database: NewMemoryDatabase()}
+  feed := nntpConnection{name: "test", feed: "test"}
+  articles := make(chan string, 16)
+  conn := testReaderPeer(t, remote, articles)
+  defer conn.Close()
+  remote.RegisterArticle(testPost("<aa@test>", "", "a", 200))
+  remote.RegisterArticle(testPost("<bb@test>", "", "b", 300))
+  feed.scrapeGroup(daemon, conn, "overchan.test")
+  if got := testDrain(articles); len(got) != 2 {
+    t.Fatalf("first sync asked for %v", got)
+  }
+  // the oldest post expires and one posted earlier than the rest arrives
+  remote.DeleteArticle("<aa@test>")
+  remote.RegisterArticle(testPost("<cc@test>", "", "c", 100))
+  feed.scrapeGroup(daemon, conn, "overchan.test")
+  if got := testDrain(articles); len(got) != 1 || got[0] != "<cc@test>" {
+    t.Fatalf("sync after expiry asked for %v", got)
+  }
+  if mark, _ := daemon.database.GetFeedHighWaterMark("test", "overchan.test"); mark != 3 {
+    t.Fatalf("bad high water mark %d", mark)
+  }
+  // nothing new
+  feed.scrapeGroup(daemon, conn, "overchan.test")
+  if got := testDrain(articles); len(got) != 0 {
+    t.Fatalf("sync with nothing new asked for %v", got)
+  }
+  // a peer that starts over gets scanned from the start
+  daemon.database.SetFeedHighWaterMark("test", "overchan.test", 10)
+  feed.scrapeGroup(daemon, conn, "overchan.test")
+  if got := testDrain(articles); len(got) != 2 {
+    t.Fatalf("sync after renumbering asked for %v", got)
+  }
+}
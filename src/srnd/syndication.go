@@ -0,0 +1,305 @@
+//
+// syndication.go
+//
+// rss and atom feeds for the http frontend
+//
+package srnd
+
+import (
+  "encoding/xml"
+  "errors"
+  "fmt"
+  "io"
+  "log"
+  "mime"
+  "net/url"
+  "path/filepath"
+  "sort"
+  "strings"
+  "time"
+)
+
+// how many posts go into a feed
+const syndicationPostCount = 30
+
+type rssEnclosure struct {
+  URL string `xml:"url,attr"`
+  // we don't know the size so this is always 0
+  Length int64 `xml:"length,attr"`
+  Type string `xml:"type,attr"`
+}
+
+type rssGUID struct {
+  IsPermaLink bool `xml:"isPermaLink,attr"`
+  Value string `xml:",chardata"`
+}
+
+type rssItem struct {
+  Title string `xml:"title"`
+  Link string `xml:"link"`
+  GUID rssGUID `xml:"guid"`
+  PubDate string `xml:"pubDate"`
+  Creator string `xml:"dc:creator"`
+  Description string `xml:"description"`
+  Enclosure *rssEnclosure `xml:"enclosure,omitempty"`
+}
+
+type rssChannel struct {
+  Title string `xml:"title"`
+  Link string `xml:"link"`
+  Description string `xml:"description"`
+  LastBuildDate string `xml:"lastBuildDate"`
+  Items []rssItem `xml:"item"`
+}
+
+type rssFeed struct {
+  XMLName xml.Name `xml:"rss"`
+  Version string `xml:"version,attr"`
+  DC string `xml:"xmlns:dc,attr"`
+  Channel rssChannel `xml:"channel"`
+}
+
+type atomLink struct {
+  Rel string `xml:"rel,attr,omitempty"`
+  Href string `xml:"href,attr"`
+  Type string `xml:"type,attr,omitempty"`
+}
+
+type atomContent struct {
+  Type string `xml:"type,attr"`
+  Value string `xml:",chardata"`
+}
+
+type atomAuthor struct {
+  Name string `xml:"name"`
+}
+
+type atomEntry struct {
+  Title string `xml:"title"`
+  ID string `xml:"id"`
+  Updated string `xml:"updated"`
+  Author atomAuthor `xml:"author"`
+  Links []atomLink `xml:"link"`
+  Content atomContent `xml:"content"`
+}
+
+type atomFeed struct {
+  XMLName xml.Name `xml:"http://www.w3.org/2005/Atom feed"`
+  Title string `xml:"title"`
+  ID string `xml:"id"`
+  Updated string `xml:"updated"`
+  Link atomLink `xml:"link"`
+  Entries []atomEntry `xml:"entry"`
+}
+
+// get the absolute url links in feeds start with
+// feed_url is used if set, otherwise prefix if it is absolute
+// returns empty string if neither is, feeds cannot have relative links
+func feedBaseURL(feed_url, prefix string) (string, error) {
+  base := feed_url
+  if len(base) == 0 {
+    u, err := url.Parse(prefix)
+    if err != nil || ! u.IsAbs() || len(u.Host) == 0 {
+      return "", nil
+    }
+    base = prefix
+  } else {
+    u, err := url.Parse(base)
+    if err != nil {
+      return "", err
+    } else if ! u.IsAbs() || len(u.Host) == 0 {
+      return "", errors.New("not an absolute url: " + base)
+    }
+  }
+  if ! strings.HasSuffix(base, "/") {
+    base += "/"
+  }
+  return base, nil
+}
+
+// get the rss filename that goes with an html file
+func rssFilename(htmlfile string) string {
+  return strings.TrimSuffix(htmlfile, ".html") + ".rss"
+}
+
+// get the atom filename that goes with an html file
+func atomFilename(htmlfile string) string {
+  return strings.TrimSuffix(htmlfile, ".html") + ".atom"
+}
+
+// guess an attachment's mime type from its filename
+func attachmentMime(att AttachmentModel) string {
+  t := mime.TypeByExtension(strings.ToLower(filepath.Ext(att.Filename())))
+  if len(t) == 0 {
+    t = "application/octet-stream"
+  }
+  return t
+}
+
+// title for a post in a feed
+func syndicationTitle(p PostModel) string {
+  subject := p.Subject()
+  if len(subject) == 0 || subject == "None" {
+    subject = ">>" + p.ShortHash()
+  }
+  return fmt.Sprintf("%s - %s", subject, p.Name())
+}
+
+// sorts posts newest first
+type postsNewestFirst []PostModel
+
+func (self postsNewestFirst) Len() int {
+  return len(self)
+}
+
+func (self postsNewestFirst) Less(i, j int) bool {
+  return self[i].Posted() > self[j].Posted()
+}
+
+func (self postsNewestFirst) Swap(i, j int) {
+  self[i], self[j] = self[j], self[i]
+}
+
+// sort posts newest first and keep only as many as go into a feed
+func syndicationPosts(posts []PostModel) []PostModel {
+  sort.Stable(postsNewestFirst(posts))
+  if len(posts) > syndicationPostCount {
+    posts = posts[:syndicationPostCount]
+  }
+  return posts
+}
+
+// write rss and atom feeds for a list of posts, newest first
+// outfile is the html page the feeds go with
+func writeSyndication(frontend, title, link string, posts []PostModel, outfile string) {
+  updated := time.Now()
+  if len(posts) > 0 {
+    updated = time.Unix(posts[0].Posted(), 0)
+  }
+  rss := rssFeed{
+    Version: "2.0",
+    DC: "http://purl.org/dc/elements/1.1/",
+    Channel: rssChannel{
+      Title: title,
+      Link: link,
+      Description: title,
+      LastBuildDate: updated.UTC().Format(time.RFC1123Z),
+    },
+  }
+  atom := atomFeed{
+    Title: title,
+    ID: fmt.Sprintf("tag:%s,2015:%s", frontend, filepath.Base(outfile)),
+    Updated: updated.UTC().Format(time.RFC3339),
+    Link: atomLink{Href: link},
+  }
+  for _, p := range posts {
+    posted := time.Unix(p.Posted(), 0).UTC()
+    body := p.RenderBody()
+    item := rssItem{
+      Title: syndicationTitle(p),
+      Link: p.PostURL(),
+      GUID: rssGUID{Value: p.MessageID()},
+      PubDate: posted.Format(time.RFC1123Z),
+      Creator: p.Name(),
+      Description: body,
+    }
+    entry := atomEntry{
+      Title: item.Title,
+      ID: fmt.Sprintf("tag:%s,2015:post/%s", frontend, p.PostHash()),
+      Updated: posted.Format(time.RFC3339),
+      Author: atomAuthor{p.Name()},
+      Links: []atomLink{
+        atomLink{Rel: "alternate", Href: p.PostURL(), Type: "text/html"},
+      },
+      Content: atomContent{Type: "html", Value: body},
+    }
+    for idx, att := range p.Attachments() {
+      if idx == 0 {
+        // rss only allows 1 enclosure
+        item.Enclosure = &rssEnclosure{URL: att.Source(), Type: attachmentMime(att)}
+      }
+      entry.Links = append(entry.Links, atomLink{Rel: "enclosure", Href: att.Source(), Type: attachmentMime(att)})
+    }
+    rss.Channel.Items = append(rss.Channel.Items, item)
+    atom.Entries = append(atom.Entries, entry)
+  }
+  writeXMLFile(rssFilename(outfile), rss)
+  writeXMLFile(atomFilename(outfile), atom)
+}
+
+// write an xml document to a file
+func writeXMLFile(outfile string, obj interface{}) {
+  wr, err := OpenFileWriter(outfile)
+  if err == nil {
+    _, err = io.WriteString(wr, xml.Header)
+    if err == nil {
+      enc := xml.NewEncoder(wr)
+      enc.Indent("", "  ")
+      err = enc.Encode(obj)
+    }
+    wr.Close()
+  }
+  if err == nil {
+    log.Println("wrote file", outfile)
+  } else {
+    log.Println("did not write", outfile, err)
+  }
+}
+
+// generate feeds for the newest posts on a board
+// outfile is the board's first page
+// prefix must be absolute, see feedBaseURL
+func (self *templateEngine) genBoardFeeds(prefix, frontend, newsgroup, outfile string, db Database) {
+  var posts []PostModel
+  last, _, err := db.GetLastAndFirstForGroup(newsgroup)
+  if err == nil {
+    var models []NumberedPost
+    models, err = db.GetPostsInGroupRange(newsgroup, last - syndicationPostCount, -1)
+    for _, m := range models {
+      // get the full model with attachments
+      p := db.GetPostModel(prefix, m.MessageID())
+      if p != nil {
+        posts = append(posts, p)
+      }
+    }
+  }
+  if err != nil {
+    log.Println("failed to get posts for feeds of", newsgroup, err)
+    return
+  }
+  link := fmt.Sprintf("%s%s-0.html", prefix, newsgroup)
+  writeSyndication(frontend, newsgroup, link, syndicationPosts(posts), outfile)
+}
+
+// generate feeds for a thread
+// outfile is the thread's page
+// prefix must be absolute, see feedBaseURL
+func (self *templateEngine) genThreadFeeds(root ArticleEntry, prefix, frontend, outfile string, db Database) {
+  op := db.GetPostModel(prefix, root.MessageID())
+  if op == nil {
+    log.Println("no root post for thread feeds", root.MessageID())
+    return
+  }
+  posts := append([]PostModel{op}, db.GetThreadReplyPostModels(prefix, root.MessageID(), syndicationPostCount)...)
+  title := fmt.Sprintf("%s - %s", root.Newsgroup(), syndicationTitle(op))
+  link := fmt.Sprintf("%sthread-%s.html", prefix, ShortHashMessageID(root.MessageID()))
+  writeSyndication(frontend, title, link, syndicationPosts(posts), outfile)
+}
+
+// generate feeds for the overboard
+// newest posts in the last bumped threads
+// prefix must be absolute, see feedBaseURL
+func (self *templateEngine) genUkkoFeeds(prefix, frontend, outfile string, db Database) {
+  var posts []PostModel
+  for _, article := range db.GetLastBumpedThreads("", 15) {
+    if article.Newsgroup() == "ctl" {
+      continue
+    }
+    op := db.GetPostModel(prefix, article.MessageID())
+    if op != nil {
+      posts = append(posts, op)
+      posts = append(posts, db.GetThreadReplyPostModels(prefix, article.MessageID(), 5)...)
+    }
+  }
+  writeSyndication(frontend, "ukko", prefix + "ukko.html", syndicationPosts(posts), outfile)
+}
@@ -5,6 +5,7 @@
 package srnd
 
 import (
+  "encoding/json"
   "fmt"
   "github.com/hoisie/mustache"
   "io"
@@ -163,6 +164,25 @@ func (self *templateEngine) obtainBoard(prefix, frontend, group string, db Datab
   return
 
 }
+// get the filename of the json file that goes with an html file
+func jsonFilename(htmlfile string) string {
+  return strings.TrimSuffix(htmlfile, ".html") + ".json"
+}
+
+// write a json file that goes with an html page
+func writeJSONFile(outfile string, obj interface{}) {
+  wr, err := OpenFileWriter(outfile)
+  if err == nil {
+    err = json.NewEncoder(wr).Encode(obj)
+    wr.Close()
+  }
+  if err == nil {
+    log.Println("wrote file", outfile)
+  } else {
+    log.Println("did not write", outfile, err)
+  }
+}
+
 // generate a board page
 func (self *templateEngine) genBoardPage(prefix, frontend, newsgroup string, page int, outfile string, db Database) {
   // get the board model
@@ -180,6 +200,7 @@ func (self *templateEngine) genBoardPage(prefix, frontend, newsgroup string, pag
     board[page].RenderTo(wr)
     wr.Close()
     log.Println("wrote file", outfile)
+    writeJSONFile(jsonFilename(outfile), apiBoardPageFromModel(board[page], page, int64(len(board)), db))
   } else {
     log.Println("error generating board page", page, "for", newsgroup, err)
   }
@@ -205,12 +226,51 @@ func (self *templateEngine) genBoard(prefix, frontend, newsgroup, outdir string,
       board[page].RenderTo(wr)
       wr.Close()
       log.Println("wrote file", outfile)
+      writeJSONFile(jsonFilename(outfile), apiBoardPageFromModel(board[page], page, int64(pages), db))
     } else {
       log.Println("error generating board page", page, "for", newsgroup, err)
     }
   }
 }
 
+// generate the catalog for a board
+func (self *templateEngine) genCatalog(prefix, frontend, newsgroup, outfile string, db Database) {
+  if ! self.hasTemplate("catalog.mustache") {
+    log.Println("no catalog template, not generating catalog for", newsgroup)
+    return
+  }
+  board := self.obtainBoard(prefix, frontend, newsgroup, db)
+  catalog := catalogModel{
+    frontend: frontend,
+    prefix: prefix,
+    board: newsgroup,
+  }
+  j := apiCatalog{
+    Board: newsgroup,
+    Threads: []apiCatalogEntry{},
+  }
+  for _, page := range board {
+    for _, th := range page.Threads() {
+      // make sure we have every reply
+      th = th.Update(db)
+      catalog.threads = append(catalog.threads, catalogItemFromThread(th))
+      j.Threads = append(j.Threads, apiCatalogEntry{
+        OP: apiPostFromModel(th.OP()),
+        ReplyCount: int64(len(th.Replies())),
+      })
+    }
+  }
+  wr, err := OpenFileWriter(outfile)
+  if err == nil {
+    catalog.RenderTo(wr)
+    wr.Close()
+    log.Println("wrote file", outfile)
+    writeJSONFile(jsonFilename(outfile), j)
+  } else {
+    log.Println("error generating catalog for", newsgroup, err)
+  }
+}
+
 func (self *templateEngine) genUkko(prefix, frontend, outfile string, database Database) {
   var threads []ThreadModel
   // get the last 15 bumped threads globally, for each...
@@ -234,6 +294,11 @@ func (self *templateEngine) genUkko(prefix, frontend, outfile string, database D
     updateLinkCache()
     io.WriteString(wr, template.renderTemplate("ukko.mustache", map[string]interface{} { "prefix" : prefix, "threads" : threads }))
     wr.Close()
+    j := apiUkko{Threads: []apiThread{}}
+    for _, th := range threads {
+      j.Threads = append(j.Threads, apiThreadFromModel(th.Truncate(), database))
+    }
+    writeJSONFile(jsonFilename(outfile), j)
   } else {
     log.Println("error generating ukko", err)
   }
@@ -274,6 +339,7 @@ func (self *templateEngine) genThread(root ArticleEntry, prefix, frontend, outfi
       th.RenderTo(wr)
       wr.Close()
       log.Println("wrote file", outfile)
+      writeJSONFile(jsonFilename(outfile), apiThreadFromModel(th, db))
     } else {
       log.Println("did not write", outfile, err)
     }
@@ -310,6 +376,9 @@ func (self *templateEngine) genFrontPage(top_count int, frontend_name, outdir st
   // the graph for the front page
   var frontpage_graph boardPageRows
 
+  // every board for boards.json
+  boards := []apiBoard{}
+
   // for each group
   groups := db.GetAllNewsgroups()
   for _, group := range groups {
@@ -325,6 +394,13 @@ func (self *templateEngine) genFrontPage(top_count int, frontend_name, outdir st
       Hour: hour,
       Board: group,
     })
+    boards = append(boards, apiBoard{
+      Name: group,
+      Pages: db.GetGroupPageCount(group),
+      PostsHour: hour,
+      PostsDay: day,
+      PostsTotal: all,
+    })
   }
   wr, err := OpenFileWriter(filepath.Join(outdir, "index.html"))
   if err != nil {
@@ -359,4 +435,11 @@ func (self *templateEngine) genFrontPage(top_count int, frontend_name, outdir st
     log.Println("error writing board list page", err)
   }
   wr.Close()
+
+  writeJSONFile(filepath.Join(outdir, "boards.json"), boards)
+  writeJSONFile(filepath.Join(outdir, "index.json"), apiFrontPage{
+    Frontend: frontend_name,
+    TotalPosts: db.ArticleCount(),
+    Boards: boards,
+  })
 }
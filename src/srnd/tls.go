@@ -2,3 +2,107 @@
 // tls.go -- tls related functions
 //
 package srnd
+
+import (
+  "crypto/sha256"
+  "crypto/tls"
+  "encoding/hex"
+  "errors"
+  "log"
+  "net"
+  "strings"
+)
+
+// load our tls config from a certificate and key file
+// asks inbound peers for a client certificate so feeds can be pinned
+func loadTLSConfig(cert_file, key_file string) (config *tls.Config, err error) {
+  var cert tls.Certificate
+  cert, err = tls.LoadX509KeyPair(cert_file, key_file)
+  if err == nil {
+    config = &tls.Config{
+      Certificates: []tls.Certificate{cert},
+      ClientAuth: tls.RequestClientCert,
+      MinVersion: tls.VersionTLS12,
+    }
+  }
+  return
+}
+
+// get the fingerprint of a der encoded certificate, hex encoded sha256
+func certFingerprint(der []byte) string {
+  digest := sha256.Sum256(der)
+  return hex.EncodeToString(digest[:])
+}
+
+// normalize a fingerprint from a config file
+// allows upper case and colon separated bytes
+func normalizeFingerprint(fingerprint string) string {
+  return strings.ToLower(strings.Replace(strings.Trim(fingerprint, " "), ":", "", -1))
+}
+
+// get the fingerprint of the certificate the remote end presented
+// empty string if they presented none
+func peerFingerprint(state tls.ConnectionState) string {
+  if len(state.PeerCertificates) > 0 {
+    return certFingerprint(state.PeerCertificates[0].Raw)
+  }
+  return ""
+}
+
+// our certificate's fingerprint
+func (self NNTPDaemon) TLSFingerprint() string {
+  if self.tls_config == nil || len(self.tls_config.Certificates) == 0 || len(self.tls_config.Certificates[0].Certificate) == 0 {
+    return ""
+  }
+  return certFingerprint(self.tls_config.Certificates[0].Certificate[0])
+}
+
+// find the feed that pinned this inbound peer's client certificate
+// returns empty string if none did
+func (self NNTPDaemon) feedForCert(state tls.ConnectionState) string {
+  fingerprint := peerFingerprint(state)
+  if self.conf != nil && fingerprint != "" {
+    for _, feed := range self.conf.feeds {
+      if feed.tls_fingerprint != "" && feed.tls_fingerprint == fingerprint {
+        return feed.name
+      }
+    }
+  }
+  return ""
+}
+
+// wrap an outbound connection to a feed in tls and do the handshake
+// if the feed pins a fingerprint we check that instead of the certificate chain
+// conn is closed on error
+func (self NNTPDaemon) clientTLS(conn net.Conn, conf FeedConfig) (tls_conn *tls.Conn, err error) {
+  config := &tls.Config{
+    MinVersion: tls.VersionTLS12,
+  }
+  host, _, err := net.SplitHostPort(conf.addr)
+  if err != nil {
+    conn.Close()
+    return
+  }
+  config.ServerName = host
+  if self.tls_config != nil {
+    // present our certificate so they can pin us
+    config.Certificates = self.tls_config.Certificates
+  }
+  if conf.tls_fingerprint != "" {
+    config.InsecureSkipVerify = true
+  }
+  tls_conn = tls.Client(conn, config)
+  err = tls_conn.Handshake()
+  if err == nil && conf.tls_fingerprint != "" {
+    fingerprint := peerFingerprint(tls_conn.ConnectionState())
+    if fingerprint != conf.tls_fingerprint {
+      log.Println(conf.name, "tls fingerprint mismatch, got", fingerprint, "expected", conf.tls_fingerprint)
+      err = errors.New("tls fingerprint mismatch")
+    }
+  }
+  if err != nil {
+    tls_conn.Close()
+    tls_conn = nil
+  }
+  return
+}
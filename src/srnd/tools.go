@@ -64,3 +64,22 @@ func KeygenTool() {
   log.Println("public key:", pub)
   log.Println("secret key:", sec)
 }
+
+// forget the sync high water marks for a feed and newsgroup
+// empty feed or newsgroup means all of them
+func ResetSyncTool(feed, group string) {
+  conf := ReadConfig()
+  if conf == nil {
+    log.Println("cannot load config, ReadConfig() returned nil")
+    return
+  }
+  db := NewDatabase(conf.database["type"], conf.database["schema"], conf.database["host"], conf.database["port"], conf.database["user"], conf.database["password"])
+  db.CreateTables()
+  defer db.Close()
+  err := db.ResetFeedHighWaterMarks(feed, group)
+  if err == nil {
+    log.Println("sync high water marks reset, next sync fetches everything")
+  } else {
+    log.Println("failed to reset sync high water marks", err)
+  }
+}
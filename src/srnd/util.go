@@ -19,6 +19,7 @@ import (
   "strconv"
   "strings"
   "time"
+  "unicode"
 )
 
 func DelFile(fname string) {
@@ -144,6 +145,33 @@ func timeNow() int64 {
   return time.Now().Unix()
 }
 
+// most times we offer a queued article to a feed before giving up on it
+const queueMaxAttempts = 50
+
+// longest an article stays queued for a feed, in seconds
+// feeds that never come back don't keep articles queued forever
+const queueMaxAge = 7 * 24 * 3600
+
+// does a feed's response to an article stay on its queue entry after it is done
+// 438 and 439 are kept until the entry expires so we know the feed didn't want it
+func queueKeepsOutcome(code int) bool {
+  return code == 438 || code == 439
+}
+
+// how many seconds to wait before offering a queued article again after it was offered N times
+// doubles each time starting at 30 seconds, at most an hour
+func queueBackoff(attempts int64) int64 {
+  backoff := int64(30)
+  for attempts > 1 && backoff < 3600 {
+    backoff *= 2
+    attempts -= 1
+  }
+  if backoff > 3600 {
+    backoff = 3600
+  }
+  return backoff
+}
+
 // sanitize data for nntp
 func nntpSanitize(data string) string {
   parts := strings.Split(data, "\n.\n")
@@ -322,6 +350,96 @@ func newsgroupValidFormat(newsgroup string) bool {
 }
 
 
+// check if a string matches an nntp wildmat
+// the last pattern that matches wins
+func wildmatMatch(wildmat, str string) (matches bool) {
+  for _, pattern := range strings.Split(wildmat, ",") {
+    negate := strings.HasPrefix(pattern, "!")
+    if negate {
+      pattern = pattern[1:]
+    }
+    if wildmatPatternMatch(pattern, str) {
+      matches = ! negate
+    }
+  }
+  return
+}
+
+// check if a string matches a single wildmat pattern
+// * matches any run of characters including / so it works for mime types
+// ? matches any 1 character
+func wildmatPatternMatch(pattern, str string) bool {
+  // where to retry from after the last *
+  star, retry := -1, 0
+  p, s := 0, 0
+  for s < len(str) {
+    if p < len(pattern) && pattern[p] == '*' {
+      star, retry = p, s
+      p ++
+    } else if p < len(pattern) && (pattern[p] == '?' || pattern[p] == str[s]) {
+      p ++
+      s ++
+    } else if star >= 0 {
+      // let the last * eat 1 more character
+      retry ++
+      p, s = star + 1, retry
+    } else {
+      return false
+    }
+  }
+  for p < len(pattern) && pattern[p] == '*' {
+    p ++
+  }
+  return p == len(pattern)
+}
+
+// parse an nntp date and time as given to NEWNEWS, always in UTC
+// date is yymmdd or yyyymmdd, time is hhmmss
+func parseNNTPDate(date, tm string) (t time.Time, err error) {
+  if len(date) == 6 {
+    t, err = time.Parse("060102150405", date + tm)
+  } else {
+    t, err = time.Parse("20060102150405", date + tm)
+  }
+  return
+}
+
+// parse the reply line to a GROUP command, "number low high group"
+// some peers swap low and high so high is the bigger one
+func parseGroupReply(line string) (count, low, high int64) {
+  fields := strings.Fields(line)
+  if len(fields) > 2 {
+    count, _ = strconv.ParseInt(fields[0], 10, 64)
+    low, _ = strconv.ParseInt(fields[1], 10, 64)
+    high, _ = strconv.ParseInt(fields[2], 10, 64)
+    if low > high {
+      low, high = high, low
+    }
+  }
+  return
+}
+
+// parse an nntp article range
+// n, n- or n-m
+// last is -1 if the range has no end
+func parseArticleRange(str string) (first, last int64, err error) {
+  idx := strings.Index(str, "-")
+  if idx == -1 {
+    first, err = strconv.ParseInt(str, 10, 64)
+    last = first
+  } else {
+    first, err = strconv.ParseInt(str[:idx], 10, 64)
+    if err == nil {
+      if idx == len(str) - 1 {
+        last = -1
+      } else {
+        last, err = strconv.ParseInt(str[idx+1:], 10, 64)
+      }
+    }
+  }
+  return
+}
+
 // generate a new signing keypair
 // public, secret
 func newSignKeypair() (string, string) {
@@ -428,3 +546,54 @@ func parseTripcodeSecret(str string) []byte {
   } 
   return raw
 }
+
+// split text into the lower case words search matches on
+// a word is a run of letters and numbers, the same as the sqlite and postgres indexes
+func searchWords(text string) []string {
+  return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+    return ! unicode.IsLetter(r) && ! unicode.IsNumber(r)
+  })
+}
+
+// split a search query into lower case words
+// only the first few words are used
+func searchTerms(query string) (terms []string) {
+  seen := make(map[string]bool)
+  for _, word := range searchWords(query) {
+    if len(terms) == 8 {
+      break
+    } else if ! seen[word] {
+      seen[word] = true
+      terms = append(terms, word)
+    }
+  }
+  return
+}
+
+// check if a search of newsgroup, or every newsgroup starting with group_prefix, finds posts in board
+// posts in ctl are never found
+func searchInGroup(board, newsgroup, group_prefix string) bool {
+  if board == "ctl" {
+    return false
+  } else if newsgroup != "" {
+    return board == newsgroup
+  }
+  return strings.HasPrefix(board, group_prefix)
+}
+
+// check if a post has every search term as a whole word in its subject, name or message
+func searchMatches(terms []string, subject, name, message string) bool {
+  if len(terms) == 0 {
+    return false
+  }
+  words := make(map[string]bool)
+  for _, word := range searchWords(subject + " " + name + " " + message) {
+    words[word] = true
+  }
+  for _, term := range terms {
+    if ! words[term] {
+      return false
+    }
+  }
+  return true
+}
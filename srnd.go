@@ -36,11 +36,20 @@ func main() {
           srnd.ThumbnailTool()
         } else if tool == "keygen" {
           srnd.KeygenTool()
+        } else if tool == "resetsync" {
+          var feed, group string
+          if len(os.Args) > 3 {
+            feed = os.Args[3]
+          }
+          if len(os.Args) > 4 {
+            group = os.Args[4]
+          }
+          srnd.ResetSyncTool(feed, group)
         } else {
-          fmt.Fprintf(os.Stdout, "Usage: %s tool [rethumb|keygen]\n", os.Args[0])
+          fmt.Fprintf(os.Stdout, "Usage: %s tool [rethumb|keygen|resetsync [feed [newsgroup]]]\n", os.Args[0])
         }
       } else {
-        fmt.Fprintf(os.Stdout, "Usage: %s tool [rethumb|keygen]\n", os.Args[0])
+        fmt.Fprintf(os.Stdout, "Usage: %s tool [rethumb|keygen|resetsync [feed [newsgroup]]]\n", os.Args[0])
       }
     } else {
       log.Println("Invalid action:",action)